@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/storage"
+	"image-processing-service/internal/uploads"
+	"log/slog"
+	"time"
+)
+
+// Runs periodic maintenance until ctx is canceled: removes unverified
+// accounts older than UnverifiedAccountTTL every CleanupInterval, and
+// abandoned resumable uploads and stored objects no image refers to every
+// StorageGCInterval
+func runScheduler(ctx context.Context, cfg config.Config) {
+	slog.Info("cleanup scheduler started", "interval", cfg.Scheduler.CleanupInterval,
+		"storage_gc_interval", cfg.Scheduler.StorageGCInterval)
+	ticker := time.NewTicker(cfg.Scheduler.CleanupInterval)
+	defer ticker.Stop()
+
+	// A nil channel never fires, which leaves the collector disabled
+	var gc <-chan time.Time
+	if cfg.Scheduler.StorageGCInterval > 0 {
+		gcTicker := time.NewTicker(cfg.Scheduler.StorageGCInterval)
+		defer gcTicker.Stop()
+		gc = gcTicker.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			count, err := db.CleanupUnverifiedAccounts(ctx, cfg.Scheduler.UnverifiedAccountTTL)
+			if err != nil {
+				slog.Error("cleanup failed", "error", err)
+			} else {
+				slog.Info("cleaned up unverified accounts", "count", count)
+			}
+		case <-gc:
+			abortExpiredResumables(ctx)
+			count, err := storage.CollectGarbage(ctx, storage.Default(), storageGCRules(cfg))
+			if err != nil {
+				slog.Error("storage garbage collection failed", "deleted", count, "error", err)
+			} else {
+				slog.Info("collected unreferenced objects", "count", count)
+			}
+		case <-ctx.Done():
+			slog.Info("cleanup scheduler stopping")
+			return
+		}
+	}
+}
+
+// Frees the multipart uploads of resumable uploads whose clients never came back
+func abortExpiredResumables(ctx context.Context) {
+	uploader, ok := storage.Default().(storage.MultipartUploader)
+	if !ok {
+		return
+	}
+	count, err := uploads.AbortExpiredResumables(ctx, uploader, time.Now())
+	if err != nil {
+		slog.Error("aborting expired resumable uploads failed", "aborted", count, "error", err)
+	} else {
+		slog.Info("aborted expired resumable uploads", "count", count)
+	}
+}
+
+// Returns what the storage garbage collector may remove: originals and
+// processed images no row refers to, and staged direct uploads and tails of
+// resumable uploads that have outlived their upload
+func storageGCRules(cfg config.Config) []storage.GCRule {
+	minAge := cfg.Scheduler.StorageGCMinAge
+	return []storage.GCRule{
+		{Prefix: "originals/", MinAge: minAge, Referenced: db.ReferencedKeys},
+		{Prefix: "processed/", MinAge: minAge, Referenced: db.ReferencedKeys},
+		{Prefix: "uploads/direct/", MinAge: cfg.Upload.URLExpiry + uploads.CompletionGrace},
+		{Prefix: "uploads/tus/", MinAge: cfg.Upload.ResumableTTL},
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/handler"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// Runs the HTTP API until ctx is canceled, then lets in-flight requests finish
+func serve(ctx context.Context, cfg config.Config) error {
+	srv := &http.Server{Addr: ":" + cfg.HTTP.Port, Handler: newRouter(cfg)}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("server started", "port", cfg.HTTP.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+		close(serverErr)
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("server shutting down", "timeout", cfg.HTTP.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// Builds the Gin router with the frontend, public, protected and admin routes
+func newRouter(cfg config.Config) *gin.Engine {
+	// Get current working directory for absolute paths
+	currentDir, err := os.Getwd()
+	if err != nil {
+		slog.Warn("unable to get working directory", "error", err)
+		currentDir = "."
+	}
+
+	// Set up Gin router with default middleware
+	router := gin.Default()
+
+	// Enable CORS middleware with custom configuration
+	router.Use(cors.New(cors.Config{
+		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:5173"},
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposeHeaders:    []string{"Content-Length", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "X-Image-Id"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}))
+
+	// Serve static files for frontend assets
+	router.Static("/assets", "./frontend/dist/assets")
+	router.Static("/static", "./frontend/dist")
+	router.StaticFile("/favicon.ico", "./frontend/dist/ips.png")
+
+	// Add absolute path route that was working
+	absDistPath := filepath.Join(currentDir, "frontend/dist")
+	router.Static("/abs-static", absDistPath)
+
+	// Root route to serve the frontend SPA (single-page application)
+	router.GET("/", func(c *gin.Context) {
+		if _, err := os.Stat("./frontend/dist/index.html"); os.IsNotExist(err) {
+			slog.Error("frontend index.html not found")
+			c.String(404, "Frontend files not found. Build may be incomplete.")
+			return
+		}
+		c.File("./frontend/dist/index.html")
+	})
+
+	// Health check
+	router.GET("/health", handler.HealthHandler)
+
+	// Files written by the local storage driver
+	if cfg.Storage.Driver == config.StorageLocal {
+		router.GET("/media/*key", handler.ServeMediaHandler)
+		router.HEAD("/media/*key", handler.ServeMediaHandler)
+	}
+
+	// Public routes for user authentication
+	router.POST("/login", handler.LoginHandler)
+	router.POST("/register", handler.RegisterHandler)
+
+	// Email verification routes
+	router.POST("/verify-email", handler.VerifyEmailHandler)
+	router.POST("/resend-verification", handler.ResendVerificationHandler)
+
+	// New Password reset routes
+	router.POST("/forgot-password", handler.ForgotPasswordHandler)
+	router.POST("/verify-reset-token", handler.VerifyResetTokenHandler)
+	router.POST("/reset-password", handler.ResetPasswordHandler)
+
+	// Resumable uploads (tus 1.0); only OPTIONS is public
+	files := router.Group("/files", handler.TusMiddleware())
+	files.OPTIONS("/", handler.TusOptionsHandler(cfg.Upload))
+	files.OPTIONS("/:id", handler.TusOptionsHandler(cfg.Upload))
+	tus := files.Group("", handler.AuthMiddleware())
+	{
+		tus.POST("/", handler.CreateResumableHandler(cfg.Upload))
+		tus.HEAD("/:id", handler.ResumableOffsetHandler)
+		tus.PATCH("/:id", handler.PatchResumableHandler(cfg.Upload))
+		tus.DELETE("/:id", handler.DeleteResumableHandler)
+	}
+
+	// Protected routes with JWT middleware
+	authorized := router.Group("/")
+	authorized.Use(handler.AuthMiddleware())
+	{
+		// User profile routes
+		authorized.GET("/profile", handler.GetUserProfileHandler)
+		authorized.GET("/images", handler.GetUserImagesHandler)
+
+		// Add new image count endpoint
+		authorized.GET("/images/count", handler.GetUserImageCountHandler)
+
+		// Image status endpoint
+		authorized.GET("/images/:id/status", handler.GetImageStatusHandler)
+
+		// Redirect to a fresh URL for the image or one of its variants
+		authorized.GET("/images/:id/download", handler.DownloadImageHandler)
+
+		// Route to upload image
+		authorized.POST("/upload", func(c *gin.Context) {
+			// Get userID from the JWT token in the context
+			userID, exists := c.Get("userID")
+			if !exists {
+				c.JSON(400, gin.H{"error": "UserID not found in context"})
+				return
+			}
+			// Handle the image upload
+			handler.UploadImageHandler(c, cfg.Upload, userID.(string))
+		})
+
+		// Direct-to-storage uploads: get a presigned request, then complete
+		authorized.POST("/uploads", handler.CreateUploadHandler(cfg.Upload))
+		authorized.POST("/uploads/:id/complete", handler.CompleteUploadHandler(cfg.Upload))
+
+		// Delete image endpoint
+		authorized.DELETE("/images/:id", handler.DeleteImageHandler)
+
+		// Dead-letter queue administration, restricted to ADMIN_USER_IDS
+		admin := authorized.Group("/admin")
+		admin.Use(handler.AdminMiddleware(cfg.AdminUserIDs))
+		{
+			admin.GET("/dead-letters", handler.ListDeadLettersHandler)
+			admin.DELETE("/dead-letters", handler.PurgeAllDeadLettersHandler)
+			admin.GET("/dead-letters/:id", handler.GetDeadLetterHandler)
+			admin.POST("/dead-letters/:id/requeue", handler.RequeueDeadLetterHandler)
+			admin.DELETE("/dead-letters/:id", handler.PurgeDeadLetterHandler)
+		}
+	}
+
+	// Catch-all for SPA routing
+	router.NoRoute(func(c *gin.Context) {
+		c.File("./frontend/dist/index.html")
+	})
+
+	return router
+}
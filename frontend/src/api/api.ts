@@ -1,4 +1,4 @@
-import { AuthResponse, ImageMeta, LoginRequest, RegisterRequest, UploadResponse, User } from '../types';
+import { AuthResponse, ImageListParams, ImageListResponse, LoginRequest, PipelineStep, RegisterRequest, UploadResponse, User } from '../types';
 import { getAuthToken } from '../utils/storage';
 
 // API URL configuration
@@ -150,9 +150,16 @@ export const getUserProfile = async (): Promise<User> => {
     return response.json();
 };
 
-// API function to handle user logout
-export const getUserImages = async (): Promise<{ images: ImageMeta[] }> => {
-    const response = await fetch(`${API_URL}/images`, {
+// API function to fetch a page of the user's images
+export const getUserImages = async (params?: ImageListParams): Promise<ImageListResponse> => {
+    const query = new URLSearchParams();
+    Object.entries(params || {}).forEach(([key, value]) => {
+        if (value !== undefined && value !== '') {
+            query.append(key, String(value));
+        }
+    });
+    const suffix = query.toString() ? `?${query.toString()}` : '';
+    const response = await fetch(`${API_URL}/images${suffix}`, {
         method: 'GET',
         headers: authHeaders(),
     });
@@ -168,21 +175,41 @@ export const uploadImage = async (
     file: File,
     params?: {
         width?: number,
+        height?: number,
+        filter?: 'nearest' | 'bilinear' | 'bicubic' | 'lanczos3',
+        fit?: 'contain' | 'cover' | 'fill' | 'inside',
         cropX?: number,
         cropY?: number,
         cropWidth?: number,
         cropHeight?: number,
-        tintColor?: string
+        tintColor?: string,
+        tintIntensity?: number,
+        tintMode?: 'normal' | 'multiply' | 'screen' | 'overlay',
+        pipeline?: PipelineStep[],
+        outputFormat?: 'jpeg' | 'png' | 'gif' | 'webp' | 'auto',
+        quality?: number,
+        lossless?: boolean,
+        variants?: string
     }
 ): Promise<UploadResponse> => {
     const formData = new FormData();
     formData.append('file', file);
     if (params?.width) formData.append('width', params.width.toString());
+    if (params?.height) formData.append('height', params.height.toString());
+    if (params?.filter) formData.append('filter', params.filter);
+    if (params?.fit) formData.append('fit', params.fit);
     if (params?.cropX) formData.append('cropX', params.cropX.toString());
     if (params?.cropY) formData.append('cropY', params.cropY.toString());
     if (params?.cropWidth) formData.append('cropWidth', params.cropWidth.toString());
     if (params?.cropHeight) formData.append('cropHeight', params.cropHeight.toString());
     if (params?.tintColor) formData.append('tintColor', params.tintColor);
+    if (params?.tintIntensity) formData.append('tintIntensity', params.tintIntensity.toString());
+    if (params?.tintMode) formData.append('tintMode', params.tintMode);
+    if (params?.pipeline) formData.append('pipeline', JSON.stringify(params.pipeline));
+    if (params?.outputFormat) formData.append('output_format', params.outputFormat);
+    if (params?.quality) formData.append('quality', params.quality.toString());
+    if (params?.lossless) formData.append('lossless', 'true');
+    if (params?.variants) formData.append('variants', params.variants);
 
     const response = await fetch(`${API_URL}/upload`, {
         method: 'POST',
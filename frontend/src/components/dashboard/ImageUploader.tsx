@@ -27,8 +27,8 @@ export const ImageUploader: React.FC<ImageUploaderProps> = ({ onUploadSuccess, c
     const [isLoadingCount, setIsLoadingCount] = useState(false);
 
     const IMAGE_LIMIT = 20; // Define the maximum number of images allowed
-    const MAX_FILE_SIZE = 10 * 1024 * 1024; // 10 MB — must match handler.MaxFileSize on the backend
-    const MAX_FILE_SIZE_LABEL = '10 MB';
+    const MAX_FILE_SIZE = 50 * 1024 * 1024; // 50 MB — must match UPLOAD_MAX_SIZE on the backend
+    const MAX_FILE_SIZE_LABEL = '50 MB';
 
     const fileInputRef = useRef<HTMLInputElement>(null);
     const imagePreviewRef = useRef<HTMLImageElement>(null);
@@ -285,7 +285,7 @@ export const ImageUploader: React.FC<ImageUploaderProps> = ({ onUploadSuccess, c
             // Add tint color if specified
             if (isTinting) {
                 params.tintColor = tintColor;
-                params.tintOpacity = 0.5;
+                params.tintIntensity = 0.5;
             }
 
             console.log("Upload params:", params);
@@ -8,6 +8,8 @@ import { Header } from '../components/layout/Header';
 const Dashboard: React.FC = () => {
     const [images, setImages] = useState<ImageMeta[]>([]);
     const [isLoading, setIsLoading] = useState(true);
+    const [nextCursor, setNextCursor] = useState<string | null>(null);
+    const [isLoadingMore, setIsLoadingMore] = useState(false);
 
     // Load initial images
     useEffect(() => {
@@ -16,9 +18,11 @@ const Dashboard: React.FC = () => {
                 setIsLoading(true);
                 const response = await getUserImages();
                 setImages(response.images || []);
+                setNextCursor(response.next_cursor);
             } catch (error) {
                 console.error('Failed to fetch images:', error);
                 setImages([]);
+                setNextCursor(null);
             } finally {
                 setIsLoading(false);
             }
@@ -71,6 +75,26 @@ const Dashboard: React.FC = () => {
         };
     }, [images]);
 
+    // Append the next page of images
+    const loadMore = async () => {
+        if (!nextCursor) {
+            return;
+        }
+        try {
+            setIsLoadingMore(true);
+            const response = await getUserImages({ cursor: nextCursor });
+            setImages(prev => {
+                const seen = new Set((prev || []).map(img => img.id));
+                return [...(prev || []), ...(response.images || []).filter(img => !seen.has(img.id))];
+            });
+            setNextCursor(response.next_cursor);
+        } catch (error) {
+            console.error('Failed to fetch more images:', error);
+        } finally {
+            setIsLoadingMore(false);
+        }
+    };
+
     const handleImageUpload = async (newImage: ImageMeta) => {
         console.log("New image uploaded:", newImage);
         setImages(prev => [newImage, ...(prev || [])]);
@@ -130,6 +154,18 @@ const Dashboard: React.FC = () => {
                         isLoading={isLoading}
                         onImageDelete={handleImageDelete}
                     />
+                    {nextCursor && !isLoading && (
+                        <div className="mt-6 flex justify-center">
+                            <button
+                                type="button"
+                                onClick={loadMore}
+                                disabled={isLoadingMore}
+                                className="px-4 py-2 text-sm font-medium rounded-md bg-indigo-600 hover:bg-indigo-500 text-white transition-colors disabled:opacity-50"
+                            >
+                                {isLoadingMore ? 'Loading...' : 'Load more'}
+                            </button>
+                        </div>
+                    )}
                 </div>
             </div>
         </div>
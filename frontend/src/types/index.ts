@@ -28,8 +28,37 @@ export interface User {
     height: number;                                          // Image dimensions
     uploaded: string;                                        // Date string
     content_type: string;                                    // MIME type
-    processed_url?: string;                                  // Processed image URL
+    processed_url?: string;                                  // Processed image URL, presigned for private buckets
+    processed_key?: string;                                  // Storage key of the processed image
+    content_hash?: string;                                   // Hex SHA-256 of the original
     processing_status?: 'pending' | 'completed' | 'failed';  // Processing status
+    variants?: ImageVariant[];                               // Named renditions
+  }
+
+  export interface ImageListParams {
+    limit?: number;                                                 // Images per page, 1-200
+    sort?: 'uploaded' | 'size' | 'name';                            // Sort key
+    order?: 'asc' | 'desc';                                         // Sort direction
+    status?: 'pending' | 'processing' | 'completed' | 'failed';     // Processing status filter
+    content_type?: string;                                          // MIME type filter
+    uploaded_from?: string;                                         // RFC 3339 time or YYYY-MM-DD
+    uploaded_to?: string;                                           // RFC 3339 time or YYYY-MM-DD
+    name?: string;                                                  // File name substring
+    cursor?: string;                                                // next_cursor of the previous page
+  }
+
+  export interface ImageListResponse {
+    images: ImageMeta[];        // One page of images
+    next_cursor: string | null; // Cursor for the next page, null on the last one
+  }
+
+  export interface ImageVariant {
+    name: string;         // Variant name, e.g. 'thumb'
+    url: string;          // URL to the rendition
+    size: number;         // File size in bytes
+    content_type: string; // MIME type
+    width: number;        // Rendition width
+    height: number;       // Rendition height
   }
 
   export interface UploadResponse {
@@ -41,4 +70,10 @@ export interface User {
     height: number;       // Image height
     status: string;       // 'pending', etc.
     message?: string;     // Success message
+    duplicate?: boolean;  // True when the user had already uploaded this file
+  }
+
+  export interface PipelineStep {
+    op: string;                        // Operation name, e.g. 'resize', 'crop', 'tint'
+    params?: Record<string, unknown>;  // Operation parameters
   }
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the process-level settings shared by every subcommand
+type Config struct {
+	Postgres     Postgres
+	Redis        Redis
+	HTTP         HTTP
+	Worker       Worker
+	Scheduler    Scheduler
+	Storage      Storage
+	Upload       Upload
+	AdminUserIDs []string // ADMIN_USER_IDS: users allowed to use the /admin endpoints
+}
+
+// Postgres holds the database connection settings
+type Postgres struct {
+	User     string // POSTGRES_USER
+	Password string // POSTGRES_PASSWORD
+	Database string // POSTGRES_DB
+	Host     string // POSTGRES_HOST
+	Port     int    // POSTGRES_PORT
+	SSLMode  string // POSTGRES_SSLMODE: disable, allow, prefer, require, verify-ca or verify-full
+}
+
+// DSN returns the connection URL, escaping the credentials
+func (p Postgres) DSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(p.User, p.Password),
+		Host:     net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+		Path:     "/" + p.Database,
+		RawQuery: url.Values{"sslmode": {p.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// SSL modes accepted by the Postgres driver
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// Redis holds the queue connection settings
+type Redis struct {
+	URL string // REDIS_URL: redis://, rediss:// or unix:// URL
+}
+
+// HTTP holds the API server settings
+type HTTP struct {
+	Port            string        // PORT
+	ShutdownTimeout time.Duration // HTTP_SHUTDOWN_TIMEOUT: time in-flight requests get on shutdown
+}
+
+// Worker holds the worker pool and retry settings
+type Worker struct {
+	Concurrency      int           // WORKER_CONCURRENCY: tasks processed in parallel
+	MaxDecodedPixels int64         // MAX_DECODED_PIXELS: pixels decoded at once across all tasks
+	DrainTimeout     time.Duration // WORKER_DRAIN_TIMEOUT: time in-flight tasks get on shutdown
+	MaxAttempts      int           // TASK_MAX_ATTEMPTS: attempts before a task is dead-lettered
+	RetryBaseDelay   time.Duration // TASK_RETRY_BASE_DELAY: delay before the first retry
+	RetryMaxDelay    time.Duration // TASK_RETRY_MAX_DELAY: cap on the doubling delay
+}
+
+// Scheduler holds the settings for periodic maintenance jobs
+type Scheduler struct {
+	CleanupInterval      time.Duration // CLEANUP_INTERVAL: how often maintenance runs
+	UnverifiedAccountTTL time.Duration // UNVERIFIED_ACCOUNT_TTL: age at which unverified accounts are removed
+	StorageGCInterval    time.Duration // STORAGE_GC_INTERVAL: how often unreferenced objects are removed; 0 disables
+	StorageGCMinAge      time.Duration // STORAGE_GC_MIN_AGE: age below which an unreferenced object may still be in use
+}
+
+// Storage drivers
+const (
+	StorageS3    = "s3"
+	StorageLocal = "local"
+)
+
+// Storage selects and configures the object storage backend
+type Storage struct {
+	Driver      string // STORAGE_DRIVER: s3 (default) or local
+	PublicURL   string // STORAGE_PUBLIC_URL: prefix of object URLs, e.g. a CDN host; derived from the driver when empty
+	S3Bucket    string // AWS_BUCKET_NAME
+	S3Region    string // AWS_REGION
+	S3Endpoint  string // S3_ENDPOINT: endpoint of an S3-compatible store such as MinIO, Ceph or LocalStack
+	S3PathStyle bool   // S3_FORCE_PATH_STYLE: address objects as <endpoint>/<bucket>/<key> rather than <bucket>.<host>/<key>
+	LocalDir    string // STORAGE_LOCAL_DIR: root directory for the local driver
+
+	Private   bool          // STORAGE_PRIVATE: store only keys and hand out presigned URLs (s3 driver only)
+	URLExpiry time.Duration // STORAGE_URL_EXPIRY: lifetime of presigned URLs
+}
+
+// Upload holds the limits applied to uploads and the settings for
+// direct-to-storage and resumable uploads
+type Upload struct {
+	MaxSize            int64         // UPLOAD_MAX_SIZE: largest file accepted through POST /upload, in bytes
+	MaxDirectSize      int64         // UPLOAD_MAX_DIRECT_SIZE: largest file accepted through POST /uploads, in bytes
+	URLExpiry          time.Duration // UPLOAD_URL_EXPIRY: how long a client has to send the file
+	MaxResumableSize   int64         // UPLOAD_MAX_RESUMABLE_SIZE: largest file accepted through the tus endpoint, in bytes
+	ResumableTTL       time.Duration // UPLOAD_RESUMABLE_TTL: how long an idle resumable upload is kept
+	MaxPixels          int64         // UPLOAD_MAX_PIXELS: largest width × height accepted, read from the header before decoding
+	MaxDimension       int           // UPLOAD_MAX_DIMENSION: largest width or height accepted
+	MaxAnimationPixels int64         // UPLOAD_MAX_ANIMATION_PIXELS: largest frames × width × height accepted for an animation whose frames are kept
+	AllowedFormats     []string      // UPLOAD_ALLOWED_FORMATS: image formats accepted, a subset of ImageFormats
+}
+
+// Image formats the service can decode, as named by the image package
+var ImageFormats = []string{"jpeg", "png", "gif", "webp"}
+
+// Longest lifetime S3 accepts for a presigned URL
+const maxURLExpiry = 7 * 24 * time.Hour
+
+// Returns the configuration used when no environment variables are set
+func Default() Config {
+	return Config{
+		Postgres: Postgres{
+			User:     "postgres",
+			Database: "postgres",
+			Host:     "localhost",
+			Port:     5432,
+			SSLMode:  "prefer",
+		},
+		Redis: Redis{
+			URL: "redis://localhost:6379/0",
+		},
+		HTTP: HTTP{
+			Port:            "8080",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Worker: Worker{
+			Concurrency:      runtime.NumCPU(),
+			MaxDecodedPixels: 100_000_000,
+			DrainTimeout:     30 * time.Second,
+			MaxAttempts:      5,
+			RetryBaseDelay:   10 * time.Second,
+			RetryMaxDelay:    10 * time.Minute,
+		},
+		Scheduler: Scheduler{
+			CleanupInterval:      24 * time.Hour,
+			UnverifiedAccountTTL: 48 * time.Hour,
+			StorageGCInterval:    24 * time.Hour,
+			StorageGCMinAge:      72 * time.Hour,
+		},
+		Storage: Storage{
+			Driver:    StorageS3,
+			S3Region:  "us-west-2",
+			LocalDir:  "./data/storage",
+			URLExpiry: 15 * time.Minute,
+		},
+		Upload: Upload{
+			MaxSize:            50 << 20,
+			MaxDirectSize:      100 << 20,
+			URLExpiry:          15 * time.Minute,
+			MaxResumableSize:   500 << 20,
+			ResumableTTL:       24 * time.Hour,
+			MaxPixels:          50_000_000,
+			MaxDimension:       16384,
+			MaxAnimationPixels: 100_000_000,
+			AllowedFormats:     slices.Clone(ImageFormats),
+		},
+	}
+}
+
+// Load reads the configuration from the environment on top of Default.
+// Every invalid value is reported, not just the first.
+func Load() (Config, error) {
+	return load(os.LookupEnv)
+}
+
+// Reads the configuration through lookup so tests need not touch the environment
+func load(lookup func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+	r := reader{lookup: lookup}
+
+	r.str("POSTGRES_USER", &cfg.Postgres.User)
+	r.str("POSTGRES_PASSWORD", &cfg.Postgres.Password)
+	r.str("POSTGRES_DB", &cfg.Postgres.Database)
+	r.str("POSTGRES_HOST", &cfg.Postgres.Host)
+	r.positiveInt("POSTGRES_PORT", &cfg.Postgres.Port)
+	if cfg.Postgres.Port > 65535 {
+		r.fail("POSTGRES_PORT", strconv.Itoa(cfg.Postgres.Port), "a port between 1 and 65535")
+	}
+	r.str("POSTGRES_SSLMODE", &cfg.Postgres.SSLMode)
+	if !slices.Contains(sslModes, cfg.Postgres.SSLMode) {
+		r.fail("POSTGRES_SSLMODE", cfg.Postgres.SSLMode, "disable, allow, prefer, require, verify-ca or verify-full")
+	}
+	r.str("REDIS_URL", &cfg.Redis.URL)
+	if u, err := url.Parse(cfg.Redis.URL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss" && u.Scheme != "unix") {
+		r.fail("REDIS_URL", cfg.Redis.URL, "a redis://, rediss:// or unix:// URL")
+	}
+
+	r.str("PORT", &cfg.HTTP.Port)
+	r.duration("HTTP_SHUTDOWN_TIMEOUT", &cfg.HTTP.ShutdownTimeout, true)
+
+	r.positiveInt("WORKER_CONCURRENCY", &cfg.Worker.Concurrency)
+	r.positiveInt64("MAX_DECODED_PIXELS", &cfg.Worker.MaxDecodedPixels)
+	r.duration("WORKER_DRAIN_TIMEOUT", &cfg.Worker.DrainTimeout, true)
+	r.positiveInt("TASK_MAX_ATTEMPTS", &cfg.Worker.MaxAttempts)
+	r.duration("TASK_RETRY_BASE_DELAY", &cfg.Worker.RetryBaseDelay, false)
+	r.duration("TASK_RETRY_MAX_DELAY", &cfg.Worker.RetryMaxDelay, false)
+
+	r.duration("CLEANUP_INTERVAL", &cfg.Scheduler.CleanupInterval, false)
+	r.duration("UNVERIFIED_ACCOUNT_TTL", &cfg.Scheduler.UnverifiedAccountTTL, false)
+
+	r.str("STORAGE_DRIVER", &cfg.Storage.Driver)
+	if d := cfg.Storage.Driver; d != StorageS3 && d != StorageLocal {
+		r.fail("STORAGE_DRIVER", d, "s3 or local")
+	}
+	r.url("STORAGE_PUBLIC_URL", &cfg.Storage.PublicURL)
+	r.str("AWS_BUCKET_NAME", &cfg.Storage.S3Bucket)
+	r.str("AWS_REGION", &cfg.Storage.S3Region)
+	r.url("S3_ENDPOINT", &cfg.Storage.S3Endpoint)
+	r.boolean("S3_FORCE_PATH_STYLE", &cfg.Storage.S3PathStyle)
+	r.str("STORAGE_LOCAL_DIR", &cfg.Storage.LocalDir)
+	r.boolean("STORAGE_PRIVATE", &cfg.Storage.Private)
+	r.duration("STORAGE_URL_EXPIRY", &cfg.Storage.URLExpiry, false)
+	if cfg.Storage.URLExpiry > maxURLExpiry {
+		r.fail("STORAGE_URL_EXPIRY", cfg.Storage.URLExpiry.String(), "at most 168h")
+	}
+	if cfg.Storage.Private && cfg.Storage.Driver != StorageS3 {
+		r.fail("STORAGE_PRIVATE", "true", "false unless STORAGE_DRIVER=s3")
+	}
+
+	r.positiveInt64("UPLOAD_MAX_SIZE", &cfg.Upload.MaxSize)
+	r.positiveInt64("UPLOAD_MAX_DIRECT_SIZE", &cfg.Upload.MaxDirectSize)
+	r.duration("UPLOAD_URL_EXPIRY", &cfg.Upload.URLExpiry, false)
+	if cfg.Upload.URLExpiry > maxURLExpiry {
+		r.fail("UPLOAD_URL_EXPIRY", cfg.Upload.URLExpiry.String(), "at most 168h")
+	}
+	r.positiveInt64("UPLOAD_MAX_RESUMABLE_SIZE", &cfg.Upload.MaxResumableSize)
+	r.duration("UPLOAD_RESUMABLE_TTL", &cfg.Upload.ResumableTTL, false)
+	// A worker refuses any image larger than its budget, so uploads must fit in it
+	cfg.Upload.MaxPixels = min(cfg.Upload.MaxPixels, cfg.Worker.MaxDecodedPixels)
+	r.positiveInt64("UPLOAD_MAX_PIXELS", &cfg.Upload.MaxPixels)
+	if cfg.Upload.MaxPixels > cfg.Worker.MaxDecodedPixels {
+		r.fail("UPLOAD_MAX_PIXELS", strconv.FormatInt(cfg.Upload.MaxPixels, 10),
+			"at most MAX_DECODED_PIXELS ("+strconv.FormatInt(cfg.Worker.MaxDecodedPixels, 10)+")")
+	}
+	r.positiveInt("UPLOAD_MAX_DIMENSION", &cfg.Upload.MaxDimension)
+	// Animations are decoded whole, so by default they get the worker budget
+	cfg.Upload.MaxAnimationPixels = cfg.Worker.MaxDecodedPixels
+	r.positiveInt64("UPLOAD_MAX_ANIMATION_PIXELS", &cfg.Upload.MaxAnimationPixels)
+	if cfg.Upload.MaxAnimationPixels > cfg.Worker.MaxDecodedPixels {
+		r.fail("UPLOAD_MAX_ANIMATION_PIXELS", strconv.FormatInt(cfg.Upload.MaxAnimationPixels, 10),
+			"at most MAX_DECODED_PIXELS ("+strconv.FormatInt(cfg.Worker.MaxDecodedPixels, 10)+")")
+	}
+	if _, ok := r.get("UPLOAD_ALLOWED_FORMATS"); ok {
+		var formats []string
+		r.list("UPLOAD_ALLOWED_FORMATS", &formats)
+		for i, format := range formats {
+			formats[i] = strings.ToLower(format)
+			if !slices.Contains(ImageFormats, formats[i]) {
+				r.fail("UPLOAD_ALLOWED_FORMATS", format, "a list of "+strings.Join(ImageFormats, ", "))
+			}
+		}
+		if len(formats) == 0 {
+			r.fail("UPLOAD_ALLOWED_FORMATS", "", "at least one format")
+		}
+		cfg.Upload.AllowedFormats = formats
+	}
+
+	// Uploads in progress are stored before any row refers to them
+	r.duration("STORAGE_GC_INTERVAL", &cfg.Scheduler.StorageGCInterval, true)
+	r.duration("STORAGE_GC_MIN_AGE", &cfg.Scheduler.StorageGCMinAge, false)
+	if minAge := max(cfg.Upload.URLExpiry+time.Hour, cfg.Upload.ResumableTTL); cfg.Scheduler.StorageGCMinAge < minAge {
+		r.fail("STORAGE_GC_MIN_AGE", cfg.Scheduler.StorageGCMinAge.String(),
+			"at least "+minAge.String()+" (UPLOAD_URL_EXPIRY + 1h and UPLOAD_RESUMABLE_TTL)")
+	}
+
+	r.list("ADMIN_USER_IDS", &cfg.AdminUserIDs)
+
+	return cfg, errors.Join(r.errs...)
+}
+
+// reader parses environment variables into typed fields, collecting errors
+type reader struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+func (r *reader) get(key string) (string, bool) {
+	v, ok := r.lookup(key)
+	v = strings.TrimSpace(v)
+	return v, ok && v != ""
+}
+
+func (r *reader) fail(key, value, want string) {
+	r.errs = append(r.errs, fmt.Errorf("%s=%q: want %s", key, value, want))
+}
+
+func (r *reader) str(key string, dst *string) {
+	if v, ok := r.get(key); ok {
+		*dst = v
+	}
+}
+
+func (r *reader) positiveInt(key string, dst *int) {
+	if v, ok := r.get(key); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			r.fail(key, v, "a positive integer")
+			return
+		}
+		*dst = n
+	}
+}
+
+func (r *reader) positiveInt64(key string, dst *int64) {
+	if v, ok := r.get(key); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			r.fail(key, v, "a positive integer")
+			return
+		}
+		*dst = n
+	}
+}
+
+func (r *reader) duration(key string, dst *time.Duration, allowZero bool) {
+	if v, ok := r.get(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || (d == 0 && !allowZero) {
+			r.fail(key, v, "a positive duration such as 30s or 5m")
+			return
+		}
+		*dst = d
+	}
+}
+
+func (r *reader) boolean(key string, dst *bool) {
+	if v, ok := r.get(key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			r.fail(key, v, "true or false")
+			return
+		}
+		*dst = b
+	}
+}
+
+// Reads an absolute http(s) URL without a trailing slash
+func (r *reader) url(key string, dst *string) {
+	if v, ok := r.get(key); ok {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.fail(key, v, "an absolute http or https URL")
+			return
+		}
+		*dst = strings.TrimSuffix(v, "/")
+	}
+}
+
+func (r *reader) list(key string, dst *[]string) {
+	v, ok := r.get(key)
+	if !ok {
+		return
+	}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
@@ -2,42 +2,35 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"sync"
+	"errors"
+	"image-processing-service/internal/config"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-var (
-	dbPool    *pgxpool.Pool // Database connection pool
-	poolOnce  sync.Once     // Makes sure database pool is only created once
-	poolError error         // Stores any error that occurs during pool creation
-)
-
-// GetDBPool returns a singleton database connection pool.
-// This function ensures that the database connection pool is created only once
-// and will return the same pool for subsequent calls.
-// It constructs a connection string from env variables and creates a connection pool
-// using the pgxpool.Connect method. If connection pool creation failes, an error is returned.
-func GetDBPool() (*pgxpool.Pool, error) {
-	poolOnce.Do(func() {
-		user := os.Getenv("POSTGRES_USER")
-		password := os.Getenv("POSTGRES_PASSWORD")
-		dbname := os.Getenv("POSTGRES_DB")
-		host := os.Getenv("POSTGRES_HOST")
-		port := os.Getenv("POSTGRES_PORT")
-		sslmode := os.Getenv("POSTGRES_SSLMODE")
+var dbPool *pgxpool.Pool // Database connection pool, set by Connect
 
-		dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
-			user, password, host, port, dbname, sslmode,
-		)
+// Returned by GetDBPool before Connect has succeeded
+var ErrNotConnected = errors.New("db: not connected")
 
-		// Create a connection pool instead of a single connection
-		dbPool, poolError = pgxpool.Connect(context.Background(), dsn)
-	})
+// Connect creates the database connection pool from the Postgres settings.
+// It is called once at startup, before any other function in this package.
+func Connect(ctx context.Context, cfg config.Postgres) error {
+	pool, err := pgxpool.Connect(ctx, cfg.DSN())
+	if err != nil {
+		return err
+	}
+	dbPool = pool
+	return nil
+}
 
-	return dbPool, poolError
+// GetDBPool returns the connection pool created by Connect, or
+// ErrNotConnected when there is none.
+func GetDBPool() (*pgxpool.Pool, error) {
+	if dbPool == nil {
+		return nil, ErrNotConnected
+	}
+	return dbPool, nil
 }
 
 // CloseDBPool closes the database connection pool, releasing all connections.
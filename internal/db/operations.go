@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"image-processing-service/internal/auth"
 	"image-processing-service/internal/models"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v4"
@@ -172,6 +174,9 @@ func UpdateVerificationToken(email string, token string, expiry time.Time) error
 	return nil
 }
 
+// Returned by InsertImageMeta when the user already has an image with the same content hash
+var ErrDuplicateImage = errors.New("image already uploaded")
+
 // Inserts image metadata and returns the generated image ID
 func InsertImageMeta(ctx context.Context, meta models.ImageMeta) (string, error) {
 	pool, err := GetDBPool()
@@ -180,12 +185,16 @@ func InsertImageMeta(ctx context.Context, meta models.ImageMeta) (string, error)
 	}
 	var imageID string
 	err = pool.QueryRow(ctx,
-		`INSERT INTO images (file_name, url, s3_key, size, uploaded, content_type, width, height, user_id, status, processed_url)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		`INSERT INTO images (file_name, url, s3_key, size, uploaded, content_type, width, height, user_id, status, processed_url, content_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''))
+		ON CONFLICT (user_id, content_hash) WHERE content_hash IS NOT NULL DO NOTHING
 		RETURNING id`,
 		meta.FileName, meta.URL, meta.S3Key, meta.Size, meta.Uploaded, meta.ContentType,
-		meta.Width, meta.Height, meta.UserID, meta.Status, meta.ProcessedURL,
+		meta.Width, meta.Height, meta.UserID, meta.Status, meta.ProcessedURL, meta.ContentHash,
 	).Scan(&imageID)
+	if err == pgx.ErrNoRows {
+		return "", ErrDuplicateImage
+	}
 	return imageID, err
 }
 
@@ -202,18 +211,67 @@ func UpdateImageStatus(ctx context.Context, imageID string, status string, proce
 	return err
 }
 
-// Retrieves the current status and processed URL of an image
-func GetImageStatus(ctx context.Context, imageID string) (string, string, error) {
+// Marks an image as completed and records where the processed image is stored.
+// processedURL is empty when URLs are generated per request.
+func CompleteImage(ctx context.Context, imageID, processedKey, processedURL string) error {
 	pool, err := GetDBPool()
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	var status, processedURL string
-	err = pool.QueryRow(ctx,
-		`SELECT status, processed_url FROM images WHERE id = $1`,
-		imageID,
-	).Scan(&status, &processedURL)
-	return status, processedURL, err
+	_, err = pool.Exec(ctx,
+		`UPDATE images SET status = 'completed', processed_key = $1, processed_url = $2 WHERE id = $3`,
+		processedKey, processedURL, imageID,
+	)
+	return err
+}
+
+// Returned when an image does not exist or belongs to another user
+var ErrImageNotFound = errors.New("image not found")
+
+// Columns of images read by scanImage
+const imageColumns = `id, file_name, url, s3_key, size, uploaded, content_type, width, height,
+	status, processed_url, COALESCE(processed_key, ''), COALESCE(content_hash, '')`
+
+// Reads a row selected with imageColumns
+func scanImage(row pgx.Row, image *models.ImageMeta) error {
+	return row.Scan(
+		&image.ID, &image.FileName, &image.URL, &image.S3Key, &image.Size,
+		&image.Uploaded, &image.ContentType, &image.Width, &image.Height,
+		&image.Status, &image.ProcessedURL, &image.ProcessedKey, &image.ContentHash)
+}
+
+// Retrieves an image belonging to a user
+func GetImage(ctx context.Context, imageID, userID string) (models.ImageMeta, error) {
+	var image models.ImageMeta
+	pool, err := GetDBPool()
+	if err != nil {
+		return image, err
+	}
+	err = scanImage(pool.QueryRow(ctx,
+		`SELECT `+imageColumns+` FROM images WHERE id = $1 AND user_id = $2`,
+		imageID, userID), &image)
+	if err == pgx.ErrNoRows {
+		return image, ErrImageNotFound
+	}
+	image.UserID = userID
+	return image, err
+}
+
+// Retrieves a user's image with the given content hash
+func GetImageByHash(ctx context.Context, userID, contentHash string) (models.ImageMeta, error) {
+	var image models.ImageMeta
+	pool, err := GetDBPool()
+	if err != nil {
+		return image, err
+	}
+	err = scanImage(pool.QueryRow(ctx,
+		`SELECT `+imageColumns+` FROM images WHERE user_id = $1 AND content_hash = $2`,
+		userID, contentHash), &image)
+	if err == pgx.ErrNoRows {
+		return image, ErrImageNotFound
+	}
+	image.UserID = userID
+	return image, err
 }
 
 // Retrievs image metadata based on the filename
@@ -233,28 +291,71 @@ func GetImageMetaByFileName(ctx context.Context, fileName string) (models.ImageM
 	return meta, err
 }
 
-// Deletes an image from the database after verifying ownership
-func DeleteImage(imageID string, userID string) error {
+// Deletes an image belonging to a user and returns the storage keys of its
+// original, processed image and variants, which the caller must remove
+func DeleteImage(ctx context.Context, imageID, userID string) ([]string, error) {
 	pool, err := GetDBPool()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// First, verify the image belongs to the user
-	var exists bool
-	err = pool.QueryRow(context.Background(),
-		"SELECT EXISTS(SELECT 1 FROM images WHERE id = $1 AND user_id = $2)",
-		imageID, userID).Scan(&exists)
+	// Every statement in the query sees the variants as they were before the cascade
+	rows, err := pool.Query(ctx,
+		`WITH deleted AS (
+			DELETE FROM images WHERE id = $1 AND user_id = $2
+			RETURNING id, s3_key, processed_key
+		)
+		SELECT s3_key FROM deleted
+		UNION ALL SELECT processed_key FROM deleted WHERE COALESCE(processed_key, '') <> ''
+		UNION ALL SELECT v.s3_key FROM image_variants v JOIN deleted d ON v.image_id = d.id`,
+		imageID, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !exists {
-		return errors.New("image not found or does not belong to the user")
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
-	// Delete the image
-	_, err = pool.Exec(context.Background(),
-		"DELETE FROM images WHERE id = $1 AND user_id = $2",
-		imageID, userID)
-	return err
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// Every image has an original, so no keys means no image was deleted
+	if len(keys) == 0 {
+		return nil, ErrImageNotFound
+	}
+	return keys, nil
+}
+
+// Reports which of the given storage keys are still used by an image or variant
+func ReferencedKeys(ctx context.Context, keys []string) (map[string]bool, error) {
+	pool, err := GetDBPool()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := pool.Query(ctx,
+		`SELECT s3_key FROM images WHERE s3_key = ANY($1)
+		UNION SELECT processed_key FROM images WHERE processed_key = ANY($1)
+		UNION SELECT s3_key FROM image_variants WHERE s3_key = ANY($1)`,
+		keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		referenced[key] = true
+	}
+	return referenced, rows.Err()
 }
 
 // Verifies that an image belongs to a user
@@ -270,37 +371,183 @@ func VerifyImageOwnership(imageID string, userID string) (bool, error) {
 	return exists, err
 }
 
-// Retrieves all images by a specific user
-func GetUserImages(userID string) ([]models.ImageMeta, error) {
+// Columns images can be listed by, keyed by the name used in ImageQuery.Sort
+var imageSortColumns = map[string]string{
+	"uploaded": "uploaded",
+	"size":     "size",
+	"name":     "file_name",
+}
+
+// ImageQuery selects, orders and pages a user's images
+type ImageQuery struct {
+	Status       string    // Only images in this processing status
+	ContentType  string    // Only images of this MIME type
+	UploadedFrom time.Time // Only images uploaded at or after this time, unless zero
+	UploadedTo   time.Time // Only images uploaded before this time, unless zero
+	NameContains string    // Only images whose file name contains this, ignoring case
+	Sort         string    // uploaded, size or name
+	Desc         bool
+	Limit        int
+	After        *ImageCursor // Where the previous page ended, or nil for the first page
+}
+
+// ImageCursor is the position of an image in a listing: the value of the
+// sort column, with the ID breaking ties
+type ImageCursor struct {
+	Uploaded time.Time
+	Size     int64
+	Name     string
+	ID       string
+}
+
+// Returned by ListUserImages for a sort it does not know
+var ErrInvalidSort = errors.New("invalid sort")
+
+// Retrieves a page of a user's images with their variants, and reports
+// whether more images follow it. Pages are keyed on the sort column and ID,
+// so they stay consistent while images are added or removed.
+func ListUserImages(ctx context.Context, userID string, q ImageQuery) ([]models.ImageMeta, bool, error) {
+	column, ok := imageSortColumns[q.Sort]
+	if !ok {
+		return nil, false, ErrInvalidSort
+	}
 	pool, err := GetDBPool()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	rows, err := pool.Query(context.Background(),
-		`SELECT id, file_name, url, s3_key, size, uploaded, content_type, width, height,
-		status, processed_url FROM images WHERE user_id = $1 ORDER BY uploaded DESC`,
-		userID)
+	args := []any{userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{"user_id = $1"}
+	if q.Status != "" {
+		where = append(where, "status = "+arg(q.Status))
+	}
+	if q.ContentType != "" {
+		where = append(where, "content_type = "+arg(q.ContentType))
+	}
+	// uploaded holds the server's local wall-clock time
+	if !q.UploadedFrom.IsZero() {
+		where = append(where, "uploaded >= "+arg(q.UploadedFrom.In(time.Local)))
+	}
+	if !q.UploadedTo.IsZero() {
+		where = append(where, "uploaded < "+arg(q.UploadedTo.In(time.Local)))
+	}
+	if q.NameContains != "" {
+		pattern := likeEscaper.Replace(q.NameContains)
+		where = append(where, "file_name ILIKE "+arg("%"+pattern+"%"))
+	}
+	direction, compare := "ASC", ">"
+	if q.Desc {
+		direction, compare = "DESC", "<"
+	}
+	if c := q.After; c != nil {
+		var value any
+		switch q.Sort {
+		case "uploaded":
+			value = c.Uploaded
+		case "size":
+			value = c.Size
+		case "name":
+			value = c.Name
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, compare, arg(value), arg(c.ID)))
+	}
+
+	// One row more than the page tells whether another page follows
+	query := fmt.Sprintf(`SELECT %s FROM images WHERE %s ORDER BY %s %s, id %s LIMIT %s`,
+		imageColumns, strings.Join(where, " AND "), column, direction, direction, arg(q.Limit+1))
+	rows, err := pool.Query(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer rows.Close()
 
 	var images []models.ImageMeta
 	for rows.Next() {
 		var image models.ImageMeta
-		err = rows.Scan(
-			&image.ID, &image.FileName, &image.URL, &image.S3Key, &image.Size,
-			&image.Uploaded, &image.ContentType, &image.Width, &image.Height,
-			&image.Status, &image.ProcessedURL)
-		if err != nil {
-			return nil, err
+		if err = scanImage(rows, &image); err != nil {
+			return nil, false, err
 		}
 		image.UserID = userID
 		images = append(images, image)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	}
+	more := len(images) > q.Limit
+	if more {
+		images = images[:q.Limit]
+	}
+
+	ids := make([]string, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	variants, err := GetImageVariants(ctx, ids...)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range images {
+		images[i].Variants = variants[images[i].ID]
+	}
 
-	return images, nil
+	return images, more, nil
+}
+
+// Escapes the wildcards of a LIKE pattern; backslash is the default escape
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Inserts or replaces a named variant of an image
+func UpsertImageVariant(ctx context.Context, v models.ImageVariant) error {
+	pool, err := GetDBPool()
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx,
+		`INSERT INTO image_variants (image_id, name, s3_key, url, size, content_type, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (image_id, name) DO UPDATE SET
+			s3_key = EXCLUDED.s3_key, url = EXCLUDED.url, size = EXCLUDED.size,
+			content_type = EXCLUDED.content_type, width = EXCLUDED.width,
+			height = EXCLUDED.height, created_at = CURRENT_TIMESTAMP`,
+		v.ImageID, v.Name, v.S3Key, v.URL, v.Size, v.ContentType, v.Width, v.Height,
+	)
+	return err
+}
+
+// Retrieves the variants of the given images, grouped by image ID
+func GetImageVariants(ctx context.Context, imageIDs ...string) (map[string][]models.ImageVariant, error) {
+	variants := make(map[string][]models.ImageVariant)
+	if len(imageIDs) == 0 {
+		return variants, nil
+	}
+	pool, err := GetDBPool()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := pool.Query(ctx,
+		`SELECT image_id, name, s3_key, url, size, content_type, width, height, created_at
+		FROM image_variants WHERE image_id = ANY($1::uuid[]) ORDER BY image_id, name`,
+		imageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v models.ImageVariant
+		err = rows.Scan(&v.ImageID, &v.Name, &v.S3Key, &v.URL, &v.Size,
+			&v.ContentType, &v.Width, &v.Height, &v.Created)
+		if err != nil {
+			return nil, err
+		}
+		variants[v.ImageID] = append(variants[v.ImageID], v)
+	}
+	return variants, rows.Err()
 }
 
 // Generates a reset token for a user and saves it to the database
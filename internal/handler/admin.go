@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/queue"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lists tasks in the dead-letter queue, most recent failure first
+func ListDeadLettersHandler(c *gin.Context) {
+	letters, err := queue.ListDeadLetters(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list dead-lettered tasks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"dead_letters": letters,
+		"count":        len(letters),
+	})
+}
+
+// Returns a single dead-lettered task, including its last error
+func GetDeadLetterHandler(c *gin.Context) {
+	dl, err := queue.GetDeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, queue.ErrDeadLetterNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead-lettered task not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dead-lettered task"})
+		return
+	}
+	c.JSON(http.StatusOK, dl)
+}
+
+// Puts a dead-lettered task back on the queue and marks its image pending again
+func RequeueDeadLetterHandler(c *gin.Context) {
+	dl, err := queue.RequeueDeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, queue.ErrDeadLetterNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead-lettered task not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue task"})
+		return
+	}
+
+	if dl.ImageID != "" {
+		if err := db.UpdateImageStatus(context.Background(), dl.ImageID, "pending", ""); err != nil {
+			slog.Error("error resetting image status", "image_id", dl.ImageID, "error", err)
+		}
+	}
+	slog.Info("requeued dead-lettered task", "dead_letter_id", dl.ID, "image_id", dl.ImageID)
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Task requeued",
+		"id":       dl.ID,
+		"image_id": dl.ImageID,
+	})
+}
+
+// Deletes a single dead-lettered task
+func PurgeDeadLetterHandler(c *gin.Context) {
+	n, err := queue.PurgeDeadLetters(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge task"})
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead-lettered task not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
+
+// Deletes every dead-lettered task
+func PurgeAllDeadLettersHandler(c *gin.Context) {
+	n, err := queue.PurgeDeadLetters(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge dead-lettered tasks"})
+		return
+	}
+	slog.Info("purged dead-lettered tasks", "count", n)
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image-processing-service/internal/queue"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// newAdminRouter mounts the dead-letter routes behind AdminMiddleware, with
+// userID taken from the X-User header instead of a JWT.
+func newAdminRouter(admins ...string) *gin.Engine {
+	r := gin.New()
+	admin := r.Group("/admin", func(c *gin.Context) {
+		if id := c.GetHeader("X-User"); id != "" {
+			c.Set("userID", id)
+		}
+	}, AdminMiddleware(admins))
+	admin.GET("/dead-letters", ListDeadLettersHandler)
+	admin.DELETE("/dead-letters", PurgeAllDeadLettersHandler)
+	admin.GET("/dead-letters/:id", GetDeadLetterHandler)
+	admin.POST("/dead-letters/:id/requeue", RequeueDeadLetterHandler)
+	admin.DELETE("/dead-letters/:id", PurgeDeadLetterHandler)
+	return r
+}
+
+// useMiniredis points queue.Rdb at an in-memory Redis for the duration of a test.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prev := queue.Rdb
+	queue.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		queue.Rdb.Close()
+		queue.Rdb = prev
+	})
+	return mr
+}
+
+func adminRequest(r *gin.Engine, method, path, user string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// ---- AdminMiddleware ------------------------------------------------------------
+
+func TestAdminMiddleware_RejectsNonAdmins(t *testing.T) {
+	tests := []struct {
+		name   string
+		admins []string
+		user   string
+	}{
+		{"no admins configured", nil, "user-1"},
+		{"not listed", []string{"admin-1", "admin-2"}, "user-1"},
+		{"no user", []string{"admin-1"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newAdminRouter(tc.admins...)
+			w := adminRequest(r, http.MethodGet, "/admin/dead-letters", tc.user)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("want 403, got %d", w.Code)
+			}
+		})
+	}
+}
+
+// ---- Dead-letter handlers -------------------------------------------------------
+
+func TestDeadLetterHandlers(t *testing.T) {
+	mr := useMiniredis(t)
+	r := newAdminRouter("admin-1", "admin-2")
+	dl, err := queue.AddDeadLetter(context.Background(), `{"id":"t-1"}`, queue.Task{ID: "t-1"}, 5, errors.New("s3 down"))
+	if err != nil {
+		t.Fatalf("add dead letter: %v", err)
+	}
+
+	w := adminRequest(r, http.MethodGet, "/admin/dead-letters", "admin-2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: want 200, got %d", w.Code)
+	}
+	var list struct {
+		DeadLetters []queue.DeadLetter `json:"dead_letters"`
+		Count       int                `json:"count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || list.Count != 1 || list.DeadLetters[0].LastError != "s3 down" {
+		t.Fatalf("list: unexpected body %s", w.Body.String())
+	}
+
+	if w := adminRequest(r, http.MethodGet, "/admin/dead-letters/"+dl.ID, "admin-1"); w.Code != http.StatusOK {
+		t.Errorf("get: want 200, got %d", w.Code)
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/dead-letters/missing", "admin-1"); w.Code != http.StatusNotFound {
+		t.Errorf("get missing: want 404, got %d", w.Code)
+	}
+
+	if w := adminRequest(r, http.MethodPost, "/admin/dead-letters/"+dl.ID+"/requeue", "admin-1"); w.Code != http.StatusOK {
+		t.Fatalf("requeue: want 200, got %d", w.Code)
+	}
+	if got, _ := mr.List(queue.TaskQueue); len(got) != 1 || got[0] != dl.Task {
+		t.Errorf("requeue: want task on the queue, got %v", got)
+	}
+	if w := adminRequest(r, http.MethodPost, "/admin/dead-letters/"+dl.ID+"/requeue", "admin-1"); w.Code != http.StatusNotFound {
+		t.Errorf("requeue twice: want 404, got %d", w.Code)
+	}
+
+	if w := adminRequest(r, http.MethodDelete, "/admin/dead-letters/"+dl.ID, "admin-1"); w.Code != http.StatusNotFound {
+		t.Errorf("purge missing: want 404, got %d", w.Code)
+	}
+	queue.AddDeadLetter(context.Background(), "a", queue.Task{}, 1, errors.New("x"))
+	queue.AddDeadLetter(context.Background(), "b", queue.Task{}, 1, errors.New("y"))
+	w = adminRequest(r, http.MethodDelete, "/admin/dead-letters", "admin-1")
+	if w.Code != http.StatusOK || w.Body.String() != `{"purged":2}` {
+		t.Errorf("purge all: got %d %s", w.Code, w.Body.String())
+	}
+}
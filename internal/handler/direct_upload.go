@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/models"
+	"image-processing-service/internal/processor"
+	"image-processing-service/internal/storage"
+	"image-processing-service/internal/uploads"
+	"image-processing-service/internal/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Image types accepted for upload and the key extension stored for each
+var uploadTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Body of POST /uploads
+type createUploadRequest struct {
+	FileName    string `json:"file_name" binding:"required"`
+	ContentType string `json:"content_type" binding:"required"`
+	Size        int64  `json:"size" binding:"required,gt=0"`
+	Method      string `json:"method"` // PUT (default) or POST
+}
+
+// Starts a direct upload: returns a presigned PUT or POST that lets the
+// client send the file straight to storage under a fresh staging key.
+// The client then calls POST /uploads/:id/complete, which copies the file to
+// its key in the user's originals/ partition. The presigned request stays
+// valid after that, so it must never be able to write an original.
+func CreateUploadHandler(cfg config.Upload) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get userID from the JWT token in the context
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		var req createUploadRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file_name, content_type and a positive size are required"})
+			return
+		}
+		ext, ok := acceptedType(cfg, req.ContentType)
+		if !ok {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":           "Unsupported content type: " + req.ContentType,
+				"allowed_formats": cfg.AllowedFormats,
+			})
+			return
+		}
+		if req.Size > cfg.MaxDirectSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":    fmt.Sprintf("File exceeds the %d byte size limit", cfg.MaxDirectSize),
+				"max_size": cfg.MaxDirectSize,
+			})
+			return
+		}
+		method := strings.ToUpper(req.Method)
+		if method == "" {
+			method = http.MethodPut
+		}
+		if method != http.MethodPut && method != http.MethodPost {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "method must be PUT or POST"})
+			return
+		}
+
+		presigner, ok := storage.Default().(storage.UploadPresigner)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Direct uploads are not supported by the configured storage driver"})
+			return
+		}
+
+		id := utils.NewUUID()
+		key := originalKey(userID.(string), id, ext)
+		staging := stagingKey(id, ext)
+		upload, err := presigner.PresignUpload(c.Request.Context(), method, staging, req.ContentType, req.Size, cfg.URLExpiry)
+		if err != nil {
+			slog.Error("failed to presign upload", "key", staging, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+			return
+		}
+
+		session := uploads.Session{
+			ID:          id,
+			UserID:      userID.(string),
+			Key:         key,
+			StagingKey:  staging,
+			FileName:    req.FileName,
+			ContentType: req.ContentType,
+			Size:        req.Size,
+			Method:      method,
+			ExpiresAt:   upload.ExpiresAt,
+		}
+		if err = uploads.Save(c.Request.Context(), session); err != nil {
+			slog.Error("failed to save upload session", "upload_id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":     id,
+			"key":    key,
+			"upload": upload,
+		})
+	}
+}
+
+// Finishes a direct upload: copies the object out of staging, checks it
+// arrived within the declared size, reads its dimensions from the header,
+// records the image and queues it for processing. Only the copy is read, so
+// whatever the client writes to staging afterwards is never seen. Accepts
+// the same processing fields as POST /upload.
+func CompleteUploadHandler(cfg config.Upload) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get userID from the JWT token in the context
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		// Validate the processing options before consuming the session
+		opts, ok := parseProcessingOptions(c, c.PostForm)
+		if !ok {
+			return
+		}
+
+		ctx := c.Request.Context()
+		session, err := uploads.Claim(ctx, c.Param("id"))
+		if errors.Is(err, uploads.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found or expired"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve upload"})
+			return
+		}
+		if session.UserID != userID.(string) {
+			releaseSession(ctx, session)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found or expired"})
+			return
+		}
+
+		backend := storage.Default()
+		if backend == nil {
+			releaseSession(ctx, session)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage is not configured"})
+			return
+		}
+
+		var resp gin.H
+		uerr := unstageUpload(ctx, backend, session)
+		if uerr == nil {
+			resp, uerr = registerStoredUpload(c, cfg, backend, storedUpload{
+				Key:         session.Key,
+				FileName:    session.FileName,
+				ContentType: session.ContentType,
+				UserID:      session.UserID,
+				MaxSize:     session.Size,
+			}, opts)
+		}
+		if uerr != nil && uerr.retry {
+			releaseSession(ctx, session)
+			c.JSON(uerr.status, uerr.body())
+			return
+		}
+		discardStaged(ctx, backend, session)
+		if uerr != nil {
+			if uerr.invalid {
+				discardUpload(ctx, backend, session)
+			}
+			c.JSON(uerr.status, uerr.body())
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// A file that a client has put in storage and now wants processed
+type storedUpload struct {
+	Key         string
+	FileName    string
+	ContentType string // Declared by the client; the object must really be of this type
+	UserID      string
+	MaxSize     int64 // The object may be smaller but not larger
+}
+
+// Why a stored upload could not be registered, and what to do about it
+type uploadError struct {
+	status  int
+	message string
+	details gin.H // Extra fields for the response body
+	invalid bool  // The object was rejected and should be deleted
+	retry   bool  // Nothing was recorded, so the client may try again
+}
+
+// Returns the response body for the error
+func (e *uploadError) body() gin.H {
+	body := gin.H{"error": e.message}
+	for k, v := range e.details {
+		body[k] = v
+	}
+	return body
+}
+
+// Checks that a stored upload arrived within its size limit and is an
+// accepted image of the declared type within the pixel limits, records it and queues it for processing.
+// Returns the same response body as POST /upload; an identical image the
+// user already has is returned instead, and the new object is deleted.
+func registerStoredUpload(c *gin.Context, cfg config.Upload, backend storage.Backend, u storedUpload, opts processingOptions) (gin.H, *uploadError) {
+	ctx := c.Request.Context()
+
+	// The file must have arrived, within the declared size
+	info, err := backend.Stat(ctx, u.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, &uploadError{status: http.StatusConflict, message: "The file has not been uploaded yet", retry: true}
+	}
+	if err != nil {
+		slog.Error("failed to stat uploaded object", "key", u.Key, "error", err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to check uploaded file", retry: true}
+	}
+	if info.Size == 0 || info.Size > u.MaxSize {
+		return nil, &uploadError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Uploaded file is %d bytes, expected at most %d", info.Size, u.MaxSize),
+			invalid: true,
+		}
+	}
+
+	// Read the dimensions from the header, hashing the file and counting its
+	// frames as it streams by
+	body, _, err := backend.Get(ctx, u.Key)
+	if err != nil {
+		slog.Error("failed to open uploaded object", "key", u.Key, "error", err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to read uploaded file", retry: true}
+	}
+	defer body.Close()
+	hash := sha256.New()
+	frames := new(processor.FrameCounter)
+	sum := io.MultiWriter(hash, frames)
+	width, height, format, err := processor.DecodeDimensions(io.TeeReader(body, sum))
+	if err != nil {
+		return nil, unsupportedFormat(cfg, "")
+	}
+	if uerr := checkImageHeader(cfg, format, width, height); uerr != nil {
+		return nil, uerr
+	}
+	if uerr := checkDeclaredType(format, u.ContentType); uerr != nil {
+		return nil, uerr
+	}
+	if _, err = io.Copy(sum, body); err != nil {
+		slog.Error("failed to read uploaded object", "key", u.Key, "error", err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to read uploaded file", retry: true}
+	}
+	if uerr := checkAnimation(cfg, opts, format, width, height, frames); uerr != nil {
+		return nil, uerr
+	}
+	contentHash := hex.EncodeToString(hash.Sum(nil))
+
+	originalURL, err := storage.StoredURL(ctx, u.Key)
+	if err != nil {
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to generate image URL", retry: true}
+	}
+	meta := models.ImageMeta{
+		FileName:    u.FileName,
+		URL:         originalURL,
+		S3Key:       u.Key,
+		Size:        info.Size,
+		Uploaded:    time.Now(),
+		ContentType: "image/" + format,
+		Width:       width,
+		Height:      height,
+		UserID:      u.UserID,
+		Status:      "pending",
+		ContentHash: contentHash,
+	}
+	imageID, err := db.InsertImageMeta(context.Background(), meta)
+	if errors.Is(err, db.ErrDuplicateImage) {
+		return registerDuplicate(ctx, backend, u, contentHash, opts)
+	}
+	if err != nil {
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "DB insert failed", retry: true}
+	}
+
+	// The image is recorded; from here on a retry would duplicate it
+	if err = enqueueProcessing(c, imageID, u.UserID, u.Key, opts); err != nil {
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to queue processing task"}
+	}
+
+	// Private buckets store no URL, so hand back a presigned one
+	originalURL, err = storage.ResolveURL(ctx, originalURL, u.Key)
+	if err != nil {
+		slog.Error("failed to resolve original URL", "image_id", imageID, "error", err)
+	}
+
+	return gin.H{
+		"message":      "Image uploaded and queued for processing",
+		"id":           imageID,
+		"original_url": originalURL,
+		"stored_key":   u.Key,
+		"width":        width,
+		"height":       height,
+		"status":       "pending",
+	}, nil
+}
+
+// Rejects a file whose detected format differs from the declared content type
+func checkDeclaredType(format, declared string) *uploadError {
+	if contentType := "image/" + format; contentType != declared {
+		return &uploadError{
+			status:  http.StatusUnsupportedMediaType,
+			message: fmt.Sprintf("Uploaded file is %s, but %s was declared", contentType, declared),
+			details: gin.H{"format": format, "declared": declared},
+			invalid: true,
+		}
+	}
+	return nil
+}
+
+// Deletes a stored upload the user already has under another key and returns
+// the existing image, or refuses the upload if it asked for processing
+func registerDuplicate(ctx context.Context, backend storage.Backend, u storedUpload, contentHash string, opts processingOptions) (gin.H, *uploadError) {
+	existing, err := db.GetImageByHash(ctx, u.UserID, contentHash)
+	if err != nil {
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to retrieve existing image", retry: true}
+	}
+	slog.Info("discarding duplicate upload", "key", u.Key, "image_id", existing.ID)
+	if err = backend.Delete(ctx, u.Key); err != nil {
+		slog.Error("failed to delete duplicate upload", "key", u.Key, "error", err)
+	}
+	if opts.Requested {
+		return nil, duplicateWithOptions(existing)
+	}
+	url, err := storage.ResolveURL(ctx, existing.URL, existing.S3Key)
+	if err != nil {
+		slog.Error("failed to resolve original URL", "image_id", existing.ID, "error", err)
+	}
+	return duplicateBody(existing, url), nil
+}
+
+// Returns the staging key a direct upload is sent to. Staged files sit
+// outside originals/ so that no presigned request can replace an original.
+func stagingKey(id, ext string) string {
+	return "uploads/direct/" + id + ext
+}
+
+// Copies a direct upload from its staging key to its original key. The
+// declared size is checked first so an oversized file is never copied.
+// Sessions without a staging key uploaded straight to the original key.
+func unstageUpload(ctx context.Context, backend storage.Backend, session uploads.Session) *uploadError {
+	if session.StagingKey == "" {
+		return nil
+	}
+	info, err := backend.Stat(ctx, session.StagingKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &uploadError{status: http.StatusConflict, message: "The file has not been uploaded yet", retry: true}
+	}
+	if err != nil {
+		slog.Error("failed to stat staged upload", "key", session.StagingKey, "error", err)
+		return &uploadError{status: http.StatusInternalServerError, message: "Failed to check uploaded file", retry: true}
+	}
+	if info.Size == 0 || info.Size > session.Size {
+		return &uploadError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Uploaded file is %d bytes, expected at most %d", info.Size, session.Size),
+			invalid: true,
+		}
+	}
+	if err = storage.CopyObject(ctx, backend, session.StagingKey, session.Key); err != nil {
+		slog.Error("failed to copy staged upload", "key", session.StagingKey, "error", err)
+		return &uploadError{status: http.StatusInternalServerError, message: "Failed to store uploaded file", retry: true}
+	}
+	return nil
+}
+
+// Deletes the staged copy of a direct upload once its session is consumed
+func discardStaged(ctx context.Context, backend storage.Backend, session uploads.Session) {
+	if session.StagingKey == "" {
+		return
+	}
+	if err := backend.Delete(ctx, session.StagingKey); err != nil {
+		slog.Error("failed to delete staged upload", "key", session.StagingKey, "error", err)
+	}
+}
+
+// Gives a claimed session back so the client can retry completion
+func releaseSession(ctx context.Context, session uploads.Session) {
+	if err := uploads.Save(ctx, session); err != nil && !errors.Is(err, uploads.ErrSessionNotFound) {
+		slog.Error("failed to release upload session", "upload_id", session.ID, "error", err)
+	}
+}
+
+// Deletes an uploaded object that failed validation; its session stays consumed
+func discardUpload(ctx context.Context, backend storage.Backend, session uploads.Session) {
+	slog.Warn("discarding invalid direct upload", "upload_id", session.ID, "key", session.Key)
+	if err := backend.Delete(ctx, session.Key); err != nil {
+		slog.Error("failed to delete invalid upload", "key", session.Key, "error", err)
+	}
+}
@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/storage"
+	"image-processing-service/internal/uploads"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newUploadsRouter mounts the direct upload routes with userID taken from
+// the X-User header instead of a JWT.
+func newUploadsRouter(cfg config.Upload) *gin.Engine {
+	r := gin.New()
+	g := r.Group("/", func(c *gin.Context) {
+		if id := c.GetHeader("X-User"); id != "" {
+			c.Set("userID", id)
+		}
+	})
+	g.POST("/uploads", CreateUploadHandler(cfg))
+	g.POST("/uploads/:id/complete", CompleteUploadHandler(cfg))
+	return r
+}
+
+func uploadsRequest(r *gin.Engine, path, user, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// usePrivateS3 makes an S3 backend with static test credentials active; it
+// can presign requests without reaching AWS.
+func usePrivateS3(t *testing.T) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	b, err := storage.NewS3Backend(context.Background(), config.Storage{
+		S3Bucket: "imgs", S3Region: "us-west-2", Private: true, URLExpiry: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := storage.Default()
+	storage.Use(b)
+	t.Cleanup(func() { storage.Use(prev) })
+}
+
+var testUploadConfig = config.Upload{
+	MaxSize:            1 << 20,
+	MaxDirectSize:      1 << 20,
+	URLExpiry:          5 * time.Minute,
+	MaxPixels:          10_000,
+	MaxDimension:       200,
+	MaxAnimationPixels: 50_000,
+	AllowedFormats:     config.ImageFormats,
+}
+
+// ---- CreateUploadHandler ------------------------------------------------------------
+
+func TestCreateUploadHandler_Validation(t *testing.T) {
+	useMiniredis(t)
+	usePrivateS3(t)
+	r := newUploadsRouter(testUploadConfig)
+
+	tests := []struct {
+		name string
+		user string
+		body string
+		want int
+	}{
+		{"unauthenticated", "", `{"file_name":"a.png","content_type":"image/png","size":10}`, http.StatusUnauthorized},
+		{"missing size", "u1", `{"file_name":"a.png","content_type":"image/png"}`, http.StatusBadRequest},
+		{"negative size", "u1", `{"file_name":"a.png","content_type":"image/png","size":-1}`, http.StatusBadRequest},
+		{"unsupported type", "u1", `{"file_name":"a.svg","content_type":"image/svg+xml","size":10}`, http.StatusUnsupportedMediaType},
+		{"too large", "u1", `{"file_name":"a.png","content_type":"image/png","size":2097152}`, http.StatusRequestEntityTooLarge},
+		{"bad method", "u1", `{"file_name":"a.png","content_type":"image/png","size":10,"method":"PATCH"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := uploadsRequest(r, "/uploads", tt.user, tt.body); w.Code != tt.want {
+				t.Errorf("want %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateUploadHandler_RequiresPresigningBackend(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	w := uploadsRequest(newUploadsRouter(testUploadConfig), "/uploads", "u1", `{"file_name":"a.png","content_type":"image/png","size":10}`)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("want 501, got %d", w.Code)
+	}
+}
+
+func TestCreateUploadHandler_PresignsAndSavesSession(t *testing.T) {
+	useMiniredis(t)
+	usePrivateS3(t)
+	r := newUploadsRouter(testUploadConfig)
+
+	for _, method := range []string{"PUT", "post"} {
+		body := `{"file_name":"cat.png","content_type":"image/png","size":1234,"method":"` + method + `"}`
+		w := uploadsRequest(r, "/uploads", "u1", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: want 201, got %d: %s", method, w.Code, w.Body.String())
+		}
+		var resp struct {
+			ID     string                  `json:"id"`
+			Key    string                  `json:"key"`
+			Upload storage.PresignedUpload `json:"upload"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Key != "originals/u1/"+resp.ID+".png" {
+			t.Errorf("unexpected key %q for id %q", resp.Key, resp.ID)
+		}
+		// The client writes to staging, never to the original's key
+		staging := "uploads/direct/" + resp.ID + ".png"
+		switch resp.Upload.Method {
+		case http.MethodPut:
+			if !strings.Contains(resp.Upload.URL, "/"+staging+"?") || !strings.Contains(resp.Upload.URL, "X-Amz-Signature=") ||
+				resp.Upload.Headers["Content-Type"] != "image/png" {
+				t.Errorf("unexpected PUT %+v", resp.Upload)
+			}
+		case http.MethodPost:
+			if resp.Upload.Fields["policy"] == "" || resp.Upload.Fields["key"] != staging || resp.Upload.Fields["Content-Type"] != "image/png" {
+				t.Errorf("unexpected POST %+v", resp.Upload)
+			}
+		default:
+			t.Errorf("unexpected method %q", resp.Upload.Method)
+		}
+
+		session, err := uploads.Claim(context.Background(), resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.UserID != "u1" || session.Key != resp.Key || session.StagingKey != staging ||
+			session.Size != 1234 || session.FileName != "cat.png" {
+			t.Errorf("unexpected session %+v", session)
+		}
+	}
+}
+
+// ---- CompleteUploadHandler ------------------------------------------------------------
+
+// saveTestSession stores a pending upload for user u1, staged under
+// uploads/direct/<id>.png
+func saveTestSession(t *testing.T, id, key string, size int64) {
+	t.Helper()
+	err := uploads.Save(context.Background(), uploads.Session{
+		ID: id, UserID: "u1", Key: key, StagingKey: "uploads/direct/" + id + ".png", FileName: "a.png", ContentType: "image/png",
+		Size: size, Method: http.MethodPut, ExpiresAt: time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompleteUploadHandler_UnknownSession(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	w := uploadsRequest(newUploadsRouter(testUploadConfig), "/uploads/nope/complete", "u1", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404, got %d", w.Code)
+	}
+}
+
+func TestCompleteUploadHandler_OtherUsersSessionIsKept(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	saveTestSession(t, "s1", "originals/s1.png", 100)
+
+	w := uploadsRequest(newUploadsRouter(testUploadConfig), "/uploads/s1/complete", "intruder", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404, got %d", w.Code)
+	}
+	if _, err := uploads.Claim(context.Background(), "s1"); err != nil {
+		t.Errorf("the owner's session should survive: %v", err)
+	}
+}
+
+func TestCompleteUploadHandler_NotUploadedYet(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	saveTestSession(t, "s1", "originals/s1.png", 100)
+
+	w := uploadsRequest(newUploadsRouter(testUploadConfig), "/uploads/s1/complete", "u1", "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("want 409, got %d", w.Code)
+	}
+	if _, err := uploads.Claim(context.Background(), "s1"); err != nil {
+		t.Errorf("session should be kept for a retry: %v", err)
+	}
+}
+
+func TestCompleteUploadHandler_RejectsInvalidObjects(t *testing.T) {
+	var pngBuf, jpegBuf bytes.Buffer
+	png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	jpeg.Encode(&jpegBuf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	bomb := pngHeader(50000, 50000)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		size   int64
+		status int
+	}{
+		{"larger than declared", pngBuf.Bytes(), int64(pngBuf.Len()) - 1, http.StatusBadRequest},
+		{"not an image", []byte("definitely not a png"), 100, http.StatusUnsupportedMediaType},
+		{"not the declared type", jpegBuf.Bytes(), int64(jpegBuf.Len()), http.StatusUnsupportedMediaType},
+		{"too many pixels", bomb, int64(len(bomb)), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMiniredis(t)
+			local := useLocalStorage(t)
+			ctx := context.Background()
+			local.Put(ctx, "uploads/direct/s1.png", bytes.NewReader(tt.data), int64(len(tt.data)), "image/png")
+			saveTestSession(t, "s1", "originals/s1.png", tt.size)
+
+			w := uploadsRequest(newUploadsRouter(testUploadConfig), "/uploads/s1/complete", "u1", "")
+			if w.Code != tt.status {
+				t.Errorf("want %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			for _, key := range []string{"originals/s1.png", "uploads/direct/s1.png"} {
+				if _, err := local.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+					t.Errorf("invalid upload should be deleted from %s, got %v", key, err)
+				}
+			}
+			if _, err := uploads.Claim(ctx, "s1"); !errors.Is(err, uploads.ErrSessionNotFound) {
+				t.Errorf("session should be consumed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUnstageUpload(t *testing.T) {
+	useMiniredis(t)
+	local := useLocalStorage(t)
+	ctx := context.Background()
+	session := uploads.Session{ID: "s1", Key: "originals/u1/s1.png", StagingKey: "uploads/direct/s1.png", Size: 100}
+
+	if uerr := unstageUpload(ctx, local, session); uerr == nil || uerr.status != http.StatusConflict || !uerr.retry {
+		t.Fatalf("not uploaded yet: want a retryable 409, got %+v", uerr)
+	}
+
+	header := pngHeader(10, 10)
+	local.Put(ctx, session.StagingKey, bytes.NewReader(header), int64(len(header)), "image/png")
+	if uerr := unstageUpload(ctx, local, session); uerr != nil {
+		t.Fatalf("unexpected error %+v", uerr)
+	}
+	// A presigned request replayed after completion only reaches staging
+	bomb := pngHeader(50000, 50000)
+	local.Put(ctx, session.StagingKey, bytes.NewReader(bomb), int64(len(bomb)), "image/png")
+	got, err := storage.Download(ctx, session.Key)
+	if err != nil || !bytes.Equal(got, header) {
+		t.Errorf("want the original to keep the completed bytes, got %v (%v)", got, err)
+	}
+
+	session.Size = int64(len(bomb)) - 1
+	if uerr := unstageUpload(ctx, local, session); uerr == nil || uerr.status != http.StatusBadRequest || !uerr.invalid {
+		t.Errorf("larger than declared: want an invalid 400, got %+v", uerr)
+	}
+}
+
+func TestCompleteUploadHandler_ValidatesOptionsFirst(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	saveTestSession(t, "s1", "originals/s1.png", 100)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/uploads/s1/complete", strings.NewReader("quality=0"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-User", "u1")
+	newUploadsRouter(testUploadConfig).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", w.Code)
+	}
+	if _, err := uploads.Claim(context.Background(), "s1"); err != nil {
+		t.Errorf("invalid options must not consume the session: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/models"
+	"image-processing-service/internal/storage"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Name of the download variant that selects the uploaded original
+const originalVariant = "original"
+
+// Fills in the URLs of an image and its variants from their storage keys
+// where none is stored or stored URLs cannot be used, as with private buckets
+func resolveImageURLs(ctx context.Context, image *models.ImageMeta) error {
+	var err error
+	if image.URL, err = storage.ResolveURL(ctx, image.URL, image.S3Key); err != nil {
+		return err
+	}
+	if image.ProcessedURL, err = storage.ResolveURL(ctx, image.ProcessedURL, image.ProcessedKey); err != nil {
+		return err
+	}
+	for i := range image.Variants {
+		v := &image.Variants[i]
+		if v.URL, err = storage.ResolveURL(ctx, v.URL, v.S3Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the storage key for a download: the named variant, the original,
+// or by default the processed image, falling back to the original until
+// processing completes
+func downloadKey(image models.ImageMeta, variants []models.ImageVariant, variant string) (string, bool) {
+	switch variant {
+	case "":
+		if image.ProcessedKey != "" {
+			return image.ProcessedKey, true
+		}
+		return image.S3Key, image.S3Key != ""
+	case originalVariant:
+		return image.S3Key, image.S3Key != ""
+	}
+	for _, v := range variants {
+		if v.Name == variant {
+			return v.S3Key, true
+		}
+	}
+	return "", false
+}
+
+// Redirects to a fresh URL for an image, its original or one of its variants.
+// Use ?variant=original or ?variant=<name>; the processed image is the default.
+func DownloadImageHandler(c *gin.Context) {
+	// Get userID from the JWT token in the context
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	imageID := c.Param("id")
+	variant := c.Query("variant")
+
+	image, err := db.GetImage(c.Request.Context(), imageID, userID.(string))
+	if errors.Is(err, db.ErrImageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve image"})
+		return
+	}
+
+	var variants []models.ImageVariant
+	if variant != "" && variant != originalVariant {
+		byImage, err := db.GetImageVariants(c.Request.Context(), imageID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image variants"})
+			return
+		}
+		variants = byImage[imageID]
+	}
+
+	key, ok := downloadKey(image, variants, variant)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found", "variant": variant})
+		return
+	}
+
+	backend := storage.Default()
+	if backend == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Storage is not configured"})
+		return
+	}
+	url, err := backend.URL(c.Request.Context(), key)
+	if err != nil {
+		slog.Error("failed to generate download URL", "image_id", imageID, "key", key, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate download URL"})
+		return
+	}
+
+	// Presigned URLs expire, so the redirect itself must not be cached
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, url)
+}
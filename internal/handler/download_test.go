@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"image-processing-service/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ---- resolveImageURLs ------------------------------------------------------------
+
+func TestResolveImageURLs_FillsMissingURLsFromKeys(t *testing.T) {
+	useLocalStorage(t)
+	image := models.ImageMeta{
+		URL:          "https://bucket.example.com/originals/a.png",
+		S3Key:        "originals/a.png",
+		ProcessedKey: "processed/a_1.webp",
+		Variants:     []models.ImageVariant{{Name: "thumb", S3Key: "processed/a_1_thumb.webp"}},
+	}
+	if err := resolveImageURLs(context.Background(), &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.URL != "https://bucket.example.com/originals/a.png" {
+		t.Errorf("stored URL should be kept, got %q", image.URL)
+	}
+	if image.ProcessedURL != "http://localhost:8080/media/processed/a_1.webp" {
+		t.Errorf("unexpected processed URL %q", image.ProcessedURL)
+	}
+	if image.Variants[0].URL != "http://localhost:8080/media/processed/a_1_thumb.webp" {
+		t.Errorf("unexpected variant URL %q", image.Variants[0].URL)
+	}
+}
+
+// ---- DownloadImageHandler ------------------------------------------------------------
+
+func TestDownloadKey(t *testing.T) {
+	pending := models.ImageMeta{S3Key: "originals/a.png"}
+	done := models.ImageMeta{S3Key: "originals/a.png", ProcessedKey: "processed/a.webp"}
+	variants := []models.ImageVariant{{Name: "thumb", S3Key: "processed/a_thumb.webp"}}
+
+	tests := []struct {
+		name    string
+		image   models.ImageMeta
+		variant string
+		want    string
+		ok      bool
+	}{
+		{"processed by default", done, "", "processed/a.webp", true},
+		{"original until processed", pending, "", "originals/a.png", true},
+		{"original on request", done, "original", "originals/a.png", true},
+		{"named variant", done, "thumb", "processed/a_thumb.webp", true},
+		{"unknown variant", done, "huge", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := downloadKey(tt.image, variants, tt.variant)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("want (%q, %v), got (%q, %v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestDownloadImageHandler_RequiresAuth(t *testing.T) {
+	r := gin.New()
+	r.GET("/images/:id/download", DownloadImageHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/abc/download", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("want 401, got %d", w.Code)
+	}
+}
@@ -2,10 +2,13 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"image-processing-service/internal/auth"
 	"image-processing-service/internal/db"
 	"image-processing-service/internal/models"
+	"image-processing-service/internal/queue"
 	"image-processing-service/internal/utils"
+	"log/slog"
 	"net/http"
 	"regexp"
 
@@ -231,12 +234,23 @@ func DeleteImageHandler(c *gin.Context) {
 	imageID := c.Param("id")
 
 	// Delete the image from the database
-	err := db.DeleteImage(imageID, userID.(string))
+	keys, err := db.DeleteImage(c.Request.Context(), imageID, userID.(string))
+	if errors.Is(err, db.ErrImageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
 		return
 	}
 
+	// A worker removes the stored objects; if the task is lost, the storage
+	// garbage collector removes them instead
+	task := queue.Task{Type: queue.TaskTypeDelete, ImageID: imageID, UserID: userID.(string), Keys: keys}
+	if _, err = queue.Enqueue(context.Background(), task); err != nil {
+		slog.Error("failed to queue deletion of image objects", "image_id", imageID, "error", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Image deleted successfully"})
 }
 
@@ -272,8 +286,8 @@ func GetUserProfileHandler(c *gin.Context) {
 	})
 }
 
-// Retrieves the authenticated user's profile information.
-// Requires a valid JWT token to access the user's details.
+// Lists a page of the authenticated user's images, filtered and sorted as
+// the query asks. Requires a valid JWT token.
 func GetUserImagesHandler(c *gin.Context) {
 	// Get userID from the JWT token in the context
 	userID, exists := c.Get("userID")
@@ -282,16 +296,38 @@ func GetUserImagesHandler(c *gin.Context) {
 		return
 	}
 
-	// Get user images from database
-	images, err := db.GetUserImages(userID.(string))
+	// Read the filters, sort and page requested
+	query, paramErr := parseImageQuery(c.Query)
+	if paramErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + paramErr.Param + ": " + paramErr.Reason, "param": paramErr.Param})
+		return
+	}
+
+	// Get a page of user images from database
+	images, more, err := db.ListUserImages(c.Request.Context(), userID.(string), query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user images"})
 		return
 	}
 
-	// Return user images
+	// Fill in URLs, presigning them for private buckets
+	for i := range images {
+		if err = resolveImageURLs(c.Request.Context(), &images[i]); err != nil {
+			slog.Error("failed to resolve image URLs", "image_id", images[i].ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate image URLs"})
+			return
+		}
+	}
+
+	// Return user images, with a cursor for the next page if there is one
+	var nextCursor *string
+	if more {
+		cursor := encodeCursor(query, images[len(images)-1])
+		nextCursor = &cursor
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"images": images,
+		"images":      images,
+		"next_cursor": nextCursor,
 	})
 }
 
@@ -325,19 +361,38 @@ func GetImageStatusHandler(c *gin.Context) {
 	}
 
 	// Get the image status
-	status, processedURL, err := db.GetImageStatus(context.Background(), imageID)
+	image, err := db.GetImage(context.Background(), imageID, userID.(string))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image status"})
 		return
 	}
 
+	// Include any named variants that have been rendered
+	variants, err := db.GetImageVariants(context.Background(), imageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image variants"})
+		return
+	}
+	image.Variants = variants[imageID]
+
+	// Fill in URLs, presigning them for private buckets
+	if err = resolveImageURLs(c.Request.Context(), &image); err != nil {
+		slog.Error("failed to resolve image URLs", "image_id", imageID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate image URLs"})
+		return
+	}
+
 	// Return the status and URL if available
 	response := gin.H{
-		"status": status,
+		"status": image.Status,
+	}
+
+	if image.ProcessedURL != "" {
+		response["processed_url"] = image.ProcessedURL
 	}
 
-	if processedURL != "" {
-		response["processed_url"] = processedURL
+	if len(image.Variants) > 0 {
+		response["variants"] = image.Variants
 	}
 
 	c.JSON(http.StatusOK, response)
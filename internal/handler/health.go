@@ -49,6 +49,9 @@ func checkPostgres(ctx context.Context) string {
 }
 
 func checkRedis(ctx context.Context) string {
+	if queue.Rdb == nil {
+		return "unavailable"
+	}
 	if err := queue.Rdb.Ping(ctx).Err(); err != nil {
 		return "unavailable"
 	}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"fmt"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/processor"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Checks an image's header against the allowed formats and size limits.
+// It runs before any pixels are decoded, so a small file that declares a
+// huge canvas never reaches the decoder.
+func checkImageHeader(cfg config.Upload, format string, width, height int) *uploadError {
+	if !slices.Contains(cfg.AllowedFormats, format) {
+		return unsupportedFormat(cfg, format)
+	}
+	if width > cfg.MaxDimension || height > cfg.MaxDimension || int64(width)*int64(height) > cfg.MaxPixels {
+		return &uploadError{
+			status: http.StatusUnprocessableEntity,
+			message: fmt.Sprintf("Image is %d×%d pixels; at most %d pixels and %d on either side are accepted",
+				width, height, cfg.MaxPixels, cfg.MaxDimension),
+			details: gin.H{
+				"width":         width,
+				"height":        height,
+				"max_pixels":    cfg.MaxPixels,
+				"max_dimension": cfg.MaxDimension,
+			},
+			invalid: true,
+		}
+	}
+	return nil
+}
+
+// Checks the frames of an animation against cfg.MaxAnimationPixels when its
+// processing keeps them, since a worker then decodes every frame at once.
+// frames has counted the whole file; the first frame of anything else is
+// covered by checkImageHeader.
+func checkAnimation(cfg config.Upload, opts processingOptions, format string, width, height int, frames *processor.FrameCounter) *uploadError {
+	if !processor.KeepsFrames(format, opts.Pipeline, opts.Output, opts.Variants) {
+		return nil
+	}
+	n, err := frames.Frames()
+	if err != nil {
+		return &uploadError{
+			status:  http.StatusUnprocessableEntity,
+			message: "Animation frames could not be read: " + err.Error(),
+			invalid: true,
+		}
+	}
+	if pixels := int64(n) * int64(width) * int64(height); n > 1 && pixels > cfg.MaxAnimationPixels {
+		return &uploadError{
+			status: http.StatusUnprocessableEntity,
+			message: fmt.Sprintf("Animation has %d frames of %d×%d pixels; at most %d pixels across all frames are accepted",
+				n, width, height, cfg.MaxAnimationPixels),
+			details: gin.H{
+				"frames":               n,
+				"width":                width,
+				"height":               height,
+				"max_animation_pixels": cfg.MaxAnimationPixels,
+			},
+			invalid: true,
+		}
+	}
+	return nil
+}
+
+// Rejects a file whose format is not accepted, or that is not an image at
+// all when format is empty, listing the formats that are
+func unsupportedFormat(cfg config.Upload, format string) *uploadError {
+	uerr := &uploadError{
+		status:  http.StatusUnsupportedMediaType,
+		message: "File is not a supported image",
+		details: gin.H{"allowed_formats": cfg.AllowedFormats},
+		invalid: true,
+	}
+	if format != "" {
+		uerr.message = "Unsupported image format: " + format
+		uerr.details["format"] = format
+	}
+	return uerr
+}
+
+// Returns the key extension for a declared content type, if uploads of that
+// type are accepted
+func acceptedType(cfg config.Upload, contentType string) (string, bool) {
+	ext, ok := uploadTypes[contentType]
+	if !ok || !slices.Contains(cfg.AllowedFormats, strings.TrimPrefix(contentType, "image/")) {
+		return "", false
+	}
+	return ext, true
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image-processing-service/internal/processor"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"testing"
+)
+
+func TestCheckImageHeader(t *testing.T) {
+	cfg := testUploadConfig
+	cfg.AllowedFormats = []string{"jpeg", "png"}
+
+	tests := []struct {
+		name          string
+		format        string
+		width, height int
+		status        int // 0 when accepted
+	}{
+		{"within limits", "png", 100, 100, 0},
+		{"at the dimension limit", "jpeg", 200, 50, 0},
+		{"format not allowed", "gif", 10, 10, http.StatusUnsupportedMediaType},
+		{"too wide", "png", 201, 1, http.StatusUnprocessableEntity},
+		{"too tall", "png", 1, 201, http.StatusUnprocessableEntity},
+		{"too many pixels", "png", 200, 51, http.StatusUnprocessableEntity},
+		{"overflowing int32", "png", 1 << 30, 1 << 30, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uerr := checkImageHeader(cfg, tt.format, tt.width, tt.height)
+			if tt.status == 0 {
+				if uerr != nil {
+					t.Errorf("want accepted, got %d %s", uerr.status, uerr.message)
+				}
+				return
+			}
+			if uerr == nil || uerr.status != tt.status || !uerr.invalid {
+				t.Errorf("want invalid %d, got %+v", tt.status, uerr)
+			}
+		})
+	}
+}
+
+// animatedGIF returns a GIF of the given number of blank w×h frames
+func animatedGIF(t *testing.T, frames, w, h int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckAnimation(t *testing.T) {
+	// 10 frames of 100×100 are twice testUploadConfig.MaxAnimationPixels
+	large := animatedGIF(t, 10, 100, 100)
+	keep := processingOptions{Output: processor.OutputOptions{Format: processor.FormatGIF}}
+	poster := processingOptions{Pipeline: processor.NewPipeline(&processor.FrameOp{})}
+
+	tests := []struct {
+		name   string
+		opts   processingOptions
+		data   []byte
+		status int // 0 when accepted
+	}{
+		{"kept frames within the budget", keep, animatedGIF(t, 5, 100, 100), 0},
+		{"kept frames over the budget", keep, large, http.StatusUnprocessableEntity},
+		{"frame step", poster, large, http.StatusUnprocessableEntity},
+		{"first frame only", processingOptions{}, large, 0},
+		{"truncated", keep, large[:len(large)/2], http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var frames processor.FrameCounter
+			frames.Write(tt.data)
+			uerr := checkAnimation(testUploadConfig, tt.opts, "gif", 100, 100, &frames)
+			if tt.status == 0 {
+				if uerr != nil {
+					t.Errorf("want accepted, got %d %s", uerr.status, uerr.message)
+				}
+				return
+			}
+			if uerr == nil || uerr.status != tt.status || !uerr.invalid {
+				t.Errorf("want invalid %d, got %+v", tt.status, uerr)
+			}
+		})
+	}
+}
+
+func TestAcceptedType(t *testing.T) {
+	cfg := testUploadConfig
+	cfg.AllowedFormats = []string{"png", "webp"}
+
+	if ext, ok := acceptedType(cfg, "image/webp"); !ok || ext != ".webp" {
+		t.Errorf("image/webp: got %q, %v", ext, ok)
+	}
+	for _, contentType := range []string{"image/jpeg", "image/svg+xml", "", "png"} {
+		if _, ok := acceptedType(cfg, contentType); ok {
+			t.Errorf("%q should not be accepted", contentType)
+		}
+	}
+}
+
+func TestUploadErrorBody(t *testing.T) {
+	body := unsupportedFormat(testUploadConfig, "bmp").body()
+	if body["error"] != "Unsupported image format: bmp" || body["format"] != "bmp" || body["allowed_formats"] == nil {
+		t.Errorf("unexpected body %v", body)
+	}
+	if body = unsupportedFormat(testUploadConfig, "").body(); body["format"] != nil {
+		t.Errorf("a file that is not an image has no format, got %v", body)
+	}
+}
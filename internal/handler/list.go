@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/models"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Images per page of GET /images, by default and at most
+const (
+	defaultImagePageSize = 50
+	maxImagePageSize     = 200
+)
+
+// Processing statuses GET /images can filter by
+var imageStatuses = []string{"pending", "processing", "completed", "failed"}
+
+// An invalid query parameter of GET /images
+type queryParamError struct {
+	Param  string
+	Reason string
+}
+
+func (e *queryParamError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Param, e.Reason)
+}
+
+// Contents of the opaque next_cursor of GET /images. It records the order
+// it was made for, so it cannot be replayed against a different one.
+type listCursor struct {
+	Sort     string    `json:"s"`
+	Desc     bool      `json:"d,omitempty"`
+	Uploaded time.Time `json:"u"`
+	Size     int64     `json:"z,omitempty"`
+	Name     string    `json:"n,omitempty"`
+	ID       string    `json:"id"`
+}
+
+// Returns the cursor for the page following image in the order of q
+func encodeCursor(q db.ImageQuery, image models.ImageMeta) string {
+	data, _ := json.Marshal(listCursor{
+		Sort:     q.Sort,
+		Desc:     q.Desc,
+		Uploaded: image.Uploaded,
+		Size:     image.Size,
+		Name:     image.FileName,
+		ID:       image.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Reads a cursor made by encodeCursor for the same order as q
+func decodeCursor(s string, q db.ImageQuery) (*db.ImageCursor, *queryParamError) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &queryParamError{"cursor", "malformed"}
+	}
+	var c listCursor
+	if err = json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, &queryParamError{"cursor", "malformed"}
+	}
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, &queryParamError{"cursor", "was made for a different sort or order"}
+	}
+	return &db.ImageCursor{Uploaded: c.Uploaded, Size: c.Size, Name: c.Name, ID: c.ID}, nil
+}
+
+// Reads the filter, sort and paging parameters of GET /images
+func parseImageQuery(query func(string) string) (db.ImageQuery, *queryParamError) {
+	q := db.ImageQuery{Sort: "uploaded", Limit: defaultImagePageSize}
+
+	if v := query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxImagePageSize {
+			return q, &queryParamError{"limit", fmt.Sprintf("must be between 1 and %d", maxImagePageSize)}
+		}
+		q.Limit = n
+	}
+
+	if v := query("sort"); v != "" {
+		if v != "uploaded" && v != "size" && v != "name" {
+			return q, &queryParamError{"sort", "must be uploaded, size or name"}
+		}
+		q.Sort = v
+	}
+	// Newest and largest first, but names in alphabetical order
+	q.Desc = q.Sort != "name"
+	switch query("order") {
+	case "":
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	default:
+		return q, &queryParamError{"order", "must be asc or desc"}
+	}
+
+	if v := query("status"); v != "" {
+		if !slices.Contains(imageStatuses, v) {
+			return q, &queryParamError{"status", "must be pending, processing, completed or failed"}
+		}
+		q.Status = v
+	}
+	if v := query("content_type"); v != "" {
+		if _, ok := uploadTypes[v]; !ok {
+			return q, &queryParamError{"content_type", "must be image/jpeg, image/png, image/gif or image/webp"}
+		}
+		q.ContentType = v
+	}
+
+	var err error
+	if q.UploadedFrom, err = parseListTime(query("uploaded_from"), false); err != nil {
+		return q, &queryParamError{"uploaded_from", err.Error()}
+	}
+	if q.UploadedTo, err = parseListTime(query("uploaded_to"), true); err != nil {
+		return q, &queryParamError{"uploaded_to", err.Error()}
+	}
+	if !q.UploadedFrom.IsZero() && !q.UploadedTo.IsZero() && !q.UploadedFrom.Before(q.UploadedTo) {
+		return q, &queryParamError{"uploaded_to", "must be after uploaded_from"}
+	}
+
+	if v := query("name"); v != "" {
+		if len(v) > 255 {
+			return q, &queryParamError{"name", "must be at most 255 bytes"}
+		}
+		q.NameContains = v
+	}
+
+	if v := query("cursor"); v != "" {
+		after, paramErr := decodeCursor(v, q)
+		if paramErr != nil {
+			return q, paramErr
+		}
+		q.After = after
+	}
+	return q, nil
+}
+
+// Parses an RFC 3339 time or a YYYY-MM-DD date. A date as the end of a
+// range covers the whole day, so it is moved to the start of the next one.
+func parseListTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, v, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("must be an RFC 3339 time or a YYYY-MM-DD date")
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
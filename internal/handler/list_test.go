@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/json"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// query returns a lookup over URL query parameters
+func query(raw string) func(string) string {
+	values, _ := url.ParseQuery(raw)
+	return values.Get
+}
+
+// ---- parseImageQuery ------------------------------------------------------------
+
+func TestParseImageQuery_Defaults(t *testing.T) {
+	q, err := parseImageQuery(query(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Sort != "uploaded" || !q.Desc || q.Limit != defaultImagePageSize || q.After != nil {
+		t.Errorf("unexpected defaults %+v", q)
+	}
+
+	// Names read alphabetically unless asked otherwise
+	if q, _ = parseImageQuery(query("sort=name")); q.Desc {
+		t.Error("sort=name should default to ascending")
+	}
+	if q, _ = parseImageQuery(query("sort=size&order=asc")); q.Desc {
+		t.Error("order=asc should be ascending")
+	}
+}
+
+func TestParseImageQuery_Filters(t *testing.T) {
+	q, err := parseImageQuery(query("limit=10&status=failed&content_type=image/png&name=cat_1%25" +
+		"&uploaded_from=2024-05-01T10:00:00Z&uploaded_to=2024-05-31"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Limit != 10 || q.Status != "failed" || q.ContentType != "image/png" || q.NameContains != "cat_1%" {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if !q.UploadedFrom.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("uploaded_from: got %v", q.UploadedFrom)
+	}
+	// A date as the end of the range includes that whole day
+	if !q.UploadedTo.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("uploaded_to: got %v", q.UploadedTo)
+	}
+}
+
+func TestParseImageQuery_Invalid(t *testing.T) {
+	tests := []struct {
+		raw   string
+		param string
+	}{
+		{"limit=0", "limit"},
+		{"limit=201", "limit"},
+		{"limit=ten", "limit"},
+		{"sort=color", "sort"},
+		{"order=up", "order"},
+		{"status=done", "status"},
+		{"content_type=image/bmp", "content_type"},
+		{"uploaded_from=yesterday", "uploaded_from"},
+		{"uploaded_to=2024-13-01", "uploaded_to"},
+		{"uploaded_from=2024-05-02&uploaded_to=2024-05-01", "uploaded_to"},
+		{"cursor=!!!", "cursor"},
+		{"cursor=e30", "cursor"}, // {} has no ID
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			_, err := parseImageQuery(query(tt.raw))
+			if err == nil || err.Param != tt.param {
+				t.Errorf("want an error for %s, got %v", tt.param, err)
+			}
+		})
+	}
+}
+
+// ---- Cursors ------------------------------------------------------------
+
+func TestCursor_RoundTrip(t *testing.T) {
+	image := models.ImageMeta{
+		ID:       "7d4f2c1e-0000-4000-8000-000000000001",
+		FileName: "cat.png",
+		Size:     4096,
+		Uploaded: time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC),
+	}
+	for _, raw := range []string{"", "sort=size", "sort=name&order=desc"} {
+		q, _ := parseImageQuery(query(raw))
+		cursor := encodeCursor(q, image)
+
+		next, err := parseImageQuery(query(raw + "&cursor=" + cursor))
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		want := db.ImageCursor{Uploaded: image.Uploaded, Size: image.Size, Name: image.FileName, ID: image.ID}
+		if next.After == nil || *next.After != want {
+			t.Errorf("%q: want %+v, got %+v", raw, want, next.After)
+		}
+	}
+}
+
+func TestCursor_RejectsOtherOrder(t *testing.T) {
+	q, _ := parseImageQuery(query("sort=size"))
+	cursor := encodeCursor(q, models.ImageMeta{ID: "a"})
+
+	for _, raw := range []string{"sort=name", "sort=size&order=asc"} {
+		if _, err := parseImageQuery(query(raw + "&cursor=" + cursor)); err == nil || err.Param != "cursor" {
+			t.Errorf("%q: want a cursor error, got %v", raw, err)
+		}
+	}
+}
+
+// ---- GetUserImagesHandler ------------------------------------------------------------
+
+func TestGetUserImagesHandler_InvalidQuery(t *testing.T) {
+	r := gin.New()
+	r.GET("/images", func(c *gin.Context) {
+		c.Set("userID", "u1")
+		GetUserImagesHandler(c)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images?sort=color", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["param"] != "sort" || body["error"] == nil {
+		t.Errorf("unexpected body %s", w.Body.String())
+	}
+}
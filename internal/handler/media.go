@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"errors"
+	"image-processing-service/internal/storage"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Serves objects written by the local storage driver at /media/*key.
+// S3 objects are fetched from the bucket directly, so this only responds
+// when a LocalBackend is active.
+func ServeMediaHandler(c *gin.Context) {
+	local, ok := storage.Default().(*storage.LocalBackend)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	info, err := local.Stat(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	if err != nil {
+		slog.Error("failed to stat media", "key", key, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	path, _ := local.Path(key) // Validated by Stat
+	c.Header("Content-Type", info.ContentType)
+	c.File(path)
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"image-processing-service/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useLocalStorage makes a LocalBackend in a temporary directory the active
+// storage backend for the duration of a test.
+func useLocalStorage(t *testing.T) *storage.LocalBackend {
+	t.Helper()
+	b, err := storage.NewLocalBackend(t.TempDir(), "http://localhost:8080/media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := storage.Default()
+	storage.Use(b)
+	t.Cleanup(func() { storage.Use(prev) })
+	return b
+}
+
+func newMediaRouter() *gin.Engine {
+	r := gin.New()
+	r.GET("/media/*key", ServeMediaHandler)
+	return r
+}
+
+// ---- ServeMediaHandler ------------------------------------------------------------
+
+func TestServeMediaHandler_ServesStoredFile(t *testing.T) {
+	b := useLocalStorage(t)
+	if err := b.Put(context.Background(), "processed/a.webp", strings.NewReader("webp"), 4, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	newMediaRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/processed/a.webp", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/webp" {
+		t.Errorf("want Content-Type image/webp, got %q", got)
+	}
+	if w.Body.String() != "webp" {
+		t.Errorf("want body %q, got %q", "webp", w.Body.String())
+	}
+}
+
+func TestServeMediaHandler_NotFound(t *testing.T) {
+	useLocalStorage(t)
+	for _, path := range []string{"/media/missing.png", "/media/../../etc/passwd", "/media/processed/"} {
+		w := httptest.NewRecorder()
+		newMediaRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: want 404, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestServeMediaHandler_RequiresLocalBackend(t *testing.T) {
+	prev := storage.Default()
+	storage.Use(nil)
+	t.Cleanup(func() { storage.Use(prev) })
+
+	w := httptest.NewRecorder()
+	newMediaRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/a.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404, got %d", w.Code)
+	}
+}
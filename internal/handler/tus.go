@@ -0,0 +1,545 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/processor"
+	"image-processing-service/internal/storage"
+	"image-processing-service/internal/uploads"
+	"image-processing-service/internal/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version of the tus resumable upload protocol implemented under /files/
+const tusVersion = "1.0.0"
+
+// Content type of PATCH requests carrying upload data
+const tusChunkContentType = "application/offset+octet-stream"
+
+// Sets the Tus-Resumable header on every response and rejects requests for
+// another protocol version. OPTIONS requests need not name a version.
+func TusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Describes the server's tus support
+func TusOptionsHandler(cfg config.Upload) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", "creation,termination")
+		c.Header("Tus-Max-Size", strconv.FormatInt(cfg.MaxResumableSize, 10))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// Creates a resumable upload (tus creation extension). The total size comes
+// from Upload-Length; Upload-Metadata carries the filename and filetype and
+// may carry the processing fields accepted by POST /upload.
+func CreateResumableHandler(cfg config.Upload) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get userID from the JWT token in the context
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a positive integer"})
+			return
+		}
+		if length > cfg.MaxResumableSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":    fmt.Sprintf("File exceeds the %d byte size limit", cfg.MaxResumableSize),
+				"max_size": cfg.MaxResumableSize,
+			})
+			return
+		}
+		metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		contentType, ext, ok := resumableContentType(cfg, metadata)
+		if !ok {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":           "filetype must be an image in one of the allowed formats",
+				"allowed_formats": cfg.AllowedFormats,
+			})
+			return
+		}
+		// Reject bad processing options now rather than after the upload
+		if _, ok = parseProcessingOptions(c, func(field string) string { return metadata[field] }); !ok {
+			return
+		}
+
+		uploader, ok := storage.Default().(storage.MultipartUploader)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Resumable uploads are not supported by the configured storage driver"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		id := utils.NewUUID()
+		key := originalKey(userID.(string), id, ext)
+		multipartID, err := uploader.CreateMultipart(ctx, key, contentType)
+		if err != nil {
+			slog.Error("failed to start multipart upload", "key", key, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		upload := uploads.Resumable{
+			ID:          id,
+			UserID:      userID.(string),
+			Key:         key,
+			FileName:    metadata["filename"],
+			ContentType: contentType,
+			Length:      length,
+			MultipartID: multipartID,
+			Metadata:    metadata,
+			CreatedAt:   time.Now().UTC(),
+		}
+		if err = uploads.SaveResumable(ctx, upload, cfg.ResumableTTL); err != nil {
+			slog.Error("failed to save resumable upload", "upload_id", id, "error", err)
+			if err := uploader.AbortMultipart(ctx, key, multipartID); err != nil {
+				slog.Error("failed to abort multipart upload", "key", key, "error", err)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		c.Header("Location", "/files/"+id)
+		c.Status(http.StatusCreated)
+	}
+}
+
+// Reports how many bytes of a resumable upload have been received
+func ResumableOffsetHandler(c *gin.Context) {
+	upload, ok := loadResumable(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Status(http.StatusOK)
+}
+
+// Appends a chunk to a resumable upload. Full parts go straight to the
+// multipart upload; bytes that do not fill one are kept in a tail object
+// until the next chunk. The image header is checked as soon as it has
+// arrived, and an upload that fails is terminated there and then. Once every
+// byte has arrived the file is assembled, recorded and queued like a direct
+// upload, and its ID is returned in the X-Image-Id header. If registration fails after assembly, an empty PATCH
+// at the final offset retries it.
+func PatchResumableHandler(cfg config.Upload) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		unlock, err := uploads.LockResumable(ctx, c.Param("id"))
+		if errors.Is(err, uploads.ErrResumableLocked) {
+			c.JSON(http.StatusLocked, gin.H{"error": "Another request is writing to this upload"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+			return
+		}
+		defer unlock()
+
+		upload, ok := loadResumable(c)
+		if !ok {
+			return
+		}
+		if c.ContentType() != tusChunkContentType {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + tusChunkContentType})
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset must be a non-negative integer"})
+			return
+		}
+		if offset != upload.Offset {
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset is %d, expected %d", offset, upload.Offset)})
+			return
+		}
+		remaining := upload.Length - upload.Offset
+		if c.Request.ContentLength > remaining {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Only %d bytes remain to be uploaded", remaining)})
+			return
+		}
+
+		backend := storage.Default()
+		uploader, ok := backend.(storage.MultipartUploader)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Resumable uploads are not supported by the configured storage driver"})
+			return
+		}
+
+		if !upload.Assembled {
+			body := &countingReader{r: io.LimitReader(c.Request.Body, remaining)}
+			if ok = appendChunk(c, cfg, uploader, &upload, body); !ok {
+				return
+			}
+		}
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if !upload.Assembled {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		finishResumable(c, cfg, backend, upload)
+	}
+}
+
+// Terminates a resumable upload and frees what it stored (tus termination extension)
+func DeleteResumableHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	unlock, err := uploads.LockResumable(ctx, c.Param("id"))
+	if errors.Is(err, uploads.ErrResumableLocked) {
+		c.JSON(http.StatusLocked, gin.H{"error": "Another request is writing to this upload"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+		return
+	}
+	defer unlock()
+
+	upload, ok := loadResumable(c)
+	if !ok {
+		return
+	}
+	backend := storage.Default()
+	if uploader, ok := backend.(storage.MultipartUploader); ok && !upload.Assembled {
+		if err = uploader.AbortMultipart(ctx, upload.Key, upload.MultipartID); err != nil {
+			slog.Error("failed to abort multipart upload", "upload_id", upload.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete upload"})
+			return
+		}
+	}
+	discardResumable(ctx, backend, upload)
+	c.Status(http.StatusNoContent)
+}
+
+// Fetches the upload named in the path, writing a 404 response and returning
+// false if it does not exist or belongs to another user
+func loadResumable(c *gin.Context) (uploads.Resumable, bool) {
+	// Get userID from the JWT token in the context
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return uploads.Resumable{}, false
+	}
+	upload, err := uploads.GetResumable(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, uploads.ErrResumableNotFound) || (err == nil && upload.UserID != userID.(string)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found or expired"})
+		return upload, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve upload"})
+		return upload, false
+	}
+	return upload, true
+}
+
+// Streams body into the upload after the bytes held in its tail, uploading
+// every full part and saving progress after each. Whatever is left over
+// becomes the new tail, or the last part once the upload is complete.
+// Writes an error response and returns false on failure; bytes already
+// saved stay saved, and the client resumes from the offset HEAD reports.
+func appendChunk(c *gin.Context, cfg config.Upload, uploader storage.MultipartUploader, upload *uploads.Resumable, body *countingReader) bool {
+	ctx := c.Request.Context()
+	backend := storage.Default()
+
+	src := io.Reader(body)
+	oldTail := upload.TailKey
+	if upload.TailSize > 0 {
+		tail, _, err := backend.Get(ctx, upload.TailKey)
+		if err != nil {
+			slog.Error("failed to open upload tail", "upload_id", upload.ID, "key", upload.TailKey, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resume upload"})
+			return false
+		}
+		defer tail.Close()
+		src = io.MultiReader(tail, body)
+	}
+	stored := upload.Offset - upload.TailSize // Bytes already in parts
+
+	// Once the saved state no longer refers to the old tail, it can go
+	savedTail := oldTail
+	save := func() bool {
+		if !saveResumable(c, cfg, *upload) {
+			return false
+		}
+		savedTail = upload.TailKey
+		return true
+	}
+	defer func() {
+		if oldTail != "" && savedTail != oldTail {
+			if err := backend.Delete(ctx, oldTail); err != nil {
+				slog.Error("failed to delete upload tail", "key", oldTail, "error", err)
+			}
+		}
+	}()
+
+	// Check the header as soon as it has arrived. Until then no part has been
+	// uploaded, since a part is larger than the header may be, so the tail
+	// holds every byte from the start of the file.
+	if !upload.HeaderOK && len(upload.Parts) == 0 {
+		head := make([]byte, min(maxHeaderSize, upload.Length))
+		n, _ := io.ReadFull(src, head)
+		head = head[:n]
+		checked, uerr := checkResumableHeader(cfg, *upload, head)
+		if uerr != nil {
+			rejectResumable(c, uploader, backend, *upload, uerr)
+			savedTail = oldTail // Deleted with the upload
+			return false
+		}
+		upload.HeaderOK = checked
+		src = io.MultiReader(bytes.NewReader(head), src)
+	}
+
+	buf := make([]byte, storage.MinPartSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n == len(buf) {
+			part, err := uploader.UploadPart(ctx, upload.Key, upload.MultipartID, len(upload.Parts)+1, bytes.NewReader(buf), int64(n))
+			if err != nil {
+				slog.Error("failed to upload part", "upload_id", upload.ID, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+				return false
+			}
+			stored += int64(n)
+			upload.Parts = append(upload.Parts, part)
+			upload.Offset, upload.TailKey, upload.TailSize = stored, "", 0
+			if !save() {
+				return false
+			}
+			continue
+		}
+
+		readErr := err
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			readErr = nil
+		}
+		if body.n == 0 && upload.TailKey == oldTail && upload.Offset < upload.Length {
+			// Nothing new arrived, so the stored state is still accurate
+			break
+		}
+
+		upload.Offset = stored + int64(n)
+		upload.TailKey, upload.TailSize = "", 0
+		switch {
+		case n > 0 && upload.Offset == upload.Length:
+			part, err := uploader.UploadPart(ctx, upload.Key, upload.MultipartID, len(upload.Parts)+1, bytes.NewReader(buf[:n]), int64(n))
+			if err != nil {
+				slog.Error("failed to upload part", "upload_id", upload.ID, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+				return false
+			}
+			upload.Parts = append(upload.Parts, part)
+		case n > 0:
+			tailKey := fmt.Sprintf("uploads/tus/%s/tail-%d", upload.ID, upload.Offset)
+			if err := backend.Put(ctx, tailKey, bytes.NewReader(buf[:n]), int64(n), "application/octet-stream"); err != nil {
+				slog.Error("failed to store upload tail", "upload_id", upload.ID, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+				return false
+			}
+			upload.TailKey, upload.TailSize = tailKey, int64(n)
+		}
+		if upload.Offset == upload.Length {
+			if err := uploader.CompleteMultipart(ctx, upload.Key, upload.MultipartID, upload.Parts); err != nil {
+				slog.Error("failed to complete multipart upload", "upload_id", upload.ID, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assemble upload"})
+				return false
+			}
+			upload.Assembled = true
+		}
+		if !save() {
+			return false
+		}
+		if readErr != nil {
+			slog.Warn("resumable upload interrupted", "upload_id", upload.ID, "offset", upload.Offset, "error", readErr)
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return false
+		}
+		break
+	}
+	return true
+}
+
+// Length of the longest signature image.DecodeConfig looks for; a file at
+// least this long that matches none is not an image
+const maxSignatureSize = 16
+
+// Runs the format, declared type and pixel checks on the first bytes of a
+// resumable upload. Returns false if too few bytes have arrived to tell yet,
+// or the error to turn the upload away with.
+func checkResumableHeader(cfg config.Upload, upload uploads.Resumable, head []byte) (bool, *uploadError) {
+	width, height, format, err := processor.DecodeDimensions(bytes.NewReader(head))
+	if err != nil {
+		complete := len(head) == maxHeaderSize || int64(len(head)) == upload.Length
+		if !complete && !(errors.Is(err, image.ErrFormat) && len(head) >= maxSignatureSize) {
+			return false, nil
+		}
+		return false, unsupportedFormat(cfg, "")
+	}
+	if uerr := checkImageHeader(cfg, format, width, height); uerr != nil {
+		return false, uerr
+	}
+	if uerr := checkDeclaredType(format, upload.ContentType); uerr != nil {
+		return false, uerr
+	}
+	return true, nil
+}
+
+// Terminates a resumable upload that failed the upload checks, freeing what
+// it stored. If its multipart upload cannot be aborted the state is kept, so
+// the expiry sweep can try again later.
+func rejectResumable(c *gin.Context, uploader storage.MultipartUploader, backend storage.Backend, upload uploads.Resumable, uerr *uploadError) {
+	ctx := c.Request.Context()
+	slog.Warn("rejecting resumable upload", "upload_id", upload.ID, "reason", uerr.message)
+	if err := uploader.AbortMultipart(ctx, upload.Key, upload.MultipartID); err != nil {
+		slog.Error("failed to abort multipart upload", "upload_id", upload.ID, "error", err)
+	} else {
+		discardResumable(ctx, backend, upload)
+	}
+	c.JSON(uerr.status, uerr.body())
+}
+
+// Registers an assembled upload like a completed direct upload and forgets
+// its state, leaving the state in place when registration can be retried
+func finishResumable(c *gin.Context, cfg config.Upload, backend storage.Backend, upload uploads.Resumable) {
+	ctx := c.Request.Context()
+	opts, ok := parseProcessingOptions(c, func(field string) string { return upload.Metadata[field] })
+	if !ok {
+		return
+	}
+	resp, uerr := registerStoredUpload(c, cfg, backend, storedUpload{
+		Key:         upload.Key,
+		FileName:    upload.FileName,
+		ContentType: upload.ContentType,
+		UserID:      upload.UserID,
+		MaxSize:     upload.Length,
+	}, opts)
+	if uerr != nil {
+		if !uerr.retry {
+			discardResumable(ctx, backend, upload)
+		}
+		if uerr.invalid {
+			slog.Warn("discarding invalid resumable upload", "upload_id", upload.ID, "key", upload.Key)
+			if err := backend.Delete(ctx, upload.Key); err != nil {
+				slog.Error("failed to delete invalid upload", "key", upload.Key, "error", err)
+			}
+		}
+		c.JSON(uerr.status, uerr.body())
+		return
+	}
+	discardResumable(ctx, backend, upload)
+	c.Header("X-Image-Id", fmt.Sprint(resp["id"]))
+	c.Status(http.StatusNoContent)
+}
+
+// Saves progress, writing a 500 response and returning false on failure
+func saveResumable(c *gin.Context, cfg config.Upload, upload uploads.Resumable) bool {
+	if err := uploads.SaveResumable(c.Request.Context(), upload, cfg.ResumableTTL); err != nil {
+		slog.Error("failed to save resumable upload", "upload_id", upload.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save upload progress"})
+		return false
+	}
+	return true
+}
+
+// Deletes an upload's tail object and state
+func discardResumable(ctx context.Context, backend storage.Backend, upload uploads.Resumable) {
+	if upload.TailKey != "" {
+		if err := backend.Delete(ctx, upload.TailKey); err != nil {
+			slog.Error("failed to delete upload tail", "key", upload.TailKey, "error", err)
+		}
+	}
+	if err := uploads.DeleteResumable(ctx, upload.ID); err != nil {
+		slog.Error("failed to delete resumable upload", "upload_id", upload.ID, "error", err)
+	}
+}
+
+// Decodes an Upload-Metadata header: comma-separated pairs of a key and an
+// optional base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata: empty key")
+		}
+		if _, dup := metadata[key]; dup {
+			return nil, fmt.Errorf("invalid Upload-Metadata: key %q is repeated", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata: value of %q is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// Returns the content type and key extension of a resumable upload from its
+// filetype metadata, falling back to the filename's extension. ok is false
+// unless the type is one that uploads accept.
+func resumableContentType(cfg config.Upload, metadata map[string]string) (contentType, ext string, ok bool) {
+	contentType = metadata["filetype"]
+	if contentType == "" {
+		ext = strings.ToLower(filepath.Ext(metadata["filename"]))
+		if ext == ".jpeg" {
+			ext = ".jpg"
+		}
+		for t, e := range uploadTypes {
+			if e == ext {
+				contentType = t
+			}
+		}
+	}
+	ext, ok = acceptedType(cfg, contentType)
+	return contentType, ext, ok
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
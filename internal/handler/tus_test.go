@@ -0,0 +1,443 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/storage"
+	"image-processing-service/internal/uploads"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testTusConfig = config.Upload{
+	MaxResumableSize:   20 << 20,
+	ResumableTTL:       time.Hour,
+	MaxPixels:          10_000,
+	MaxDimension:       200,
+	MaxAnimationPixels: 50_000,
+	AllowedFormats:     config.ImageFormats,
+}
+
+// newTusRouter mounts the tus routes with userID taken from the X-User
+// header instead of a JWT.
+func newTusRouter(cfg config.Upload) *gin.Engine {
+	r := gin.New()
+	files := r.Group("/files", TusMiddleware())
+	files.OPTIONS("/", TusOptionsHandler(cfg))
+	g := files.Group("", func(c *gin.Context) {
+		if id := c.GetHeader("X-User"); id != "" {
+			c.Set("userID", id)
+		}
+	})
+	g.POST("/", CreateResumableHandler(cfg))
+	g.HEAD("/:id", ResumableOffsetHandler)
+	g.PATCH("/:id", PatchResumableHandler(cfg))
+	g.DELETE("/:id", DeleteResumableHandler)
+	return r
+}
+
+func tusRequest(r *gin.Engine, method, path, user string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func tusMetadata(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// createTusUpload starts an upload of a PNG of length bytes for u1 and
+// returns its path
+func createTusUpload(t *testing.T, r *gin.Engine, length int) string {
+	t.Helper()
+	return createTusUploadWith(t, r, length, tusMetadata("filename", "photo.png", "filetype", "image/png"))
+}
+
+// createTusUploadWith starts an upload of length bytes for u1 with the given
+// metadata and returns its path
+func createTusUploadWith(t *testing.T, r *gin.Engine, length int, metadata string) string {
+	t.Helper()
+	w := tusRequest(r, http.MethodPost, "/files/", "u1", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	return w.Header().Get("Location")
+}
+
+func patchTus(r *gin.Engine, path string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return tusRequest(r, http.MethodPatch, path, "u1", map[string]string{"Upload-Offset": strconv.Itoa(offset)}, chunk)
+}
+
+// ---- Protocol ------------------------------------------------------------
+
+func TestTusMiddleware_RequiresVersion(t *testing.T) {
+	r := newTusRouter(testTusConfig)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files/", nil))
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("want 412, got %d", w.Code)
+	}
+	if got := w.Header().Get("Tus-Version"); got != "1.0.0" {
+		t.Errorf("Tus-Version = %q", got)
+	}
+}
+
+func TestTusOptionsHandler(t *testing.T) {
+	r := newTusRouter(testTusConfig)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/files/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Tus-Resumable": "1.0.0",
+		"Tus-Version":   "1.0.0",
+		"Tus-Extension": "creation,termination",
+		"Tus-Max-Size":  strconv.Itoa(20 << 20),
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	got, err := parseUploadMetadata("filename " + base64.StdEncoding.EncodeToString([]byte("a b.png")) + ", is_private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["filename"] != "a b.png" || len(got) != 2 {
+		t.Errorf("got %v", got)
+	}
+	for _, bad := range []string{"filename !!!", "a YQ==,a YQ==", ",a YQ=="} {
+		if _, err := parseUploadMetadata(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+// ---- Creation ------------------------------------------------------------
+
+func TestCreateResumableHandler_Validation(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+
+	tests := []struct {
+		name    string
+		user    string
+		headers map[string]string
+		want    int
+	}{
+		{"unauthenticated", "", map[string]string{"Upload-Length": "10"}, http.StatusUnauthorized},
+		{"no length", "u1", nil, http.StatusBadRequest},
+		{"zero length", "u1", map[string]string{"Upload-Length": "0"}, http.StatusBadRequest},
+		{"too large", "u1", map[string]string{"Upload-Length": strconv.Itoa(21 << 20)}, http.StatusRequestEntityTooLarge},
+		{"bad metadata", "u1", map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename !!!"}, http.StatusBadRequest},
+		{"unsupported type", "u1", map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMetadata("filename", "a.tiff")}, http.StatusUnsupportedMediaType},
+		{"bad options", "u1", map[string]string{"Upload-Length": "10", "Upload-Metadata": tusMetadata("filename", "a.png", "quality", "0")}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tusRequest(r, http.MethodPost, "/files/", tt.user, tt.headers, nil)
+			if w.Code != tt.want {
+				t.Errorf("want %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateResumableHandler_TypeFromFileName(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+
+	w := tusRequest(r, http.MethodPost, "/files/", "u1", map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": tusMetadata("filename", "IMG_0001.JPEG"),
+	}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), "/files/")
+	upload, err := uploads.GetResumable(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.ContentType != "image/jpeg" || upload.Key != "originals/u1/"+id+".jpg" {
+		t.Errorf("got type %q key %q", upload.ContentType, upload.Key)
+	}
+}
+
+// ---- Upload ------------------------------------------------------------
+
+func TestPatchResumableHandler_ChunksAndOffsets(t *testing.T) {
+	useMiniredis(t)
+	local := useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	ctx := context.Background()
+
+	// An animation over the frame budget, which only shows once it has all arrived
+	data := make([]byte, 2*storage.MinPartSize)
+	copy(data, animatedGIF(t, 10, 100, 100))
+	path := createTusUploadWith(t, r, len(data),
+		tusMetadata("filename", "clip.gif", "filetype", "image/gif", "output_format", "gif"))
+	id := strings.TrimPrefix(path, "/files/")
+
+	// A small chunk is kept as the tail
+	first := storage.MinPartSize / 2
+	if w := patchTus(r, path, 0, data[:first]); w.Code != http.StatusNoContent {
+		t.Fatalf("patch 1: want 204, got %d: %s", w.Code, w.Body.String())
+	}
+	upload, _ := uploads.GetResumable(ctx, id)
+	if upload.Offset != int64(first) || len(upload.Parts) != 0 || upload.TailSize != int64(first) || !upload.HeaderOK {
+		t.Fatalf("after patch 1: offset %d, %d parts, tail %d, header checked %v",
+			upload.Offset, len(upload.Parts), upload.TailSize, upload.HeaderOK)
+	}
+	firstTail := upload.TailKey
+
+	// The tail and the next chunk fill a part; the rest becomes a new tail
+	second := storage.MinPartSize
+	w := patchTus(r, path, first, data[first:first+second])
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("patch 2: want 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Upload-Offset"); got != strconv.Itoa(first+second) {
+		t.Errorf("Upload-Offset = %s", got)
+	}
+	upload, _ = uploads.GetResumable(ctx, id)
+	if len(upload.Parts) != 1 || upload.TailSize != int64(first+second-storage.MinPartSize) {
+		t.Fatalf("after patch 2: %d parts, tail %d", len(upload.Parts), upload.TailSize)
+	}
+	if _, err := local.Stat(ctx, firstTail); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the replaced tail should be deleted, got %v", err)
+	}
+
+	// HEAD reports the offset to resume from
+	w = tusRequest(r, http.MethodHead, path, "u1", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != strconv.Itoa(first+second) ||
+		w.Header().Get("Upload-Length") != strconv.Itoa(len(data)) {
+		t.Errorf("HEAD: %d, offset %s, length %s", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+
+	// The file is assembled, then rejected for its frames
+	w = patchTus(r, path, first+second, data[first+second:])
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("final patch: want 422, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := local.Stat(ctx, upload.Key); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("invalid upload should be deleted, got %v", err)
+	}
+	if _, err := local.Stat(ctx, upload.TailKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("tail should be deleted, got %v", err)
+	}
+	if _, err := uploads.GetResumable(ctx, id); !errors.Is(err, uploads.ErrResumableNotFound) {
+		t.Errorf("upload state should be deleted, got %v", err)
+	}
+}
+
+func TestPatchResumableHandler_AssemblesInOrder(t *testing.T) {
+	useMiniredis(t)
+	local := useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	ctx := context.Background()
+
+	data := make([]byte, storage.MinPartSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	copy(data, pngHeader(10, 10))
+	path := createTusUpload(t, r, len(data))
+	id := strings.TrimPrefix(path, "/files/")
+	if w := patchTus(r, path, 0, data[:len(data)-10]); w.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %d", w.Code)
+	}
+
+	// Finish by hand to check the stored part and tail assemble in order
+	upload, _ := uploads.GetResumable(ctx, id)
+	uploader := storage.MultipartUploader(local)
+	tail, err := storage.Download(ctx, upload.TailKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := append(tail, data[len(data)-10:]...)
+	last, err := uploader.UploadPart(ctx, upload.Key, upload.MultipartID, 2, bytes.NewReader(rest), int64(len(rest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = uploader.CompleteMultipart(ctx, upload.Key, upload.MultipartID, append(upload.Parts, last)); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := local.Get(ctx, upload.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	got, _ := io.ReadAll(body)
+	if !bytes.Equal(got, data) {
+		t.Errorf("assembled %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestPatchResumableHandler_Rejections(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	path := createTusUpload(t, r, 100)
+
+	tests := []struct {
+		name    string
+		user    string
+		headers map[string]string
+		body    []byte
+		want    int
+	}{
+		{"other user", "intruder", map[string]string{"Upload-Offset": "0"}, []byte("abc"), http.StatusNotFound},
+		{"wrong content type", "u1", map[string]string{"Upload-Offset": "0", "Content-Type": "application/octet-stream"}, []byte("abc"), http.StatusUnsupportedMediaType},
+		{"missing offset", "u1", nil, []byte("abc"), http.StatusBadRequest},
+		{"wrong offset", "u1", map[string]string{"Upload-Offset": "5"}, []byte("abc"), http.StatusConflict},
+		{"too long", "u1", map[string]string{"Upload-Offset": "0"}, make([]byte, 101), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tusRequest(r, http.MethodPatch, path, tt.user, tt.headers, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("want %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPatchResumableHandler_ChecksHeaderEarly(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	ctx := context.Background()
+
+	// A header split across chunks is checked once it is whole
+	header := pngHeader(10, 10)
+	path := createTusUpload(t, r, storage.MinPartSize)
+	id := strings.TrimPrefix(path, "/files/")
+	for i, chunk := range [][]byte{header[:10], header[10:]} {
+		offset := i * 10
+		if w := patchTus(r, path, offset, chunk); w.Code != http.StatusNoContent {
+			t.Fatalf("patch %d: want 204, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+		upload, _ := uploads.GetResumable(ctx, id)
+		if want := i == 1; upload.HeaderOK != want {
+			t.Errorf("after patch %d: want header checked %v", i+1, want)
+		}
+	}
+}
+
+func TestPatchResumableHandler_RejectsHeaderEarly(t *testing.T) {
+	useMiniredis(t)
+	local := useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		metadata string
+		chunk    []byte
+		status   int
+	}{
+		{"not an image", tusMetadata("filetype", "image/png"), bytes.Repeat([]byte("text "), 10), http.StatusUnsupportedMediaType},
+		{"too many pixels", tusMetadata("filetype", "image/png"), pngHeader(150, 150), http.StatusUnprocessableEntity},
+		{"too wide", tusMetadata("filetype", "image/png"), pngHeader(300, 10), http.StatusUnprocessableEntity},
+		{"declared type differs", tusMetadata("filetype", "image/gif"), pngHeader(10, 10), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first chunk of a file far larger than it
+			path := createTusUploadWith(t, r, 2*storage.MinPartSize, tt.metadata)
+			upload, err := uploads.GetResumable(ctx, strings.TrimPrefix(path, "/files/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := patchTus(r, path, 0, tt.chunk); w.Code != tt.status {
+				t.Fatalf("want %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if _, err := uploads.GetResumable(ctx, upload.ID); !errors.Is(err, uploads.ErrResumableNotFound) {
+				t.Errorf("upload state should be deleted, got %v", err)
+			}
+			part := strings.NewReader("x")
+			if _, err := local.UploadPart(ctx, upload.Key, upload.MultipartID, 1, part, 1); err == nil {
+				t.Error("the multipart upload should be aborted")
+			}
+			if w := tusRequest(r, http.MethodHead, path, "u1", nil, nil); w.Code != http.StatusNotFound {
+				t.Errorf("HEAD after rejection: want 404, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestPatchResumableHandler_Locked(t *testing.T) {
+	useMiniredis(t)
+	useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	path := createTusUpload(t, r, 100)
+
+	unlock, err := uploads.LockResumable(context.Background(), strings.TrimPrefix(path, "/files/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if w := patchTus(r, path, 0, []byte("abc")); w.Code != http.StatusLocked {
+		t.Errorf("want 423, got %d", w.Code)
+	}
+}
+
+// ---- Termination ------------------------------------------------------------
+
+func TestDeleteResumableHandler(t *testing.T) {
+	useMiniredis(t)
+	local := useLocalStorage(t)
+	r := newTusRouter(testTusConfig)
+	ctx := context.Background()
+	path := createTusUpload(t, r, 100)
+	patchTus(r, path, 0, pngHeader(10, 10))
+	upload, _ := uploads.GetResumable(ctx, strings.TrimPrefix(path, "/files/"))
+
+	if w := tusRequest(r, http.MethodDelete, path, "intruder", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("other user: want 404, got %d", w.Code)
+	}
+	if w := tusRequest(r, http.MethodDelete, path, "u1", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %d", w.Code)
+	}
+	if w := tusRequest(r, http.MethodHead, path, "u1", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after delete: want 404, got %d", w.Code)
+	}
+	if _, err := local.Stat(ctx, upload.TailKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("tail should be deleted, got %v", err)
+	}
+}
@@ -3,168 +3,477 @@ package handler
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image-processing-service/internal/config"
 	"image-processing-service/internal/db"
 	"image-processing-service/internal/models"
 	"image-processing-service/internal/processor"
 	"image-processing-service/internal/queue"
 	"image-processing-service/internal/storage"
+	"image-processing-service/internal/utils"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const MaxFileSize = 10 * 1024 * 1024 // 10 MB
+// Room allowed in a POST /upload body for the form fields and multipart framing
+const maxFormFieldsSize = 1 << 20
+
+// Bytes of a file that may be read while looking for its image header
+const maxHeaderSize = 1 << 20
 
 // Handles the image upload and processing request.
-// It receives the image file, processes it, and stores it in S3
-// while also inserting metadata into the database.
-// The function also queues the image for further processing
-// and returns the original image URL and metadata to the client.
-func UploadImageHandler(c *gin.Context, userID string) {
-	// Get the uploaded file from the request
-	fileHeader, err := c.FormFile("file")
+// It streams the image file to storage as it arrives, checking its format
+// and dimensions from the header against cfg before anything is stored and
+// hashing it on the way, so memory use does not grow with the file.
+// It then inserts metadata into the database, queues the image for further
+// processing and returns the original image URL and metadata to the client.
+func UploadImageHandler(c *gin.Context, cfg config.Upload, userID string) {
+	if c.Request.ContentLength > cfg.MaxSize+maxFormFieldsSize {
+		uerr := fileTooLarge(cfg.MaxSize)
+		c.JSON(uerr.status, uerr.body())
+		return
+	}
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request must be multipart/form-data"})
 		return
 	}
 
-	if fileHeader.Size > MaxFileSize {
-		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File exceeds the 10 MB size limit"})
+	// Read the form in order: fields are collected, and the file is stored
+	// as soon as it arrives
+	fields := make(map[string]string)
+	form := func(field string) string { return fields[field] }
+	fieldsSize := 0
+	var file *receivedFile
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discardReceived(c, file)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed multipart body"})
+			return
+		}
+
+		name := part.FormName()
+		if part.FileName() != "" {
+			if name != "file" || file != nil {
+				continue
+			}
+			// Options sent ahead of the file are checked before anything is stored
+			if _, ok := parseProcessingOptions(c, form); !ok {
+				return
+			}
+			var uerr *uploadError
+			if file, uerr = receiveOriginal(c.Request.Context(), cfg, userID, part); uerr != nil {
+				c.JSON(uerr.status, uerr.body())
+				return
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, int64(maxFormFieldsSize-fieldsSize+1)))
+		if err == nil && len(value) > maxFormFieldsSize-fieldsSize {
+			err = errors.New("too large")
+		}
+		if err != nil {
+			discardReceived(c, file)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read form field", "field": name})
+			return
+		}
+		fieldsSize += len(value)
+		if _, seen := fields[name]; !seen {
+			fields[name] = string(value)
+		}
+	}
+	if file == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
 		return
 	}
 
-	// Open the uploaded file
-	file, err := fileHeader.Open()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+	// Fields may also follow the file, so check the options again with all of them
+	opts, ok := parseProcessingOptions(c, form)
+	if !ok {
+		discardReceived(c, file)
 		return
 	}
-	defer file.Close()
-
-	// Read file into buffer
-	var buf bytes.Buffer
-	_, err = buf.ReadFrom(file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+	if uerr := checkAnimation(cfg, opts, file.Format, file.Width, file.Height, file.Frames); uerr != nil {
+		discardReceived(c, file)
+		c.JSON(uerr.status, uerr.body())
 		return
 	}
 
-	// Unique S3 object name for the original image
-	originalKey := fmt.Sprintf("originals/img_%d%s", time.Now().Unix(), filepath.Ext(fileHeader.Filename))
-
-	// Upload original image to S3
-	originalURL, err := storage.UploadToS3(context.Background(), originalKey, buf.Bytes())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "S3 upload failed"})
+	// Identical re-uploads return the image already stored
+	existing, err := db.GetImageByHash(context.Background(), userID, file.ContentHash)
+	if err == nil {
+		discardReceived(c, file)
+		respondDuplicate(c, existing, opts)
 		return
 	}
-
-	// Decode the image to get dimensions
-	originalImg, _, err := processor.DecodeImage(buf.Bytes())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode image"})
+	if !errors.Is(err, db.ErrImageNotFound) {
+		discardReceived(c, file)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for duplicate image"})
 		return
 	}
 
-	// Get content type for original image
-	contentType := http.DetectContentType(buf.Bytes())
-
 	// Create metadata object for original image with "pending" status
 	meta := models.ImageMeta{
-		FileName:    fileHeader.Filename,
-		URL:         originalURL,
-		S3Key:       originalKey,
-		Size:        int64(len(buf.Bytes())),
+		FileName:    file.FileName,
+		URL:         file.URL,
+		S3Key:       file.Key,
+		Size:        file.Size,
 		Uploaded:    time.Now(),
-		ContentType: contentType,
-		Width:       originalImg.Bounds().Dx(),
-		Height:      originalImg.Bounds().Dy(),
+		ContentType: file.ContentType,
+		Width:       file.Width,
+		Height:      file.Height,
 		UserID:      userID,
 		Status:      "pending",
+		ContentHash: file.ContentHash,
 	}
 
 	// Insert original image metadata into the database
 	imageID, err := db.InsertImageMeta(context.Background(), meta)
+	if errors.Is(err, db.ErrDuplicateImage) {
+		// A concurrent upload of the same file won the race
+		resp, uerr := registerDuplicate(c.Request.Context(), storage.Default(), storedUpload{Key: file.Key, UserID: userID}, file.ContentHash, opts)
+		if uerr != nil {
+			c.JSON(uerr.status, uerr.body())
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
 	if err != nil {
+		discardReceived(c, file)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB insert failed"})
 		return
 	}
 
-	// Get image processing parameters from form
-	width := 800 // DEFAULT
-	if widthStr := c.PostForm("width"); widthStr != "" {
-		if w, err := strconv.Atoi(widthStr); err == nil && w > 0 {
-			width = w
-		}
+	// Queue the processing task
+	if err = enqueueProcessing(c, imageID, userID, file.Key, opts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue processing task"})
+		return
+	}
+
+	// Private buckets store no URL, so hand back a presigned one
+	originalURL, err := storage.ResolveURL(c.Request.Context(), file.URL, file.Key)
+	if err != nil {
+		slog.Error("failed to resolve original URL", "image_id", imageID, "error", err)
 	}
 
-	// Get crop parameters
-	cropX, _ := strconv.Atoi(c.PostForm("cropX"))
-	cropY, _ := strconv.Atoi(c.PostForm("cropY"))
-	cropWidth, _ := strconv.Atoi(c.PostForm("cropWidth"))
-	cropHeight, _ := strconv.Atoi(c.PostForm("cropHeight"))
+	// Return success response with the original URL and metadata
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Image uploaded and queued for processing",
+		"id":           imageID,
+		"original_url": originalURL,
+		"stored_key":   file.Key,
+		"width":        file.Width,
+		"height":       file.Height,
+		"status":       "pending",
+	})
+}
 
-	// Get tint color
-	tintColor := c.PostForm("tintColor")
+// An original streamed to storage by POST /upload
+type receivedFile struct {
+	FileName    string
+	Key         string
+	URL         string
+	Size        int64
+	ContentType string
+	Width       int
+	Height      int
+	ContentHash string
+	Format      string
+	Frames      *processor.FrameCounter // Fed the whole file as it was stored
+}
 
-	// Create processing options JSON
-	processingOptions := map[string]interface{}{
-		"imageID": imageID,
-		"resize": map[string]int{
-			"width": width,
-		},
+// Checks the header of an uploaded file, then streams the file to storage
+// while hashing it and counting its frames. Only the header and one storage
+// part are held in memory.
+func receiveOriginal(ctx context.Context, cfg config.Upload, userID string, part *multipart.Part) (*receivedFile, *uploadError) {
+	// The bytes read to find the header are replayed into storage
+	var head bytes.Buffer
+	width, height, format, err := processor.DecodeDimensions(io.TeeReader(io.LimitReader(part, maxHeaderSize), &head))
+	if err != nil {
+		return nil, unsupportedFormat(cfg, "")
+	}
+	if uerr := checkImageHeader(cfg, format, width, height); uerr != nil {
+		return nil, uerr
 	}
 
-	// Add crop if specified
-	if cropWidth > 0 && cropHeight > 0 {
-		processingOptions["crop"] = map[string]int{
-			"x":      cropX,
-			"y":      cropY,
-			"width":  cropWidth,
-			"height": cropHeight,
-		}
+	contentType := "image/" + format
+	key := originalKey(userID, utils.NewUUID(), uploadTypes[contentType])
+	hash := sha256.New()
+	frames := new(processor.FrameCounter)
+	src := io.TeeReader(io.MultiReader(&head, part), io.MultiWriter(hash, frames))
+	size, url, err := storage.UploadStream(ctx, key, src, cfg.MaxSize)
+	if errors.Is(err, storage.ErrTooLarge) {
+		return nil, fileTooLarge(cfg.MaxSize)
+	}
+	if err != nil {
+		slog.Error("failed to store upload", "key", key, "error", err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Storage upload failed"}
 	}
 
-	// Add tint if specified
-	if tintColor != "" {
-		processingOptions["tint"] = tintColor
+	return &receivedFile{
+		FileName:    part.FileName(),
+		Key:         key,
+		URL:         url,
+		Size:        size,
+		ContentType: contentType,
+		Width:       width,
+		Height:      height,
+		ContentHash: hex.EncodeToString(hash.Sum(nil)),
+		Format:      format,
+		Frames:      frames,
+	}, nil
+}
+
+// Rejects a file over the POST /upload size limit
+func fileTooLarge(maxSize int64) *uploadError {
+	return &uploadError{
+		status:  http.StatusRequestEntityTooLarge,
+		message: fmt.Sprintf("File exceeds the %d byte size limit", maxSize),
+		details: gin.H{"max_size": maxSize},
 	}
+}
 
-	// Convert options to JSON
-	optionsJSON, err := json.Marshal(processingOptions)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode processing options"})
+// Deletes a received original that will not be recorded
+func discardReceived(c *gin.Context, file *receivedFile) {
+	if file == nil {
 		return
 	}
+	if err := storage.DeleteObjects(context.WithoutCancel(c.Request.Context()), []string{file.Key}); err != nil {
+		slog.Error("failed to delete discarded upload", "key", file.Key, "error", err)
+	}
+}
 
-	// Create task for the queue - Base64 encode the JSON to avoid delimiter issues
-	encodedOptions := base64.StdEncoding.EncodeToString(optionsJSON)
-	task := fmt.Sprintf("process:%s:%s:%s", originalKey, encodedOptions, userID)
+// Returns the storage key of an original: partitioned by user, named by a
+// fresh UUID and given the extension of the detected format
+func originalKey(userID, name, ext string) string {
+	return "originals/" + userID + "/" + name + ext
+}
 
-	// Queue the processing task
-	err = queue.EnqueueTask(context.Background(), task)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue processing task"})
+// Writes the response for an upload whose content the user already uploaded.
+// The existing image is returned as it is and is not processed again, so an
+// upload that asked for processing is refused rather than have its options
+// silently dropped.
+func respondDuplicate(c *gin.Context, image models.ImageMeta, opts processingOptions) {
+	if opts.Requested {
+		uerr := duplicateWithOptions(image)
+		c.JSON(uerr.status, uerr.body())
 		return
 	}
+	url, err := storage.ResolveURL(c.Request.Context(), image.URL, image.S3Key)
+	if err != nil {
+		slog.Error("failed to resolve original URL", "image_id", image.ID, "error", err)
+	}
+	c.JSON(http.StatusOK, duplicateBody(image, url))
+}
 
-	// Return success response with the original S3 URL and metadata
-	c.JSON(http.StatusOK, gin.H{
-		"message":      "Image uploaded and queued for processing",
-		"id":           imageID,
+// Rejects a duplicate upload that asked for processing, pointing at the
+// existing image
+func duplicateWithOptions(image models.ImageMeta) *uploadError {
+	return &uploadError{
+		status:  http.StatusConflict,
+		message: "Image already uploaded; processing options are not applied to an existing image",
+		details: gin.H{"id": image.ID, "duplicate": true},
+	}
+}
+
+// Body of the response for a duplicate upload
+func duplicateBody(image models.ImageMeta, originalURL string) gin.H {
+	return gin.H{
+		"message":      "Image already uploaded",
+		"id":           image.ID,
 		"original_url": originalURL,
-		"stored_key":   originalKey,
-		"width":        originalImg.Bounds().Dx(),
-		"height":       originalImg.Bounds().Dy(),
-		"status":       "pending",
-	})
+		"stored_key":   image.S3Key,
+		"width":        image.Width,
+		"height":       image.Height,
+		"status":       image.Status,
+		"duplicate":    true,
+	}
+}
+
+// Processing requested for an upload
+type processingOptions struct {
+	Pipeline  processor.Pipeline
+	Output    processor.OutputOptions
+	Variants  []processor.Variant
+	Requested bool // Some processing field was given, rather than all defaults
+}
+
+// Form fields that change how an upload is processed
+var processingFields = []string{
+	"pipeline", "width", "height", "filter", "fit",
+	"cropX", "cropY", "cropWidth", "cropHeight",
+	"tintColor", "tintIntensity", "tintMode",
+	"output_format", "quality", "lossless", "variants",
+}
+
+// Reads the pipeline, output and variants fields through form, writing a 400
+// response and returning false if any of them is invalid
+func parseProcessingOptions(c *gin.Context, form func(string) string) (processingOptions, bool) {
+	var opts processingOptions
+	var err error
+	if opts.Pipeline, err = buildPipeline(form); err != nil {
+		respondPipelineError(c, err)
+		return opts, false
+	}
+	if opts.Output, err = buildOutputOptions(form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid output options: " + err.Error()})
+		return opts, false
+	}
+	if opts.Variants, err = processor.ParseVariants(form("variants")); err != nil {
+		respondVariantError(c, err)
+		return opts, false
+	}
+	opts.Requested = slices.ContainsFunc(processingFields, func(field string) bool { return form(field) != "" })
+	return opts, true
+}
+
+// Queues an uploaded original for processing, propagating the caller's trace context
+func enqueueProcessing(c *gin.Context, imageID, userID, key string, opts processingOptions) error {
+	task := queue.Task{
+		Type:     queue.TaskTypeProcess,
+		ImageID:  imageID,
+		UserID:   userID,
+		ImageKey: key,
+		Pipeline: opts.Pipeline,
+		Output:   opts.Output,
+		Variants: opts.Variants,
+	}
+	if traceparent := c.GetHeader("traceparent"); traceparent != "" {
+		task.Trace = map[string]string{"traceparent": traceparent}
+	}
+	_, err := queue.Enqueue(context.Background(), task)
+	return err
+}
+
+// Builds the processing pipeline from the upload form.
+// A "pipeline" field holding a JSON array of steps takes precedence;
+// otherwise the legacy width/height/filter/fit, crop and tintColor/tintIntensity/tintMode
+// fields are translated into the equivalent resize → crop → tint pipeline.
+func buildPipeline(form func(string) string) (processor.Pipeline, error) {
+	if spec := form("pipeline"); spec != "" {
+		return processor.ParsePipeline([]byte(spec))
+	}
+
+	var steps []processor.Operation
+
+	// Resize to the requested box, 800 pixels wide by default
+	resizeOp := &processor.ResizeOp{
+		Filter: form("filter"),
+		Fit:    form("fit"),
+	}
+	dimensions := []struct {
+		field string
+		dst   *int
+	}{{"width", &resizeOp.Width}, {"height", &resizeOp.Height}}
+	for _, d := range dimensions {
+		if value := form(d.field); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return processor.Pipeline{}, &processor.StepError{Index: len(steps), Op: "resize", Err: fmt.Errorf("invalid %s %q", d.field, value)}
+			}
+			*d.dst = n
+		}
+	}
+	if form("width") == "" && form("height") == "" {
+		resizeOp.Width = 800
+	}
+	steps = append(steps, resizeOp)
+
+	// Crop only when a region was given
+	cropX, _ := strconv.Atoi(form("cropX"))
+	cropY, _ := strconv.Atoi(form("cropY"))
+	cropWidth, _ := strconv.Atoi(form("cropWidth"))
+	cropHeight, _ := strconv.Atoi(form("cropHeight"))
+	if cropWidth > 0 && cropHeight > 0 {
+		steps = append(steps, &processor.CropOp{
+			X: float64(cropX), Y: float64(cropY), Width: float64(cropWidth), Height: float64(cropHeight),
+		})
+	}
+
+	// Tint if a color was given
+	if tintColor := form("tintColor"); tintColor != "" {
+		tintOp := &processor.TintOp{Color: tintColor, Mode: form("tintMode")}
+		if value := form("tintIntensity"); value != "" {
+			intensity, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return processor.Pipeline{}, &processor.StepError{Index: len(steps), Op: "tint", Err: fmt.Errorf("invalid tintIntensity %q", value)}
+			}
+			tintOp.Intensity = intensity
+		}
+		steps = append(steps, tintOp)
+	}
+
+	pipeline := processor.NewPipeline(steps...)
+	if err := pipeline.Validate(); err != nil {
+		return processor.Pipeline{}, err
+	}
+	return pipeline, nil
+}
+
+// Reads the output_format, quality and lossless form fields
+func buildOutputOptions(form func(string) string) (processor.OutputOptions, error) {
+	output := processor.OutputOptions{Format: form("output_format")}
+	if qualityStr := form("quality"); qualityStr != "" {
+		q, err := strconv.Atoi(qualityStr)
+		if err != nil || q < 1 {
+			return output, fmt.Errorf("quality must be between 1 and 100, got %q", qualityStr)
+		}
+		output.Quality = q
+	}
+	if losslessStr := form("lossless"); losslessStr != "" {
+		lossless, err := strconv.ParseBool(losslessStr)
+		if err != nil {
+			return output, fmt.Errorf("lossless must be true or false, got %q", losslessStr)
+		}
+		output.Lossless = lossless
+	}
+	return output, output.Validate()
+}
+
+// Writes a 400 response for an invalid pipeline, naming the offending step when known
+func respondPipelineError(c *gin.Context, err error) {
+	var stepErr *processor.StepError
+	if errors.As(err, &stepErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid processing pipeline: " + stepErr.Error(),
+			"step":  stepErr.Index,
+			"op":    stepErr.Op,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid processing pipeline: " + err.Error()})
+}
+
+// Writes a 400 response for an invalid variant set, naming the variant and step when known
+func respondVariantError(c *gin.Context, err error) {
+	body := gin.H{"error": "Invalid variants: " + err.Error()}
+	var variantErr *processor.VariantError
+	if errors.As(err, &variantErr) && variantErr.Name != "" {
+		body["variant"] = variantErr.Name
+	}
+	var stepErr *processor.StepError
+	if errors.As(err, &stepErr) {
+		body["step"] = stepErr.Index
+		body["op"] = stepErr.Op
+	}
+	c.JSON(http.StatusBadRequest, body)
 }
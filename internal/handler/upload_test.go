@@ -2,6 +2,15 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/models"
+	"image-processing-service/internal/storage"
+	"image/png"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -12,11 +21,10 @@ import (
 )
 
 // newUploadRouter wires UploadImageHandler with a fixed userID, mirroring main.go.
-func newUploadRouter() *gin.Engine {
+func newUploadRouter(cfg config.Upload) *gin.Engine {
 	r := gin.New()
-	r.MaxMultipartMemory = MaxFileSize
 	r.POST("/upload", func(c *gin.Context) {
-		UploadImageHandler(c, "test-user-id")
+		UploadImageHandler(c, cfg, "test-user-id")
 	})
 	return r
 }
@@ -41,7 +49,7 @@ func multipartRequest(t *testing.T, fieldName, fileName string, content []byte)
 }
 
 func TestUploadImageHandler_NoFile(t *testing.T) {
-	r := newUploadRouter()
+	r := newUploadRouter(testUploadConfig)
 	w := httptest.NewRecorder()
 	// Send an empty multipart body — no file field at all
 	var buf bytes.Buffer
@@ -57,7 +65,7 @@ func TestUploadImageHandler_NoFile(t *testing.T) {
 }
 
 func TestUploadImageHandler_NoContentType(t *testing.T) {
-	r := newUploadRouter()
+	r := newUploadRouter(testUploadConfig)
 	w := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("not multipart"))
 	// No Content-Type header — Gin can't parse a multipart form
@@ -69,12 +77,30 @@ func TestUploadImageHandler_NoContentType(t *testing.T) {
 }
 
 func TestUploadImageHandler_FileTooLarge(t *testing.T) {
-	r := newUploadRouter()
+	local := useLocalStorage(t)
+	r := newUploadRouter(testUploadConfig)
 	w := httptest.NewRecorder()
 
-	// Create a file that is exactly one byte over the limit
-	oversized := make([]byte, MaxFileSize+1)
-	req := multipartRequest(t, "file", "big.jpg", oversized)
+	// A valid header passes the checks, so the size is enforced while streaming
+	oversized := make([]byte, testUploadConfig.MaxSize+1)
+	copy(oversized, pngHeader(10, 10))
+	req := multipartRequest(t, "file", "big.png", oversized)
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want 413, got %d: %s", w.Code, w.Body.String())
+	}
+	if keys := listOriginals(t, local); len(keys) != 0 {
+		t.Errorf("nothing should be stored, got %v", keys)
+	}
+}
+
+func TestUploadImageHandler_BodyTooLarge(t *testing.T) {
+	r := newUploadRouter(testUploadConfig)
+	w := httptest.NewRecorder()
+
+	// Rejected from Content-Length before the body is read
+	req := multipartRequest(t, "file", "big.png", make([]byte, testUploadConfig.MaxSize+maxFormFieldsSize))
 	r.ServeHTTP(w, req)
 
 	if w.Code != http.StatusRequestEntityTooLarge {
@@ -83,12 +109,12 @@ func TestUploadImageHandler_FileTooLarge(t *testing.T) {
 }
 
 func TestUploadImageHandler_FileAtLimit(t *testing.T) {
-	r := newUploadRouter()
+	r := newUploadRouter(testUploadConfig)
 	w := httptest.NewRecorder()
 
 	// A file exactly at the limit should pass the size check (it will fail later
 	// on image decoding since it's not a real image, but must not return 413).
-	atLimit := make([]byte, MaxFileSize)
+	atLimit := make([]byte, testUploadConfig.MaxSize)
 	req := multipartRequest(t, "file", "exact.jpg", atLimit)
 	r.ServeHTTP(w, req)
 
@@ -97,8 +123,47 @@ func TestUploadImageHandler_FileAtLimit(t *testing.T) {
 	}
 }
 
+func TestUploadImageHandler_OptionsAfterFile(t *testing.T) {
+	local := useLocalStorage(t)
+	r := newUploadRouter(testUploadConfig)
+
+	// Fields that follow the file are checked once it is stored, and a
+	// rejected upload is removed again
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "photo.png")
+	fw.Write(pngHeader(10, 10))
+	mw.WriteField("quality", "0")
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400, got %d: %s", w.Code, w.Body.String())
+	}
+	if keys := listOriginals(t, local); len(keys) != 0 {
+		t.Errorf("rejected upload should be deleted, got %v", keys)
+	}
+}
+
+// listOriginals returns the keys stored under originals/
+func listOriginals(t *testing.T, local *storage.LocalBackend) []string {
+	t.Helper()
+	var keys []string
+	err := local.List(context.Background(), "originals/", func(obj storage.ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
 func TestUploadImageHandler_WrongFieldName(t *testing.T) {
-	r := newUploadRouter()
+	r := newUploadRouter(testUploadConfig)
 	w := httptest.NewRecorder()
 
 	// Upload with a field named "image" instead of "file"
@@ -109,3 +174,257 @@ func TestUploadImageHandler_WrongFieldName(t *testing.T) {
 		t.Errorf("want 400 for wrong field name, got %d", w.Code)
 	}
 }
+
+func TestUploadImageHandler_NotAnImage(t *testing.T) {
+	r := newUploadRouter(testUploadConfig)
+	w := httptest.NewRecorder()
+
+	// Rejected by its content, before anything is stored or recorded
+	req := multipartRequest(t, "file", "photo.jpg", []byte("definitely not a jpeg"))
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("want 415 for a file that is not an image, got %d", w.Code)
+	}
+}
+
+// pngHeader returns the signature and IHDR chunk of a PNG declaring the
+// given size: enough for DecodeConfig, with no pixel data behind it.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = binary.BigEndian.AppendUint32(out, 13)
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestUploadImageHandler_RejectsByHeader(t *testing.T) {
+	var small bytes.Buffer
+	png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	jpegOnly := testUploadConfig
+	jpegOnly.AllowedFormats = []string{"jpeg"}
+
+	tests := []struct {
+		name   string
+		cfg    config.Upload
+		data   []byte
+		status int
+		field  string // Present in the structured error body
+	}{
+		{"decompression bomb", testUploadConfig, pngHeader(50000, 50000), http.StatusUnprocessableEntity, "max_pixels"},
+		{"too wide", testUploadConfig, pngHeader(201, 1), http.StatusUnprocessableEntity, "max_dimension"},
+		{"format not allowed", jpegOnly, small.Bytes(), http.StatusUnsupportedMediaType, "format"},
+		{"not an image", testUploadConfig, []byte("definitely not an image"), http.StatusUnsupportedMediaType, "allowed_formats"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newUploadRouter(tt.cfg).ServeHTTP(w, multipartRequest(t, "file", "photo.png", tt.data))
+			if w.Code != tt.status {
+				t.Fatalf("want %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			var body map[string]any
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if _, ok := body[tt.field]; !ok || body["error"] == nil {
+				t.Errorf("want error and %s in body, got %s", tt.field, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadImageHandler_RejectsLargeAnimation(t *testing.T) {
+	local := useLocalStorage(t)
+	r := newUploadRouter(testUploadConfig)
+
+	// The frames are only counted once the file is stored, so it is removed again
+	req := multipartRequestWithFields(t, animatedGIF(t, 10, 100, 100), map[string]string{"output_format": "gif"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("want 422, got %d: %s", w.Code, w.Body.String())
+	}
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["frames"] != float64(10) || body["max_animation_pixels"] == nil {
+		t.Errorf("want the frame count and limit in the body, got %s", w.Body.String())
+	}
+	if keys := listOriginals(t, local); len(keys) != 0 {
+		t.Errorf("rejected upload should be deleted, got %v", keys)
+	}
+}
+
+// multipartRequestWithFields builds an upload request with a file and extra form fields.
+func multipartRequestWithFields(t *testing.T, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			t.Fatalf("write field %s: %v", k, err)
+		}
+	}
+	fw, err := w.CreateFormFile("file", "photo.jpg")
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	if _, err = fw.Write(content); err != nil {
+		t.Fatalf("write file content: %v", err)
+	}
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestUploadImageHandler_InvalidPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		wantStep float64
+		wantOp   string
+	}{
+		{"unknown op", map[string]string{"pipeline": `[{"op":"resize","params":{"width":100}},{"op":"melt"}]`}, 1, "melt"},
+		{"bad param", map[string]string{"pipeline": `[{"op":"crop","params":{"width":-5,"height":10}}]`}, 0, "crop"},
+		{"legacy bad tint", map[string]string{"tintColor": "blue"}, 1, "tint"},
+		{"legacy bad tint intensity", map[string]string{"tintColor": "#0000ff", "tintIntensity": "strong"}, 1, "tint"},
+		{"legacy tint intensity out of range", map[string]string{"tintColor": "#0000ff", "tintIntensity": "1.5"}, 1, "tint"},
+		{"legacy bad tint mode", map[string]string{"tintColor": "#0000ff", "tintMode": "dodge"}, 1, "tint"},
+		{"color op out of range", map[string]string{"pipeline": `[{"op":"brightness","params":{"amount":2}}]`}, 0, "brightness"},
+		{"legacy bad width", map[string]string{"width": "abc"}, 0, "resize"},
+		{"legacy bad filter", map[string]string{"width": "100", "filter": "sinc"}, 0, "resize"},
+		{"legacy bad fit", map[string]string{"height": "100", "fit": "stretch"}, 0, "resize"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newUploadRouter(testUploadConfig)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, multipartRequestWithFields(t, []byte("data"), tc.fields))
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("want 400, got %d", w.Code)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not valid JSON: %v", err)
+			}
+			if body["step"] != tc.wantStep || body["op"] != tc.wantOp {
+				t.Errorf("want step %v (%s), got step %v (%v)", tc.wantStep, tc.wantOp, body["step"], body["op"])
+			}
+		})
+	}
+}
+
+func TestUploadImageHandler_MalformedPipeline(t *testing.T) {
+	r := newUploadRouter(testUploadConfig)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartRequestWithFields(t, []byte("data"), map[string]string{"pipeline": "{not json"}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", w.Code)
+	}
+}
+
+func TestUploadImageHandler_InvalidOutputOptions(t *testing.T) {
+	tests := []map[string]string{
+		{"output_format": "bmp"},
+		{"quality": "0"},
+		{"quality": "101"},
+		{"quality": "high"},
+		{"output_format": "jpeg", "lossless": "true"},
+		{"output_format": "webp", "lossless": "maybe"},
+	}
+	for _, fields := range tests {
+		r := newUploadRouter(testUploadConfig)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, multipartRequestWithFields(t, []byte("data"), fields))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: want 400, got %d", fields, w.Code)
+		}
+	}
+}
+
+func TestUploadImageHandler_InvalidVariants(t *testing.T) {
+	tests := []struct {
+		name        string
+		variants    string
+		wantVariant any
+		wantOp      any
+	}{
+		{"bad token", "thumb: 150x150 sepia", "thumb", nil},
+		{"bad name", "Thumb!: 150w", "Thumb!", nil},
+		{"duplicate", "thumb: 150w; thumb: 300w", "thumb", nil},
+		{"bad step", `[{"name":"web","pipeline":[{"op":"rotate","params":{"angle":400}}]}]`, "web", "rotate"},
+		{"malformed json", `[{"name":`, nil, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newUploadRouter(testUploadConfig)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, multipartRequestWithFields(t, []byte("data"), map[string]string{"variants": tc.variants}))
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("want 400, got %d", w.Code)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not valid JSON: %v", err)
+			}
+			if body["variant"] != tc.wantVariant || body["op"] != tc.wantOp {
+				t.Errorf("want variant %v op %v, got %v %v", tc.wantVariant, tc.wantOp, body["variant"], body["op"])
+			}
+		})
+	}
+}
+
+func TestRespondDuplicate(t *testing.T) {
+	useLocalStorage(t)
+	existing := models.ImageMeta{ID: "img-1", S3Key: "originals/u/a.png", URL: "http://localhost:8080/media/originals/u/a.png", Status: "completed"}
+
+	// The duplicate check needs the database, so the response is exercised
+	// behind the real option parsing
+	r := gin.New()
+	r.POST("/upload", func(c *gin.Context) {
+		if opts, ok := parseProcessingOptions(c, c.PostForm); ok {
+			respondDuplicate(c, existing, opts)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		form   string
+		status int
+	}{
+		{"no options", "", http.StatusOK},
+		{"legacy resize", "width=300", http.StatusConflict},
+		{"pipeline", `pipeline=[{"op":"grayscale"}]`, http.StatusConflict},
+		{"output", "output_format=png", http.StatusConflict},
+		{"variants", "variants=thumb: 150w", http.StatusConflict},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tc.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("want %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			var body map[string]any
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body["id"] != "img-1" || body["duplicate"] != true {
+				t.Errorf("want the existing image referenced, got %s", w.Body.String())
+			}
+			if tc.status == http.StatusConflict && body["error"] == nil {
+				t.Errorf("want an error explaining the options were not applied, got %s", w.Body.String())
+			}
+		})
+	}
+}
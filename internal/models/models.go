@@ -42,18 +42,34 @@ type ResendVerificationRequest struct {
 
 // Represents metadata for an image
 type ImageMeta struct {
-	ID           string    `json:"id"`            // Unique identifier for the image
-	FileName     string    `json:"file_name"`     // Original file name
-	URL          string    `json:"url"`           // URL to original image
-	S3Key        string    `json:"s3_key"`        // S3 key for the original image
-	Size         int64     `json:"size"`          // Size of the image in bytes
-	Uploaded     time.Time `json:"uploaded"`      // Timestamp when the image was uploaded
-	ContentType  string    `json:"content_type"`  // MIME type of the image
-	Width        int       `json:"width"`         // Width of the image in pixels
-	Height       int       `json:"height"`        // Height of the image in pixels
-	UserID       string    `json:"user_id"`       // ID of the user who uploaded the image
-	Status       string    `json:"status"`        // pending, processing, completed, failed
-	ProcessedURL string    `json:"processed_url"` // URL to processed image (if completed)
+	ID           string         `json:"id"`                 // Unique identifier for the image
+	FileName     string         `json:"file_name"`          // Original file name
+	URL          string         `json:"url"`                // URL to original image
+	S3Key        string         `json:"s3_key"`             // Storage key of the original image
+	Size         int64          `json:"size"`               // Size of the image in bytes
+	Uploaded     time.Time      `json:"uploaded"`           // Timestamp when the image was uploaded
+	ContentType  string         `json:"content_type"`       // MIME type of the image
+	Width        int            `json:"width"`              // Width of the image in pixels
+	Height       int            `json:"height"`             // Height of the image in pixels
+	UserID       string         `json:"user_id"`            // ID of the user who uploaded the image
+	Status       string         `json:"status"`             // pending, processing, completed, failed
+	ProcessedURL string         `json:"processed_url"`      // URL to processed image (if completed)
+	ProcessedKey string         `json:"processed_key"`      // Storage key of the processed image (if completed)
+	ContentHash  string         `json:"content_hash"`       // Hex SHA-256 of the original; empty for images uploaded before hashing
+	Variants     []ImageVariant `json:"variants,omitempty"` // Named renditions produced by the worker
+}
+
+// Represents a named rendition of an image, such as a thumbnail
+type ImageVariant struct {
+	ImageID     string    `json:"image_id"`     // ID of the image this variant belongs to
+	Name        string    `json:"name"`         // Variant name, unique per image
+	URL         string    `json:"url"`          // URL to the rendition
+	S3Key       string    `json:"s3_key"`       // Storage key of the rendition
+	Size        int64     `json:"size"`         // Size of the rendition in bytes
+	ContentType string    `json:"content_type"` // MIME type of the rendition
+	Width       int       `json:"width"`        // Width of the rendition in pixels
+	Height      int       `json:"height"`       // Height of the rendition in pixels
+	Created     time.Time `json:"created"`      // Timestamp when the rendition was stored
 }
 
 // Represents a request to reset a password
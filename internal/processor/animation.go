@@ -0,0 +1,313 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// Animation is a decoded image with one or more frames. Stills have a single
+// frame; animated GIFs keep every frame, composited onto the full canvas as
+// it is displayed, together with their timing and loop count.
+type Animation struct {
+	Frames    []image.Image
+	Delays    []int  // Per frame, in hundredths of a second
+	Disposals []byte // Per frame, as in image/gif
+	LoopCount int    // As in image/gif: 0 loops forever, -1 plays once
+}
+
+// Wraps a single image as an Animation
+func Still(img image.Image) *Animation {
+	return &Animation{Frames: []image.Image{img}, Delays: []int{0}, Disposals: []byte{0}}
+}
+
+// Reports whether there is more than one frame
+func (a *Animation) Animated() bool { return len(a.Frames) > 1 }
+
+// Returns frame i as a still; a frame past the end picks the last
+func (a *Animation) Frame(i int) *Animation {
+	return Still(a.Frames[min(i, len(a.Frames)-1)])
+}
+
+var errTruncatedGIF = errors.New("gif: truncated file")
+
+var gifSignature = []byte("GIF8")
+
+// Counts the frames of a GIF by walking its blocks, without decoding any
+// pixels, so an animation can be sized up before it is decoded. Other
+// formats have a single frame.
+func CountFrames(data []byte) (int, error) {
+	var fc FrameCounter
+	fc.Write(data)
+	return fc.Frames()
+}
+
+// Where a FrameCounter is in the GIF block structure
+type frameCounterState int
+
+const (
+	fcHeader     frameCounterState = iota // Signature, version and logical screen descriptor
+	fcBlock                               // Block introducer
+	fcExtension                           // Extension label
+	fcDescriptor                          // Image descriptor, then the LZW code size
+	fcSubBlock                            // Size of the next data sub-block
+	fcDone                                // Past the trailer, or not a GIF
+)
+
+// FrameCounter counts the frames of a GIF written to it piece by piece,
+// walking its blocks as CountFrames does, so a file can be sized up while it
+// streams past without holding it in memory. Anything that is not a GIF
+// counts as a single frame.
+type FrameCounter struct {
+	state  frameCounterState
+	buf    []byte // Fixed-size fields collected so far
+	skip   int    // Bytes still to pass over before the next field
+	frames int
+	notGIF bool
+	err    error
+}
+
+// Write never fails so the counter can sit behind an io.TeeReader; a file
+// that is not a well-formed GIF is reported by Frames
+func (fc *FrameCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && fc.state != fcDone {
+		if fc.skip > 0 {
+			k := min(fc.skip, len(p))
+			fc.skip -= k
+			p = p[k:]
+			continue
+		}
+		switch fc.state {
+		case fcHeader:
+			if !fc.collect(&p, 13) {
+				continue
+			}
+			if !bytes.HasPrefix(fc.buf, gifSignature) {
+				fc.notGIF, fc.state = true, fcDone
+				continue
+			}
+			if flags := fc.buf[10]; flags&0x80 != 0 {
+				fc.skip = 3 << (flags&0x07 + 1)
+			}
+			fc.buf, fc.state = fc.buf[:0], fcBlock
+		case fcBlock:
+			switch p[0] {
+			case 0x21:
+				fc.state = fcExtension
+			case 0x2C:
+				fc.state = fcDescriptor
+			case 0x3B:
+				fc.state = fcDone
+			default:
+				fc.err, fc.state = fmt.Errorf("gif: unknown block type 0x%02x", p[0]), fcDone
+			}
+			p = p[1:]
+		case fcExtension:
+			p, fc.state = p[1:], fcSubBlock
+		case fcDescriptor:
+			// Position, size and flags, then the local color table and LZW code size
+			if !fc.collect(&p, 9) {
+				continue
+			}
+			fc.frames++
+			fc.skip = 1
+			if flags := fc.buf[8]; flags&0x80 != 0 {
+				fc.skip += 3 << (flags&0x07 + 1)
+			}
+			fc.buf, fc.state = fc.buf[:0], fcSubBlock
+		case fcSubBlock:
+			if p[0] == 0 {
+				fc.state = fcBlock
+			}
+			fc.skip = int(p[0])
+			p = p[1:]
+		}
+	}
+	return n, nil
+}
+
+// Appends bytes from p to the field being collected until it holds size
+// bytes, reporting whether it is complete
+func (fc *FrameCounter) collect(p *[]byte, size int) bool {
+	k := min(size-len(fc.buf), len(*p))
+	fc.buf = append(fc.buf, (*p)[:k]...)
+	*p = (*p)[k:]
+	return len(fc.buf) == size
+}
+
+// Returns the number of frames written, or an error if the GIF is malformed
+// or ended before its trailer
+func (fc *FrameCounter) Frames() (int, error) {
+	switch {
+	case fc.err != nil:
+		return 0, fc.err
+	case fc.notGIF:
+		return 1, nil
+	case fc.state == fcHeader && !bytes.HasPrefix(fc.buf, gifSignature):
+		return 1, nil
+	case fc.state != fcDone:
+		return 0, errTruncatedGIF
+	}
+	return fc.frames, nil
+}
+
+// Reports whether processing with these options can use the frames of an
+// animation: GIF outputs keep them all and frame steps pick among them.
+// Otherwise only the first frame is worth decoding.
+func KeepsFrames(inputFormat string, p Pipeline, out OutputOptions, variants []Variant) bool {
+	if out.Animates(inputFormat) || p.HasFrameStep() {
+		return true
+	}
+	for _, variant := range variants {
+		if variant.Output.Animates(inputFormat) || variant.Pipeline.HasFrameStep() {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes an image with all of its frames. GIFs are composited frame by
+// frame onto the full canvas following each frame's disposal; everything
+// else decodes as with DecodeImage into a single frame.
+func DecodeAnimation(data []byte) (*Animation, string, error) {
+	if !bytes.HasPrefix(data, gifSignature) {
+		img, format, err := DecodeImage(data)
+		if err != nil {
+			return nil, "", err
+		}
+		return Still(img), format, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if len(g.Image) == 1 && g.Image[0].Bounds() == bounds {
+		return Still(g.Image[0]), "gif", nil
+	}
+
+	a := &Animation{Delays: g.Delay, Disposals: g.Disposal, LoopCount: g.LoopCount}
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		a.Frames = append(a.Frames, cloneRGBA(canvas))
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return a, "gif", nil
+}
+
+// Draws the first frame of a GIF onto the full canvas when it covers only
+// part of it, as DecodeAnimation would
+func onGIFCanvas(data []byte, frame image.Image) (image.Image, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := image.Rect(0, 0, config.Width, config.Height)
+	if frame.Bounds() == bounds {
+		return frame, nil
+	}
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	dst := *img
+	dst.Pix = append([]uint8(nil), img.Pix...)
+	return &dst
+}
+
+// AnimationEncoder is an Encoder that can also write every frame of an animation
+type AnimationEncoder interface {
+	Encoder
+	// EncodeAnimation writes all frames of a to w
+	EncodeAnimation(w io.Writer, a *Animation) error
+}
+
+// Encodes an animation with the given encoder. Encoders that cannot animate
+// get the first frame.
+func EncodeAnimation(a *Animation, enc Encoder) ([]byte, error) {
+	ae, ok := enc.(AnimationEncoder)
+	if !ok || !a.Animated() {
+		return EncodeImage(a.Frames[0], enc)
+	}
+	var buf bytes.Buffer
+	if err := ae.EncodeAnimation(&buf, a); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FrameOp keeps a single frame of an animated GIF, counting from zero; a
+// frame past the end picks the last. The steps after it and the output see
+// a still image, so a frame step first in the pipeline makes a cheap poster.
+// Stills are left as they are.
+type FrameOp struct {
+	Index int `json:"index,omitempty"`
+}
+
+func (op *FrameOp) Name() string { return "frame" }
+
+func (op *FrameOp) Validate() error {
+	if op.Index < 0 {
+		return fmt.Errorf("index must not be negative, got %d", op.Index)
+	}
+	return nil
+}
+
+// Apply sees one frame at a time and has nothing to pick from;
+// Pipeline.ApplyAnimation does the picking
+func (op *FrameOp) Apply(img image.Image) (image.Image, error) {
+	return img, nil
+}
+
+// Reports whether any step picks a frame of an animation
+func (p Pipeline) HasFrameStep() bool {
+	for _, op := range p.Steps {
+		if _, ok := op.(*FrameOp); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyAnimation runs every step on each frame of an animation, keeping its
+// timing. A frame step picks one frame, so the steps after it run once.
+func (p Pipeline) ApplyAnimation(a *Animation) (*Animation, error) {
+	for i, op := range p.Steps {
+		if f, ok := op.(*FrameOp); ok {
+			a = a.Frame(f.Index)
+			continue
+		}
+		frames := make([]image.Image, len(a.Frames))
+		for j, frame := range a.Frames {
+			out, err := op.Apply(frame)
+			if err != nil {
+				if a.Animated() {
+					err = fmt.Errorf("frame %d: %w", j, err)
+				}
+				return nil, &StepError{Index: i, Op: op.Name(), Err: err}
+			}
+			frames[j] = out
+		}
+		a = &Animation{Frames: frames, Delays: a.Delays, Disposals: a.Disposals, LoopCount: a.LoopCount}
+	}
+	return a, nil
+}
@@ -0,0 +1,382 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	green = color.RGBA{G: 255, A: 255}
+	blue  = color.RGBA{B: 255, A: 255}
+)
+
+var testPalette = color.Palette{color.Transparent, red, green, blue}
+
+// Returns a paletted frame covering r, filled with c
+func newFrame(r image.Rectangle, c color.Color) *image.Paletted {
+	img := image.NewPaletted(r, testPalette)
+	idx := uint8(testPalette.Index(c))
+	for i := range img.Pix {
+		img.Pix[i] = idx
+	}
+	return img
+}
+
+// Encodes a 4×4 animation: a red background, a green square over its
+// top-left quarter and a blue square over its bottom-right quarter, with
+// the given disposal for the green square
+func newAnimatedGIF(t *testing.T, disposal byte) []byte {
+	t.Helper()
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			newFrame(image.Rect(0, 0, 4, 4), red),
+			newFrame(image.Rect(0, 0, 2, 2), green),
+			newFrame(image.Rect(2, 2, 4, 4), blue),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{ColorModel: testPalette, Width: 4, Height: 4},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+// ---- Decoding -------------------------------------------------------------------
+
+func TestCountFrames(t *testing.T) {
+	var still bytes.Buffer
+	if err := png.Encode(&still, newSolidImage(2, 2, red)); err != nil {
+		t.Fatal(err)
+	}
+	stillGIF := newFrame(image.Rect(0, 0, 3, 3), green)
+	var single bytes.Buffer
+	if err := gif.Encode(&single, stillGIF, nil); err != nil {
+		t.Fatal(err)
+	}
+	animated := newAnimatedGIF(t, gif.DisposalNone)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"png", still.Bytes(), 1, false},
+		{"still gif", single.Bytes(), 1, false},
+		{"animated gif", animated, 3, false},
+		{"truncated", animated[:len(animated)-10], 0, true},
+		{"header only", animated[:8], 0, true},
+		{"not an image", []byte("GIF"), 1, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CountFrames(tc.data)
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("want %d frames (error %v), got %d (%v)", tc.want, tc.wantErr, got, err)
+			}
+
+			// Streamed a byte at a time, the count is the same
+			var fc FrameCounter
+			for i := range tc.data {
+				fc.Write(tc.data[i : i+1])
+			}
+			if got, err := fc.Frames(); (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("streamed: want %d frames (error %v), got %d (%v)", tc.want, tc.wantErr, got, err)
+			}
+		})
+	}
+}
+
+func TestDecodeAnimation_Composites(t *testing.T) {
+	tests := []struct {
+		name     string
+		disposal byte
+		// Top-left pixel of the last frame, once the green square is disposed of
+		want color.RGBA
+	}{
+		{"none", gif.DisposalNone, green},
+		{"background", gif.DisposalBackground, color.RGBA{}},
+		{"previous", gif.DisposalPrevious, red},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a, format, err := DecodeAnimation(newAnimatedGIF(t, tc.disposal))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if format != "gif" || len(a.Frames) != 3 || a.LoopCount != 3 || a.Delays[2] != 30 {
+				t.Fatalf("want 3 frames of a gif looping 3 times, got %s with %d frames, loop %d, delays %v",
+					format, len(a.Frames), a.LoopCount, a.Delays)
+			}
+			for i, frame := range a.Frames {
+				if frame.Bounds() != image.Rect(0, 0, 4, 4) {
+					t.Errorf("frame %d: want the full canvas, got %v", i, frame.Bounds())
+				}
+			}
+			if c := rgbaAt(a.Frames[1], 0, 0); c != green {
+				t.Errorf("frame 1: want green over the background, got %v", c)
+			}
+			if c := rgbaAt(a.Frames[1], 3, 3); c != red {
+				t.Errorf("frame 1: want the red background kept, got %v", c)
+			}
+			if c := rgbaAt(a.Frames[2], 0, 0); c != tc.want {
+				t.Errorf("frame 2: want %v, got %v", tc.want, c)
+			}
+			if c := rgbaAt(a.Frames[2], 3, 3); c != blue {
+				t.Errorf("frame 2: want blue, got %v", c)
+			}
+		})
+	}
+}
+
+func TestDecodeAnimation_Stills(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, newFrame(image.Rect(0, 0, 3, 3), green), nil); err != nil {
+		t.Fatal(err)
+	}
+	a, format, err := DecodeAnimation(buf.Bytes())
+	if err != nil || format != "gif" || a.Animated() {
+		t.Fatalf("want a still gif, got %s, %d frames, %v", format, len(a.Frames), err)
+	}
+	if _, ok := a.Frames[0].(*image.Paletted); !ok {
+		t.Errorf("want the paletted frame kept, got %T", a.Frames[0])
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, newSolidImage(2, 2, red)); err != nil {
+		t.Fatal(err)
+	}
+	if a, format, err = DecodeAnimation(buf.Bytes()); err != nil || format != "png" || a.Animated() {
+		t.Errorf("want a still png, got %s, %v", format, err)
+	}
+}
+
+func TestDecodeImage_FirstGIFFrame(t *testing.T) {
+	for _, disposal := range []byte{gif.DisposalNone, gif.DisposalBackground} {
+		img, format, err := DecodeImage(newAnimatedGIF(t, disposal))
+		if err != nil || format != "gif" {
+			t.Fatalf("decode: %s, %v", format, err)
+		}
+		if b := img.Bounds(); b != image.Rect(0, 0, 4, 4) {
+			t.Fatalf("want the 4×4 canvas, got %v", b)
+		}
+		if got := rgbaAt(img, 3, 3); got != red {
+			t.Errorf("want the first frame only, got %v", got)
+		}
+	}
+
+	// A first frame smaller than the canvas is placed on it
+	g := &gif.GIF{
+		Image:  []*image.Paletted{newFrame(image.Rect(1, 1, 3, 3), green)},
+		Delay:  []int{0},
+		Config: image.Config{ColorModel: testPalette, Width: 4, Height: 4},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := DecodeImage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if b := img.Bounds(); b != image.Rect(0, 0, 4, 4) {
+		t.Fatalf("want the 4×4 canvas, got %v", b)
+	}
+	if rgbaAt(img, 0, 0).A != 0 || rgbaAt(img, 1, 1) != green {
+		t.Errorf("want the frame at its offset on a clear canvas, got %v and %v", rgbaAt(img, 0, 0), rgbaAt(img, 1, 1))
+	}
+}
+
+// ---- Processing -----------------------------------------------------------------
+
+func TestPipeline_ApplyAnimation(t *testing.T) {
+	a, _, err := DecodeAnimation(newAnimatedGIF(t, gif.DisposalNone))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	out, err := NewPipeline(&ResizeOp{Width: 8, Filter: "nearest"}, &InvertOp{}).ApplyAnimation(a)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(out.Frames) != 3 || out.LoopCount != 3 || out.Delays[1] != 20 {
+		t.Fatalf("want 3 frames with their timing, got %d, loop %d, delays %v", len(out.Frames), out.LoopCount, out.Delays)
+	}
+	for i, frame := range out.Frames {
+		if frame.Bounds() != image.Rect(0, 0, 8, 8) {
+			t.Errorf("frame %d: want 8×8, got %v", i, frame.Bounds())
+		}
+	}
+	// Inverted green is magenta
+	if c := rgbaAt(out.Frames[1], 0, 0); c != (color.RGBA{R: 255, B: 255, A: 255}) {
+		t.Errorf("want magenta, got %v", c)
+	}
+}
+
+func TestPipeline_ApplyAnimationFrameStep(t *testing.T) {
+	a, _, err := DecodeAnimation(newAnimatedGIF(t, gif.DisposalNone))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	tests := []struct {
+		index int
+		want  color.RGBA // Bottom-right pixel
+	}{
+		{0, red},
+		{2, blue},
+		{9, blue}, // Past the end: the last frame
+	}
+	for _, tc := range tests {
+		p := NewPipeline(&FrameOp{Index: tc.index}, &ResizeOp{Width: 2, Filter: "nearest"})
+		out, err := p.ApplyAnimation(a)
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if out.Animated() {
+			t.Fatalf("index %d: want a still, got %d frames", tc.index, len(out.Frames))
+		}
+		if c := rgbaAt(out.Frames[0], 1, 1); c != tc.want {
+			t.Errorf("index %d: want %v, got %v", tc.index, tc.want, c)
+		}
+	}
+
+	// On a still the frame step does nothing
+	still := Still(newSolidImage(3, 3, green))
+	if out, err := NewPipeline(&FrameOp{Index: 4}).ApplyAnimation(still); err != nil || rgbaAt(out.Frames[0], 0, 0) != green {
+		t.Errorf("want the still unchanged, got %v", err)
+	}
+}
+
+func TestPipeline_ApplyAnimationError(t *testing.T) {
+	a, _, err := DecodeAnimation(newAnimatedGIF(t, gif.DisposalNone))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	_, err = NewPipeline(&InvertOp{}, &CropOp{X: 10, Width: 1, Height: 1}).ApplyAnimation(a)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Index != 1 || stepErr.Op != "crop" {
+		t.Fatalf("want a crop StepError, got %v", err)
+	}
+	if want := "step 1 (crop): frame 0: crop origin (10,0) is outside the 4x4 image"; err.Error() != want {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+// ---- Encoding -------------------------------------------------------------------
+
+func TestEncodeAnimation_GIF(t *testing.T) {
+	a, _, err := DecodeAnimation(newAnimatedGIF(t, gif.DisposalPrevious))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	data, err := EncodeAnimation(a, GIFEncoder{})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	if len(g.Image) != 3 || g.LoopCount != 3 || g.Delay[0] != 10 || g.Delay[2] != 30 {
+		t.Fatalf("want 3 frames with their timing, got %d, loop %d, delays %v", len(g.Image), g.LoopCount, g.Delay)
+	}
+	if g.Disposal[1] != gif.DisposalPrevious {
+		t.Errorf("want the disposal kept, got %v", g.Disposal)
+	}
+
+	// Decoding the output again gives back the same pictures
+	again, _, err := DecodeAnimation(data)
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	for i := range a.Frames {
+		for _, p := range []image.Point{{0, 0}, {3, 3}} {
+			if want, got := rgbaAt(a.Frames[i], p.X, p.Y), rgbaAt(again.Frames[i], p.X, p.Y); want != got {
+				t.Errorf("frame %d at %v: want %v, got %v", i, p, want, got)
+			}
+		}
+	}
+}
+
+func TestEncodeAnimation_ClearsBeforeTransparentFrames(t *testing.T) {
+	opaque := newSolidImage(2, 2, red)
+	clear := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	a := &Animation{
+		Frames:    []image.Image{opaque, clear, opaque},
+		Delays:    []int{5, 5, 5},
+		Disposals: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalPrevious},
+	}
+	data, err := EncodeAnimation(a, GIFEncoder{})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []byte{gif.DisposalBackground, gif.DisposalNone, gif.DisposalPrevious}
+	if !bytes.Equal(g.Disposal, want) {
+		t.Errorf("want disposals %v, got %v", want, g.Disposal)
+	}
+}
+
+func TestEncodeAnimation_StillFormats(t *testing.T) {
+	a, _, err := DecodeAnimation(newAnimatedGIF(t, gif.DisposalNone))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	data, err := EncodeAnimation(a, PNGEncoder{})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if c := rgbaAt(img, 0, 0); c != red {
+		t.Errorf("want the first frame, got %v", c)
+	}
+}
+
+func TestOutputOptions_Animates(t *testing.T) {
+	tests := []struct {
+		opts        OutputOptions
+		inputFormat string
+		want        bool
+	}{
+		{OutputOptions{Format: FormatGIF}, "png", true},
+		{OutputOptions{Format: FormatAuto}, "gif", true},
+		{OutputOptions{Format: FormatAuto}, "png", false},
+		{OutputOptions{}, "gif", false},
+		{OutputOptions{Format: FormatWebP}, "gif", false},
+	}
+	for _, tc := range tests {
+		if got := tc.opts.Animates(tc.inputFormat); got != tc.want {
+			t.Errorf("%+v from %s: want %v, got %v", tc.opts, tc.inputFormat, tc.want, got)
+		}
+	}
+}
+
+func TestFrameOp_Validate(t *testing.T) {
+	if _, err := ParsePipeline([]byte(`[{"op":"frame","params":{"index":2}},{"op":"resize","params":{"width":10}}]`)); err != nil {
+		t.Errorf("want a valid frame step, got %v", err)
+	}
+	if _, err := ParsePipeline([]byte(`[{"op":"frame","params":{"index":-1}}]`)); err == nil {
+		t.Error("want an error for a negative index")
+	}
+}
@@ -0,0 +1,372 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Blend modes describing how a tint color is combined with the image
+const (
+	BlendNormal   = "normal"   // Mix the tint color over the image
+	BlendMultiply = "multiply" // Multiply the image by the tint, darkening it
+	BlendScreen   = "screen"   // Screen the image with the tint, lightening it
+	BlendOverlay  = "overlay"  // Multiply the shadows and screen the highlights
+)
+
+const (
+	DefaultTintIntensity = 0.3
+	DefaultTintMode      = BlendNormal
+)
+
+// Blend functions keyed by mode. Each combines one channel of the image
+// with the same channel of the tint, both in the 0-1 range.
+var blendModes = map[string]func(base, tint float64) float64{
+	BlendNormal:   func(base, tint float64) float64 { return tint },
+	BlendMultiply: func(base, tint float64) float64 { return base * tint },
+	BlendScreen:   func(base, tint float64) float64 { return 1 - (1-base)*(1-tint) },
+	BlendOverlay: func(base, tint float64) float64 {
+		if base < 0.5 {
+			return 2 * base * tint
+		}
+		return 1 - 2*(1-base)*(1-tint)
+	},
+}
+
+// Rec. 709 luma weights, as used by the CSS filter effects
+const (
+	lumaR = 0.2126
+	lumaG = 0.7152
+	lumaB = 0.0722
+)
+
+// Reports whether v lies in [lo, hi]; NaN never does
+func inRange(v, lo, hi float64) bool {
+	return v >= lo && v <= hi
+}
+
+// Scales a 0-1 channel value to a byte, clamping out-of-range values
+func unitToByte(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+}
+
+// Passes every pixel's color channels through a lookup table, keeping alpha.
+// Channels are non-premultiplied, so transparency does not darken the result.
+func mapChannels(img image.Image, lut *[256]uint8) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		si, di := src.PixOffset(0, y), dst.PixOffset(0, y)
+		for x := 0; x < b.Dx(); x, si, di = x+1, si+4, di+4 {
+			dst.Pix[di] = lut[src.Pix[si]]
+			dst.Pix[di+1] = lut[src.Pix[si+1]]
+			dst.Pix[di+2] = lut[src.Pix[si+2]]
+			dst.Pix[di+3] = src.Pix[si+3]
+		}
+	}
+	return dst
+}
+
+// Builds the lookup table for a per-channel curve over the 0-1 range
+func channelCurve(f func(v float64) float64) *[256]uint8 {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = unitToByte(f(float64(i) / 255))
+	}
+	return &lut
+}
+
+// Replaces every pixel's color with f of it, keeping alpha. Channels are
+// non-premultiplied and in the 0-1 range; results are clamped.
+func mapColors(img image.Image, f func(r, g, b float64) (float64, float64, float64)) *image.NRGBA {
+	src := toNRGBA(img)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		si, di := src.PixOffset(0, y), dst.PixOffset(0, y)
+		for x := 0; x < b.Dx(); x, si, di = x+1, si+4, di+4 {
+			r, g, bl := f(float64(src.Pix[si])/255, float64(src.Pix[si+1])/255, float64(src.Pix[si+2])/255)
+			dst.Pix[di] = unitToByte(r)
+			dst.Pix[di+1] = unitToByte(g)
+			dst.Pix[di+2] = unitToByte(bl)
+			dst.Pix[di+3] = src.Pix[si+3]
+		}
+	}
+	return dst
+}
+
+// Applies a 3×3 color matrix to every pixel
+func mapMatrix(img image.Image, m [9]float64) *image.NRGBA {
+	return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+		return m[0]*r + m[1]*g + m[2]*b,
+			m[3]*r + m[4]*g + m[5]*b,
+			m[6]*r + m[7]*g + m[8]*b
+	})
+}
+
+// Lightens (amount > 0) or darkens (amount < 0) the image by adding
+// amount, from -1 to 1, to every channel
+func AdjustBrightness(img image.Image, amount float64) image.Image {
+	return mapChannels(img, channelCurve(func(v float64) float64 { return v + amount }))
+}
+
+// Stretches (amount > 0) or flattens (amount < 0) the channels around
+// middle gray. An amount of -1 turns the whole image gray.
+func AdjustContrast(img image.Image, amount float64) image.Image {
+	return mapChannels(img, channelCurve(func(v float64) float64 { return (v-0.5)*(1+amount) + 0.5 }))
+}
+
+// Applies a gamma curve; values above 1 brighten the midtones and values
+// below 1 darken them, leaving black and white in place
+func AdjustGamma(img image.Image, gamma float64) image.Image {
+	return mapChannels(img, channelCurve(func(v float64) float64 { return math.Pow(v, 1/gamma) }))
+}
+
+// Inverts every color channel, keeping alpha
+func Invert(img image.Image) image.Image {
+	return mapChannels(img, channelCurve(func(v float64) float64 { return 1 - v }))
+}
+
+// Moves every pixel's color away from (amount > 0) or towards (amount < 0)
+// its luma. An amount of -1 yields a grayscale image.
+func AdjustSaturation(img image.Image, amount float64) image.Image {
+	s := 1 + amount
+	return mapMatrix(img, [9]float64{
+		lumaR + (1-lumaR)*s, lumaG - lumaG*s, lumaB - lumaB*s,
+		lumaR - lumaR*s, lumaG + (1-lumaG)*s, lumaB - lumaB*s,
+		lumaR - lumaR*s, lumaG - lumaG*s, lumaB + (1-lumaB)*s,
+	})
+}
+
+// Rotates every pixel's hue by the given degrees while keeping its luma,
+// using the hue-rotate matrix of the CSS filter effects
+func RotateHue(img image.Image, degrees float64) image.Image {
+	rad := degrees * math.Pi / 180
+	cos, sin := math.Cos(rad), math.Sin(rad)
+	return mapMatrix(img, [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	})
+}
+
+// Replaces every pixel's color with its luma, keeping alpha
+func Grayscale(img image.Image) image.Image {
+	return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+		y := lumaR*r + lumaG*g + lumaB*b
+		return y, y, y
+	})
+}
+
+// Gives the image a sepia tone. Amount, from 0 to 1, mixes between the
+// original and the full effect.
+func Sepia(img image.Image, amount float64) image.Image {
+	k := 1 - amount
+	return mapMatrix(img, [9]float64{
+		0.393 + 0.607*k, 0.769 - 0.769*k, 0.189 - 0.189*k,
+		0.349 - 0.349*k, 0.686 + 0.314*k, 0.168 - 0.168*k,
+		0.272 - 0.272*k, 0.534 - 0.534*k, 0.131 + 0.869*k,
+	})
+}
+
+// Blends the tint color into the image. Mode picks the blend function and
+// intensity, from 0 to 1, how much of its result replaces the original.
+// Unknown modes fall back to normal.
+func TintImage(img image.Image, tintColor color.Color, intensity float64, mode string) image.Image {
+	blend, ok := blendModes[mode]
+	if !ok {
+		blend = blendModes[BlendNormal]
+	}
+	c := color.NRGBAModel.Convert(tintColor).(color.NRGBA)
+	tR, tG, tB := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	mix := func(base, tint float64) float64 {
+		return base*(1-intensity) + blend(base, tint)*intensity
+	}
+	return mapColors(img, func(r, g, b float64) (float64, float64, float64) {
+		return mix(r, tR), mix(g, tG), mix(b, tB)
+	})
+}
+
+// BrightnessOp shifts every channel by Amount, from -1 to 1
+type BrightnessOp struct {
+	Amount float64 `json:"amount"`
+}
+
+func (op *BrightnessOp) Name() string { return "brightness" }
+
+func (op *BrightnessOp) Validate() error {
+	if !inRange(op.Amount, -1, 1) {
+		return fmt.Errorf("amount must be between -1 and 1, got %v", op.Amount)
+	}
+	return nil
+}
+
+func (op *BrightnessOp) Apply(img image.Image) (image.Image, error) {
+	return AdjustBrightness(img, op.Amount), nil
+}
+
+// ContrastOp raises or lowers contrast by Amount, from -1 to 1
+type ContrastOp struct {
+	Amount float64 `json:"amount"`
+}
+
+func (op *ContrastOp) Name() string { return "contrast" }
+
+func (op *ContrastOp) Validate() error {
+	if !inRange(op.Amount, -1, 1) {
+		return fmt.Errorf("amount must be between -1 and 1, got %v", op.Amount)
+	}
+	return nil
+}
+
+func (op *ContrastOp) Apply(img image.Image) (image.Image, error) {
+	return AdjustContrast(img, op.Amount), nil
+}
+
+// SaturationOp raises or lowers saturation by Amount, from -1 to 1
+type SaturationOp struct {
+	Amount float64 `json:"amount"`
+}
+
+func (op *SaturationOp) Name() string { return "saturation" }
+
+func (op *SaturationOp) Validate() error {
+	if !inRange(op.Amount, -1, 1) {
+		return fmt.Errorf("amount must be between -1 and 1, got %v", op.Amount)
+	}
+	return nil
+}
+
+func (op *SaturationOp) Apply(img image.Image) (image.Image, error) {
+	return AdjustSaturation(img, op.Amount), nil
+}
+
+// HueOp rotates every hue by Degrees
+type HueOp struct {
+	Degrees float64 `json:"degrees"`
+}
+
+func (op *HueOp) Name() string { return "hue" }
+
+func (op *HueOp) Validate() error {
+	if !inRange(op.Degrees, -360, 360) {
+		return fmt.Errorf("degrees must be between -360 and 360, got %v", op.Degrees)
+	}
+	return nil
+}
+
+func (op *HueOp) Apply(img image.Image) (image.Image, error) {
+	return RotateHue(img, op.Degrees), nil
+}
+
+// GammaOp applies a gamma curve; Gamma above 1 brightens the midtones
+type GammaOp struct {
+	Gamma float64 `json:"gamma"`
+}
+
+func (op *GammaOp) Name() string { return "gamma" }
+
+func (op *GammaOp) Validate() error {
+	if !inRange(op.Gamma, 0.01, 10) {
+		return fmt.Errorf("gamma must be between 0.01 and 10, got %v", op.Gamma)
+	}
+	return nil
+}
+
+func (op *GammaOp) Apply(img image.Image) (image.Image, error) {
+	return AdjustGamma(img, op.Gamma), nil
+}
+
+// GrayscaleOp removes all color from the image
+type GrayscaleOp struct{}
+
+func (op *GrayscaleOp) Name() string { return "grayscale" }
+
+func (op *GrayscaleOp) Validate() error { return nil }
+
+func (op *GrayscaleOp) Apply(img image.Image) (image.Image, error) {
+	return Grayscale(img), nil
+}
+
+// SepiaOp tones the image sepia. Amount, from 0 to 1, defaults to the
+// full effect when zero.
+type SepiaOp struct {
+	Amount float64 `json:"amount,omitempty"`
+}
+
+func (op *SepiaOp) Name() string { return "sepia" }
+
+func (op *SepiaOp) amount() float64 {
+	if op.Amount == 0 {
+		return 1
+	}
+	return op.Amount
+}
+
+func (op *SepiaOp) Validate() error {
+	if !inRange(op.Amount, 0, 1) {
+		return fmt.Errorf("amount must be between 0 and 1, got %v", op.Amount)
+	}
+	return nil
+}
+
+func (op *SepiaOp) Apply(img image.Image) (image.Image, error) {
+	return Sepia(img, op.amount()), nil
+}
+
+// InvertOp turns the image into its negative
+type InvertOp struct{}
+
+func (op *InvertOp) Name() string { return "invert" }
+
+func (op *InvertOp) Validate() error { return nil }
+
+func (op *InvertOp) Apply(img image.Image) (image.Image, error) {
+	return Invert(img), nil
+}
+
+// TintOp blends the image with a hex color such as "#ff8800"
+type TintOp struct {
+	Color     string  `json:"color"`
+	Intensity float64 `json:"intensity,omitempty"` // 0 to 1, DefaultTintIntensity when zero
+	Mode      string  `json:"mode,omitempty"`      // normal (default), multiply, screen or overlay
+}
+
+func (op *TintOp) Name() string { return "tint" }
+
+func (op *TintOp) intensity() float64 {
+	if op.Intensity == 0 {
+		return DefaultTintIntensity
+	}
+	return op.Intensity
+}
+
+func (op *TintOp) mode() string {
+	if op.Mode == "" {
+		return DefaultTintMode
+	}
+	return op.Mode
+}
+
+func (op *TintOp) Validate() error {
+	if _, err := ParseHexColor(op.Color); err != nil {
+		return fmt.Errorf("invalid color %q", op.Color)
+	}
+	if !inRange(op.Intensity, 0, 1) {
+		return fmt.Errorf("intensity must be between 0 and 1, got %v", op.Intensity)
+	}
+	if _, ok := blendModes[op.mode()]; !ok {
+		return fmt.Errorf("unknown mode %q (want normal, multiply, screen or overlay)", op.Mode)
+	}
+	return nil
+}
+
+func (op *TintOp) Apply(img image.Image) (image.Image, error) {
+	tintColor, err := ParseHexColor(op.Color)
+	if err != nil {
+		return nil, err
+	}
+	return TintImage(img, tintColor, op.intensity(), op.mode()), nil
+}
@@ -0,0 +1,235 @@
+package processor
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata/golden")
+
+// newColorChart draws a deterministic chart covering the color space: red
+// across, green down and blue along the diagonal, with the last column
+// half transparent
+func newColorChart() *image.NRGBA {
+	const w, h = 24, 16
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / (w - 1)),
+				G: uint8(y * 255 / (h - 1)),
+				B: uint8(255 - (x+y)*255/(w+h-2)),
+				A: 255,
+			}
+			if x == w-1 {
+				c.A = 128
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// assertGolden compares img with testdata/golden/<name>.png, allowing each
+// channel to differ by one for floating-point rounding across platforms.
+// With -update the golden image is rewritten instead.
+func assertGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".png")
+	got := toNRGBA(img)
+
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, got); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	defer f.Close()
+	decoded, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+	want := toNRGBA(decoded)
+
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("want bounds %v, got %v", want.Bounds(), got.Bounds())
+	}
+	for i := range want.Pix {
+		if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+			x, y := (i/4)%want.Bounds().Dx(), (i/4)/want.Bounds().Dx()
+			t.Fatalf("pixel (%d,%d) channel %d: want %d, got %d", x, y, i%4, want.Pix[i], got.Pix[i])
+		}
+	}
+}
+
+// ---- Golden images --------------------------------------------------------------
+
+func TestColorOperations_Golden(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Operation
+	}{
+		{"brightness_up", &BrightnessOp{Amount: 0.25}},
+		{"brightness_down", &BrightnessOp{Amount: -0.25}},
+		{"contrast_up", &ContrastOp{Amount: 0.5}},
+		{"contrast_down", &ContrastOp{Amount: -0.5}},
+		{"saturation_up", &SaturationOp{Amount: 0.6}},
+		{"saturation_down", &SaturationOp{Amount: -0.6}},
+		{"hue_120", &HueOp{Degrees: 120}},
+		{"gamma_2_2", &GammaOp{Gamma: 2.2}},
+		{"grayscale", &GrayscaleOp{}},
+		{"sepia", &SepiaOp{}},
+		{"sepia_half", &SepiaOp{Amount: 0.5}},
+		{"invert", &InvertOp{}},
+		{"tint_normal", &TintOp{Color: "#ff8800"}},
+		{"tint_multiply", &TintOp{Color: "#ff8800", Intensity: 1, Mode: BlendMultiply}},
+		{"tint_screen", &TintOp{Color: "#0044ff", Intensity: 0.7, Mode: BlendScreen}},
+		{"tint_overlay", &TintOp{Color: "#00ff88", Intensity: 0.5, Mode: BlendOverlay}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.op.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			out, err := tc.op.Apply(newColorChart())
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			assertGolden(t, tc.name, out)
+		})
+	}
+}
+
+// ---- Color operations -----------------------------------------------------------
+
+func TestColorOperations_Identity(t *testing.T) {
+	src := newColorChart()
+	for _, img := range []image.Image{
+		AdjustBrightness(src, 0),
+		AdjustContrast(src, 0),
+		AdjustSaturation(src, 0),
+		AdjustGamma(src, 1),
+		RotateHue(src, 0),
+		Sepia(src, 0),
+		Invert(Invert(src)),
+		TintImage(src, color.White, 0, BlendNormal),
+	} {
+		got := toNRGBA(img)
+		for i := range src.Pix {
+			if d := int(got.Pix[i]) - int(src.Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("byte %d: want %d, got %d", i, src.Pix[i], got.Pix[i])
+			}
+		}
+	}
+}
+
+func TestColorOperations_KeepAlpha(t *testing.T) {
+	src := newSolidImage(4, 4, color.RGBA{R: 40, G: 80, B: 120, A: 128})
+	for _, img := range []image.Image{
+		AdjustBrightness(src, 0.5),
+		Grayscale(src),
+		Invert(src),
+		TintImage(src, color.White, 1, BlendScreen),
+	} {
+		if _, _, _, a := img.At(1, 1).RGBA(); a>>8 != 128 {
+			t.Errorf("%T: want alpha 128, got %d", img, a>>8)
+		}
+	}
+}
+
+func TestGrayscale_EqualChannels(t *testing.T) {
+	out := toNRGBA(Grayscale(newColorChart()))
+	for i := 0; i < len(out.Pix); i += 4 {
+		if out.Pix[i] != out.Pix[i+1] || out.Pix[i] != out.Pix[i+2] {
+			t.Fatalf("pixel %d is not gray: %v", i/4, out.Pix[i:i+3])
+		}
+	}
+}
+
+func TestAdjustSaturation_MinusOneIsGrayscale(t *testing.T) {
+	got, want := toNRGBA(AdjustSaturation(newColorChart(), -1)), toNRGBA(Grayscale(newColorChart()))
+	for i := range want.Pix {
+		if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+			t.Fatalf("byte %d: want %d, got %d", i, want.Pix[i], got.Pix[i])
+		}
+	}
+}
+
+func TestTintImage_BlendModes(t *testing.T) {
+	gray := newSolidImage(1, 1, color.RGBA{R: 64, G: 64, B: 64, A: 255})
+	orange := color.RGBA{R: 255, G: 128, B: 0, A: 255}
+
+	tests := []struct {
+		mode    string
+		r, g, b uint8
+	}{
+		{BlendNormal, 255, 128, 0},
+		{BlendMultiply, 64, 32, 0},
+		{BlendScreen, 255, 160, 64},
+		{BlendOverlay, 128, 64, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.mode, func(t *testing.T) {
+			c := toNRGBA(TintImage(gray, orange, 1, tc.mode)).NRGBAAt(0, 0)
+			if c.R != tc.r || c.G != tc.g || c.B != tc.b {
+				t.Errorf("want (%d,%d,%d), got (%d,%d,%d)", tc.r, tc.g, tc.b, c.R, c.G, c.B)
+			}
+		})
+	}
+}
+
+// ---- Color operation validation ------------------------------------------------
+
+func TestColorOperations_Validate(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{`{"op":"brightness","params":{"amount":-1}}`, false},
+		{`{"op":"brightness","params":{"amount":1.5}}`, true},
+		{`{"op":"contrast","params":{"amount":1}}`, false},
+		{`{"op":"contrast","params":{"amount":-2}}`, true},
+		{`{"op":"saturation","params":{"amount":0.3}}`, false},
+		{`{"op":"saturation","params":{"level":0.3}}`, true},
+		{`{"op":"hue","params":{"degrees":-90}}`, false},
+		{`{"op":"hue","params":{"degrees":400}}`, true},
+		{`{"op":"gamma","params":{"gamma":0.5}}`, false},
+		{`{"op":"gamma"}`, true},
+		{`{"op":"gamma","params":{"gamma":11}}`, true},
+		{`{"op":"grayscale"}`, false},
+		{`{"op":"grayscale","params":{"amount":1}}`, true},
+		{`{"op":"sepia"}`, false},
+		{`{"op":"sepia","params":{"amount":1.2}}`, true},
+		{`{"op":"invert"}`, false},
+		{`{"op":"tint","params":{"color":"#ff0000","intensity":0.8,"mode":"overlay"}}`, false},
+		{`{"op":"tint","params":{"color":"#ff0000","intensity":-0.1}}`, true},
+		{`{"op":"tint","params":{"color":"#ff0000","mode":"dodge"}}`, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.spec, func(t *testing.T) {
+			_, err := ParsePipeline([]byte(fmt.Sprintf("[%s]", tc.spec)))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
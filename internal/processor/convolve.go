@@ -0,0 +1,461 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Limits on filter parameters, keeping kernels small enough to run in
+// well under a second on a 12 megapixel image
+const (
+	MaxBlurSigma     = 20.0
+	MaxBoxBlurRadius = 50
+	MaxSharpenAmount = 10.0
+)
+
+const (
+	DefaultSharpenAmount = 1.0
+	DefaultUnsharpAmount = 1.0
+	DefaultUnsharpRadius = 1.0
+)
+
+// Runs fn over the rows [0, h) split into one contiguous band per CPU
+func parallelRows(h int, fn func(y0, y1 int)) {
+	workers := min(runtime.GOMAXPROCS(0), h)
+	if workers <= 1 {
+		fn(0, h)
+		return
+	}
+	band := (h + workers - 1) / workers
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < h; y0 += band {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+band, h))
+	}
+	wg.Wait()
+}
+
+// Fixed-point scale of separable kernel weights
+const kernelShift = 14
+
+// Converts normalized weights to fixed point, putting any rounding error
+// on the center tap so the weights still sum to exactly one
+func fixedKernel(weights []float64) []int32 {
+	k := make([]int32, len(weights))
+	var sum int32
+	for i, w := range weights {
+		k[i] = int32(math.Round(w * (1 << kernelShift)))
+		sum += k[i]
+	}
+	k[len(k)/2] += 1<<kernelShift - sum
+	return k
+}
+
+// Returns a normalized Gaussian kernel reaching three sigmas either side
+func gaussianKernel(sigma float64) []int32 {
+	radius := max(1, int(math.Ceil(3*sigma)))
+	weights := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range weights {
+		d := float64(i - radius)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= sum
+	}
+	return fixedKernel(weights)
+}
+
+// Returns a kernel averaging radius pixels either side
+func boxKernel(radius int) []int32 {
+	weights := make([]float64, 2*radius+1)
+	for i := range weights {
+		weights[i] = 1 / float64(len(weights))
+	}
+	return fixedKernel(weights)
+}
+
+// Rounds and clamps a channel value to a byte
+func roundByte(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// Rounds a fixed-point sum of a non-negative kernel back to a byte
+func fixedByte(v int32) uint8 {
+	return uint8(min((v+1<<(kernelShift-1))>>kernelShift, 255))
+}
+
+// Sets acc to the fixed-point sum of a symmetric kernel over a line of
+// channel values. tap(d) returns the values d pixels from each output
+// position, for d from -radius to radius, aligned with acc.
+func convolveLine(acc []int32, k []int32, tap func(d int) []uint8) {
+	radius := len(k) / 2
+	for j, v := range tap(0)[:len(acc)] {
+		acc[j] = k[radius] * int32(v)
+	}
+	// Taps the same distance from the center share a multiply, and two
+	// distances are summed per sweep to halve the traffic through acc
+	d := 1
+	for ; d < radius; d += 2 {
+		k1, k2 := k[radius+d], k[radius+d+1]
+		b1, a1 := tap(-d)[:len(acc)], tap(d)[:len(acc)]
+		b2, a2 := tap(-d - 1)[:len(acc)], tap(d + 1)[:len(acc)]
+		for j := range acc {
+			acc[j] += k1*(int32(b1[j])+int32(a1[j])) + k2*(int32(b2[j])+int32(a2[j]))
+		}
+	}
+	if d == radius {
+		kw := k[radius+d]
+		before, after := tap(-d)[:len(acc)], tap(d)[:len(acc)]
+		for j := range acc {
+			acc[j] += kw * (int32(before[j]) + int32(after[j]))
+		}
+	}
+}
+
+// Convolves all four channels of a premultiplied image with a symmetric,
+// non-negative kernel along rows and then along columns. Edge pixels are
+// repeated outward.
+func convolveSeparable(src *image.RGBA, k []int32) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	radius := len(k) / 2
+	tmp := image.NewRGBA(image.Rect(0, 0, w, h))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == 0 || h == 0 {
+		return dst
+	}
+
+	// Rows: pad each row with its edge pixels, then slide the kernel along it
+	parallelRows(h, func(y0, y1 int) {
+		padded := make([]uint8, (w+2*radius)*4)
+		acc := make([]int32, w*4)
+		for y := y0; y < y1; y++ {
+			padRow(padded, src.Pix[y*src.Stride:][:w*4], radius)
+			convolveLine(acc, k, func(d int) []uint8 { return padded[(radius+d)*4:] })
+			storeFixed(tmp.Pix[y*tmp.Stride:][:w*4], acc)
+		}
+	})
+
+	// Columns: the same, a whole row of output at a time
+	parallelRows(h, func(y0, y1 int) {
+		acc := make([]int32, w*4)
+		for y := y0; y < y1; y++ {
+			convolveLine(acc, k, func(d int) []uint8 {
+				return tmp.Pix[min(max(y+d, 0), h-1)*tmp.Stride:]
+			})
+			storeFixed(dst.Pix[y*dst.Stride:][:w*4], acc)
+		}
+	})
+	return dst
+}
+
+// Copies a row of pixels into the middle of padded, repeating its first
+// and last pixels radius times on either side
+func padRow(padded, row []uint8, radius int) {
+	copy(padded[radius*4:], row)
+	for x := 0; x < radius; x++ {
+		copy(padded[x*4:x*4+4], row[:4])
+		copy(padded[len(padded)-(x+1)*4:], row[len(row)-4:])
+	}
+}
+
+// Rounds fixed-point sums back to channel values
+func storeFixed(out []uint8, acc []int32) {
+	for j, v := range acc[:len(out)] {
+		out[j] = fixedByte(v)
+	}
+}
+
+// Convolves a premultiplied image with a 3×3 kernel, given row by row.
+// Color channels are kept within alpha so the result stays premultiplied.
+func convolve3x3(src *image.RGBA, k [9]float32) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == 0 || h == 0 {
+		return dst
+	}
+	parallelRows(h, func(y0, y1 int) {
+		var padded [3][]uint8
+		for i := range padded {
+			padded[i] = make([]uint8, (w+2)*4)
+		}
+		acc := make([]float32, w*4)
+		for y := y0; y < y1; y++ {
+			for i := range padded {
+				sy := min(max(y+i-1, 0), h-1)
+				padRow(padded[i], src.Pix[sy*src.Stride:][:w*4], 1)
+			}
+			clear(acc)
+			for i, kw := range k {
+				if kw == 0 {
+					continue
+				}
+				line := padded[i/3][i%3*4:][:len(acc)]
+				for j := range acc {
+					acc[j] += kw * float32(line[j])
+				}
+			}
+			out := dst.Pix[y*dst.Stride:][:len(acc)]
+			for i := 0; i+3 < len(acc); i += 4 {
+				a := roundByte(acc[i+3])
+				out[i] = min(roundByte(acc[i]), a)
+				out[i+1] = min(roundByte(acc[i+1]), a)
+				out[i+2] = min(roundByte(acc[i+2]), a)
+				out[i+3] = a
+			}
+		}
+	})
+	return dst
+}
+
+// Blurs the image with a Gaussian of the given standard deviation in pixels
+func GaussianBlur(img image.Image, sigma float64) image.Image {
+	if sigma <= 0 {
+		return img
+	}
+	return convolveSeparable(toRGBA(img), gaussianKernel(sigma))
+}
+
+// Replaces every pixel with the mean of the square reaching radius pixels
+// around it
+func BoxBlur(img image.Image, radius int) image.Image {
+	if radius <= 0 {
+		return img
+	}
+	return convolveSeparable(toRGBA(img), boxKernel(radius))
+}
+
+// Sharpens fine detail with a 3×3 Laplacian kernel scaled by amount
+func Sharpen(img image.Image, amount float64) image.Image {
+	a := float32(amount)
+	return convolve3x3(toRGBA(img), [9]float32{
+		0, -a, 0,
+		-a, 1 + 4*a, -a,
+		0, -a, 0,
+	})
+}
+
+// Raises the surface of the image as if lit from the top left
+func Emboss(img image.Image) image.Image {
+	return convolve3x3(toRGBA(img), [9]float32{
+		-2, -1, 0,
+		-1, 1, 1,
+		0, 1, 2,
+	})
+}
+
+// Sharpens by adding back amount times the difference between the image
+// and its Gaussian blur of the given radius. Differences smaller than
+// threshold (0-255) are left alone, so flat areas and noise stay smooth.
+func UnsharpMask(img image.Image, amount, radius float64, threshold int) image.Image {
+	src := toRGBA(img)
+	blurred := convolveSeparable(src, gaussianKernel(radius))
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	amt, limit := float32(amount), float32(threshold)
+
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in := src.Pix[y*src.Stride:][:w*4]
+			soft := blurred.Pix[y*blurred.Stride:][:len(in)]
+			out := dst.Pix[y*dst.Stride:][:len(in)]
+			for i := 0; i+3 < len(in); i += 4 {
+				a := in[i+3]
+				for c := i; c < i+3; c++ {
+					v := float32(in[c])
+					diff := v - float32(soft[c])
+					if diff >= limit || -diff >= limit {
+						v += amt * diff
+					}
+					out[c] = min(roundByte(v), a)
+				}
+				out[i+3] = a
+			}
+		}
+	})
+	return dst
+}
+
+// Detects edges with the Sobel operator and returns their strength as a
+// grayscale image. The operator is separable: a derivative along one
+// axis combined with smoothing along the other.
+func DetectEdges(img image.Image) image.Image {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	luma := make([]float32, w*h)
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				p := src.Pix[src.PixOffset(x, y):]
+				luma[y*w+x] = lumaR*float32(p[0]) + lumaG*float32(p[1]) + lumaB*float32(p[2])
+			}
+		}
+	})
+
+	// Rows: the horizontal derivative and the horizontal smoothing
+	diff := make([]float32, w*h)
+	smooth := make([]float32, w*h)
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := luma[y*w : (y+1)*w]
+			for x := 0; x < w; x++ {
+				l, c, r := row[max(x-1, 0)], row[x], row[min(x+1, w-1)]
+				diff[y*w+x] = r - l
+				smooth[y*w+x] = l + 2*c + r
+			}
+		}
+	})
+
+	// Columns: smooth the derivative and differentiate the smoothing
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			up, down := max(y-1, 0)*w, min(y+1, h-1)*w
+			for x := 0; x < w; x++ {
+				gx := diff[up+x] + 2*diff[y*w+x] + diff[down+x]
+				gy := smooth[down+x] - smooth[up+x]
+				// Scaled so a full black to white step reads as white
+				dst.Pix[y*dst.Stride+x] = roundByte(float32(math.Sqrt(float64(gx*gx+gy*gy))) / 4)
+			}
+		}
+	})
+	return dst
+}
+
+// BlurOp applies a Gaussian blur of Sigma pixels
+type BlurOp struct {
+	Sigma float64 `json:"sigma"`
+}
+
+func (op *BlurOp) Name() string { return "blur" }
+
+func (op *BlurOp) Validate() error {
+	if !(op.Sigma > 0 && op.Sigma <= MaxBlurSigma) {
+		return fmt.Errorf("sigma must be greater than 0 and at most %v, got %v", MaxBlurSigma, op.Sigma)
+	}
+	return nil
+}
+
+func (op *BlurOp) Apply(img image.Image) (image.Image, error) {
+	return GaussianBlur(img, op.Sigma), nil
+}
+
+// BoxBlurOp averages each pixel with Radius pixels around it
+type BoxBlurOp struct {
+	Radius int `json:"radius"`
+}
+
+func (op *BoxBlurOp) Name() string { return "box_blur" }
+
+func (op *BoxBlurOp) Validate() error {
+	if op.Radius < 1 || op.Radius > MaxBoxBlurRadius {
+		return fmt.Errorf("radius must be between 1 and %d, got %d", MaxBoxBlurRadius, op.Radius)
+	}
+	return nil
+}
+
+func (op *BoxBlurOp) Apply(img image.Image) (image.Image, error) {
+	return BoxBlur(img, op.Radius), nil
+}
+
+// SharpenOp sharpens fine detail; Amount defaults to DefaultSharpenAmount
+type SharpenOp struct {
+	Amount float64 `json:"amount,omitempty"`
+}
+
+func (op *SharpenOp) Name() string { return "sharpen" }
+
+func (op *SharpenOp) amount() float64 {
+	if op.Amount == 0 {
+		return DefaultSharpenAmount
+	}
+	return op.Amount
+}
+
+func (op *SharpenOp) Validate() error {
+	if !inRange(op.Amount, 0, MaxSharpenAmount) {
+		return fmt.Errorf("amount must be between 0 and %v, got %v", MaxSharpenAmount, op.Amount)
+	}
+	return nil
+}
+
+func (op *SharpenOp) Apply(img image.Image) (image.Image, error) {
+	return Sharpen(img, op.amount()), nil
+}
+
+// UnsharpMaskOp sharpens edges wider than a pixel. Zero Amount and Radius
+// take their defaults; Threshold is 0 to 255.
+type UnsharpMaskOp struct {
+	Amount    float64 `json:"amount,omitempty"`
+	Radius    float64 `json:"radius,omitempty"`
+	Threshold int     `json:"threshold,omitempty"`
+}
+
+func (op *UnsharpMaskOp) Name() string { return "unsharp" }
+
+func (op *UnsharpMaskOp) amount() float64 {
+	if op.Amount == 0 {
+		return DefaultUnsharpAmount
+	}
+	return op.Amount
+}
+
+func (op *UnsharpMaskOp) radius() float64 {
+	if op.Radius == 0 {
+		return DefaultUnsharpRadius
+	}
+	return op.Radius
+}
+
+func (op *UnsharpMaskOp) Validate() error {
+	if !inRange(op.Amount, 0, MaxSharpenAmount) {
+		return fmt.Errorf("amount must be between 0 and %v, got %v", MaxSharpenAmount, op.Amount)
+	}
+	if !inRange(op.Radius, 0, MaxBlurSigma) {
+		return fmt.Errorf("radius must be between 0 and %v, got %v", MaxBlurSigma, op.Radius)
+	}
+	if op.Threshold < 0 || op.Threshold > 255 {
+		return fmt.Errorf("threshold must be between 0 and 255, got %d", op.Threshold)
+	}
+	return nil
+}
+
+func (op *UnsharpMaskOp) Apply(img image.Image) (image.Image, error) {
+	return UnsharpMask(img, op.amount(), op.radius(), op.Threshold), nil
+}
+
+// EmbossOp gives the image a raised, lit-from-the-top-left look
+type EmbossOp struct{}
+
+func (op *EmbossOp) Name() string { return "emboss" }
+
+func (op *EmbossOp) Validate() error { return nil }
+
+func (op *EmbossOp) Apply(img image.Image) (image.Image, error) {
+	return Emboss(img), nil
+}
+
+// EdgesOp replaces the image with the strength of its edges
+type EdgesOp struct{}
+
+func (op *EdgesOp) Name() string { return "edges" }
+
+func (op *EdgesOp) Validate() error { return nil }
+
+func (op *EdgesOp) Apply(img image.Image) (image.Image, error) {
+	return DetectEdges(img), nil
+}
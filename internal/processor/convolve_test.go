@@ -0,0 +1,241 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// newEdgeImage returns a w×h image, black on the left half and white on the right
+func newEdgeImage(w, h int) *image.RGBA {
+	img := newSolidImage(w, h, color.RGBA{A: 255})
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+		}
+	}
+	return img
+}
+
+// ---- Golden images --------------------------------------------------------------
+
+func TestConvolutionOperations_Golden(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Operation
+	}{
+		{"blur_1_5", &BlurOp{Sigma: 1.5}},
+		{"box_blur_2", &BoxBlurOp{Radius: 2}},
+		{"sharpen", &SharpenOp{}},
+		{"unsharp", &UnsharpMaskOp{Amount: 1.5, Radius: 2, Threshold: 4}},
+		{"emboss", &EmbossOp{}},
+		{"edges", &EdgesOp{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.op.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			out, err := tc.op.Apply(newColorChart())
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			assertGolden(t, tc.name, out)
+		})
+	}
+}
+
+// ---- Kernels --------------------------------------------------------------------
+
+func TestKernels_Normalized(t *testing.T) {
+	for _, k := range [][]int32{gaussianKernel(0.5), gaussianKernel(3), boxKernel(1), boxKernel(7)} {
+		var sum int32
+		for _, w := range k {
+			sum += w
+		}
+		if len(k)%2 != 1 || sum != 1<<kernelShift {
+			t.Errorf("kernel of %d taps sums to %v", len(k), sum)
+		}
+	}
+	if k := gaussianKernel(2); len(k) != 13 || k[6] <= k[5] || k[0] != k[12] {
+		t.Errorf("want a symmetric 13-tap kernel peaking in the middle, got %v", k)
+	}
+}
+
+func TestParallelRows_CoversEveryRowOnce(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	for _, h := range []int{1, 3, 4, 97} {
+		seen := make([]int32, h)
+		parallelRows(h, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				atomic.AddInt32(&seen[y], 1)
+			}
+		})
+		for y, n := range seen {
+			if n != 1 {
+				t.Errorf("h=%d: row %d visited %d times", h, y, n)
+			}
+		}
+	}
+}
+
+// ---- Filters --------------------------------------------------------------------
+
+func TestFilters_KeepSolidImages(t *testing.T) {
+	c := color.RGBA{R: 90, G: 160, B: 30, A: 255}
+	src := newSolidImage(20, 12, c)
+	for name, img := range map[string]image.Image{
+		"blur":     GaussianBlur(src, 3),
+		"box_blur": BoxBlur(src, 4),
+		"sharpen":  Sharpen(src, 2),
+		"unsharp":  UnsharpMask(src, 2, 2, 0),
+	} {
+		if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 12 {
+			t.Errorf("%s: want 20×12, got %d×%d", name, b.Dx(), b.Dy())
+		}
+		// Edges are extended, so the borders do not darken
+		for _, p := range []image.Point{{0, 0}, {19, 11}, {10, 6}} {
+			if got := color.RGBAModel.Convert(img.At(p.X, p.Y)); got != c {
+				t.Errorf("%s at %v: want %v, got %v", name, p, c, got)
+			}
+		}
+	}
+}
+
+func TestFilters_EmptyImage(t *testing.T) {
+	empty := image.NewRGBA(image.Rect(0, 0, 0, 5))
+	for _, img := range []image.Image{GaussianBlur(empty, 1), Sharpen(empty, 1), UnsharpMask(empty, 1, 1, 0), DetectEdges(empty)} {
+		if !img.Bounds().Empty() {
+			t.Errorf("want an empty image, got %v", img.Bounds())
+		}
+	}
+}
+
+func TestGaussianBlur_NonZeroOrigin(t *testing.T) {
+	src := newEdgeImage(40, 10).SubImage(image.Rect(10, 2, 30, 8))
+	out := GaussianBlur(src, 1)
+	if b := out.Bounds(); b != image.Rect(0, 0, 20, 6) {
+		t.Fatalf("want bounds (0,0)-(20,6), got %v", b)
+	}
+	// The step sits in the middle of the sub-image and is softened
+	r, _, _, _ := out.At(9, 3).RGBA()
+	if r>>8 == 0 || r>>8 == 255 {
+		t.Errorf("want a gray pixel next to the step, got %d", r>>8)
+	}
+}
+
+func TestGaussianBlur_TransparentPixelsDoNotBleed(t *testing.T) {
+	// Opaque red next to transparent green: the blur must not turn the red green
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 1))
+	for x := 0; x < 10; x++ {
+		if x < 5 {
+			src.SetNRGBA(x, 0, color.NRGBA{R: 255, A: 255})
+		} else {
+			src.SetNRGBA(x, 0, color.NRGBA{G: 255, A: 0})
+		}
+	}
+	c := color.NRGBAModel.Convert(GaussianBlur(src, 1).At(5, 0)).(color.NRGBA)
+	if c.A == 0 || c.G > 1 || c.R < 250 {
+		t.Errorf("want a partly transparent red, got %v", c)
+	}
+}
+
+func TestSharpen_IncreasesEdgeContrast(t *testing.T) {
+	out := Sharpen(newEdgeImage(10, 3), 1)
+	dark, _, _, _ := out.At(4, 1).RGBA()
+	light, _, _, _ := out.At(5, 1).RGBA()
+	if dark != 0 || light>>8 != 255 {
+		t.Errorf("want clipped black and white at the step, got %d and %d", dark>>8, light>>8)
+	}
+}
+
+func TestUnsharpMask_Threshold(t *testing.T) {
+	// A faint step of 4 levels is below a threshold of 10 and left alone
+	src := newSolidImage(10, 3, color.RGBA{R: 100, G: 100, B: 100, A: 255})
+	for y := 0; y < 3; y++ {
+		for x := 5; x < 10; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: 104, G: 104, B: 104, A: 255})
+		}
+	}
+	if r, _, _, _ := UnsharpMask(src, 2, 1, 10).At(4, 1).RGBA(); r>>8 != 100 {
+		t.Errorf("want 100 below the threshold, got %d", r>>8)
+	}
+	if r, _, _, _ := UnsharpMask(src, 2, 1, 0).At(4, 1).RGBA(); r>>8 >= 100 {
+		t.Errorf("want the dark side darkened without a threshold, got %d", r>>8)
+	}
+}
+
+func TestDetectEdges(t *testing.T) {
+	out := DetectEdges(newEdgeImage(10, 4)).(*image.Gray)
+	if v := out.GrayAt(4, 2).Y; v != 255 {
+		t.Errorf("want a full-strength edge at the step, got %d", v)
+	}
+	if v := out.GrayAt(1, 2).Y; v != 0 {
+		t.Errorf("want no edge in the flat area, got %d", v)
+	}
+}
+
+// ---- Convolution operation validation -----------------------------------------
+
+func TestConvolutionOperations_Validate(t *testing.T) {
+	tests := []struct {
+		op      Operation
+		wantErr bool
+	}{
+		{&BlurOp{Sigma: 0.5}, false},
+		{&BlurOp{}, true},
+		{&BlurOp{Sigma: MaxBlurSigma + 1}, true},
+		{&BoxBlurOp{Radius: 3}, false},
+		{&BoxBlurOp{}, true},
+		{&BoxBlurOp{Radius: MaxBoxBlurRadius + 1}, true},
+		{&SharpenOp{}, false},
+		{&SharpenOp{Amount: -1}, true},
+		{&UnsharpMaskOp{}, false},
+		{&UnsharpMaskOp{Radius: -1}, true},
+		{&UnsharpMaskOp{Threshold: 256}, true},
+		{&UnsharpMaskOp{Amount: MaxSharpenAmount + 1}, true},
+	}
+	for _, tc := range tests {
+		if err := tc.op.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: want error %v, got %v", tc.op, tc.wantErr, err)
+		}
+	}
+}
+
+// ---- Benchmarks -----------------------------------------------------------------
+
+// A 12 megapixel photo
+func newBenchmarkImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 4000, 3000))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	return img
+}
+
+func BenchmarkGaussianBlur_12MP(b *testing.B) {
+	img := newBenchmarkImage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GaussianBlur(img, 2)
+	}
+}
+
+func BenchmarkUnsharpMask_12MP(b *testing.B) {
+	img := newBenchmarkImage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		UnsharpMask(img, 1, 1, 0)
+	}
+}
+
+func BenchmarkDetectEdges_12MP(b *testing.B) {
+	img := newBenchmarkImage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DetectEdges(img)
+	}
+}
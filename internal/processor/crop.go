@@ -0,0 +1,268 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GravityAttention places a region on the most detailed part of the image
+const GravityAttention = "attention"
+
+// Units of the crop region
+const (
+	CropUnitPixels  = "px"
+	CropUnitPercent = "percent"
+)
+
+const MaxCropAspect = 100 // Longest side over shortest side of an aspect ratio
+
+// The attention crop is chosen on a copy scaled down to attentionSize on
+// the longer side, measuring entropy over attentionBins luminance levels
+const (
+	attentionSize = 128
+	attentionBins = 16
+)
+
+// Reports whether g names one of the nine gravities
+func isGravity(g string) bool {
+	switch g {
+	case GravityCenter, GravityNorth, GravitySouth, GravityEast, GravityWest,
+		GravityNorthEast, GravityNorthWest, GravitySouthEast, GravitySouthWest:
+		return true
+	}
+	return false
+}
+
+// Checks a gravity that places a region, which may also be attention
+func validateRegionGravity(g string) error {
+	if g != GravityAttention && !isGravity(g) {
+		return fmt.Errorf("unknown gravity %q (want center, north, south, east, west, northeast, northwest, southeast, southwest or attention)", g)
+	}
+	return nil
+}
+
+// Parses an aspect ratio such as "16:9" into its width and height terms
+func parseAspect(s string) (float64, float64, error) {
+	invalid := fmt.Errorf("invalid aspect %q (want width:height, e.g. 16:9)", s)
+	ws, hs, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, invalid
+	}
+	w, errW := strconv.ParseFloat(ws, 64)
+	h, errH := strconv.ParseFloat(hs, 64)
+	if errW != nil || errH != nil || !(w > 0) || !(h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, 0, invalid
+	}
+	if ratio := w / h; ratio > MaxCropAspect || ratio < 1.0/MaxCropAspect {
+		return 0, 0, fmt.Errorf("aspect %q must be at most %d:1 either way", s, MaxCropAspect)
+	}
+	return w, h, nil
+}
+
+// Returns the size of the largest region with the aspect ratio aw:ah that
+// fits in a w×h image
+func aspectSize(w, h int, aw, ah float64) (int, int) {
+	if float64(w)*ah <= float64(h)*aw {
+		return w, min(h, max(1, int(math.Round(float64(w)*ah/aw))))
+	}
+	return min(w, max(1, int(math.Round(float64(h)*aw/ah)))), h
+}
+
+// Returns where a w×h region goes on img: placed by gravity, or on the most
+// detailed part of the image for GravityAttention. The region must fit.
+func placeRegion(img image.Image, w, h int, gravity string) image.Rectangle {
+	var at image.Point
+	if gravity == GravityAttention {
+		at = attentionPoint(img, w, h)
+	} else {
+		at = gravityPoint(img.Bounds(), w, h, 0, gravity)
+	}
+	return image.Rectangle{Min: at, Max: at.Add(image.Pt(w, h))}
+}
+
+// Returns the top-left corner of the w×h window of img with the most
+// detail. Each window is scored by its mean edge strength, from a Sobel
+// filter, weighted by the entropy of its luminance histogram, so busy
+// subjects win over both flat backgrounds and smooth gradients. Ties go to
+// the window nearest the center.
+func attentionPoint(img image.Image, w, h int) image.Point {
+	b := img.Bounds()
+	if w >= b.Dx() && h >= b.Dy() {
+		return b.Min
+	}
+
+	// Score windows on a small copy; summed-area tables give the edge
+	// total and histogram of any window in constant time
+	small := img
+	if longer := max(b.Dx(), b.Dy()); longer > attentionSize {
+		scale := float64(attentionSize) / float64(longer)
+		small = ResizeImageWith(img, ResizeOptions{
+			Width:  max(1, int(math.Round(float64(b.Dx())*scale))),
+			Height: max(1, int(math.Round(float64(b.Dy())*scale))),
+			Filter: "bilinear",
+			Fit:    FitFill,
+		})
+	}
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	sx, sy := float64(sw)/float64(b.Dx()), float64(sh)/float64(b.Dy())
+	ww := min(sw, max(1, int(math.Round(float64(w)*sx))))
+	wh := min(sh, max(1, int(math.Round(float64(h)*sy))))
+
+	edges := DetectEdges(small).(*image.Gray)
+	src := toNRGBA(small)
+	stride := sw + 1
+	edgeSum := make([]int32, stride*(sh+1))
+	binSum := make([][]int32, attentionBins)
+	for k := range binSum {
+		binSum[k] = make([]int32, stride*(sh+1))
+	}
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			i := (y+1)*stride + x + 1
+			edgeSum[i] = int32(edges.Pix[y*edges.Stride+x]) + edgeSum[i-1] + edgeSum[i-stride] - edgeSum[i-stride-1]
+
+			p := src.Pix[src.PixOffset(x, y):]
+			luma := (lumaR*float32(p[0]) + lumaG*float32(p[1]) + lumaB*float32(p[2])) * float32(p[3]) / 255
+			bin := min(attentionBins-1, int(luma)*attentionBins/256)
+			for k, sum := range binSum {
+				sum[i] = sum[i-1] + sum[i-stride] - sum[i-stride-1]
+				if k == bin {
+					sum[i]++
+				}
+			}
+		}
+	}
+	area := func(sum []int32, x, y int) float64 {
+		return float64(sum[(y+wh)*stride+x+ww] - sum[y*stride+x+ww] - sum[(y+wh)*stride+x] + sum[y*stride+x])
+	}
+
+	n := float64(ww * wh)
+	cx, cy := float64(sw-ww)/2, float64(sh-wh)/2
+	best, bestScore, bestDist := image.Point{}, -1.0, math.Inf(1)
+	for y := 0; y <= sh-wh; y++ {
+		for x := 0; x <= sw-ww; x++ {
+			var entropy float64
+			for _, sum := range binSum {
+				if c := area(sum, x, y); c > 0 {
+					entropy -= c / n * math.Log2(c/n)
+				}
+			}
+			score := area(edgeSum, x, y) / (n * 255) * entropy / math.Log2(attentionBins)
+			dist := (float64(x)-cx)*(float64(x)-cx) + (float64(y)-cy)*(float64(y)-cy)
+			if score > bestScore+1e-9 || (score > bestScore-1e-9 && dist < bestDist) {
+				best, bestScore, bestDist = image.Pt(x, y), score, dist
+			}
+		}
+	}
+
+	// Map the window back onto the full image
+	x := min(b.Max.X-w, b.Min.X+int(math.Round(float64(best.X)/sx)))
+	y := min(b.Max.Y-h, b.Min.Y+int(math.Round(float64(best.Y)/sy)))
+	return image.Pt(max(b.Min.X, x), max(b.Min.Y, y))
+}
+
+// CropOp cuts out a region of the image, given one of three ways:
+//   - X, Y, Width and Height, in pixels or, with Unit percent, in percent
+//     of the image, so the region survives an earlier resize
+//   - Width and Height placed by Gravity
+//   - Aspect, the largest region of that ratio, placed by Gravity
+//
+// GravityAttention places the region on the most detailed part of the image.
+type CropOp struct {
+	X       float64 `json:"x,omitempty"`
+	Y       float64 `json:"y,omitempty"`
+	Width   float64 `json:"width,omitempty"`
+	Height  float64 `json:"height,omitempty"`
+	Unit    string  `json:"unit,omitempty"`    // px (default) or percent
+	Aspect  string  `json:"aspect,omitempty"`  // Width to height ratio such as 16:9
+	Gravity string  `json:"gravity,omitempty"` // center (default), a side, a corner or attention
+}
+
+func (op *CropOp) Name() string { return "crop" }
+
+func (op *CropOp) gravity() string {
+	if op.Gravity == "" {
+		return GravityCenter
+	}
+	return op.Gravity
+}
+
+func (op *CropOp) Validate() error {
+	switch op.Unit {
+	case "", CropUnitPixels, CropUnitPercent:
+	default:
+		return fmt.Errorf("unknown unit %q (want px or percent)", op.Unit)
+	}
+	if err := validateRegionGravity(op.gravity()); err != nil {
+		return err
+	}
+
+	if op.Aspect != "" {
+		if op.X != 0 || op.Y != 0 || op.Width != 0 || op.Height != 0 || op.Unit != "" {
+			return errors.New("x, y, width, height and unit cannot be combined with aspect")
+		}
+		_, _, err := parseAspect(op.Aspect)
+		return err
+	}
+
+	if op.Gravity != "" && (op.X != 0 || op.Y != 0) {
+		return errors.New("x and y cannot be combined with gravity")
+	}
+	if op.X < 0 || op.Y < 0 {
+		return errors.New("x and y must not be negative")
+	}
+	if !(op.Width > 0) || !(op.Height > 0) {
+		return errors.New("width and height must be positive")
+	}
+	if op.Unit == CropUnitPercent {
+		if op.X > 100 || op.Y > 100 || op.Width > 100 || op.Height > 100 {
+			return errors.New("percentages must be at most 100")
+		}
+	} else if op.X != math.Trunc(op.X) || op.Y != math.Trunc(op.Y) ||
+		op.Width != math.Trunc(op.Width) || op.Height != math.Trunc(op.Height) {
+		return errors.New("pixel values must be whole numbers")
+	}
+	return nil
+}
+
+func (op *CropOp) Apply(img image.Image) (image.Image, error) {
+	b := img.Bounds()
+	if op.Aspect != "" {
+		if b.Empty() {
+			return img, nil
+		}
+		aw, ah, err := parseAspect(op.Aspect)
+		if err != nil {
+			return nil, err
+		}
+		w, h := aspectSize(b.Dx(), b.Dy(), aw, ah)
+		r := placeRegion(img, w, h, op.gravity())
+		return CropImage(img, r.Min.X, r.Min.Y, w, h), nil
+	}
+
+	x, y, w, h := int(op.X), int(op.Y), int(op.Width), int(op.Height)
+	if op.Unit == CropUnitPercent {
+		x = int(math.Round(op.X * float64(b.Dx()) / 100))
+		y = int(math.Round(op.Y * float64(b.Dy()) / 100))
+		w = max(1, int(math.Round(op.Width*float64(b.Dx())/100)))
+		h = max(1, int(math.Round(op.Height*float64(b.Dy())/100)))
+	}
+
+	if op.Gravity != "" {
+		if b.Empty() {
+			return img, nil
+		}
+		w, h = min(w, b.Dx()), min(h, b.Dy())
+		r := placeRegion(img, w, h, op.Gravity)
+		return CropImage(img, r.Min.X, r.Min.Y, w, h), nil
+	}
+
+	if b.Min.X+x >= b.Max.X || b.Min.Y+y >= b.Max.Y {
+		return nil, fmt.Errorf("crop origin (%d,%d) is outside the %dx%d image", x, y, b.Dx(), b.Dy())
+	}
+	return CropImage(img, b.Min.X+x, b.Min.Y+y, w, h), nil
+}
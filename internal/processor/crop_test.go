@@ -0,0 +1,255 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// newCoordImage returns a w×h image whose pixels record their own position:
+// red is x and green is y
+func newCoordImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	return img
+}
+
+// newBusyImage returns a w×h flat gray image with random noise in the given
+// region, standing in for a subject on a plain background
+func newBusyImage(w, h int, subject image.Rectangle) *image.RGBA {
+	img := newSolidImage(w, h, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+	rng := rand.New(rand.NewSource(1))
+	for y := subject.Min.Y; y < subject.Max.Y; y++ {
+		for x := subject.Min.X; x < subject.Max.X; x++ {
+			v := uint8(rng.Intn(256))
+			img.SetRGBA(x, y, color.RGBA{R: v, G: 255 - v, B: v / 2, A: 255})
+		}
+	}
+	return img
+}
+
+// Returns the position and size of the crop of newCoordImage(w, h) made by op
+func cropRegion(t *testing.T, op *CropOp, w, h int) image.Rectangle {
+	t.Helper()
+	if err := op.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	out, err := op.Apply(newCoordImage(w, h))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	b := out.Bounds()
+	c := color.RGBAModel.Convert(out.At(b.Min.X, b.Min.Y)).(color.RGBA)
+	return image.Rect(int(c.R), int(c.G), int(c.R)+b.Dx(), int(c.G)+b.Dy())
+}
+
+// ---- Aspect ratios --------------------------------------------------------------
+
+func TestParseAspect(t *testing.T) {
+	tests := []struct {
+		in      string
+		w, h    float64
+		wantErr bool
+	}{
+		{"16:9", 16, 9, false},
+		{"1:1", 1, 1, false},
+		{"1.91:1", 1.91, 1, false},
+		{"16/9", 0, 0, true},
+		{"16:", 0, 0, true},
+		{"0:1", 0, 0, true},
+		{"-4:3", 0, 0, true},
+		{"1:101", 0, 0, true},
+	}
+	for _, tc := range tests {
+		w, h, err := parseAspect(tc.in)
+		if (err != nil) != tc.wantErr || w != tc.w || h != tc.h {
+			t.Errorf("%q: want %v:%v (error %v), got %v:%v (%v)", tc.in, tc.w, tc.h, tc.wantErr, w, h, err)
+		}
+	}
+}
+
+func TestCrop_Aspect(t *testing.T) {
+	tests := []struct {
+		name string
+		op   CropOp
+		want image.Rectangle
+	}{
+		{"wide image, center", CropOp{Aspect: "1:1"}, image.Rect(50, 0, 150, 100)},
+		{"wide image, west", CropOp{Aspect: "1:1", Gravity: GravityWest}, image.Rect(0, 0, 100, 100)},
+		{"wide image, southeast", CropOp{Aspect: "1:1", Gravity: GravitySouthEast}, image.Rect(100, 0, 200, 100)},
+		{"tall result, north", CropOp{Aspect: "4:1", Gravity: GravityNorth}, image.Rect(0, 0, 200, 50)},
+		{"tall result, south", CropOp{Aspect: "4:1", Gravity: GravitySouth}, image.Rect(0, 50, 200, 100)},
+		{"same ratio", CropOp{Aspect: "2:1"}, image.Rect(0, 0, 200, 100)},
+		{"16:9", CropOp{Aspect: "16:9"}, image.Rect(11, 0, 189, 100)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cropRegion(t, &tc.op, 200, 100); got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// ---- Regions --------------------------------------------------------------------
+
+func TestCrop_Regions(t *testing.T) {
+	tests := []struct {
+		name string
+		op   CropOp
+		want image.Rectangle
+	}{
+		{"pixels", CropOp{X: 10, Y: 20, Width: 30, Height: 40}, image.Rect(10, 20, 40, 60)},
+		{"pixels clamped", CropOp{X: 180, Y: 90, Width: 50, Height: 50}, image.Rect(180, 90, 200, 100)},
+		{"percent", CropOp{X: 25, Y: 50, Width: 50, Height: 50, Unit: CropUnitPercent}, image.Rect(50, 50, 150, 100)},
+		{"percent whole image", CropOp{Width: 100, Height: 100, Unit: CropUnitPercent}, image.Rect(0, 0, 200, 100)},
+		{"size at gravity", CropOp{Width: 40, Height: 20, Gravity: GravityNorthEast}, image.Rect(160, 0, 200, 20)},
+		{"size at center", CropOp{Width: 40, Height: 20, Gravity: GravityCenter}, image.Rect(80, 40, 120, 60)},
+		{"percent at gravity", CropOp{Width: 10, Height: 10, Unit: CropUnitPercent, Gravity: GravitySouthWest}, image.Rect(0, 90, 20, 100)},
+		{"oversized at gravity", CropOp{Width: 400, Height: 50, Gravity: GravitySouth}, image.Rect(0, 50, 200, 100)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cropRegion(t, &tc.op, 200, 100); got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCrop_PercentFollowsResize(t *testing.T) {
+	// The same percent crop picks the same part of the picture at any size
+	op := &CropOp{X: 50, Y: 0, Width: 50, Height: 100, Unit: CropUnitPercent}
+	for _, w := range []int{200, 100} {
+		out, err := NewPipeline(&ResizeOp{Width: w}, op).Apply(newSolidImage(400, 200, color.RGBA{A: 255}))
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if b := out.Bounds(); b.Dx() != w/2 || b.Dy() != w/2 {
+			t.Errorf("width %d: want %d×%d, got %v", w, w/2, w/2, b)
+		}
+	}
+}
+
+// ---- Attention ------------------------------------------------------------------
+
+func TestCrop_Attention(t *testing.T) {
+	// Of the windows that hold the whole subject, the one nearest the center wins
+	tests := []struct {
+		name    string
+		w, h    int
+		subject image.Rectangle
+		op      CropOp
+		want    image.Rectangle
+	}{
+		{"subject on the right", 300, 100, image.Rect(220, 20, 280, 80), CropOp{Aspect: "1:1", Gravity: GravityAttention}, image.Rect(180, 0, 280, 100)},
+		{"subject on the left", 300, 100, image.Rect(10, 20, 60, 80), CropOp{Aspect: "1:1", Gravity: GravityAttention}, image.Rect(10, 0, 110, 100)},
+		{"subject at the bottom", 100, 400, image.Rect(20, 330, 80, 390), CropOp{Aspect: "1:1", Gravity: GravityAttention}, image.Rect(0, 290, 100, 390)},
+		{"fixed size", 400, 400, image.Rect(300, 40, 360, 100), CropOp{Width: 100, Height: 100, Gravity: GravityAttention}, image.Rect(260, 40, 360, 140)},
+		{"flat image stays centered", 300, 100, image.Rectangle{}, CropOp{Aspect: "1:1", Gravity: GravityAttention}, image.Rect(100, 0, 200, 100)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.op.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			out, err := tc.op.Apply(newBusyImage(tc.w, tc.h, tc.subject))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if b := out.Bounds(); b.Dx() != tc.want.Dx() || b.Dy() != tc.want.Dy() {
+				t.Fatalf("want %d×%d, got %v", tc.want.Dx(), tc.want.Dy(), b)
+			}
+			at := attentionPoint(newBusyImage(tc.w, tc.h, tc.subject), tc.want.Dx(), tc.want.Dy())
+			if d := at.Sub(tc.want.Min); d.X < -12 || d.X > 12 || d.Y < -12 || d.Y > 12 {
+				t.Errorf("want the window near %v, got %v", tc.want.Min, at)
+			}
+			if window := (image.Rectangle{Min: at, Max: at.Add(tc.want.Size())}); !window.In(image.Rect(0, 0, tc.w, tc.h)) {
+				t.Errorf("window at %v leaves the image", at)
+			}
+		})
+	}
+}
+
+func TestResize_CoverGravity(t *testing.T) {
+	// 400×100 covering 50×50 scales to 200×50 and keeps a quarter of the width
+	src := newBusyImage(400, 100, image.Rect(320, 10, 390, 90))
+	for _, tc := range []struct {
+		gravity string
+		wantX   int // Source column the first output column comes from
+	}{
+		{"", 150},
+		{GravityWest, 0},
+		{GravityEast, 300},
+		{GravityAttention, 300},
+	} {
+		opts := ResizeOptions{Width: 50, Height: 50, Fit: FitCover, Filter: "nearest", Gravity: tc.gravity}
+		if err := opts.Validate(); err != nil {
+			t.Fatalf("%q: validate: %v", tc.gravity, err)
+		}
+		out := ResizeImageWith(src, opts)
+		if b := out.Bounds(); b.Dx() != 50 || b.Dy() != 50 {
+			t.Fatalf("%q: want 50×50, got %v", tc.gravity, b)
+		}
+		// Only the attention and east crops see the noisy subject
+		busy := color.RGBAModel.Convert(out.At(40, 25)) != color.RGBA{R: 128, G: 128, B: 128, A: 255}
+		if want := tc.wantX >= 300; busy != want {
+			t.Errorf("%q: want the subject in view %v, got %v", tc.gravity, want, busy)
+		}
+	}
+}
+
+// ---- Crop validation ------------------------------------------------------------
+
+func TestCrop_Validate(t *testing.T) {
+	tests := []struct {
+		op      CropOp
+		wantErr bool
+	}{
+		{CropOp{X: 1, Y: 2, Width: 3, Height: 4}, false},
+		{CropOp{Width: 3, Height: 4, Unit: CropUnitPixels}, false},
+		{CropOp{X: 12.5, Width: 50, Height: 50, Unit: CropUnitPercent}, false},
+		{CropOp{Aspect: "16:9"}, false},
+		{CropOp{Aspect: "3:2", Gravity: GravityAttention}, false},
+		{CropOp{Width: 10, Height: 10, Gravity: GravityNorthWest}, false},
+		{CropOp{}, true},
+		{CropOp{X: -1, Width: 3, Height: 4}, true},
+		{CropOp{X: 1.5, Width: 3, Height: 4}, true},
+		{CropOp{Width: 101, Height: 50, Unit: CropUnitPercent}, true},
+		{CropOp{Width: 3, Height: 4, Unit: "em"}, true},
+		{CropOp{Aspect: "16:9", Width: 100}, true},
+		{CropOp{Aspect: "wide"}, true},
+		{CropOp{Aspect: "1:1", Gravity: "top"}, true},
+		{CropOp{X: 5, Width: 10, Height: 10, Gravity: GravityNorth}, true},
+	}
+	for _, tc := range tests {
+		if err := tc.op.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: want error %v, got %v", tc.op, tc.wantErr, err)
+		}
+	}
+
+	for _, opts := range []ResizeOptions{
+		{Width: 10, Height: 10, Gravity: GravityNorth},
+		{Width: 10, Height: 10, Fit: FitCover, Gravity: "middle"},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("%+v: want an error", opts)
+		}
+	}
+}
+
+// ---- Benchmarks -----------------------------------------------------------------
+
+func BenchmarkAttentionCrop_12MP(b *testing.B) {
+	img := newBenchmarkImage()
+	op := &CropOp{Aspect: "1:1", Gravity: GravityAttention}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		op.Apply(img)
+	}
+}
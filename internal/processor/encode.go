@@ -0,0 +1,250 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	_ "golang.org/x/image/webp" // Registers the WebP decoder with image.Decode
+)
+
+// Output formats accepted in OutputOptions
+const (
+	FormatAuto = "auto" // Same format as the uploaded original
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+const (
+	DefaultOutputFormat = FormatJPEG
+	DefaultQuality      = 85
+)
+
+// Encoder writes an image in a specific file format
+type Encoder interface {
+	// Encode writes img to w
+	Encode(w io.Writer, img image.Image) error
+	// ContentType returns the MIME type of the produced file
+	ContentType() string
+	// Extension returns the file extension, including the leading dot
+	Extension() string
+}
+
+// OutputOptions select the encoder used for a processed image
+type OutputOptions struct {
+	Format   string `json:"format,omitempty"`   // jpeg (default), png, gif, webp or auto
+	Quality  int    `json:"quality,omitempty"`  // 1-100: JPEG or lossy WebP quality; 85 by default
+	Lossless bool   `json:"lossless,omitempty"` // WebP only: bit-exact output
+}
+
+// Checks that the options name a supported format and a sane quality
+func (o OutputOptions) Validate() error {
+	switch o.format() {
+	case FormatAuto, FormatJPEG, FormatPNG, FormatGIF, FormatWebP:
+	default:
+		return fmt.Errorf("unknown output format %q (want jpeg, png, gif, webp or auto)", o.Format)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, got %d", o.Quality)
+	}
+	// With auto the format is not known yet, so neither is whether lossless applies
+	if o.Lossless && o.format() != FormatWebP {
+		return fmt.Errorf("lossless is only supported for webp output")
+	}
+	return nil
+}
+
+func (o OutputOptions) format() string {
+	switch o.Format {
+	case "":
+		return DefaultOutputFormat
+	case "jpg":
+		return FormatJPEG
+	}
+	return o.Format
+}
+
+// Reports whether the output keeps the frames of an animation. Only GIF
+// does; the other formats get a single frame.
+func (o OutputOptions) Animates(inputFormat string) bool {
+	format := o.format()
+	if format == FormatAuto {
+		format = inputFormat
+	}
+	return format == FormatGIF
+}
+
+func (o OutputOptions) quality() int {
+	if o.Quality == 0 {
+		return DefaultQuality
+	}
+	return o.Quality
+}
+
+// Returns the encoder for the options. For "auto", inputFormat (as reported
+// by DecodeImage) decides; unknown input formats fall back to JPEG.
+func NewEncoder(o OutputOptions, inputFormat string) (Encoder, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	format := o.format()
+	if format == FormatAuto {
+		format = inputFormat
+	}
+	switch format {
+	case FormatPNG:
+		return PNGEncoder{}, nil
+	case FormatGIF:
+		return GIFEncoder{}, nil
+	case FormatWebP:
+		return WebPEncoder{Quality: o.quality(), Lossless: o.Lossless}, nil
+	default:
+		return JPEGEncoder{Quality: o.quality()}, nil
+	}
+}
+
+// Encodes an image into a byte slice with the given encoder
+func EncodeImage(img image.Image, enc Encoder) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// JPEGEncoder writes baseline JPEGs; transparency is flattened onto white
+type JPEGEncoder struct {
+	Quality int
+}
+
+func (e JPEGEncoder) Encode(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, flatten(img, color.White), &jpeg.Options{Quality: e.Quality})
+}
+
+func (JPEGEncoder) ContentType() string { return "image/jpeg" }
+func (JPEGEncoder) Extension() string   { return ".jpg" }
+
+// PNGEncoder writes lossless PNGs, preserving transparency
+type PNGEncoder struct{}
+
+func (PNGEncoder) Encode(w io.Writer, img image.Image) error {
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	return enc.Encode(w, img)
+}
+
+func (PNGEncoder) ContentType() string { return "image/png" }
+func (PNGEncoder) Extension() string   { return ".png" }
+
+// GIFEncoder writes 256-color GIFs with Floyd-Steinberg dithering.
+// Fully transparent pixels stay transparent.
+type GIFEncoder struct{}
+
+func (GIFEncoder) Encode(w io.Writer, img image.Image) error {
+	if p, ok := img.(*image.Paletted); ok {
+		return gif.Encode(w, p, nil)
+	}
+	return gif.Encode(w, toPaletted(img), nil)
+}
+
+// EncodeAnimation writes every frame with its delay, and the loop count.
+// Frames are full pictures, so a frame followed by one with transparent
+// pixels is cleared rather than left to show through them; otherwise each
+// frame keeps its disposal.
+func (GIFEncoder) EncodeAnimation(w io.Writer, a *Animation) error {
+	n := len(a.Frames)
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, n),
+		Delay:     append([]int(nil), a.Delays...),
+		Disposal:  append([]byte(nil), a.Disposals...),
+		LoopCount: a.LoopCount,
+	}
+	transparent := make([]bool, n)
+	for i, frame := range a.Frames {
+		transparent[i] = hasTransparentPixels(frame)
+		g.Image[i] = toPaletted(frame)
+	}
+	for i := range g.Disposal {
+		if transparent[(i+1)%n] {
+			g.Disposal[i] = gif.DisposalBackground
+		}
+	}
+	return gif.EncodeAll(w, g)
+}
+
+func (GIFEncoder) ContentType() string { return "image/gif" }
+func (GIFEncoder) Extension() string   { return ".gif" }
+
+// WebPEncoder writes lossy (VP8) WebP files at Quality, or bit-exact
+// lossless (VP8L) ones when Lossless is set.
+type WebPEncoder struct {
+	Quality  int
+	Lossless bool
+}
+
+func (e WebPEncoder) Encode(w io.Writer, img image.Image) error {
+	return encodeWebP(w, img, e.Quality, e.Lossless)
+}
+
+func (WebPEncoder) ContentType() string { return "image/webp" }
+func (WebPEncoder) Extension() string   { return ".webp" }
+
+// Composites an image onto a solid background, removing transparency
+func flatten(img image.Image, bg color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// Quantizes an image to the web-safe Plan 9 palette, reserving one entry
+// for transparency when the image has fully transparent pixels
+func toPaletted(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	pal := color.Palette(palette.Plan9)
+	transparent := hasTransparentPixels(img)
+	if transparent {
+		pal = append(append(color.Palette{}, palette.Plan9[:255]...), color.Transparent)
+	}
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, b.Min)
+
+	// Dithering can bleed color into transparent areas; restore them
+	if transparent {
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				if _, _, _, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA(); a == 0 {
+					dst.SetColorIndex(x, y, uint8(len(pal)-1))
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func hasTransparentPixels(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return false
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// newTransparentLogo creates a w×h image that is transparent except for a
+// solid red square in the middle.
+func newTransparentLogo(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := h / 4; y < h*3/4; y++ {
+		for x := w / 4; x < w*3/4; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	return img
+}
+
+// ---- NewEncoder -----------------------------------------------------------------
+
+func TestNewEncoder_Formats(t *testing.T) {
+	tests := []struct {
+		opts        OutputOptions
+		input       string
+		wantType    string
+		wantExt     string
+		wantDecoded string
+	}{
+		{OutputOptions{}, "png", "image/jpeg", ".jpg", "jpeg"},
+		{OutputOptions{Format: "jpg", Quality: 60}, "png", "image/jpeg", ".jpg", "jpeg"},
+		{OutputOptions{Format: FormatPNG}, "jpeg", "image/png", ".png", "png"},
+		{OutputOptions{Format: FormatGIF}, "jpeg", "image/gif", ".gif", "gif"},
+		{OutputOptions{Format: FormatWebP, Lossless: true}, "jpeg", "image/webp", ".webp", "webp"},
+		{OutputOptions{Format: FormatWebP, Quality: 70}, "jpeg", "image/webp", ".webp", "webp"},
+		{OutputOptions{Format: FormatAuto}, "png", "image/png", ".png", "png"},
+		{OutputOptions{Format: FormatAuto}, "gif", "image/gif", ".gif", "gif"},
+		{OutputOptions{Format: FormatAuto}, "webp", "image/webp", ".webp", "webp"},
+		{OutputOptions{Format: FormatAuto}, "bmp", "image/jpeg", ".jpg", "jpeg"},
+	}
+	src := newSolidImage(20, 10, color.RGBA{R: 40, G: 80, B: 120, A: 255})
+	for _, tc := range tests {
+		enc, err := NewEncoder(tc.opts, tc.input)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tc.opts, err)
+		}
+		if enc.ContentType() != tc.wantType || enc.Extension() != tc.wantExt {
+			t.Errorf("%+v from %s: want %s %s, got %s %s", tc.opts, tc.input,
+				tc.wantType, tc.wantExt, enc.ContentType(), enc.Extension())
+		}
+		data, err := EncodeImage(src, enc)
+		if err != nil {
+			t.Fatalf("%+v: encode: %v", tc.opts, err)
+		}
+		img, format, err := DecodeImage(data)
+		if err != nil {
+			t.Fatalf("%+v: decode: %v", tc.opts, err)
+		}
+		if format != tc.wantDecoded {
+			t.Errorf("%+v: decoded as %q, want %q", tc.opts, format, tc.wantDecoded)
+		}
+		if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+			t.Errorf("%+v: want 20×10, got %d×%d", tc.opts, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestOutputOptions_Validate(t *testing.T) {
+	invalid := []OutputOptions{
+		{Format: "bmp"},
+		{Quality: -1},
+		{Quality: 101},
+		{Format: FormatPNG, Lossless: true},
+		{Format: FormatAuto, Lossless: true},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected validation error", o)
+		}
+	}
+	if err := (OutputOptions{Format: FormatWebP, Quality: 100, Lossless: true}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// ---- Transparency ---------------------------------------------------------------
+
+func TestEncoders_PreserveTransparency(t *testing.T) {
+	logo := newTransparentLogo(16, 16)
+	for _, enc := range []Encoder{PNGEncoder{}, GIFEncoder{}, WebPEncoder{Lossless: true}} {
+		data, err := EncodeImage(logo, enc)
+		if err != nil {
+			t.Fatalf("%T: encode: %v", enc, err)
+		}
+		img, _, err := DecodeImage(data)
+		if err != nil {
+			t.Fatalf("%T: decode: %v", enc, err)
+		}
+		if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("%T: corner should stay transparent, got alpha %d", enc, a>>8)
+		}
+		if r, _, _, a := img.At(8, 8).RGBA(); a>>8 != 255 || r>>8 < 200 {
+			t.Errorf("%T: center should stay opaque red, got r=%d a=%d", enc, r>>8, a>>8)
+		}
+	}
+}
+
+func TestJPEGEncoder_FlattensOntoWhite(t *testing.T) {
+	data, err := EncodeImage(newTransparentLogo(16, 16), JPEGEncoder{Quality: 95})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	img, _, err := DecodeImage(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 < 240 || g>>8 < 240 || b>>8 < 240 {
+		t.Errorf("expected white background, got (%d,%d,%d)", r>>8, g>>8, b>>8)
+	}
+}
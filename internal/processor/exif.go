@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const exifOrientationTag = 0x0112
+
+// Reads the EXIF Orientation (1-8) from JPEG data.
+// Returns 1 (upright) when the data is not a JPEG, carries no EXIF block
+// or the orientation tag is missing or malformed.
+func ReadOrientation(data []byte) int {
+	// JPEG files start with the SOI marker
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Walk the marker segments until the APP1 EXIF block or the image data
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// Padding bytes before a marker
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		// Start of scan or end of image: no more metadata segments follow
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseTIFFOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// Extracts the orientation tag from the first IFD of a TIFF structure
+func parseTIFFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+
+	// Each IFD entry is 12 bytes: tag, type, count, value/offset
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) != exifOrientationTag {
+			continue
+		}
+		// The orientation is a single SHORT stored inline
+		if order.Uint16(tiff[entry+2:entry+4]) != 3 {
+			return 1
+		}
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
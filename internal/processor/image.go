@@ -5,26 +5,60 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/jpeg"
+	"io"
 	"strconv"
 	"strings"
-
-	"github.com/nfnt/resize"
 )
 
-// Resizes an image to the specified width using nearest-neighbor scaling
+// Resizes an image to the specified width, preserving aspect ratio,
+// using the default Lanczos3 filter
 func ResizeImage(img image.Image, width uint) image.Image {
-	newImg := resize.Resize(width, 0, img, resize.NearestNeighbor)
-	return newImg
+	return ResizeImageWith(img, ResizeOptions{Width: int(width)})
 }
 
-// Decodes an image from a byte slice and returns the image and its format
+// Decodes an image from a byte slice and returns the image and its format.
+// JPEGs carrying an EXIF Orientation are rotated/flipped upright so that
+// every later step sees the image the way it is meant to be displayed.
+// GIFs decode only their first frame, shown on the full canvas.
 func DecodeImage(data []byte) (image.Image, string, error) {
 	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, "", err
 	}
-	return img, format, nil
+	switch format {
+	case "jpeg":
+		img = ApplyOrientation(img, ReadOrientation(data))
+	case "gif":
+		img, err = onGIFCanvas(data, img)
+	}
+	return img, format, err
+}
+
+// Bytes read ahead of the image header, enough to reach a JPEG's EXIF block
+const headerPeekSize = 64 << 10
+
+// Reads an image's format and dimensions from the start of r without decoding
+// its pixels. Width and height are swapped for JPEGs whose EXIF orientation
+// turns them on their side, matching what DecodeImage returns.
+func DecodeDimensions(r io.Reader) (width, height int, format string, err error) {
+	head := make([]byte, headerPeekSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, 0, "", err
+	}
+	head = head[:n]
+
+	config, format, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return 0, 0, "", err
+	}
+	width, height = config.Width, config.Height
+	if format == "jpeg" && ReadOrientation(head) >= 5 {
+		width, height = height, width
+	}
+	return width, height, format, nil
 }
 
 // Compresses the image to JPEG format with a given quality
@@ -62,57 +96,14 @@ func CropImage(img image.Image, x, y, width, height int) image.Image {
 	cropImg := image.NewRGBA(image.Rect(0, 0, width, height))
 
 	// Copy pixels from the original image to the cropped one
-	for cy := 0; cy < height; cy++ {
-		for cx := 0; cx < width; cx++ {
-			cropImg.Set(cx, cy, img.At(x+cx, y+cy))
-		}
-	}
+	draw.Draw(cropImg, cropImg.Bounds(), img, image.Pt(x, y), draw.Src)
 
 	return cropImg
 }
 
-// Applies a color tint to the image with intensity control
+// Applies a color tint to the image at the default intensity
 func AddTint(img image.Image, tintColor color.Color) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(bounds)
-
-	// Get tint color components (16-bit values)
-	tintR, tintG, tintB, _ := tintColor.RGBA()
-
-	// Convert to 0-1 range for easier blending
-	tR := float64(tintR) / 65535.0
-	tG := float64(tintG) / 65535.0
-	tB := float64(tintB) / 65535.0
-
-	// Tint intensity (0.0 - 1.0)
-	intensity := 0.3
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			origColor := img.At(x, y)
-			r, g, b, a := origColor.RGBA()
-
-			// Convert original to 0-1 range
-			oR := float64(r) / 65535.0
-			oG := float64(g) / 65535.0
-			oB := float64(b) / 65535.0
-
-			// Blend original with tint
-			blendR := oR*(1-intensity) + tR*intensity
-			blendG := oG*(1-intensity) + tG*intensity
-			blendB := oB*(1-intensity) + tB*intensity
-
-			// Convert back to 8-bit color
-			newColor := color.RGBA{
-				R: uint8(blendR * 255),
-				G: uint8(blendG * 255),
-				B: uint8(blendB * 255),
-				A: uint8(a / 256),
-			}
-			newImg.Set(x, y, newColor)
-		}
-	}
-	return newImg
+	return TintImage(img, tintColor, DefaultTintIntensity, DefaultTintMode)
 }
 
 // Converts a hex color string to color.RGBA
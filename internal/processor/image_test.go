@@ -2,6 +2,7 @@ package processor
 
 import (
 	"bytes"
+	"encoding/binary"
 	"image"
 	"image/color"
 	"image/jpeg"
@@ -82,6 +83,31 @@ func TestDecodeImage_Empty(t *testing.T) {
 	}
 }
 
+// ---- DecodeDimensions -----------------------------------------------------------
+
+func TestDecodeDimensions(t *testing.T) {
+	pngData := toPNG(t, newSolidImage(30, 20, color.RGBA{A: 255}))
+	w, h, format, err := DecodeDimensions(bytes.NewReader(pngData))
+	if err != nil || w != 30 || h != 20 || format != "png" {
+		t.Errorf("want 30×20 png, got %d×%d %q, %v", w, h, format, err)
+	}
+
+	// Matches DecodeImage for JPEGs stored on their side
+	rotated := withOrientation(t, toJPEG(t, newSolidImage(80, 40, color.RGBA{A: 255})), 6, binary.BigEndian)
+	w, h, format, err = DecodeDimensions(bytes.NewReader(rotated))
+	if err != nil || w != 40 || h != 80 || format != "jpeg" {
+		t.Errorf("want 40×80 jpeg, got %d×%d %q, %v", w, h, format, err)
+	}
+}
+
+func TestDecodeDimensions_Invalid(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not an image")} {
+		if _, _, _, err := DecodeDimensions(bytes.NewReader(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
 // ---- ResizeImage ----------------------------------------------------------------
 
 func TestResizeImage_Width(t *testing.T) {
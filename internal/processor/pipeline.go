@@ -0,0 +1,241 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+)
+
+const (
+	MaxPipelineSteps = 20         // Maximum number of operations in a single pipeline
+	MaxDimension     = 10000      // Largest width or height an operation may produce
+	MaxOutputPixels  = 50_000_000 // Largest number of pixels an operation may produce
+)
+
+// Operation is a single typed step of a Pipeline.
+// Implementations carry their own parameters, validate them up front
+// and apply the transformation to an image when the pipeline runs.
+type Operation interface {
+	// Name returns the identifier used for the operation in pipeline specs
+	Name() string
+	// Validate reports whether the operation's parameters are usable
+	Validate() error
+	// Apply runs the operation and returns the transformed image
+	Apply(img image.Image) (image.Image, error)
+}
+
+// Registry of operations that can appear in a pipeline spec, keyed by name.
+// Each entry returns a zero-valued operation ready to be decoded into.
+var operations = map[string]func() Operation{
+	"resize": func() Operation { return &ResizeOp{} },
+	"crop":   func() Operation { return &CropOp{} },
+	"rotate": func() Operation { return &RotateOp{} },
+	"flip":   func() Operation { return &FlipOp{} },
+	"frame":  func() Operation { return &FrameOp{} },
+
+	"tint":       func() Operation { return &TintOp{} },
+	"brightness": func() Operation { return &BrightnessOp{} },
+	"contrast":   func() Operation { return &ContrastOp{} },
+	"saturation": func() Operation { return &SaturationOp{} },
+	"hue":        func() Operation { return &HueOp{} },
+	"gamma":      func() Operation { return &GammaOp{} },
+	"grayscale":  func() Operation { return &GrayscaleOp{} },
+	"sepia":      func() Operation { return &SepiaOp{} },
+	"invert":     func() Operation { return &InvertOp{} },
+
+	"blur":     func() Operation { return &BlurOp{} },
+	"box_blur": func() Operation { return &BoxBlurOp{} },
+	"sharpen":  func() Operation { return &SharpenOp{} },
+	"unsharp":  func() Operation { return &UnsharpMaskOp{} },
+	"emboss":   func() Operation { return &EmbossOp{} },
+	"edges":    func() Operation { return &EdgesOp{} },
+
+	"watermark": func() Operation { return &WatermarkOp{} },
+}
+
+// Returns the sorted names of all registered operations
+func OperationNames() []string {
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StepError describes a pipeline step that could not be decoded or validated
+type StepError struct {
+	Index int    // Zero-based position of the step in the pipeline
+	Op    string // Operation name as given in the spec
+	Err   error  // Underlying problem
+}
+
+func (e *StepError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("step %d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("step %d (%s): %v", e.Index, e.Op, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline is an ordered list of operations applied to an image one after another
+type Pipeline struct {
+	Steps []Operation
+}
+
+// Wire representation of a single pipeline step
+type stepSpec struct {
+	Op     string          `json:"op"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Builds a pipeline from the given operations
+func NewPipeline(steps ...Operation) Pipeline {
+	return Pipeline{Steps: steps}
+}
+
+// Decodes and validates a pipeline from its JSON spec, e.g.
+//
+//	[{"op":"crop","params":{"x":0,"y":0,"width":400,"height":300}},
+//	 {"op":"resize","params":{"width":200}}]
+func ParsePipeline(data []byte) (Pipeline, error) {
+	var p Pipeline
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Pipeline{}, err
+	}
+	return p, nil
+}
+
+// Validate checks the pipeline length and every step's parameters.
+// The first invalid step is reported as a *StepError.
+func (p Pipeline) Validate() error {
+	if len(p.Steps) > MaxPipelineSteps {
+		return fmt.Errorf("pipeline has %d steps, maximum is %d", len(p.Steps), MaxPipelineSteps)
+	}
+	for i, op := range p.Steps {
+		if op == nil {
+			return &StepError{Index: i, Err: errors.New("missing operation")}
+		}
+		if err := op.Validate(); err != nil {
+			return &StepError{Index: i, Op: op.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// Apply runs every step in order and returns the final image
+func (p Pipeline) Apply(img image.Image) (image.Image, error) {
+	for i, op := range p.Steps {
+		out, err := op.Apply(img)
+		if err != nil {
+			return nil, &StepError{Index: i, Op: op.Name(), Err: err}
+		}
+		img = out
+	}
+	return img, nil
+}
+
+// Names returns the operation names of the pipeline in order
+func (p Pipeline) Names() []string {
+	names := make([]string, len(p.Steps))
+	for i, op := range p.Steps {
+		names[i] = op.Name()
+	}
+	return names
+}
+
+// MarshalJSON encodes the pipeline as an ordered array of {"op","params"} objects
+func (p Pipeline) MarshalJSON() ([]byte, error) {
+	specs := make([]stepSpec, len(p.Steps))
+	for i, op := range p.Steps {
+		params, err := json.Marshal(op)
+		if err != nil {
+			return nil, &StepError{Index: i, Op: op.Name(), Err: err}
+		}
+		specs[i] = stepSpec{Op: op.Name(), Params: params}
+	}
+	return json.Marshal(specs)
+}
+
+// UnmarshalJSON decodes an array of {"op","params"} objects.
+// Unknown operations, unknown parameters and invalid values are rejected.
+func (p *Pipeline) UnmarshalJSON(data []byte) error {
+	var specs []stepSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return fmt.Errorf("invalid pipeline: %w", err)
+	}
+
+	steps := make([]Operation, 0, len(specs))
+	for i, spec := range specs {
+		newOp, ok := operations[spec.Op]
+		if !ok {
+			return &StepError{Index: i, Op: spec.Op, Err: fmt.Errorf("unknown operation %q", spec.Op)}
+		}
+		op := newOp()
+		if len(spec.Params) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(spec.Params))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(op); err != nil {
+				return &StepError{Index: i, Op: spec.Op, Err: fmt.Errorf("invalid params: %w", err)}
+			}
+		}
+		steps = append(steps, op)
+	}
+
+	decoded := Pipeline{Steps: steps}
+	if err := decoded.Validate(); err != nil {
+		return err
+	}
+	*p = decoded
+	return nil
+}
+
+// LegacyOptions are the processing options of tasks queued before pipelines
+// existed, e.g. {"resize":{"width":800},"crop":{"x":0,"y":0,"width":400,"height":300},"tint":"#336699"}
+type LegacyOptions struct {
+	Resize *struct {
+		Width int `json:"width"`
+	} `json:"resize"`
+	Crop *struct {
+		X      int `json:"x"`
+		Y      int `json:"y"`
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"crop"`
+	Tint string `json:"tint"`
+}
+
+// Reports whether any legacy option is present
+func (o LegacyOptions) Present() bool {
+	return o.Resize != nil || o.Crop != nil || o.Tint != ""
+}
+
+// Translates the options into the steps the old worker ran, in its order: a
+// nearest-neighbor resize to the width (600 when not positive), a crop when
+// its size is positive, then a tint at the default intensity. As before, a
+// tint color that does not parse is skipped rather than failing the task.
+func (o LegacyOptions) Pipeline() Pipeline {
+	var steps []Operation
+	if o.Resize != nil {
+		width := o.Resize.Width
+		if width <= 0 {
+			width = 600
+		}
+		steps = append(steps, &ResizeOp{Width: width, Filter: "nearest"})
+	}
+	if c := o.Crop; c != nil && c.Width > 0 && c.Height > 0 {
+		steps = append(steps, &CropOp{
+			X: float64(max(c.X, 0)), Y: float64(max(c.Y, 0)), Width: float64(c.Width), Height: float64(c.Height),
+		})
+	}
+	if tint := (&TintOp{Color: o.Tint}); o.Tint != "" && tint.Validate() == nil {
+		steps = append(steps, tint)
+	}
+	return NewPipeline(steps...)
+}
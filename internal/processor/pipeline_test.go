@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"testing"
+)
+
+// ---- ParsePipeline --------------------------------------------------------------
+
+func TestParsePipeline_Valid(t *testing.T) {
+	spec := `[
+		{"op":"crop","params":{"x":10,"y":10,"width":50,"height":40}},
+		{"op":"resize","params":{"width":25}},
+		{"op":"tint","params":{"color":"#ff0000"}},
+		{"op":"tint","params":{"color":"#0000ff"}}
+	]`
+	p, err := ParsePipeline([]byte(spec))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"crop", "resize", "tint", "tint"}
+	got := p.Names()
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("step %d: want %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestParsePipeline_Empty(t *testing.T) {
+	p, err := ParsePipeline([]byte(`[]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.Steps) != 0 {
+		t.Errorf("want 0 steps, got %d", len(p.Steps))
+	}
+}
+
+func TestParsePipeline_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantIndex int
+		wantOp    string
+	}{
+		{"unknown op", `[{"op":"resize","params":{"width":10}},{"op":"explode"}]`, 1, "explode"},
+		{"unknown param", `[{"op":"resize","params":{"width":10,"depth":3}}]`, 0, "resize"},
+		{"zero width", `[{"op":"resize","params":{"width":0}}]`, 0, "resize"},
+		{"missing params", `[{"op":"crop"}]`, 0, "crop"},
+		{"negative crop", `[{"op":"crop","params":{"x":-1,"y":0,"width":5,"height":5}}]`, 0, "crop"},
+		{"bad color", `[{"op":"tint","params":{"color":"red"}}]`, 0, "tint"},
+		{"wrong type", `[{"op":"resize","params":{"width":"wide"}}]`, 0, "resize"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePipeline([]byte(tc.spec))
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("want *StepError, got %v", err)
+			}
+			if stepErr.Index != tc.wantIndex || stepErr.Op != tc.wantOp {
+				t.Errorf("want step %d (%s), got step %d (%s)", tc.wantIndex, tc.wantOp, stepErr.Index, stepErr.Op)
+			}
+		})
+	}
+}
+
+func TestParsePipeline_NotAnArray(t *testing.T) {
+	if _, err := ParsePipeline([]byte(`{"op":"resize"}`)); err == nil {
+		t.Error("expected error for non-array spec")
+	}
+}
+
+func TestParsePipeline_TooManySteps(t *testing.T) {
+	steps := make([]Operation, MaxPipelineSteps+1)
+	for i := range steps {
+		steps[i] = &TintOp{Color: "#000000"}
+	}
+	data, err := json.Marshal(NewPipeline(steps...))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if _, err := ParsePipeline(data); err == nil {
+		t.Error("expected error for oversized pipeline")
+	}
+}
+
+// ---- Pipeline JSON round trip ---------------------------------------------------
+
+func TestPipeline_RoundTrip(t *testing.T) {
+	orig := NewPipeline(
+		&CropOp{X: 1, Y: 2, Width: 3, Height: 4},
+		&ResizeOp{Width: 100},
+	)
+	data, err := json.Marshal(orig)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	decoded, err := ParsePipeline(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	crop, ok := decoded.Steps[0].(*CropOp)
+	if !ok || *crop != (CropOp{X: 1, Y: 2, Width: 3, Height: 4}) {
+		t.Errorf("crop step not preserved: %#v", decoded.Steps[0])
+	}
+	resize, ok := decoded.Steps[1].(*ResizeOp)
+	if !ok || resize.Width != 100 {
+		t.Errorf("resize step not preserved: %#v", decoded.Steps[1])
+	}
+}
+
+// ---- Pipeline.Apply -------------------------------------------------------------
+
+func TestPipeline_ApplyRespectsOrder(t *testing.T) {
+	src := newSolidImage(200, 100, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+
+	// Crop first, then resize: 80×80 region scaled to width 40 → 40×40
+	cropFirst := NewPipeline(&CropOp{Width: 80, Height: 80}, &ResizeOp{Width: 40})
+	out, err := cropFirst.Apply(src)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if b := out.Bounds(); b.Dx() != 40 || b.Dy() != 40 {
+		t.Errorf("crop→resize: want 40×40, got %d×%d", b.Dx(), b.Dy())
+	}
+
+	// Resize first, then crop: 200×100 → 40×20, then crop clamps to 40×20
+	resizeFirst := NewPipeline(&ResizeOp{Width: 40}, &CropOp{Width: 80, Height: 80})
+	out, err = resizeFirst.Apply(src)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if b := out.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Errorf("resize→crop: want 40×20, got %d×%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestPipeline_ApplyCropOutsideImage(t *testing.T) {
+	src := newSolidImage(50, 50, color.RGBA{A: 255})
+	p := NewPipeline(&CropOp{X: 60, Y: 0, Width: 10, Height: 10})
+	_, err := p.Apply(src)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Op != "crop" {
+		t.Errorf("want crop StepError, got %v", err)
+	}
+}
+
+// ---- Legacy options -------------------------------------------------------------
+
+func TestLegacyOptions_Pipeline(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		steps []string
+		w, h  int // Output size for a 200×100 image
+	}{
+		{"resize only", `{"imageID":"i","resize":{"width":100}}`, []string{"resize"}, 100, 50},
+		{"default width", `{"resize":{"width":0}}`, []string{"resize"}, 600, 300},
+		{"resize, crop and tint", `{"resize":{"width":100},"crop":{"x":-5,"y":10,"width":40,"height":30},"tint":"#336699"}`,
+			[]string{"resize", "crop", "tint"}, 40, 30},
+		{"empty crop", `{"resize":{"width":100},"crop":{"x":0,"y":0,"width":0,"height":0}}`, []string{"resize"}, 100, 50},
+		{"unparsable tint", `{"resize":{"width":100},"tint":"red"}`, []string{"resize"}, 100, 50},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts LegacyOptions
+			if err := json.Unmarshal([]byte(tc.json), &opts); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !opts.Present() {
+				t.Fatal("want the legacy options present")
+			}
+			p := opts.Pipeline()
+			if err := p.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if got := p.Names(); fmt.Sprint(got) != fmt.Sprint(tc.steps) {
+				t.Errorf("want steps %v, got %v", tc.steps, got)
+			}
+			out, err := p.Apply(newSolidImage(200, 100, color.RGBA{R: 128, G: 128, B: 128, A: 255}))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if b := out.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+				t.Errorf("want %d×%d, got %d×%d", tc.w, tc.h, b.Dx(), b.Dy())
+			}
+		})
+	}
+
+	var none LegacyOptions
+	if err := json.Unmarshal([]byte(`{"imageID":"i","pipeline":[]}`), &none); err != nil || none.Present() {
+		t.Errorf("want no legacy options, got %+v (%v)", none, err)
+	}
+}
@@ -0,0 +1,194 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// Resampling kernels accepted by the resize operation
+var resizeFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"lanczos3": resize.Lanczos3,
+}
+
+// Fit modes describing how an image is mapped onto a width×height box
+const (
+	FitContain = "contain" // Scale to fit inside the box, keeping aspect ratio
+	FitCover   = "cover"   // Scale to cover the box, keeping aspect ratio, then crop the overflow
+	FitFill    = "fill"    // Stretch to exactly the box, ignoring aspect ratio
+	FitInside  = "inside"  // Like contain, but never enlarge the image
+)
+
+const (
+	DefaultResizeFilter = "lanczos3"
+	DefaultResizeFit    = FitContain
+)
+
+// ResizeOptions control how ResizeImageWith scales an image.
+// A zero Width or Height means "derive from the other side's scale".
+type ResizeOptions struct {
+	Width   int
+	Height  int
+	Filter  string // nearest, bilinear, bicubic or lanczos3 (default)
+	Fit     string // contain (default), cover, fill or inside
+	Gravity string // Part a cover crop keeps: center (default), a side, a corner or attention
+}
+
+// Checks that the options describe a usable resize
+func (o ResizeOptions) Validate() error {
+	if o.Width < 0 || o.Height < 0 {
+		return errors.New("width and height must not be negative")
+	}
+	if o.Width == 0 && o.Height == 0 {
+		return errors.New("width or height must be positive")
+	}
+	if o.Width > MaxDimension || o.Height > MaxDimension {
+		return fmt.Errorf("width and height must be at most %d", MaxDimension)
+	}
+	if o.Width*o.Height > MaxOutputPixels {
+		return fmt.Errorf("width × height must be at most %d pixels", MaxOutputPixels)
+	}
+	if _, ok := resizeFilters[o.filter()]; !ok {
+		return fmt.Errorf("unknown filter %q (want nearest, bilinear, bicubic or lanczos3)", o.Filter)
+	}
+	switch o.fit() {
+	case FitContain, FitCover, FitFill, FitInside:
+	default:
+		return fmt.Errorf("unknown fit %q (want contain, cover, fill or inside)", o.Fit)
+	}
+	if o.Gravity != "" {
+		if o.fit() != FitCover {
+			return errors.New("gravity applies to fit cover")
+		}
+		if err := validateRegionGravity(o.Gravity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o ResizeOptions) filter() string {
+	if o.Filter == "" {
+		return DefaultResizeFilter
+	}
+	return o.Filter
+}
+
+func (o ResizeOptions) gravity() string {
+	if o.Gravity == "" {
+		return GravityCenter
+	}
+	return o.Gravity
+}
+
+func (o ResizeOptions) fit() string {
+	if o.Fit == "" {
+		return DefaultResizeFit
+	}
+	return o.Fit
+}
+
+// Computes the size the image is scaled to before any cover crop.
+// A zero result means the image should be returned unchanged.
+func (o ResizeOptions) scaledSize(srcW, srcH int) (int, int) {
+	w, h := float64(srcW), float64(srcH)
+
+	var scale float64
+	switch {
+	case o.Width > 0 && o.Height > 0 && o.fit() == FitFill:
+		return o.Width, o.Height
+	case o.Width > 0 && o.Height > 0 && o.fit() == FitCover:
+		scale = math.Max(float64(o.Width)/w, float64(o.Height)/h)
+	case o.Width > 0 && o.Height > 0:
+		scale = math.Min(float64(o.Width)/w, float64(o.Height)/h)
+	case o.Width > 0:
+		scale = float64(o.Width) / w
+	default:
+		scale = float64(o.Height) / h
+	}
+
+	if o.fit() == FitInside && scale >= 1 {
+		return 0, 0
+	}
+
+	newW := int(math.Max(1, math.Round(w*scale)))
+	newH := int(math.Max(1, math.Round(h*scale)))
+	if o.fit() == FitCover {
+		// Never round below the requested box, or the crop would come up short
+		newW = max(newW, o.Width)
+		newH = max(newH, o.Height)
+	}
+	return newW, newH
+}
+
+// Checks the size a srcW×srcH image is scaled to against MaxDimension and
+// MaxOutputPixels. Validate only sees the requested sides; the other one
+// follows from the image's aspect ratio, and a cover resize overshoots the
+// box before trimming, so either can be far larger.
+func (o ResizeOptions) checkScaledSize(srcW, srcH int) error {
+	w, h := o.scaledSize(srcW, srcH)
+	if w > MaxDimension || h > MaxDimension || int64(w)*int64(h) > MaxOutputPixels {
+		return fmt.Errorf("scaling %d×%d would make a %d×%d image; at most %d pixels per side and %d in total are allowed",
+			srcW, srcH, w, h, MaxDimension, MaxOutputPixels)
+	}
+	return nil
+}
+
+// Resizes an image according to the given options.
+// The caller is expected to have validated the options.
+func ResizeImageWith(img image.Image, opts ResizeOptions) image.Image {
+	b := img.Bounds()
+	newW, newH := opts.scaledSize(b.Dx(), b.Dy())
+	if newW == 0 || newH == 0 {
+		return img
+	}
+
+	resized := img
+	if newW != b.Dx() || newH != b.Dy() {
+		resized = resize.Resize(uint(newW), uint(newH), img, resizeFilters[opts.filter()])
+	}
+
+	// Cover: trim the overflow, evenly from both sides unless a gravity
+	// keeps another part
+	if opts.fit() == FitCover && opts.Width > 0 && opts.Height > 0 &&
+		(newW != opts.Width || newH != opts.Height) {
+		r := placeRegion(resized, opts.Width, opts.Height, opts.gravity())
+		resized = CropImage(resized, r.Min.X, r.Min.Y, opts.Width, opts.Height)
+	}
+	return resized
+}
+
+// ResizeOp scales the image to a target width and/or height using the
+// chosen resampling filter and fit mode
+type ResizeOp struct {
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	Fit    string `json:"fit,omitempty"`
+
+	Gravity string `json:"gravity,omitempty"`
+}
+
+func (op *ResizeOp) Name() string { return "resize" }
+
+func (op *ResizeOp) options() ResizeOptions {
+	return ResizeOptions{Width: op.Width, Height: op.Height, Filter: op.Filter, Fit: op.Fit, Gravity: op.Gravity}
+}
+
+func (op *ResizeOp) Validate() error {
+	return op.options().Validate()
+}
+
+func (op *ResizeOp) Apply(img image.Image) (image.Image, error) {
+	b := img.Bounds()
+	if err := op.options().checkScaledSize(b.Dx(), b.Dy()); err != nil {
+		return nil, err
+	}
+	return ResizeImageWith(img, op.options()), nil
+}
@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// ---- ResizeImageWith ------------------------------------------------------------
+
+func TestResizeImageWith_FitModes(t *testing.T) {
+	// 200×100 source into a 100×100 box
+	tests := []struct {
+		name       string
+		opts       ResizeOptions
+		wantW      int
+		wantH      int
+		srcW, srcH int
+	}{
+		{"contain", ResizeOptions{Width: 100, Height: 100, Fit: FitContain}, 100, 50, 200, 100},
+		{"default fit is contain", ResizeOptions{Width: 100, Height: 100}, 100, 50, 200, 100},
+		{"cover", ResizeOptions{Width: 100, Height: 100, Fit: FitCover}, 100, 100, 200, 100},
+		{"fill", ResizeOptions{Width: 100, Height: 100, Fit: FitFill}, 100, 100, 200, 100},
+		{"inside shrinks", ResizeOptions{Width: 100, Height: 100, Fit: FitInside}, 100, 50, 200, 100},
+		{"inside never enlarges", ResizeOptions{Width: 400, Height: 400, Fit: FitInside}, 200, 100, 200, 100},
+		{"contain enlarges", ResizeOptions{Width: 400, Height: 400, Fit: FitContain}, 400, 200, 200, 100},
+		{"height only", ResizeOptions{Height: 50}, 100, 50, 200, 100},
+		{"width only", ResizeOptions{Width: 50}, 50, 25, 200, 100},
+		{"cover portrait", ResizeOptions{Width: 60, Height: 30, Fit: FitCover}, 60, 30, 90, 120},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := newSolidImage(tc.srcW, tc.srcH, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+			if err := tc.opts.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			b := ResizeImageWith(src, tc.opts).Bounds()
+			if b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+				t.Errorf("want %d×%d, got %d×%d", tc.wantW, tc.wantH, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestResizeImageWith_Filters(t *testing.T) {
+	src := newSolidImage(64, 64, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	for name := range resizeFilters {
+		t.Run(name, func(t *testing.T) {
+			out := ResizeImageWith(src, ResizeOptions{Width: 20, Filter: name})
+			if b := out.Bounds(); b.Dx() != 20 || b.Dy() != 20 {
+				t.Fatalf("want 20×20, got %d×%d", b.Dx(), b.Dy())
+			}
+			// A solid image stays solid under every kernel
+			r, g, b, _ := out.At(10, 10).RGBA()
+			if r>>8 != 200 || g>>8 != 100 || b>>8 != 50 {
+				t.Errorf("color drifted to (%d,%d,%d)", r>>8, g>>8, b>>8)
+			}
+		})
+	}
+}
+
+func TestResizeImageWith_CoverKeepsCenter(t *testing.T) {
+	// Left third red, middle third green, right third blue; cover to a square keeps green
+	src := newSolidImage(300, 100, color.RGBA{G: 255, A: 255})
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			src.Set(x, y, color.RGBA{R: 255, A: 255})
+			src.Set(x+200, y, color.RGBA{B: 255, A: 255})
+		}
+	}
+	out := ResizeImageWith(src, ResizeOptions{Width: 50, Height: 50, Fit: FitCover, Filter: "nearest"})
+	r, g, b, _ := out.At(out.Bounds().Min.X+25, out.Bounds().Min.Y+25).RGBA()
+	if g>>8 != 255 || r != 0 || b != 0 {
+		t.Errorf("expected green center, got (%d,%d,%d)", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestResizeOp_LimitsComputedSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     ResizeOp
+		w, h   int // Source size
+		wantOK bool
+	}{
+		{"width on a tall image", ResizeOp{Width: MaxDimension}, 100, 16384, false},
+		{"height on a wide image", ResizeOp{Height: 5000}, 16384, 100, false},
+		{"cover overshoot", ResizeOp{Width: MaxDimension, Height: 10, Fit: FitCover}, 100, 16384, false},
+		{"too many pixels", ResizeOp{Width: 8000}, 100, 100, false},
+		{"within the limits", ResizeOp{Width: 200}, 100, 50, true},
+		{"contain box", ResizeOp{Width: MaxDimension, Height: 10, Fit: FitContain}, 100, 16384, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.op.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			out, err := tc.op.Apply(image.NewRGBA(image.Rect(0, 0, tc.w, tc.h)))
+			if (err == nil) != tc.wantOK {
+				t.Fatalf("want ok %v, got %v", tc.wantOK, err)
+			}
+			if err == nil {
+				if b := out.Bounds(); b.Dx() > MaxDimension || b.Dy() > MaxDimension {
+					t.Errorf("got %v", b)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ResizeOptions
+	}{
+		{"no dimensions", ResizeOptions{}},
+		{"negative", ResizeOptions{Width: -1, Height: 10}},
+		{"too large", ResizeOptions{Width: MaxDimension + 1}},
+		{"too many pixels", ResizeOptions{Width: MaxDimension, Height: MaxDimension, Fit: FitFill}},
+		{"unknown filter", ResizeOptions{Width: 10, Filter: "sinc"}},
+		{"unknown fit", ResizeOptions{Width: 10, Fit: "stretch"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.Validate(); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Converts any image to an *image.RGBA whose bounds start at (0, 0)
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// Converts any image to an *image.NRGBA whose bounds start at (0, 0)
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA); ok && b.Min == (image.Point{}) {
+		return nrgba
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// Builds a new image of size w×h where each destination pixel (x, y)
+// is copied from the source pixel returned by the mapping function
+func remap(img image.Image, w, h int, from func(x, y int) (int, int)) *image.RGBA {
+	src := toRGBA(img)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := from(x, y)
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// Mirrors the image left to right
+func FlipHorizontal(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+}
+
+// Mirrors the image top to bottom
+func FlipVertical(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+// Rotates the image 90 degrees clockwise
+func Rotate90(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+}
+
+// Rotates the image 180 degrees
+func Rotate180(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+}
+
+// Rotates the image 270 degrees clockwise (90 degrees counter-clockwise)
+func Rotate270(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+}
+
+// Mirrors the image across its top-left to bottom-right diagonal
+func Transpose(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, h, w, func(x, y int) (int, int) { return y, x })
+}
+
+// Mirrors the image across its top-right to bottom-left diagonal
+func Transverse(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+}
+
+// Rotates the image clockwise by an arbitrary angle in degrees.
+// Multiples of 90 degrees are exact; other angles expand the canvas to fit
+// the rotated image, sample bilinearly and fill uncovered areas with bg.
+func RotateImage(img image.Image, degrees float64, bg color.Color) image.Image {
+	degrees = math.Mod(degrees, 360)
+	if degrees < 0 {
+		degrees += 360
+	}
+
+	switch degrees {
+	case 0:
+		return img
+	case 90:
+		return Rotate90(img)
+	case 180:
+		return Rotate180(img)
+	case 270:
+		return Rotate270(img)
+	}
+
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	rad := degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	// Size of the canvas that fits the whole rotated image
+	newW := int(math.Ceil(math.Abs(float64(w)*cos) + math.Abs(float64(h)*sin)))
+	newH := int(math.Ceil(math.Abs(float64(w)*sin) + math.Abs(float64(h)*cos)))
+
+	br, bgG, bb, ba := bg.RGBA()
+	fill := [4]float64{float64(br >> 8), float64(bgG >> 8), float64(bb >> 8), float64(ba >> 8)}
+
+	// Returns the source pixel at (x, y), or the background when out of bounds
+	sample := func(x, y int) [4]float64 {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return fill
+		}
+		i := src.PixOffset(x, y)
+		return [4]float64{float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2]), float64(src.Pix[i+3])}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, newW, newH))
+	srcCX, srcCY := float64(w)/2, float64(h)/2
+	dstCX, dstCY := float64(newW)/2, float64(newH)/2
+
+	for y := 0; y < newH; y++ {
+		for x := 0; x < newW; x++ {
+			// Map the destination pixel center back into source space
+			dx := float64(x) + 0.5 - dstCX
+			dy := float64(y) + 0.5 - dstCY
+			sx := dx*cos + dy*sin + srcCX - 0.5
+			sy := -dx*sin + dy*cos + srcCY - 0.5
+
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+
+			p00, p10 := sample(x0, y0), sample(x0+1, y0)
+			p01, p11 := sample(x0, y0+1), sample(x0+1, y0+1)
+
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				top := p00[c]*(1-fx) + p10[c]*fx
+				bottom := p01[c]*(1-fx) + p11[c]*fx
+				dst.Pix[i+c] = uint8(math.Round(top*(1-fy) + bottom*fy))
+			}
+		}
+	}
+	return dst
+}
+
+// Applies the transform that brings an image stored with the given
+// EXIF orientation (1-8) upright. Unknown values leave the image untouched.
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return FlipHorizontal(img)
+	case 3:
+		return Rotate180(img)
+	case 4:
+		return FlipVertical(img)
+	case 5:
+		return Transpose(img)
+	case 6:
+		return Rotate90(img)
+	case 7:
+		return Transverse(img)
+	case 8:
+		return Rotate270(img)
+	default:
+		return img
+	}
+}
+
+// Parses a background color for operations that expose new canvas area.
+// An empty string or "transparent" yields a fully transparent color.
+func parseBackground(s string) (color.Color, error) {
+	if s == "" || s == "transparent" {
+		return color.Transparent, nil
+	}
+	return ParseHexColor(s)
+}
+
+// RotateOp rotates the image clockwise by Angle degrees.
+// Non-right angles grow the canvas and fill the corners with Background.
+type RotateOp struct {
+	Angle      float64 `json:"angle"`
+	Background string  `json:"background,omitempty"` // "#rrggbb" or "transparent" (default)
+}
+
+func (op *RotateOp) Name() string { return "rotate" }
+
+func (op *RotateOp) Validate() error {
+	if math.IsNaN(op.Angle) || math.IsInf(op.Angle, 0) {
+		return errors.New("angle must be a finite number")
+	}
+	if op.Angle <= -360 || op.Angle >= 360 {
+		return errors.New("angle must be between -360 and 360 degrees")
+	}
+	if _, err := parseBackground(op.Background); err != nil {
+		return fmt.Errorf("invalid background %q", op.Background)
+	}
+	return nil
+}
+
+func (op *RotateOp) Apply(img image.Image) (image.Image, error) {
+	bg, err := parseBackground(op.Background)
+	if err != nil {
+		return nil, err
+	}
+	return RotateImage(img, op.Angle, bg), nil
+}
+
+// FlipOp mirrors the image horizontally or vertically
+type FlipOp struct {
+	Direction string `json:"direction"` // "horizontal" or "vertical"
+}
+
+func (op *FlipOp) Name() string { return "flip" }
+
+func (op *FlipOp) Validate() error {
+	switch op.Direction {
+	case "horizontal", "vertical":
+		return nil
+	}
+	return fmt.Errorf("direction must be \"horizontal\" or \"vertical\", got %q", op.Direction)
+}
+
+func (op *FlipOp) Apply(img image.Image) (image.Image, error) {
+	if op.Direction == "vertical" {
+		return FlipVertical(img), nil
+	}
+	return FlipHorizontal(img), nil
+}
@@ -0,0 +1,235 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// newMarkedImage creates a 3×2 image where every pixel has a distinct red value
+// (10*x + 100*y), so transforms can be checked pixel by pixel.
+//
+//	 0  10  20
+//	100 110 120
+func newMarkedImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(10*x + 100*y), A: 255})
+		}
+	}
+	return img
+}
+
+// redGrid returns the red channel of every pixel row by row.
+func redGrid(img image.Image) [][]uint8 {
+	b := img.Bounds()
+	grid := make([][]uint8, b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		grid[y] = make([]uint8, b.Dx())
+		for x := 0; x < b.Dx(); x++ {
+			r, _, _, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			grid[y][x] = uint8(r >> 8)
+		}
+	}
+	return grid
+}
+
+func assertGrid(t *testing.T, img image.Image, want [][]uint8) {
+	t.Helper()
+	got := redGrid(img)
+	if len(got) != len(want) || len(got[0]) != len(want[0]) {
+		t.Fatalf("want %d×%d, got %d×%d", len(want[0]), len(want), len(got[0]), len(got))
+	}
+	for y := range want {
+		for x := range want[y] {
+			if got[y][x] != want[y][x] {
+				t.Fatalf("want %v, got %v", want, got)
+			}
+		}
+	}
+}
+
+// ---- Flip / Rotate --------------------------------------------------------------
+
+func TestFlipHorizontal(t *testing.T) {
+	assertGrid(t, FlipHorizontal(newMarkedImage()), [][]uint8{
+		{20, 10, 0},
+		{120, 110, 100},
+	})
+}
+
+func TestFlipVertical(t *testing.T) {
+	assertGrid(t, FlipVertical(newMarkedImage()), [][]uint8{
+		{100, 110, 120},
+		{0, 10, 20},
+	})
+}
+
+func TestRotate90(t *testing.T) {
+	assertGrid(t, Rotate90(newMarkedImage()), [][]uint8{
+		{100, 0},
+		{110, 10},
+		{120, 20},
+	})
+}
+
+func TestRotate180(t *testing.T) {
+	assertGrid(t, Rotate180(newMarkedImage()), [][]uint8{
+		{120, 110, 100},
+		{20, 10, 0},
+	})
+}
+
+func TestRotate270(t *testing.T) {
+	assertGrid(t, Rotate270(newMarkedImage()), [][]uint8{
+		{20, 120},
+		{10, 110},
+		{0, 100},
+	})
+}
+
+func TestTransposeAndTransverse(t *testing.T) {
+	assertGrid(t, Transpose(newMarkedImage()), [][]uint8{
+		{0, 100},
+		{10, 110},
+		{20, 120},
+	})
+	assertGrid(t, Transverse(newMarkedImage()), [][]uint8{
+		{120, 20},
+		{110, 10},
+		{100, 0},
+	})
+}
+
+func TestRotateImage_RightAnglesAreExact(t *testing.T) {
+	src := newMarkedImage()
+	assertGrid(t, RotateImage(src, -90, color.Transparent), redGrid(Rotate270(src)))
+	assertGrid(t, RotateImage(src, 450, color.Transparent), redGrid(Rotate90(src)))
+	if RotateImage(src, 360, color.Transparent) != image.Image(src) {
+		t.Error("expected a full turn to return the original image")
+	}
+}
+
+func TestRotateImage_ArbitraryAngleExpandsCanvas(t *testing.T) {
+	src := newSolidImage(100, 50, color.RGBA{R: 255, A: 255})
+	out := RotateImage(src, 45, color.RGBA{B: 255, A: 255})
+	b := out.Bounds()
+	// |100·cos45| + |50·sin45| ≈ 106.07
+	if b.Dx() != 107 || b.Dy() != 107 {
+		t.Errorf("want 107×107, got %d×%d", b.Dx(), b.Dy())
+	}
+	// The center stays red, the corners are filled with the background
+	if r, _, bl, _ := out.At(53, 53).RGBA(); r>>8 != 255 || bl != 0 {
+		t.Errorf("expected red center, got r=%d b=%d", r>>8, bl>>8)
+	}
+	if r, _, bl, _ := out.At(0, 0).RGBA(); r != 0 || bl>>8 != 255 {
+		t.Errorf("expected blue corner, got r=%d b=%d", r>>8, bl>>8)
+	}
+}
+
+func TestRotateImage_TransparentBackground(t *testing.T) {
+	src := newSolidImage(20, 20, color.RGBA{G: 255, A: 255})
+	out := RotateImage(src, 30, color.Transparent)
+	if _, _, _, a := out.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected transparent corner, got alpha %d", a>>8)
+	}
+}
+
+// ---- Rotate / Flip operations ---------------------------------------------------
+
+func TestRotateOp_Validate(t *testing.T) {
+	tests := []struct {
+		op      RotateOp
+		wantErr bool
+	}{
+		{RotateOp{Angle: 90}, false},
+		{RotateOp{Angle: -33.5, Background: "#ffffff"}, false},
+		{RotateOp{Angle: 15, Background: "transparent"}, false},
+		{RotateOp{Angle: 400}, true},
+		{RotateOp{Angle: 10, Background: "white"}, true},
+	}
+	for _, tc := range tests {
+		if err := tc.op.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: want error %v, got %v", tc.op, tc.wantErr, err)
+		}
+	}
+}
+
+func TestFlipOp_Validate(t *testing.T) {
+	if err := (&FlipOp{Direction: "horizontal"}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (&FlipOp{Direction: "diagonal"}).Validate(); err == nil {
+		t.Error("expected error for unknown direction")
+	}
+}
+
+// ---- EXIF orientation -----------------------------------------------------------
+
+// withOrientation inserts an APP1 EXIF segment carrying the given orientation
+// right after the SOI marker of a JPEG.
+func withOrientation(t *testing.T, jpegData []byte, orientation uint16, order binary.ByteOrder) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8)) // IFD0 offset
+	binary.Write(&tiff, order, uint16(1)) // one entry
+	binary.Write(&tiff, order, uint16(exifOrientationTag))
+	binary.Write(&tiff, order, uint16(3)) // SHORT
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, orientation)
+	binary.Write(&tiff, order, uint16(0))
+	binary.Write(&tiff, order, uint32(0)) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegData[2:]...)
+}
+
+func TestReadOrientation(t *testing.T) {
+	base := toJPEG(t, newSolidImage(8, 4, color.RGBA{A: 255}))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := uint16(1); o <= 8; o++ {
+			if got := ReadOrientation(withOrientation(t, base, o, order)); got != int(o) {
+				t.Errorf("%v: want orientation %d, got %d", order, o, got)
+			}
+		}
+	}
+}
+
+func TestReadOrientation_Missing(t *testing.T) {
+	if got := ReadOrientation(toJPEG(t, newSolidImage(4, 4, color.RGBA{A: 255}))); got != 1 {
+		t.Errorf("want 1 without EXIF, got %d", got)
+	}
+	if got := ReadOrientation(toPNG(t, newSolidImage(4, 4, color.RGBA{A: 255}))); got != 1 {
+		t.Errorf("want 1 for PNG, got %d", got)
+	}
+	if got := ReadOrientation([]byte{0xFF, 0xD8, 0xFF}); got != 1 {
+		t.Errorf("want 1 for truncated data, got %d", got)
+	}
+}
+
+func TestDecodeImage_AppliesOrientation(t *testing.T) {
+	// An 80×40 landscape JPEG tagged "rotate 90 CW" must decode as 40×80 portrait
+	data := withOrientation(t, toJPEG(t, newSolidImage(80, 40, color.RGBA{R: 200, A: 255})), 6, binary.BigEndian)
+	img, _, err := DecodeImage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 80 {
+		t.Errorf("want 40×80, got %d×%d", b.Dx(), b.Dy())
+	}
+}
@@ -0,0 +1,217 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxVariants caps the number of renditions a single upload may request
+const MaxVariants = 10
+
+var variantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Variant is a named rendition of an image, e.g. a thumbnail.
+// Its pipeline runs on the result of the upload's main pipeline.
+type Variant struct {
+	Name     string        `json:"name"`
+	Pipeline Pipeline      `json:"pipeline"`
+	Output   OutputOptions `json:"output"`
+}
+
+// VariantError describes a variant that could not be parsed or validated
+type VariantError struct {
+	Name string // Variant name, if known
+	Err  error  // Underlying problem, possibly a *StepError
+}
+
+func (e *VariantError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("variant: %v", e.Err)
+	}
+	return fmt.Sprintf("variant %q: %v", e.Name, e.Err)
+}
+
+func (e *VariantError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks the variant's name, pipeline and output options
+func (v Variant) Validate() error {
+	if !variantNamePattern.MatchString(v.Name) {
+		return &VariantError{Name: v.Name, Err: errors.New("name must be 1-32 lowercase letters, digits, '-' or '_'")}
+	}
+	if err := v.Pipeline.Validate(); err != nil {
+		return &VariantError{Name: v.Name, Err: err}
+	}
+	if err := v.Output.Validate(); err != nil {
+		return &VariantError{Name: v.Name, Err: err}
+	}
+	return nil
+}
+
+// Checks a whole variant set: size, uniqueness of names and each variant
+func ValidateVariants(variants []Variant) error {
+	if len(variants) > MaxVariants {
+		return fmt.Errorf("%d variants requested, maximum is %d", len(variants), MaxVariants)
+	}
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		if seen[v.Name] {
+			return &VariantError{Name: v.Name, Err: errors.New("duplicate variant name")}
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
+
+// Parses a variant set given either as a JSON array of Variant objects or
+// in the compact form, one variant per line or separated by semicolons:
+//
+//	thumb: 150x150 cover webp; web: 1200w jpeg q80
+//
+// Compact tokens: WxH, Nw or Nh (resize box), contain/cover/fill/inside (fit),
+// nearest/bilinear/bicubic/lanczos3 (filter), jpeg/png/gif/webp/auto (format),
+// qN (quality) and lossless.
+func ParseVariants(spec string) ([]Variant, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var variants []Variant
+	if strings.HasPrefix(spec, "[") {
+		parsed, err := parseJSONVariants(spec)
+		if err != nil {
+			return nil, err
+		}
+		variants = parsed
+	} else {
+		entries := strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' })
+		for _, entry := range entries {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			v, err := parseCompactVariant(entry)
+			if err != nil {
+				return nil, err
+			}
+			variants = append(variants, v)
+		}
+	}
+
+	if err := ValidateVariants(variants); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// Parses a JSON array of variants, attributing errors to the variant's name
+func parseJSONVariants(spec string) ([]Variant, error) {
+	var raw []struct {
+		Name     string          `json:"name"`
+		Pipeline json.RawMessage `json:"pipeline"`
+		Output   json.RawMessage `json:"output"`
+	}
+	if err := json.Unmarshal([]byte(spec), &raw); err != nil {
+		return nil, &VariantError{Err: err}
+	}
+
+	variants := make([]Variant, 0, len(raw))
+	for _, r := range raw {
+		v := Variant{Name: r.Name}
+		if len(r.Pipeline) > 0 {
+			p, err := ParsePipeline(r.Pipeline)
+			if err != nil {
+				return nil, &VariantError{Name: r.Name, Err: err}
+			}
+			v.Pipeline = p
+		}
+		if len(r.Output) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(r.Output))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&v.Output); err != nil {
+				return nil, &VariantError{Name: r.Name, Err: fmt.Errorf("invalid output: %w", err)}
+			}
+		}
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// Parses a single "name: token token ..." entry
+func parseCompactVariant(entry string) (Variant, error) {
+	name, rest, ok := strings.Cut(entry, ":")
+	name = strings.TrimSpace(name)
+	if !ok {
+		return Variant{}, &VariantError{Name: name, Err: errors.New(`expected "name: options"`)}
+	}
+
+	resize := &ResizeOp{}
+	var output OutputOptions
+	for _, token := range strings.Fields(strings.ToLower(rest)) {
+		if err := applyCompactToken(token, resize, &output); err != nil {
+			return Variant{}, &VariantError{Name: name, Err: err}
+		}
+	}
+
+	v := Variant{Name: name, Output: output}
+	if resize.Width > 0 || resize.Height > 0 {
+		v.Pipeline = NewPipeline(resize)
+	} else if resize.Fit != "" || resize.Filter != "" {
+		return Variant{}, &VariantError{Name: name, Err: errors.New("fit and filter need a size such as 300x200 or 300w")}
+	}
+	return v, nil
+}
+
+// Applies one compact token to the resize step or output options
+func applyCompactToken(token string, resize *ResizeOp, output *OutputOptions) error {
+	switch token {
+	case FitContain, FitCover, FitFill, FitInside:
+		resize.Fit = token
+		return nil
+	case "lossless":
+		output.Lossless = true
+		return nil
+	case "jpg", FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatAuto:
+		output.Format = token
+		return nil
+	}
+	if _, ok := resizeFilters[token]; ok {
+		resize.Filter = token
+		return nil
+	}
+
+	atoi := func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid token %q", token)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(token, "q"):
+		output.Quality, err = atoi(token[1:])
+	case strings.HasSuffix(token, "w"):
+		resize.Width, err = atoi(strings.TrimSuffix(token, "w"))
+	case strings.HasSuffix(token, "h"):
+		resize.Height, err = atoi(strings.TrimSuffix(token, "h"))
+	case strings.Contains(token, "x"):
+		w, h, _ := strings.Cut(token, "x")
+		if resize.Width, err = atoi(w); err == nil {
+			resize.Height, err = atoi(h)
+		}
+	default:
+		err = fmt.Errorf("unknown token %q", token)
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"image/color"
+	"testing"
+)
+
+// ---- ParseVariants --------------------------------------------------------------
+
+func TestParseVariants_Compact(t *testing.T) {
+	variants, err := ParseVariants("thumb: 150x150 cover webp; web: 1200w jpeg q80\nlogo: png")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(variants) != 3 {
+		t.Fatalf("want 3 variants, got %d", len(variants))
+	}
+
+	thumb := variants[0]
+	if thumb.Name != "thumb" || thumb.Output.Format != FormatWebP {
+		t.Errorf("thumb: got %+v", thumb)
+	}
+	resize, ok := thumb.Pipeline.Steps[0].(*ResizeOp)
+	if !ok || resize.Width != 150 || resize.Height != 150 || resize.Fit != FitCover {
+		t.Errorf("thumb: unexpected resize step %+v", thumb.Pipeline.Steps[0])
+	}
+
+	web := variants[1]
+	if web.Output.Quality != 80 || web.Output.Format != FormatJPEG {
+		t.Errorf("web: got output %+v", web.Output)
+	}
+	if r := web.Pipeline.Steps[0].(*ResizeOp); r.Width != 1200 || r.Height != 0 {
+		t.Errorf("web: unexpected resize step %+v", r)
+	}
+
+	if logo := variants[2]; len(logo.Pipeline.Steps) != 0 || logo.Output.Format != FormatPNG {
+		t.Errorf("logo: want a format-only variant, got %+v", logo)
+	}
+}
+
+func TestParseVariants_JSON(t *testing.T) {
+	spec := `[{"name":"small","pipeline":[{"op":"resize","params":{"width":64}},{"op":"flip","params":{"direction":"horizontal"}}],"output":{"format":"png"}}]`
+	variants, err := ParseVariants(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(variants) != 1 || variants[0].Name != "small" {
+		t.Fatalf("unexpected variants %+v", variants)
+	}
+	if got := variants[0].Pipeline.Names(); len(got) != 2 || got[1] != "flip" {
+		t.Errorf("unexpected pipeline %v", got)
+	}
+}
+
+func TestParseVariants_Empty(t *testing.T) {
+	variants, err := ParseVariants("  ")
+	if err != nil || variants != nil {
+		t.Errorf("want no variants and no error, got %v, %v", variants, err)
+	}
+}
+
+func TestParseVariants_Errors(t *testing.T) {
+	tests := []struct {
+		spec     string
+		wantName string
+	}{
+		{"thumb 150x150", "thumb 150x150"},
+		{"thumb: 0x150", "thumb"},
+		{"thumb: 150x150 sepia", "thumb"},
+		{"thumb: cover", "thumb"},
+		{"thumb: png lossless", "thumb"},
+		{"Thumb: 150w", "Thumb"},
+		{"a: 10w; a: 20w", "a"},
+		{`[{"name":"x","pipeline":[{"op":"melt"}]}]`, "x"},
+		{`[{"name":"x","output":{"fromat":"png"}}]`, "x"},
+	}
+	for _, tc := range tests {
+		_, err := ParseVariants(tc.spec)
+		var ve *VariantError
+		if !errors.As(err, &ve) {
+			t.Errorf("%q: want *VariantError, got %v", tc.spec, err)
+			continue
+		}
+		if ve.Name != tc.wantName {
+			t.Errorf("%q: want variant %q, got %q", tc.spec, tc.wantName, ve.Name)
+		}
+	}
+}
+
+func TestParseVariants_StepErrorIsReachable(t *testing.T) {
+	_, err := ParseVariants(`[{"name":"x","pipeline":[{"op":"resize","params":{"width":10}},{"op":"rotate","params":{"angle":720}}]}]`)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Index != 1 || stepErr.Op != "rotate" {
+		t.Errorf("want step 1 (rotate), got %v", err)
+	}
+}
+
+func TestParseVariants_TooMany(t *testing.T) {
+	spec := ""
+	for i := 0; i <= MaxVariants; i++ {
+		spec += string(rune('a'+i)) + ": 10w;"
+	}
+	if _, err := ParseVariants(spec); err == nil {
+		t.Errorf("expected error for %d variants", MaxVariants+1)
+	}
+}
+
+// ---- Task round trip ------------------------------------------------------------
+
+func TestVariant_JSONRoundTrip(t *testing.T) {
+	variants, err := ParseVariants("thumb: 40x30 fill png")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	data, err := json.Marshal(variants)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded []Variant
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	src := newSolidImage(200, 100, color.RGBA{R: 200, A: 255})
+	out, err := decoded[0].Pipeline.Apply(src)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if b := out.Bounds(); b.Dx() != 40 || b.Dy() != 30 {
+		t.Errorf("want 40×30, got %d×%d", b.Dx(), b.Dy())
+	}
+	if enc, _ := NewEncoder(decoded[0].Output, "jpeg"); enc.ContentType() != "image/png" {
+		t.Errorf("want png output, got %s", enc.ContentType())
+	}
+}
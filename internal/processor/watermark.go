@@ -0,0 +1,329 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Gravities placing a watermark on the image
+const (
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravitySouth     = "south"
+	GravityEast      = "east"
+	GravityWest      = "west"
+	GravityNorthEast = "northeast"
+	GravityNorthWest = "northwest"
+	GravitySouthEast = "southeast"
+	GravitySouthWest = "southwest"
+)
+
+const (
+	DefaultWatermarkGravity  = GravitySouthEast
+	DefaultWatermarkOpacity  = 0.5
+	DefaultWatermarkMargin   = 0.02 // Of the output's shorter side
+	DefaultWatermarkScale    = 0.2  // Logo width, of the output width
+	DefaultWatermarkTextSize = 0.05 // Font size, of the output's shorter side
+	DefaultWatermarkFont     = "regular"
+	DefaultWatermarkColor    = "#ffffff"
+
+	MaxWatermarkTextLength = 200 // In characters
+)
+
+// Fonts embedded for text watermarks
+var watermarkFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"mono":    gomono.TTF,
+}
+
+// Parsed watermark fonts, by name
+var (
+	parsedFontsMu sync.Mutex
+	parsedFonts   = map[string]*opentype.Font{}
+)
+
+// Returns the parsed embedded font with the given name
+func watermarkFont(name string) (*opentype.Font, error) {
+	parsedFontsMu.Lock()
+	defer parsedFontsMu.Unlock()
+	if f, ok := parsedFonts[name]; ok {
+		return f, nil
+	}
+	data, ok := watermarkFonts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown font %q", name)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	parsedFonts[name] = f
+	return f, nil
+}
+
+// Image IDs are UUIDs
+var imageIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// LogoLoader returns the decoded image with the given ID, for watermarks
+// that use one of the user's images as a logo
+type LogoLoader func(imageID string) (image.Image, error)
+
+// Loads the logo of every image watermark in the pipeline. It must be
+// called before Apply when the pipeline holds any.
+func (p Pipeline) LoadLogos(load LogoLoader) error {
+	for i, op := range p.Steps {
+		wm, ok := op.(*WatermarkOp)
+		if !ok || wm.Image == "" {
+			continue
+		}
+		logo, err := load(wm.Image)
+		if err != nil {
+			return &StepError{Index: i, Op: op.Name(), Err: err}
+		}
+		wm.logo = logo
+	}
+	return nil
+}
+
+// Renders a single line of text in the given font and color on a
+// transparent image just large enough to hold it. The font shrinks when
+// the line would be wider than maxWidth.
+func renderText(text string, f *opentype.Font, size float64, c color.Color, maxWidth int) (*image.RGBA, error) {
+	newFace := func(size float64) (font.Face, error) {
+		return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	}
+	face, err := newFace(size)
+	if err != nil {
+		return nil, err
+	}
+	if width := font.MeasureString(face, text).Ceil(); width > maxWidth && maxWidth > 0 {
+		face.Close()
+		if face, err = newFace(max(1, size*float64(maxWidth)/float64(width))); err != nil {
+			return nil, err
+		}
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	stamp := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	d := font.Drawer{
+		Dst:  stamp,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.Point26_6{Y: metrics.Ascent},
+	}
+	d.DrawString(text)
+	return stamp, nil
+}
+
+// Returns the top-left corner of a w×h stamp placed on bounds by gravity,
+// margin pixels in from the edges it is drawn towards
+func gravityPoint(bounds image.Rectangle, w, h, margin int, gravity string) image.Point {
+	x := bounds.Min.X + (bounds.Dx()-w)/2
+	y := bounds.Min.Y + (bounds.Dy()-h)/2
+	switch gravity {
+	case GravityWest, GravityNorthWest, GravitySouthWest:
+		x = bounds.Min.X + margin
+	case GravityEast, GravityNorthEast, GravitySouthEast:
+		x = bounds.Max.X - w - margin
+	}
+	switch gravity {
+	case GravityNorth, GravityNorthWest, GravityNorthEast:
+		y = bounds.Min.Y + margin
+	case GravitySouth, GravitySouthWest, GravitySouthEast:
+		y = bounds.Max.Y - h - margin
+	}
+	return image.Pt(x, y)
+}
+
+// Draws stamp over a copy of img with the given opacity, once at gravity
+// or, when tile is set, repeated across the whole image margin pixels apart
+func overlay(img, stamp image.Image, opacity float64, gravity string, margin int, tile bool) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+	sb := stamp.Bounds()
+	place := func(at image.Point) {
+		r := image.Rectangle{Min: at, Max: at.Add(sb.Size())}
+		draw.DrawMask(dst, r, stamp, sb.Min, mask, image.Point{}, draw.Over)
+	}
+
+	if !tile {
+		place(gravityPoint(dst.Bounds(), sb.Dx(), sb.Dy(), margin, gravity))
+		return dst
+	}
+	stepX, stepY := sb.Dx()+max(margin, 1), sb.Dy()+max(margin, 1)
+	for y := margin; y < b.Dy(); y += stepY {
+		for x := margin; x < b.Dx(); x += stepX {
+			place(image.Pt(x, y))
+		}
+	}
+	return dst
+}
+
+// WatermarkOp overlays a logo, one of the user's images, or a line of text.
+// Sizes and the margin are fractions of the output, so the watermark looks
+// the same on every rendition; zero values take the defaults.
+type WatermarkOp struct {
+	Image   string  `json:"image,omitempty"`   // ID of the user's image to use as a logo
+	Scale   float64 `json:"scale,omitempty"`   // Logo width, of the output width
+	Text    string  `json:"text,omitempty"`    // Text to draw instead of a logo
+	Font    string  `json:"font,omitempty"`    // regular (default), bold or mono
+	Size    float64 `json:"size,omitempty"`    // Font size, of the output's shorter side
+	Color   string  `json:"color,omitempty"`   // Text color "#rrggbb", white by default
+	Gravity string  `json:"gravity,omitempty"` // center, a side or a corner such as southeast (default)
+	Tile    bool    `json:"tile,omitempty"`    // Repeat across the whole image instead
+	Opacity float64 `json:"opacity,omitempty"` // 0 to 1
+	Margin  float64 `json:"margin,omitempty"`  // Gap to the edges and between tiles, of the output's shorter side
+
+	logo image.Image // Set by Pipeline.LoadLogos
+}
+
+func (op *WatermarkOp) Name() string { return "watermark" }
+
+func (op *WatermarkOp) scale() float64 {
+	if op.Scale == 0 {
+		return DefaultWatermarkScale
+	}
+	return op.Scale
+}
+
+func (op *WatermarkOp) font() string {
+	if op.Font == "" {
+		return DefaultWatermarkFont
+	}
+	return op.Font
+}
+
+func (op *WatermarkOp) size() float64 {
+	if op.Size == 0 {
+		return DefaultWatermarkTextSize
+	}
+	return op.Size
+}
+
+func (op *WatermarkOp) color() string {
+	if op.Color == "" {
+		return DefaultWatermarkColor
+	}
+	return op.Color
+}
+
+func (op *WatermarkOp) gravity() string {
+	if op.Gravity == "" {
+		return DefaultWatermarkGravity
+	}
+	return op.Gravity
+}
+
+func (op *WatermarkOp) opacity() float64 {
+	if op.Opacity == 0 {
+		return DefaultWatermarkOpacity
+	}
+	return op.Opacity
+}
+
+func (op *WatermarkOp) margin() float64 {
+	if op.Margin == 0 {
+		return DefaultWatermarkMargin
+	}
+	return op.Margin
+}
+
+func (op *WatermarkOp) Validate() error {
+	switch {
+	case op.Image == "" && op.Text == "":
+		return errors.New("image or text is required")
+	case op.Image != "" && op.Text != "":
+		return errors.New("image and text cannot be combined")
+	}
+
+	if op.Image != "" {
+		if !imageIDPattern.MatchString(op.Image) {
+			return fmt.Errorf("invalid image ID %q", op.Image)
+		}
+		if op.Font != "" || op.Size != 0 || op.Color != "" {
+			return errors.New("font, size and color apply to text watermarks")
+		}
+		if !inRange(op.Scale, 0, 1) {
+			return fmt.Errorf("scale must be between 0 and 1, got %v", op.Scale)
+		}
+	} else {
+		if n := utf8.RuneCountInString(op.Text); n > MaxWatermarkTextLength {
+			return fmt.Errorf("text must be at most %d characters, got %d", MaxWatermarkTextLength, n)
+		}
+		if op.Scale != 0 {
+			return errors.New("scale applies to image watermarks; use size for text")
+		}
+		if _, ok := watermarkFonts[op.font()]; !ok {
+			return fmt.Errorf("unknown font %q (want regular, bold or mono)", op.Font)
+		}
+		if !inRange(op.Size, 0, 0.5) {
+			return fmt.Errorf("size must be between 0 and 0.5, got %v", op.Size)
+		}
+		if _, err := ParseHexColor(op.color()); err != nil {
+			return fmt.Errorf("invalid color %q", op.Color)
+		}
+	}
+
+	if !isGravity(op.gravity()) {
+		return fmt.Errorf("unknown gravity %q (want center, north, south, east, west, northeast, northwest, southeast or southwest)", op.Gravity)
+	}
+	if !inRange(op.Opacity, 0, 1) {
+		return fmt.Errorf("opacity must be between 0 and 1, got %v", op.Opacity)
+	}
+	if !inRange(op.Margin, 0, 0.25) {
+		return fmt.Errorf("margin must be between 0 and 0.25, got %v", op.Margin)
+	}
+	return nil
+}
+
+func (op *WatermarkOp) Apply(img image.Image) (image.Image, error) {
+	b := img.Bounds()
+	shorter := float64(min(b.Dx(), b.Dy()))
+	margin := int(math.Round(op.margin() * shorter))
+
+	var stamp image.Image
+	if op.Image != "" {
+		if op.logo == nil {
+			return nil, fmt.Errorf("logo %s was not loaded", op.Image)
+		}
+		// Tall logos are kept within the image height
+		width := max(1, int(math.Round(op.scale()*float64(b.Dx()))))
+		height := max(1, b.Dy()-2*margin)
+		stamp = ResizeImageWith(op.logo, ResizeOptions{Width: width, Height: height, Fit: FitContain})
+	} else {
+		f, err := watermarkFont(op.font())
+		if err != nil {
+			return nil, err
+		}
+		c, err := ParseHexColor(op.color())
+		if err != nil {
+			return nil, err
+		}
+		size := max(1, op.size()*shorter)
+		if stamp, err = renderText(op.Text, f, size, c, b.Dx()-2*margin); err != nil {
+			return nil, err
+		}
+	}
+	return overlay(img, stamp, op.opacity(), op.gravity(), margin, op.Tile), nil
+}
@@ -0,0 +1,254 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+const testLogoID = "3f2b8c1e-6a4d-4e2f-9b7a-1c5d8e9f0a12"
+
+// newLogo returns a w×h opaque red logo
+func newLogo(w, h int) *image.RGBA {
+	return newSolidImage(w, h, color.RGBA{R: 255, A: 255})
+}
+
+// Parses a one-step watermark pipeline and loads newLogo(40, 20) for it
+func parseWatermark(t *testing.T, params string) Pipeline {
+	t.Helper()
+	p, err := ParsePipeline([]byte(fmt.Sprintf(`[{"op":"watermark","params":%s}]`, params)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	err = p.LoadLogos(func(string) (image.Image, error) { return newLogo(40, 20), nil })
+	if err != nil {
+		t.Fatalf("load logos: %v", err)
+	}
+	return p
+}
+
+// Returns the bounds of the pixels of img that differ from the solid color c
+func changedBounds(img image.Image, c color.Color) image.Rectangle {
+	want := color.RGBAModel.Convert(c)
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.RGBAModel.Convert(img.At(x, y)) != want {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+// ---- Golden images --------------------------------------------------------------
+
+func TestWatermark_Golden(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+	}{
+		{"watermark_text", `{"text":"© Demo","size":0.4,"color":"#000000","gravity":"center","opacity":1}`},
+		{"watermark_logo", `{"image":"` + testLogoID + `","scale":0.25,"gravity":"northwest","margin":0.125}`},
+		{"watermark_tiled", `{"image":"` + testLogoID + `","scale":0.125,"tile":true,"margin":0.0625}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := parseWatermark(t, tc.params).Apply(newColorChart())
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			assertGolden(t, tc.name, out)
+		})
+	}
+}
+
+// ---- Placement ------------------------------------------------------------------
+
+func TestWatermark_Gravity(t *testing.T) {
+	// A 20×10 logo on a 100×50 image with a 5 pixel margin
+	tests := []struct {
+		gravity string
+		want    image.Rectangle
+	}{
+		{GravityNorthWest, image.Rect(5, 5, 25, 15)},
+		{GravityNorth, image.Rect(40, 5, 60, 15)},
+		{GravityNorthEast, image.Rect(75, 5, 95, 15)},
+		{GravityWest, image.Rect(5, 20, 25, 30)},
+		{GravityCenter, image.Rect(40, 20, 60, 30)},
+		{GravityEast, image.Rect(75, 20, 95, 30)},
+		{GravitySouthWest, image.Rect(5, 35, 25, 45)},
+		{GravitySouth, image.Rect(40, 35, 60, 45)},
+		{GravitySouthEast, image.Rect(75, 35, 95, 45)},
+	}
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	for _, tc := range tests {
+		t.Run(tc.gravity, func(t *testing.T) {
+			p := parseWatermark(t, fmt.Sprintf(`{"image":%q,"gravity":%q,"margin":0.1}`, testLogoID, tc.gravity))
+			out, err := p.Apply(newSolidImage(100, 50, white))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if got := changedBounds(out, white); got != tc.want {
+				t.Errorf("want the logo at %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWatermark_Opacity(t *testing.T) {
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	for _, tc := range []struct {
+		params string
+		want   color.RGBA
+	}{
+		{`{"image":"` + testLogoID + `","gravity":"center"}`, color.RGBA{R: 255, G: 127, B: 127, A: 255}},
+		{`{"image":"` + testLogoID + `","gravity":"center","opacity":1}`, color.RGBA{R: 255, A: 255}},
+		{`{"image":"` + testLogoID + `","gravity":"center","opacity":0.2}`, color.RGBA{R: 255, G: 204, B: 204, A: 255}},
+	} {
+		out, err := parseWatermark(t, tc.params).Apply(newSolidImage(100, 50, white))
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		got := color.RGBAModel.Convert(out.At(50, 25)).(color.RGBA)
+		for i, d := range []int{int(got.R) - int(tc.want.R), int(got.G) - int(tc.want.G), int(got.B) - int(tc.want.B)} {
+			if d < -1 || d > 1 {
+				t.Errorf("%s: channel %d: want %v, got %v", tc.params, i, tc.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestWatermark_Tile(t *testing.T) {
+	// 20×10 tiles, 5 pixels apart, starting 5 pixels in
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	p := parseWatermark(t, `{"image":"`+testLogoID+`","tile":true,"opacity":1,"margin":0.1}`)
+	out, err := p.Apply(newSolidImage(100, 50, white))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for _, pt := range []image.Point{{5, 5}, {30, 5}, {55, 20}, {80, 35}, {99, 44}} {
+		if c := color.RGBAModel.Convert(out.At(pt.X, pt.Y)); c != (color.RGBA{R: 255, A: 255}) {
+			t.Errorf("want a tile at %v, got %v", pt, c)
+		}
+	}
+	for _, pt := range []image.Point{{2, 2}, {27, 5}, {30, 17}} {
+		if c := color.RGBAModel.Convert(out.At(pt.X, pt.Y)); c != white {
+			t.Errorf("want a gap at %v, got %v", pt, c)
+		}
+	}
+}
+
+func TestWatermark_TallLogoFitsTheImage(t *testing.T) {
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	p := parseWatermark(t, `{"image":"`+testLogoID+`","scale":1}`)
+	p.Steps[0].(*WatermarkOp).logo = newLogo(10, 100)
+	out, err := p.Apply(newSolidImage(100, 50, white))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := changedBounds(out, white); got.Dy() != 48 || got.Min.Y != 1 {
+		t.Errorf("want the logo inside the 1 pixel margin, got %v", got)
+	}
+}
+
+func TestWatermark_Text(t *testing.T) {
+	black := color.RGBA{A: 255}
+	p := parseWatermark(t, `{"text":"Copyright","color":"#ff0000","gravity":"southwest","opacity":1}`)
+	out, err := p.Apply(newSolidImage(400, 200, black))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	got := changedBounds(out, black)
+	if got.Empty() || got.Min.X < 4 || got.Max.Y > 196 || got.Dy() > 15 {
+		t.Errorf("want 10px text in the bottom left corner, got %v", got)
+	}
+	// Glyphs are drawn in the text color, antialiased against the black
+	for y := got.Min.Y; y < got.Max.Y; y++ {
+		for x := got.Min.X; x < got.Max.X; x++ {
+			if c := color.RGBAModel.Convert(out.At(x, y)).(color.RGBA); c.G != 0 || c.B != 0 {
+				t.Fatalf("want only shades of red, got %v at (%d,%d)", c, x, y)
+			}
+		}
+	}
+}
+
+func TestWatermark_LongTextShrinksToFit(t *testing.T) {
+	black := color.RGBA{A: 255}
+	p := parseWatermark(t, `{"text":"A rather long line of watermark text","size":0.5,"gravity":"center"}`)
+	out, err := p.Apply(newSolidImage(200, 100, black))
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := changedBounds(out, black); got.Empty() || got.Min.X < 2 || got.Max.X > 198 {
+		t.Errorf("want the text within the margins, got %v", got)
+	}
+}
+
+// ---- Logos ----------------------------------------------------------------------
+
+func TestLoadLogos(t *testing.T) {
+	p, err := ParsePipeline([]byte(`[{"op":"grayscale"},
+		{"op":"watermark","params":{"text":"hi"}},
+		{"op":"watermark","params":{"image":"` + testLogoID + `"}}]`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var loaded []string
+	err = p.LoadLogos(func(id string) (image.Image, error) {
+		loaded = append(loaded, id)
+		return nil, errors.New("not yours")
+	})
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Index != 2 || stepErr.Op != "watermark" {
+		t.Fatalf("want a StepError for step 2, got %v", err)
+	}
+	if len(loaded) != 1 || loaded[0] != testLogoID {
+		t.Errorf("want only the logo loaded, got %v", loaded)
+	}
+}
+
+func TestWatermark_LogoNotLoaded(t *testing.T) {
+	op := &WatermarkOp{Image: testLogoID}
+	if _, err := op.Apply(newSolidImage(10, 10, color.RGBA{A: 255})); err == nil {
+		t.Error("want an error for a logo that was not loaded")
+	}
+}
+
+// ---- Watermark validation -------------------------------------------------------
+
+func TestWatermark_Validate(t *testing.T) {
+	tests := []struct {
+		op      WatermarkOp
+		wantErr bool
+	}{
+		{WatermarkOp{Text: "© Example"}, false},
+		{WatermarkOp{Text: "x", Font: "mono", Size: 0.1, Color: "#336699", Gravity: GravityNorth, Opacity: 1, Margin: 0.25}, false},
+		{WatermarkOp{Image: testLogoID, Scale: 0.5, Tile: true}, false},
+		{WatermarkOp{}, true},
+		{WatermarkOp{Image: testLogoID, Text: "x"}, true},
+		{WatermarkOp{Image: "logo.png"}, true},
+		{WatermarkOp{Image: testLogoID, Scale: 1.5}, true},
+		{WatermarkOp{Image: testLogoID, Color: "#ffffff"}, true},
+		{WatermarkOp{Text: "x", Scale: 0.5}, true},
+		{WatermarkOp{Text: "x", Font: "comic"}, true},
+		{WatermarkOp{Text: "x", Size: 0.6}, true},
+		{WatermarkOp{Text: "x", Color: "white"}, true},
+		{WatermarkOp{Text: "x", Gravity: "top"}, true},
+		{WatermarkOp{Text: "x", Opacity: -0.5}, true},
+		{WatermarkOp{Text: "x", Margin: 0.3}, true},
+		{WatermarkOp{Text: strings.Repeat("é", MaxWatermarkTextLength)}, false},
+		{WatermarkOp{Text: strings.Repeat("é", MaxWatermarkTextLength+1)}, true},
+	}
+	for _, tc := range tests {
+		if err := tc.op.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: want error %v, got %v", tc.op, tc.wantErr, err)
+		}
+	}
+}
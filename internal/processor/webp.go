@@ -0,0 +1,36 @@
+package processor
+
+import (
+	"errors"
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// WebP output is encoded by libwebp (bundled with github.com/chai2010/webp,
+// so the build needs cgo). Lossy files use VP8 and lossless files VP8L.
+
+// Largest width or height libwebp can encode
+const webpMaxDimension = 16383
+
+// Writes an image as a WebP file: lossless (VP8L) when lossless is set,
+// otherwise lossy (VP8) at the given 1-100 quality
+func encodeWebP(w io.Writer, img image.Image, quality int, lossless bool) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > webpMaxDimension || b.Dy() > webpMaxDimension {
+		return errors.New("webp: image dimensions must be between 1 and 16383")
+	}
+
+	// libwebp expects non-premultiplied RGBA, but the library passes the
+	// bytes of an *image.RGBA through unchanged. Handing it NRGBA bytes keeps
+	// semi-transparent pixels from darkening.
+	src := toNRGBA(img)
+	straight := &image.RGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+
+	return webp.Encode(w, straight, &webp.Options{
+		Lossless: lossless,
+		Quality:  float32(quality),
+		Exact:    lossless,
+	})
+}
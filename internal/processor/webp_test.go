@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// newNoisyImage creates a w×h NRGBA image with smooth gradients, a few flat
+// areas, random noise and partial transparency, exercising every coding path.
+func newNoisyImage(w, h int, seed int64) *image.NRGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x + y), A: 255}
+			switch {
+			case x < w/4:
+				c = color.NRGBA{R: 30, G: 60, B: 90, A: 255}
+			case y > h*3/4:
+				c.A = uint8(x * 7)
+			case (x+y)%7 == 0:
+				c.R = uint8(rng.Intn(256))
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func decodeWebP(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode webp: %v", err)
+	}
+	return img
+}
+
+// Reports the fourCC of the first chunk after the RIFF WEBP header
+func webpChunk(data []byte) string {
+	if len(data) < 16 {
+		return ""
+	}
+	return string(data[12:16])
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func TestEncodeWebP_LosslessRoundTrip(t *testing.T) {
+	sizes := [][2]int{{1, 1}, {2, 3}, {17, 5}, {64, 48}, {131, 77}}
+	for _, size := range sizes {
+		src := newNoisyImage(size[0], size[1], int64(size[0]))
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, src, 0, true); err != nil {
+			t.Fatalf("%v: encode: %v", size, err)
+		}
+		if chunk := webpChunk(buf.Bytes()); chunk != "VP8L" {
+			t.Fatalf("%v: lossless output should be VP8L, got %q", size, chunk)
+		}
+		out := decodeWebP(t, buf.Bytes())
+		if out.Bounds().Dx() != size[0] || out.Bounds().Dy() != size[1] {
+			t.Fatalf("%v: got %v", size, out.Bounds())
+		}
+		for y := 0; y < size[1]; y++ {
+			for x := 0; x < size[0]; x++ {
+				want := src.NRGBAAt(x, y)
+				got := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+				if want != got {
+					t.Fatalf("%v: pixel (%d,%d): want %v, got %v", size, x, y, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeWebP_SolidImageIsSmall(t *testing.T) {
+	src := newSolidImage(256, 256, color.RGBA{R: 10, G: 200, B: 30, A: 255})
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, src, 0, true); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if buf.Len() > 512 {
+		t.Errorf("solid 256×256 image should compress well, got %d bytes", buf.Len())
+	}
+	decodeWebP(t, buf.Bytes())
+}
+
+func TestEncodeWebP_LossyIsVP8AndSmaller(t *testing.T) {
+	src := newNoisyImage(120, 80, 7)
+	var lossless, lossy bytes.Buffer
+	if err := encodeWebP(&lossless, src, 0, true); err != nil {
+		t.Fatalf("encode lossless: %v", err)
+	}
+	if err := encodeWebP(&lossy, src, 50, false); err != nil {
+		t.Fatalf("encode lossy: %v", err)
+	}
+	if lossy.Len() >= lossless.Len() {
+		t.Errorf("lossy (%d bytes) should be smaller than lossless (%d bytes)", lossy.Len(), lossless.Len())
+	}
+	// Transparent lossy images start with a VP8X header; the VP8 data follows
+	// the alpha chunk
+	if !bytes.Contains(lossy.Bytes(), []byte("VP8 ")) || bytes.Contains(lossy.Bytes(), []byte("VP8L")) {
+		t.Errorf("lossy output should be VP8, starts with %q", webpChunk(lossy.Bytes()))
+	}
+	out := decodeWebP(t, lossy.Bytes())
+	want := src.NRGBAAt(15, 10) // Inside the flat area
+	got := color.NRGBAModel.Convert(out.At(15, 10)).(color.NRGBA)
+	if absDiff(want.R, got.R) > 12 || absDiff(want.G, got.G) > 12 || absDiff(want.B, got.B) > 12 || got.A != 255 {
+		t.Errorf("lossy pixel drifted too far: want %v, got %v", want, got)
+	}
+}
+
+func TestEncodeWebP_QualityControlsSize(t *testing.T) {
+	src := newNoisyImage(160, 120, 3)
+	var low, high bytes.Buffer
+	if err := encodeWebP(&low, src, 20, false); err != nil {
+		t.Fatalf("encode q20: %v", err)
+	}
+	if err := encodeWebP(&high, src, 95, false); err != nil {
+		t.Fatalf("encode q95: %v", err)
+	}
+	if low.Len() >= high.Len() {
+		t.Errorf("quality 20 (%d bytes) should be smaller than quality 95 (%d bytes)", low.Len(), high.Len())
+	}
+}
+
+func TestEncodeWebP_OpaqueLossyHasNoAlpha(t *testing.T) {
+	src := newSolidImage(32, 32, color.RGBA{R: 200, G: 40, B: 40, A: 255})
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, src, 80, false); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if chunk := webpChunk(buf.Bytes()); chunk != "VP8 " {
+		t.Errorf("opaque lossy output should be a simple VP8 file, got %q", chunk)
+	}
+}
+
+func TestEncodeWebP_RejectsOversizedImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, webpMaxDimension+1, 1))
+	if err := encodeWebP(&bytes.Buffer{}, src, 0, true); err == nil {
+		t.Error("expected error for image wider than 16383 pixels")
+	}
+}
@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Hash of dead-letter ID → JSON-encoded DeadLetter
+const DeadLetterKey = "image_tasks:dead"
+
+// Returned when a dead-letter ID does not exist
+var ErrDeadLetterNotFound = errors.New("queue: dead letter not found")
+
+// DeadLetter is a task that exhausted its retries or failed permanently
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Task      string    `json:"task"`
+	ImageID   string    `json:"image_id,omitempty"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// Uses the task ID so the same task is never dead-lettered twice; entries
+// too broken to carry an ID are keyed by a hash of the raw string
+func deadLetterID(raw string, t Task) string {
+	if t.ID != "" {
+		return t.ID
+	}
+	sum := sha256.Sum256([]byte(raw))
+	return "raw-" + hex.EncodeToString(sum[:8])
+}
+
+// Stores a raw queue entry in the dead-letter queue and drops its retry
+// bookkeeping. t is the entry as far as it could be decoded.
+func AddDeadLetter(ctx context.Context, raw string, t Task, attempts int, lastErr error) (DeadLetter, error) {
+	dl := DeadLetter{
+		ID:        deadLetterID(raw, t),
+		Task:      raw,
+		ImageID:   t.ImageID,
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return dl, err
+	}
+	_, err = Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, DeadLetterKey, dl.ID, data)
+		pipe.HDel(ctx, attemptsKey, t.ID)
+		pipe.HDel(ctx, errorsKey, t.ID)
+		return nil
+	})
+	return dl, err
+}
+
+// Lists dead-lettered tasks, most recent failure first
+func ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	raw, err := Rdb.HVals(ctx, DeadLetterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(raw))
+	for _, r := range raw {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(r), &dl); err != nil {
+			return nil, err
+		}
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.After(letters[j].FailedAt) })
+	return letters, nil
+}
+
+// Retrieves a single dead-lettered task
+func GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	var dl DeadLetter
+	raw, err := Rdb.HGet(ctx, DeadLetterKey, id).Result()
+	if err == redis.Nil {
+		return dl, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return dl, err
+	}
+	err = json.Unmarshal([]byte(raw), &dl)
+	return dl, err
+}
+
+// Removes the dead letter ARGV[1] from the hash KEYS[1] and pushes its task
+// onto the queue KEYS[2], returning the entry, or false when there is none.
+// Running as a script means a task is never both dead-lettered and queued,
+// nor lost between the two, and concurrent requeues push it only once.
+var requeueScript = redis.NewScript(`
+local entry = redis.call('HGET', KEYS[1], ARGV[1])
+if not entry then
+	return false
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('LPUSH', KEYS[2], cjson.decode(entry).task)
+return entry
+`)
+
+// Puts a dead-lettered task back on the queue with a fresh attempt count
+func RequeueDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	var dl DeadLetter
+	raw, err := requeueScript.Run(ctx, Rdb, []string{DeadLetterKey, TaskQueue}, id).Text()
+	if err == redis.Nil {
+		return dl, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return dl, err
+	}
+	err = json.Unmarshal([]byte(raw), &dl)
+	return dl, err
+}
+
+// Deletes the given dead-lettered tasks, or all of them when no IDs are given,
+// and returns how many were removed
+func PurgeDeadLetters(ctx context.Context, ids ...string) (int, error) {
+	if len(ids) == 0 {
+		n, err := Rdb.HLen(ctx, DeadLetterKey).Result()
+		if err != nil {
+			return 0, err
+		}
+		return int(n), Rdb.Del(ctx, DeadLetterKey).Err()
+	}
+	n, err := Rdb.HDel(ctx, DeadLetterKey, ids...).Result()
+	return int(n), err
+}
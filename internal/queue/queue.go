@@ -3,38 +3,156 @@ package queue
 
 import (
 	"context"
-	"github.com/redis/go-redis/v9"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/config"
 	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 var Rdb *redis.Client
 
-// Initialize Redis client
-func init() {
-	// Get Redis URL from environment variable or use default
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		// Default fallback if environment variable is not set
-		Rdb = redis.NewClient(&redis.Options{
-			Addr: "localhost:6379",
-		})
-	} else {
-		// Parse the Redis URL from environment variable
-		opt, err := redis.ParseURL(redisURL)
-		if err != nil {
-			panic(err)
-		}
-		Rdb = redis.NewClient(opt)
+// Redis keys used by the queue
+const (
+	TaskQueue        = "image_tasks"             // Pending tasks; pushed on the left, consumed from the right
+	WorkersKey       = "image_tasks:workers"     // Set of worker IDs that may own in-flight tasks
+	processingPrefix = "image_tasks:processing:" // Per-worker list of in-flight tasks
+	heartbeatPrefix  = "image_tasks:heartbeat:"  // Per-worker liveness key with a TTL
+)
+
+// How long a worker may go without heartbeating before its tasks are re-queued
+const HeartbeatTTL = 30 * time.Second
+
+// Returned by Consumer.Dequeue when no task arrived before the timeout
+var ErrNoTask = errors.New("queue: no task available")
+
+// Creates the Redis client from the Redis settings. It is called once at
+// startup, before any other function in this package.
+func Connect(cfg config.Redis) error {
+	opt, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return err
 	}
+	Rdb = redis.NewClient(opt)
+	return nil
 }
 
 // Adds a task to the Redis queue
 func EnqueueTask(ctx context.Context, task string) error {
-	// "image_tasks" is the name of the Redis list queue
-	return Rdb.LPush(ctx, "image_tasks", task).Err()
+	return Rdb.LPush(ctx, TaskQueue, task).Err()
+}
+
+// Consumer takes tasks off the queue on behalf of one worker. Every task it
+// hands out stays in the worker's processing list until it is acknowledged,
+// so a crash never loses a task: once the heartbeat expires, ReapDeadWorkers
+// moves the task back onto the queue.
+type Consumer struct {
+	ID string
+}
+
+// Registers a worker and returns its consumer
+func NewConsumer(ctx context.Context, id string) (*Consumer, error) {
+	c := &Consumer{ID: id}
+	if err := c.Heartbeat(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns a worker ID that is unique across hosts and restarts
+func NewWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+func processingKey(workerID string) string { return processingPrefix + workerID }
+func heartbeatKey(workerID string) string  { return heartbeatPrefix + workerID }
+
+// Atomically moves the next task into this worker's processing list, waiting
+// up to timeout for one to arrive. Returns ErrNoTask when the wait times out.
+func (c *Consumer) Dequeue(ctx context.Context, timeout time.Duration) (string, error) {
+	task, err := Rdb.BLMove(ctx, TaskQueue, processingKey(c.ID), "RIGHT", "LEFT", timeout).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNoTask
+	}
+	return task, err
+}
+
+// Removes a finished task from the processing list
+func (c *Consumer) Ack(ctx context.Context, task string) error {
+	return Rdb.LRem(ctx, processingKey(c.ID), 1, task).Err()
+}
+
+// Refreshes the worker's liveness key and registration; call well within HeartbeatTTL.
+// Re-registering on every beat lets a worker that was reaped while unreachable recover.
+func (c *Consumer) Heartbeat(ctx context.Context) error {
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, heartbeatKey(c.ID), time.Now().Unix(), HeartbeatTTL)
+		pipe.SAdd(ctx, WorkersKey, c.ID)
+		return nil
+	})
+	return err
+}
+
+// Returns any unacknowledged tasks to the queue and unregisters the worker
+func (c *Consumer) Close(ctx context.Context) error {
+	if _, err := requeueAll(ctx, c.ID, false); err != nil {
+		return err
+	}
+	return Rdb.Del(ctx, heartbeatKey(c.ID)).Err()
 }
 
-// Fetches a task from the Redis queue
-func DequeueTask(ctx context.Context) (string, error) {
-	return Rdb.RPop(ctx, "image_tasks").Result()
+// Re-queues the in-flight tasks of every registered worker whose heartbeat
+// has expired and returns how many tasks were moved back
+func ReapDeadWorkers(ctx context.Context) (int, error) {
+	workers, err := Rdb.SMembers(ctx, WorkersKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, id := range workers {
+		// The heartbeat is checked again inside the script, so a worker
+		// that beats after SMEMBERS keeps its tasks
+		n, err := requeueAll(ctx, id, true)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Moves the processing list KEYS[2] back onto the consuming end of the queue
+// KEYS[3], newest first so the oldest task ends up rightmost and is consumed
+// first, then removes worker ARGV[1] from the registry KEYS[4]. When ARGV[2]
+// is "1" nothing happens while the heartbeat KEYS[1] exists, so a worker is
+// never reaped between its heartbeat check and the move. Returns the number
+// of tasks moved.
+var reclaimScript = redis.NewScript(`
+if ARGV[2] == '1' and redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local n = 0
+while redis.call('LMOVE', KEYS[2], KEYS[3], 'LEFT', 'RIGHT') do
+	n = n + 1
+end
+redis.call('SREM', KEYS[4], ARGV[1])
+return n
+`)
+
+// Moves a worker's processing list back onto the queue, keeping the oldest
+// task next in line, and removes the worker from the registry. With
+// onlyIfDead the worker is left alone while its heartbeat is live.
+func requeueAll(ctx context.Context, workerID string, onlyIfDead bool) (int, error) {
+	check := "0"
+	if onlyIfDead {
+		check = "1"
+	}
+	keys := []string{heartbeatKey(workerID), processingKey(workerID), TaskQueue, WorkersKey}
+	return reclaimScript.Run(ctx, Rdb, keys, workerID, check).Int()
 }
@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useMiniredis points Rdb at an in-memory Redis for the duration of a test.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prev := Rdb
+	Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		Rdb.Close()
+		Rdb = prev
+	})
+	return mr
+}
+
+func newTestConsumer(t *testing.T, id string) *Consumer {
+	t.Helper()
+	c, err := NewConsumer(context.Background(), id)
+	if err != nil {
+		t.Fatalf("NewConsumer: %v", err)
+	}
+	return c
+}
+
+// ---- Consumer -------------------------------------------------------------------
+
+func TestConsumer_DequeueIsFIFO(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	for _, task := range []string{"a", "b", "c"} {
+		if err := EnqueueTask(ctx, task); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	c := newTestConsumer(t, "w1")
+	for _, want := range []string{"a", "b", "c"} {
+		got, err := c.Dequeue(ctx, time.Second)
+		if err != nil || got != want {
+			t.Fatalf("want %q, got %q (%v)", want, got, err)
+		}
+	}
+}
+
+func TestConsumer_DequeueEmptyQueue(t *testing.T) {
+	useMiniredis(t)
+	c := newTestConsumer(t, "w1")
+	if _, err := c.Dequeue(context.Background(), 10*time.Millisecond); !errors.Is(err, ErrNoTask) {
+		t.Errorf("want ErrNoTask, got %v", err)
+	}
+}
+
+func TestConsumer_TaskStaysInFlightUntilAck(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	EnqueueTask(ctx, "task-1")
+	c := newTestConsumer(t, "w1")
+
+	task, err := c.Dequeue(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if got, _ := mr.List(processingKey("w1")); len(got) != 1 || got[0] != task {
+		t.Fatalf("want task in processing list, got %v", got)
+	}
+
+	if err := c.Ack(ctx, task); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if mr.Exists(processingKey("w1")) {
+		t.Error("processing list should be empty after ack")
+	}
+}
+
+func TestConsumer_CloseRequeuesInFlightTasks(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	EnqueueTask(ctx, "task-1")
+	c := newTestConsumer(t, "w1")
+	c.Dequeue(ctx, time.Second)
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got, _ := mr.List(TaskQueue); len(got) != 1 || got[0] != "task-1" {
+		t.Errorf("want task back on the queue, got %v", got)
+	}
+	if ok, _ := mr.SIsMember(WorkersKey, "w1"); ok {
+		t.Error("closed worker should be unregistered")
+	}
+}
+
+// ---- Reaper ---------------------------------------------------------------------
+
+func TestReapDeadWorkers_RequeuesExpiredWorkersOnly(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	for _, task := range []string{"t1", "t2", "t3"} {
+		EnqueueTask(ctx, task)
+	}
+	dead := newTestConsumer(t, "dead")
+	alive := newTestConsumer(t, "alive")
+	dead.Dequeue(ctx, time.Second)  // t1
+	dead.Dequeue(ctx, time.Second)  // t2
+	alive.Dequeue(ctx, time.Second) // t3
+
+	// Let both heartbeats lapse, then revive one worker
+	mr.FastForward(HeartbeatTTL + time.Second)
+	if err := alive.Heartbeat(ctx); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+
+	n, err := ReapDeadWorkers(ctx)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 tasks re-queued, got %d", n)
+	}
+
+	// Re-queued tasks come back in their original order
+	c := newTestConsumer(t, "next")
+	for _, want := range []string{"t1", "t2"} {
+		if got, _ := c.Dequeue(ctx, time.Second); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+	if got, _ := mr.List(processingKey("alive")); len(got) != 1 || got[0] != "t3" {
+		t.Errorf("live worker's task should be untouched, got %v", got)
+	}
+	if ok, _ := mr.SIsMember(WorkersKey, "dead"); ok {
+		t.Error("dead worker should be unregistered")
+	}
+}
+
+func TestRequeueAll_SkipsLiveWorker(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	EnqueueTask(ctx, "t1")
+	w := newTestConsumer(t, "w1")
+	w.Dequeue(ctx, time.Second)
+
+	// The reaper saw the worker as dead, but it beat again before the move
+	if n, err := requeueAll(ctx, "w1", true); err != nil || n != 0 {
+		t.Fatalf("want live worker skipped, got %d (%v)", n, err)
+	}
+	if got, _ := mr.List(processingKey("w1")); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("live worker's task should be untouched, got %v", got)
+	}
+	if ok, _ := mr.SIsMember(WorkersKey, "w1"); !ok {
+		t.Error("live worker should stay registered")
+	}
+
+	mr.FastForward(HeartbeatTTL + time.Second)
+	if n, err := requeueAll(ctx, "w1", true); err != nil || n != 1 {
+		t.Fatalf("want 1 task requeued once the heartbeat expired, got %d (%v)", n, err)
+	}
+}
+
+func TestReapDeadWorkers_NothingToDo(t *testing.T) {
+	useMiniredis(t)
+	newTestConsumer(t, "w1")
+	if n, err := ReapDeadWorkers(context.Background()); err != nil || n != 0 {
+		t.Errorf("want 0 tasks, no error; got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys used for retries
+const (
+	DelayedKey  = "image_tasks:delayed"  // Sorted set of tasks waiting to be retried, scored by due time (unix ms)
+	attemptsKey = "image_tasks:attempts" // Hash of task ID → number of attempts started
+	errorsKey   = "image_tasks:errors"   // Hash of task ID → error from the last failed attempt
+)
+
+// Records the start of a new attempt at a task and returns the attempt number.
+// Counting at start rather than on failure also catches tasks that crash the worker.
+func StartAttempt(ctx context.Context, taskID string) (int, error) {
+	n, err := Rdb.HIncrBy(ctx, attemptsKey, taskID, 1).Result()
+	return int(n), err
+}
+
+// Returns the error recorded for the task's last failed attempt, if any
+func LastError(ctx context.Context, taskID string) (string, error) {
+	msg, err := Rdb.HGet(ctx, errorsKey, taskID).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return msg, err
+}
+
+// Schedules a failed task to run again after delay, remembering the failure.
+// The task is re-enqueued as a current-version envelope recording the attempts
+// made so far, which also upgrades legacy tasks.
+func RetryLater(ctx context.Context, t Task, attempts int, delay time.Duration, lastErr error) error {
+	t.Attempt = attempts
+	t.Version = TaskVersion
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	due := time.Now().Add(delay).UnixMilli()
+	_, err = Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, errorsKey, t.ID, lastErr.Error())
+		pipe.ZAdd(ctx, DelayedKey, redis.Z{Score: float64(due), Member: string(data)})
+		return nil
+	})
+	return err
+}
+
+// Drops the retry bookkeeping for a task that succeeded or was dead-lettered
+func ForgetTask(ctx context.Context, taskID string) error {
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, attemptsKey, taskID)
+		pipe.HDel(ctx, errorsKey, taskID)
+		return nil
+	})
+	return err
+}
+
+// promoteBatch is how many due retries one run of promoteScript moves
+const promoteBatch = 100
+
+// Moves up to ARGV[2] tasks due by ARGV[1] from the delayed set KEYS[1] to the
+// queue KEYS[2]. Running as a script keeps each task in exactly one of the two
+// at every moment, even if the caller dies halfway.
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, task in ipairs(due) do
+	redis.call('ZREM', KEYS[1], task)
+	redis.call('LPUSH', KEYS[2], task)
+end
+return #due
+`)
+
+// Moves retries that are due back onto the queue and returns how many moved.
+// Each batch moves atomically, so a task is never lost between the delayed set
+// and the queue, and several workers may run this at once.
+func PromoteDueRetries(ctx context.Context, now time.Time) (int, error) {
+	max := strconv.FormatInt(now.UnixMilli(), 10)
+	moved := 0
+	for {
+		n, err := promoteScript.Run(ctx, Rdb, []string{DelayedKey, TaskQueue}, max, promoteBatch).Int()
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+		if n < promoteBatch {
+			return moved, nil
+		}
+	}
+}
+
+// Returns the delay before retry number attempt+1: base doubled for every
+// attempt already made, capped at max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
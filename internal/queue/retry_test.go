@@ -0,0 +1,250 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ---- Backoff --------------------------------------------------------------------
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Second, 2*time.Minute
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 80 * time.Second},
+		{5, 2 * time.Minute},
+		{50, 2 * time.Minute},
+	}
+	for _, tc := range tests {
+		if got := Backoff(tc.attempt, base, max); got != tc.want {
+			t.Errorf("attempt %d: want %v, got %v", tc.attempt, tc.want, got)
+		}
+	}
+	if got := Backoff(1, time.Hour, time.Minute); got != time.Minute {
+		t.Errorf("base above max should be capped, got %v", got)
+	}
+}
+
+// ---- Attempts and retries -------------------------------------------------------
+
+func TestStartAttempt_Counts(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	for want := 1; want <= 3; want++ {
+		if got, err := StartAttempt(ctx, "task"); err != nil || got != want {
+			t.Fatalf("want attempt %d, got %d (%v)", want, got, err)
+		}
+	}
+	if err := ForgetTask(ctx, "task"); err != nil {
+		t.Fatalf("forget: %v", err)
+	}
+	if got, _ := StartAttempt(ctx, "task"); got != 1 {
+		t.Errorf("want count reset after ForgetTask, got %d", got)
+	}
+}
+
+func TestRetryLater_PromotedOnlyWhenDue(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	task := Task{ID: "t1", Type: TaskTypeProcess, ImageID: "img", ImageKey: "originals/a.png"}
+	if err := RetryLater(ctx, task, 2, time.Minute, errors.New("s3 timeout")); err != nil {
+		t.Fatalf("retry later: %v", err)
+	}
+	if msg, _ := LastError(ctx, "t1"); msg != "s3 timeout" {
+		t.Errorf("want last error recorded, got %q", msg)
+	}
+
+	if n, err := PromoteDueRetries(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("nothing should be due yet, moved %d (%v)", n, err)
+	}
+	if n, err := PromoteDueRetries(ctx, time.Now().Add(2*time.Minute)); err != nil || n != 1 {
+		t.Fatalf("want 1 task promoted, moved %d (%v)", n, err)
+	}
+	queued, _ := mr.List(TaskQueue)
+	if len(queued) != 1 {
+		t.Fatalf("want task back on the queue, got %v", queued)
+	}
+	got, err := DecodeTask(queued[0])
+	if err != nil || got.ID != "t1" || got.Attempt != 2 || got.Version != TaskVersion {
+		t.Errorf("unexpected retried task %+v (%v)", got, err)
+	}
+	if mr.Exists(DelayedKey) {
+		t.Error("delayed set should be empty")
+	}
+}
+
+func TestPromoteDueRetries_NeverLosesATask(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	const n = 2*promoteBatch + 50
+	for i := 0; i < n; i++ {
+		task := Task{ID: fmt.Sprintf("t%d", i), Type: TaskTypeProcess, ImageID: "img", ImageKey: "originals/a.png"}
+		if err := RetryLater(ctx, task, 1, 0, errors.New("boom")); err != nil {
+			t.Fatalf("retry later: %v", err)
+		}
+	}
+
+	// Several promoters race while an observer checks that every task is
+	// always in either the delayed set or the queue
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var total atomic.Int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			moved, err := PromoteDueRetries(ctx, time.Now().Add(time.Second))
+			if err != nil {
+				t.Errorf("promote: %v", err)
+			}
+			total.Add(int64(moved))
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for observing := true; observing; {
+		select {
+		case <-done:
+			observing = false
+		default:
+		}
+		var delayed *redis.IntCmd
+		var queued *redis.IntCmd
+		_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			delayed = pipe.ZCard(ctx, DelayedKey)
+			queued = pipe.LLen(ctx, TaskQueue)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("observe: %v", err)
+		}
+		if got := delayed.Val() + queued.Val(); got != n {
+			t.Fatalf("want %d tasks across the delayed set and the queue, got %d delayed and %d queued", n, delayed.Val(), queued.Val())
+		}
+	}
+	if total.Load() != n {
+		t.Errorf("want %d tasks promoted once each, got %d", n, total.Load())
+	}
+}
+
+// ---- Dead letters ---------------------------------------------------------------
+
+func TestDeadLetters_Lifecycle(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	StartAttempt(ctx, "t1")
+
+	first, err := AddDeadLetter(ctx, "raw-1", Task{ID: "t1", ImageID: "img-1"}, 5, errors.New("boom"))
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := AddDeadLetter(ctx, "raw-2", Task{}, 1, errors.New("bad task")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got, _ := StartAttempt(ctx, "t1"); got != 1 {
+		t.Errorf("dead-lettering should clear attempts, next attempt is %d", got)
+	}
+
+	letters, err := ListDeadLetters(ctx)
+	if err != nil || len(letters) != 2 {
+		t.Fatalf("want 2 dead letters, got %d (%v)", len(letters), err)
+	}
+	if letters[0].Task != "raw-2" {
+		t.Errorf("want most recent first, got %q", letters[0].Task)
+	}
+
+	dl, err := GetDeadLetter(ctx, first.ID)
+	if err != nil || dl.ImageID != "img-1" || dl.Attempts != 5 || dl.LastError != "boom" {
+		t.Errorf("unexpected dead letter %+v (%v)", dl, err)
+	}
+
+	if _, err := RequeueDeadLetter(ctx, first.ID); err != nil {
+		t.Fatalf("requeue: %v", err)
+	}
+	if got, _ := mr.List(TaskQueue); len(got) != 1 || got[0] != "raw-1" {
+		t.Errorf("want raw-1 back on the queue, got %v", got)
+	}
+	if _, err := GetDeadLetter(ctx, first.ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("requeued task should leave the dead-letter queue, got %v", err)
+	}
+	if _, err := RequeueDeadLetter(ctx, first.ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("second requeue: want ErrDeadLetterNotFound, got %v", err)
+	}
+
+	if n, err := PurgeDeadLetters(ctx); err != nil || n != 1 {
+		t.Errorf("want 1 purged, got %d (%v)", n, err)
+	}
+	if letters, _ := ListDeadLetters(ctx); len(letters) != 0 {
+		t.Errorf("want empty dead-letter queue, got %d", len(letters))
+	}
+}
+
+func TestRequeueDeadLetter_Atomic(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	if _, err := AddDeadLetter(ctx, "raw-1", Task{ID: "t1"}, 5, errors.New("boom")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	// Concurrent requeues of the same dead letter push the task exactly once,
+	// and an observer never sees it in both places or in neither
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var requeued atomic.Int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := RequeueDeadLetter(ctx, "t1")
+			switch {
+			case err == nil:
+				requeued.Add(1)
+			case !errors.Is(err, ErrDeadLetterNotFound):
+				t.Errorf("requeue: %v", err)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for observing := true; observing; {
+		select {
+		case <-done:
+			observing = false
+		default:
+		}
+		var dead *redis.IntCmd
+		var queued *redis.IntCmd
+		_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			dead = pipe.HLen(ctx, DeadLetterKey)
+			queued = pipe.LLen(ctx, TaskQueue)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("observe: %v", err)
+		}
+		if got := dead.Val() + queued.Val(); got != 1 {
+			t.Fatalf("want the task in exactly one place, got %d dead-lettered and %d queued", dead.Val(), queued.Val())
+		}
+	}
+	if requeued.Load() != 1 {
+		t.Errorf("want exactly one successful requeue, got %d", requeued.Load())
+	}
+}
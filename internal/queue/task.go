@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/processor"
+	"image-processing-service/internal/utils"
+	"strings"
+	"time"
+)
+
+// Task types
+const (
+	TaskTypeProcess = "process" // Run a pipeline over an uploaded original and store the results
+	TaskTypeDelete  = "delete"  // Remove the stored objects of a deleted image
+)
+
+// TaskVersion is the envelope schema version written by Enqueue. Workers
+// reject tasks from a newer version rather than misreading them.
+const TaskVersion = 1
+
+// Task is the JSON envelope pushed onto the queue
+type Task struct {
+	ID         string                  `json:"id"`                 // Unique per task; keys retry bookkeeping
+	Type       string                  `json:"type"`               // What the worker should do, e.g. "process"
+	Version    int                     `json:"version"`            // Envelope schema version; 0 for legacy tasks
+	ImageID    string                  `json:"image_id"`           // Database ID of the image
+	UserID     string                  `json:"user_id"`            // Owner of the image
+	ImageKey   string                  `json:"image_key"`          // Storage key of the original
+	Pipeline   processor.Pipeline      `json:"pipeline"`           // Steps run on the original
+	Output     processor.OutputOptions `json:"output"`             // Encoding of the processed image
+	Variants   []processor.Variant     `json:"variants,omitempty"` // Extra named renditions
+	Keys       []string                `json:"keys,omitempty"`     // Delete tasks: storage keys to remove
+	EnqueuedAt time.Time               `json:"enqueued_at"`        // When the task was first queued
+	Attempt    int                     `json:"attempt"`            // Attempts made before this enqueue
+	Trace      map[string]string       `json:"trace,omitempty"`    // Trace context, e.g. {"traceparent": "00-..."}
+}
+
+// Returned by DecodeTask for tasks that can never be processed
+var ErrInvalidTask = errors.New("queue: invalid task")
+
+// Stamps a task with an ID, version and timestamp and adds it to the queue.
+// Returns the task as enqueued.
+func Enqueue(ctx context.Context, t Task) (Task, error) {
+	if t.ID == "" {
+		t.ID = utils.NewUUID()
+	}
+	if t.Type == "" {
+		t.Type = TaskTypeProcess
+	}
+	if t.EnqueuedAt.IsZero() {
+		t.EnqueuedAt = time.Now().UTC()
+	}
+	t.Version = TaskVersion
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+	return t, EnqueueTask(ctx, string(data))
+}
+
+// Parses a raw queue entry: a JSON envelope, or the legacy
+// "process:<key>:<base64 json>:<userID>" string accepted during the migration.
+// Parse failures wrap ErrInvalidTask.
+func DecodeTask(raw string) (Task, error) {
+	if !strings.HasPrefix(raw, "{") {
+		return decodeLegacyTask(raw)
+	}
+
+	var t Task
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return t, fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	switch {
+	case t.Version > TaskVersion:
+		return t, fmt.Errorf("%w: unsupported version %d (newest known is %d)", ErrInvalidTask, t.Version, TaskVersion)
+	case t.Type != TaskTypeProcess && t.Type != TaskTypeDelete:
+		return t, fmt.Errorf("%w: unknown type %q", ErrInvalidTask, t.Type)
+	case t.ID == "":
+		return t, fmt.Errorf("%w: missing id", ErrInvalidTask)
+	case t.Type == TaskTypeProcess && (t.ImageID == "" || t.ImageKey == ""):
+		return t, fmt.Errorf("%w: missing image_id or image_key", ErrInvalidTask)
+	case t.Type == TaskTypeDelete && len(t.Keys) == 0:
+		return t, fmt.Errorf("%w: missing keys", ErrInvalidTask)
+	}
+	return t, nil
+}
+
+// Parses the legacy colon-delimited format. Its ID is derived from the raw
+// string so that retries of the same entry share bookkeeping. The baseline's
+// resize, crop and tint options become the equivalent pipeline.
+func decodeLegacyTask(raw string) (Task, error) {
+	t := Task{ID: legacyTaskID(raw), Type: TaskTypeProcess}
+
+	parts := strings.SplitN(raw, ":", 4)
+	if len(parts) < 4 {
+		return t, fmt.Errorf("%w: invalid legacy task format", ErrInvalidTask)
+	}
+	if parts[0] != TaskTypeProcess {
+		return t, fmt.Errorf("%w: unknown command %q", ErrInvalidTask, parts[0])
+	}
+	t.ImageKey, t.UserID = parts[1], parts[3]
+
+	jsonBytes, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return t, fmt.Errorf("%w: decoding task options: %v", ErrInvalidTask, err)
+	}
+	// The first releases sent resize, crop and tint keys; later ones a pipeline
+	var options struct {
+		ImageID  string                  `json:"imageID"`
+		Pipeline processor.Pipeline      `json:"pipeline"`
+		Output   processor.OutputOptions `json:"output"`
+		Variants []processor.Variant     `json:"variants"`
+		processor.LegacyOptions
+	}
+	err = json.Unmarshal(jsonBytes, &options)
+	t.ImageID = options.ImageID
+	if err != nil {
+		return t, fmt.Errorf("%w: parsing task options: %v", ErrInvalidTask, err)
+	}
+	if t.ImageID == "" {
+		return t, fmt.Errorf("%w: missing imageID in task options", ErrInvalidTask)
+	}
+	t.Pipeline, t.Output, t.Variants = options.Pipeline, options.Output, options.Variants
+	if options.LegacyOptions.Present() {
+		if len(t.Pipeline.Steps) > 0 {
+			return t, fmt.Errorf("%w: both a pipeline and legacy resize, crop or tint options", ErrInvalidTask)
+		}
+		t.Pipeline = options.LegacyOptions.Pipeline()
+		if err := t.Pipeline.Validate(); err != nil {
+			return t, fmt.Errorf("%w: translating legacy options: %v", ErrInvalidTask, err)
+		}
+	}
+	return t, nil
+}
+
+func legacyTaskID(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return "legacy-" + hex.EncodeToString(sum[:8])
+}
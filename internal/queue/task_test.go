@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image-processing-service/internal/processor"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func legacyTask(key, options, userID string) string {
+	return "process:" + key + ":" + base64.StdEncoding.EncodeToString([]byte(options)) + ":" + userID
+}
+
+// ---- Enqueue --------------------------------------------------------------------
+
+func TestEnqueue_RoundTrip(t *testing.T) {
+	mr := useMiniredis(t)
+	pipeline := processor.NewPipeline(&processor.FlipOp{Direction: "vertical"})
+	sent, err := Enqueue(context.Background(), Task{
+		ImageID:  "img-1",
+		UserID:   "user-1",
+		ImageKey: "originals/user:1/photo:2024.jpg", // colons no longer break parsing
+		Pipeline: pipeline,
+		Output:   processor.OutputOptions{Format: processor.FormatWebP},
+		Trace:    map[string]string{"traceparent": "00-abc-def-01"},
+	})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(sent.ID) {
+		t.Errorf("want a UUIDv4 task ID, got %q", sent.ID)
+	}
+	if sent.Version != TaskVersion || sent.Type != TaskTypeProcess || sent.EnqueuedAt.IsZero() {
+		t.Errorf("envelope not stamped: %+v", sent)
+	}
+
+	queued, _ := mr.List(TaskQueue)
+	if len(queued) != 1 {
+		t.Fatalf("want 1 queued task, got %d", len(queued))
+	}
+	got, err := DecodeTask(queued[0])
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.ID != sent.ID || got.ImageKey != sent.ImageKey || got.UserID != "user-1" ||
+		got.Output.Format != processor.FormatWebP || got.Trace["traceparent"] != "00-abc-def-01" {
+		t.Errorf("round trip mismatch: %+v", got)
+	}
+	if names := got.Pipeline.Names(); len(names) != 1 || names[0] != "flip" {
+		t.Errorf("unexpected pipeline %v", names)
+	}
+}
+
+// ---- DecodeTask -----------------------------------------------------------------
+
+func TestDecodeTask_Legacy(t *testing.T) {
+	// As queued by the baseline upload handler
+	raw := legacyTask("originals/img_1.png",
+		`{"crop":{"height":300,"width":400,"x":10,"y":20},"imageID":"img-1","resize":{"width":800},"tint":"#336699"}`,
+		"user-1")
+	got, err := DecodeTask(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Version != 0 || got.ImageID != "img-1" || got.ImageKey != "originals/img_1.png" || got.UserID != "user-1" {
+		t.Errorf("unexpected task %+v", got)
+	}
+	if names := got.Pipeline.Names(); strings.Join(names, ",") != "resize,crop,tint" {
+		t.Fatalf("want resize, crop and tint steps, got %v", names)
+	}
+	resize := got.Pipeline.Steps[0].(*processor.ResizeOp)
+	crop := got.Pipeline.Steps[1].(*processor.CropOp)
+	tint := got.Pipeline.Steps[2].(*processor.TintOp)
+	if resize.Width != 800 || crop.X != 10 || crop.Y != 20 || crop.Width != 400 || crop.Height != 300 || tint.Color != "#336699" {
+		t.Errorf("unexpected steps %+v %+v %+v", resize, crop, tint)
+	}
+	if got.Output.Format != "" {
+		t.Errorf("want the default JPEG output, got %+v", got.Output)
+	}
+	again, _ := DecodeTask(raw)
+	if !strings.HasPrefix(got.ID, "legacy-") || again.ID != got.ID {
+		t.Errorf("legacy IDs should be stable, got %q and %q", got.ID, again.ID)
+	}
+}
+
+func TestDecodeTask_LegacyPipeline(t *testing.T) {
+	// Queued between the pipeline and the envelope releases
+	raw := legacyTask("originals/img_1.png",
+		`{"imageID":"img-1","pipeline":[{"op":"resize","params":{"width":100}}],"variants":[{"name":"thumb","output":{"format":"png"}}]}`,
+		"user-1")
+	got, err := DecodeTask(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := got.Pipeline.Names(); len(names) != 1 || names[0] != "resize" {
+		t.Errorf("unexpected pipeline %v", names)
+	}
+	if len(got.Variants) != 1 || got.Variants[0].Name != "thumb" {
+		t.Errorf("unexpected variants %+v", got.Variants)
+	}
+}
+
+func TestDecodeTask_Invalid(t *testing.T) {
+	valid := Task{ID: "t", Type: TaskTypeProcess, Version: 1, ImageID: "i", ImageKey: "k"}
+	envelope := func(mutate func(*Task)) string {
+		task := valid
+		mutate(&task)
+		data, _ := json.Marshal(task)
+		return string(data)
+	}
+	tests := map[string]string{
+		"legacy too short":    "process:key",
+		"legacy unknown cmd":  "resize:key:e30=:u",
+		"legacy bad base64":   "process:key:!!!:u",
+		"legacy bad pipeline": legacyTask("k", `{"imageID":"x","pipeline":[{"op":"melt"}]}`, "u"),
+		"legacy no image":     legacyTask("k", `{}`, "u"),
+		"legacy huge resize":  legacyTask("k", `{"imageID":"x","resize":{"width":20000}}`, "u"),
+		"legacy mixed":        legacyTask("k", `{"imageID":"x","resize":{"width":800},"pipeline":[{"op":"grayscale"}]}`, "u"),
+		"malformed json":      `{"id":`,
+		"future version":      envelope(func(t *Task) { t.Version = TaskVersion + 1 }),
+		"unknown type":        envelope(func(t *Task) { t.Type = "melt" }),
+		"delete without keys": envelope(func(t *Task) { t.Type = TaskTypeDelete }),
+		"missing id":          envelope(func(t *Task) { t.ID = "" }),
+		"missing key":         envelope(func(t *Task) { t.ImageKey = "" }),
+		"bad pipeline":        `{"id":"t","type":"process","version":1,"image_id":"i","image_key":"k","pipeline":[{"op":"melt"}]}`,
+	}
+	for name, raw := range tests {
+		if _, err := DecodeTask(raw); !errors.Is(err, ErrInvalidTask) {
+			t.Errorf("%s: want ErrInvalidTask, got %v", name, err)
+		}
+	}
+	if _, err := DecodeTask(envelope(func(*Task) {})); err != nil {
+		t.Errorf("valid envelope: unexpected error %v", err)
+	}
+	deletion := envelope(func(t *Task) {
+		*t = Task{ID: "t", Type: TaskTypeDelete, Version: 1, ImageID: "i", Keys: []string{"originals/a.png"}}
+	})
+	if got, err := DecodeTask(deletion); err != nil || len(got.Keys) != 1 {
+		t.Errorf("valid delete task: got %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// GCRule selects the objects under a key prefix that CollectGarbage may remove
+type GCRule struct {
+	Prefix string
+	MinAge time.Duration // Objects modified more recently may still be in use and are kept
+	// Reports which of the keys are still in use. When nil, no object
+	// under Prefix is in use once it is older than MinAge.
+	Referenced func(ctx context.Context, keys []string) (map[string]bool, error)
+}
+
+// Number of keys passed to each Referenced call
+const gcBatchSize = 500
+
+// Deletes the objects matched by each rule that are older than its MinAge
+// and no longer referenced, and returns how many were deleted. A failed
+// reference check stops the sweep rather than risk deleting live objects.
+func CollectGarbage(ctx context.Context, b Backend, rules []GCRule) (int, error) {
+	lister, ok := b.(Lister)
+	if !ok {
+		return 0, fmt.Errorf("storage: %T cannot list objects", b)
+	}
+
+	deleted := 0
+	for _, rule := range rules {
+		cutoff := time.Now().Add(-rule.MinAge)
+		var batch []string
+		sweep := func() error {
+			n, err := deleteUnreferenced(ctx, b, rule, batch)
+			deleted += n
+			batch = batch[:0]
+			return err
+		}
+
+		err := lister.List(ctx, rule.Prefix, func(obj ObjectInfo) error {
+			if !obj.LastModified.Before(cutoff) {
+				return nil
+			}
+			if batch = append(batch, obj.Key); len(batch) < gcBatchSize {
+				return nil
+			}
+			return sweep()
+		})
+		if err == nil && len(batch) > 0 {
+			err = sweep()
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("collecting %s: %w", rule.Prefix, err)
+		}
+	}
+	return deleted, nil
+}
+
+// Deletes the keys the rule does not report as referenced
+func deleteUnreferenced(ctx context.Context, b Backend, rule GCRule, keys []string) (int, error) {
+	var referenced map[string]bool
+	if rule.Referenced != nil {
+		var err error
+		if referenced, err = rule.Referenced(ctx, keys); err != nil {
+			return 0, fmt.Errorf("checking references: %w", err)
+		}
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if referenced[key] {
+			continue
+		}
+		if err := b.Delete(ctx, key); err != nil {
+			return deleted, err
+		}
+		slog.Info("deleted unreferenced object", "key", key)
+		deleted++
+	}
+	return deleted, nil
+}
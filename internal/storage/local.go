@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBackend stores objects as files under a root directory, for
+// development and tests. The API serves them under /media.
+type LocalBackend struct {
+	root    string
+	baseURL string
+}
+
+// Creates the root directory if needed and returns a backend whose object
+// URLs start with baseURL
+func NewLocalBackend(root, baseURL string) (*LocalBackend, error) {
+	if root == "" {
+		return nil, errors.New("storage: STORAGE_LOCAL_DIR is not set")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("storage: creating %s: %w", abs, err)
+	}
+	return &LocalBackend{root: abs, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// Returns the file that holds key
+func (b *LocalBackend) Path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, filepath.FromSlash(key)), nil
+}
+
+// Writes the object to a temporary file and renames it into place so
+// readers never see a partial file
+func (b *LocalBackend) Put(_ context.Context, key string, body io.Reader, _ int64, _ string) error {
+	p, err := b.Path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err = io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Opens the object's file
+func (b *LocalBackend) Get(_ context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := b.Path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, notFound(key, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if st.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return f, fileInfo(key, st), nil
+}
+
+// Removes the object's file
+func (b *LocalBackend) Delete(_ context.Context, key string) error {
+	p, err := b.Path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Describes the object's file
+func (b *LocalBackend) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	p, err := b.Path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, notFound(key, err)
+	}
+	if st.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return fileInfo(key, st), nil
+}
+
+// Returns baseURL followed by the escaped key
+func (b *LocalBackend) URL(_ context.Context, key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return joinURL(b.baseURL, key), nil
+}
+
+// Walks the files under the prefix's directory in lexical order. Hidden
+// files, such as multipart parts and writes in progress, are skipped.
+func (b *LocalBackend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		p, err := b.Path(prefix[:i])
+		if err != nil {
+			return err
+		}
+		dir = p
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		st, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Removed since the directory was read
+		}
+		if err != nil {
+			return err
+		}
+		return fn(fileInfo(key, st))
+	})
+	if errors.Is(err, fs.ErrNotExist) && dir != b.root {
+		return nil // Nothing has been stored under the prefix yet
+	}
+	return err
+}
+
+// Directory under the root holding the parts of unfinished multipart uploads.
+// Keys may not start with a dot, so it can never be read as an object.
+const multipartDir = ".multipart"
+
+// Returns the directory holding the parts of a multipart upload
+func (b *LocalBackend) multipartPath(uploadID string) (string, error) {
+	if uploadID == "" || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%w: upload %q", ErrNotFound, uploadID)
+	}
+	return filepath.Join(b.root, multipartDir, uploadID), nil
+}
+
+// Starts a multipart upload by creating a directory for its parts
+func (b *LocalBackend) CreateMultipart(_ context.Context, key, _ string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id[:])
+	dir, _ := b.multipartPath(uploadID)
+	return uploadID, os.MkdirAll(dir, 0o755)
+}
+
+// Writes one part to its own file
+func (b *LocalBackend) UploadPart(_ context.Context, _, uploadID string, number int, body io.Reader, _ int64) (Part, error) {
+	dir, err := b.multipartPath(uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if _, err = os.Stat(dir); err != nil {
+		return Part{}, notFound("upload "+uploadID, err)
+	}
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%05d", number)))
+	if err != nil {
+		return Part{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{Number: number, ETag: hex.EncodeToString(h.Sum(nil)[:8]), Size: n}, nil
+}
+
+// Concatenates the parts into the object and removes them
+func (b *LocalBackend) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, err := b.multipartPath(uploadID)
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%05d", p.Number)))
+		if err != nil {
+			return notFound(fmt.Sprintf("part %d of upload %s", p.Number, uploadID), err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if err = b.Put(ctx, key, io.MultiReader(readers...), -1, ""); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// Removes the parts of an abandoned multipart upload
+func (b *LocalBackend) AbortMultipart(_ context.Context, _, uploadID string) error {
+	dir, err := b.multipartPath(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func fileInfo(key string, st fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         st.Size(),
+		ContentType:  detectContentType(key),
+		LastModified: st.ModTime(),
+	}
+}
+
+// Maps a missing file to ErrNotFound
+func notFound(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
+}
@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image-processing-service/internal/config"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+	b, err := NewLocalBackend(t.TempDir(), "http://localhost:8080/media/")
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	return b
+}
+
+// ---- Keys ------------------------------------------------------------
+
+func TestValidateKey(t *testing.T) {
+	valid := []string{"a.png", "originals/img_1.png", "processed/x_1_thumb.webp"}
+	for _, key := range valid {
+		if err := validateKey(key); err != nil {
+			t.Errorf("validateKey(%q): unexpected error %v", key, err)
+		}
+	}
+	invalid := []string{"", "/etc/passwd", "../secret", "a/../../b", "a//b", "a/./b", "a/", `a\b`, "..", ".multipart/x/00001", "a/.hidden"}
+	for _, key := range invalid {
+		if err := validateKey(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("validateKey(%q): want ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
+
+// ---- LocalBackend ------------------------------------------------------------
+
+func TestLocalBackend_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	if err := b.Put(ctx, "originals/a.png", strings.NewReader("png bytes"), 9, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	body, info, err := b.Get(ctx, "originals/a.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "png bytes" {
+		t.Errorf("want %q, got %q", "png bytes", data)
+	}
+	if info.Size != 9 || info.ContentType != "image/png" || info.Key != "originals/a.png" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	st, err := b.Stat(ctx, "originals/a.png")
+	if err != nil || st.Size != 9 {
+		t.Errorf("Stat: want size 9, got %+v, %v", st, err)
+	}
+
+	// Put replaces and leaves no temporary files behind
+	if err = b.Put(ctx, "originals/a.png", strings.NewReader("new"), -1, "image/png"); err != nil {
+		t.Fatalf("Put replace: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(b.root, "originals"))
+	if len(entries) != 1 {
+		t.Errorf("want 1 file after replace, got %d", len(entries))
+	}
+
+	if err = b.Delete(ctx, "originals/a.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = b.Stat(ctx, "originals/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after delete: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestLocalBackend_NotFound(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	if _, _, err := b.Get(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: want ErrNotFound, got %v", err)
+	}
+	if _, err := b.Stat(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat: want ErrNotFound, got %v", err)
+	}
+	if err := b.Delete(ctx, "missing.png"); err != nil {
+		t.Errorf("Delete of a missing key: want nil, got %v", err)
+	}
+
+	// Directories are not objects
+	b.Put(ctx, "dir/a.png", strings.NewReader("x"), 1, "image/png")
+	if _, err := b.Stat(ctx, "dir"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat of a directory: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestLocalBackend_RejectsTraversal(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+	outside := filepath.Join(filepath.Dir(b.root), "escaped.txt")
+
+	if err := b.Put(ctx, "../escaped.txt", strings.NewReader("x"), 1, "text/plain"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put: want ErrInvalidKey, got %v", err)
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Error("file was written outside the storage root")
+	}
+	if _, _, err := b.Get(ctx, "../../etc/passwd"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Get: want ErrInvalidKey, got %v", err)
+	}
+	if err := b.Delete(ctx, "/etc/passwd"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Delete: want ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestLocalBackend_URL(t *testing.T) {
+	b := newTestBackend(t)
+	got, err := b.URL(context.Background(), "processed/my image_1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://localhost:8080/media/processed/my%20image_1.png"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// ---- Package helpers ------------------------------------------------------------
+
+func TestUploadDownload_UseActiveBackend(t *testing.T) {
+	ctx := context.Background()
+	prev := Default()
+	t.Cleanup(func() { Use(prev) })
+
+	Use(nil)
+	if _, err := Upload(ctx, "a.png", []byte("x")); err == nil {
+		t.Error("Upload without a backend: want error")
+	}
+
+	Use(newTestBackend(t))
+	url, err := Upload(ctx, "originals/a.png", []byte("data"))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if url != "http://localhost:8080/media/originals/a.png" {
+		t.Errorf("unexpected URL %q", url)
+	}
+	data, err := Download(ctx, "originals/a.png")
+	if err != nil || string(data) != "data" {
+		t.Errorf("Download: want %q, got %q, %v", "data", data, err)
+	}
+	if _, err = Download(ctx, "originals/missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Download missing: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	ctx := context.Background()
+	prev := Default()
+	t.Cleanup(func() { Use(prev) })
+	Use(newTestBackend(t))
+
+	tests := []struct {
+		name, stored, key, want string
+	}{
+		{"stored URL kept", "https://old.example.com/a.png", "a.png", "https://old.example.com/a.png"},
+		{"generated from key", "", "a.png", "http://localhost:8080/media/a.png"},
+		{"nothing stored", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveURL(ctx, tt.stored, tt.key)
+			if err != nil || got != tt.want {
+				t.Errorf("want %q, got %q, %v", tt.want, got, err)
+			}
+		})
+	}
+
+	// Expiring URLs are never taken from storage, and never returned by Upload
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	private, err := NewS3Backend(ctx, config.Storage{S3Bucket: "imgs", S3Region: "us-west-2", Private: true, URLExpiry: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Use(private)
+	got, err := ResolveURL(ctx, "https://imgs.s3.us-west-2.amazonaws.com/a.png", "a.png")
+	if err != nil || !strings.Contains(got, "X-Amz-Signature=") {
+		t.Errorf("want a presigned URL, got %q, %v", got, err)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	b := newTestBackend(t)
+	ctx := context.Background()
+	b.Put(ctx, "uploads/direct/a.png", strings.NewReader("first"), 5, "image/png")
+	b.Put(ctx, "originals/u1/a.png", strings.NewReader("stale"), 5, "image/png")
+
+	if err := CopyObject(ctx, b, "uploads/direct/a.png", "originals/u1/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	// Later writes to the source leave the copy alone
+	b.Put(ctx, "uploads/direct/a.png", strings.NewReader("second"), 6, "image/png")
+	body, _, err := b.Get(ctx, "originals/u1/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if got, _ := io.ReadAll(body); string(got) != "first" {
+		t.Errorf("want the copied bytes, got %q", got)
+	}
+	if err := CopyObject(ctx, b, "uploads/direct/missing.png", "originals/u1/b.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+// ---- Multipart uploads ------------------------------------------------------------
+
+func TestLocalBackend_Multipart(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	id, err := b.CreateMultipart(ctx, "originals/big.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []Part
+	for i, chunk := range []string{"hello ", "multipart ", "world"} {
+		p, err := b.UploadPart(ctx, "originals/big.jpg", id, i+1, strings.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			t.Fatalf("part %d: %v", i+1, err)
+		}
+		if p.Number != i+1 || p.Size != int64(len(chunk)) || p.ETag == "" {
+			t.Errorf("unexpected part %+v", p)
+		}
+		parts = append(parts, p)
+	}
+	if err = b.CompleteMultipart(ctx, "originals/big.jpg", id, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _, err := b.Get(ctx, "originals/big.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "hello multipart world" {
+		t.Errorf("unexpected object %q", data)
+	}
+	if _, err = os.Stat(filepath.Join(b.root, multipartDir, id)); !os.IsNotExist(err) {
+		t.Errorf("parts should be removed after completion: %v", err)
+	}
+}
+
+func TestLocalBackend_MultipartAbortAndUnknown(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t)
+
+	id, _ := b.CreateMultipart(ctx, "originals/a.jpg", "image/jpeg")
+	b.UploadPart(ctx, "originals/a.jpg", id, 1, strings.NewReader("x"), 1)
+	if err := b.AbortMultipart(ctx, "originals/a.jpg", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.UploadPart(ctx, "originals/a.jpg", id, 2, strings.NewReader("y"), 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("part after abort: want ErrNotFound, got %v", err)
+	}
+	if _, err := b.UploadPart(ctx, "originals/a.jpg", "../../etc", 1, strings.NewReader("y"), 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("malformed upload ID: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	prev := Default()
+	t.Cleanup(func() { Use(prev) })
+	b := newTestBackend(t)
+	Use(b)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		size    int
+		maxSize int64
+		tooBig  bool
+	}{
+		{"single put", 100, 100, false},
+		{"exactly one part", MinPartSize, 3 * MinPartSize, false},
+		{"several parts", 2*MinPartSize + 7, 3 * MinPartSize, false},
+		{"over a small limit", 101, 100, true},
+		{"over the limit mid-upload", 2 * MinPartSize, MinPartSize + 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			size, url, err := UploadStream(ctx, "originals/s.png", bytes.NewReader(data), tt.maxSize)
+			if tt.tooBig {
+				if !errors.Is(err, ErrTooLarge) {
+					t.Fatalf("want ErrTooLarge, got %v", err)
+				}
+				if keys := listKeys(t, b, "originals/"); len(keys) != 0 {
+					t.Errorf("nothing should be stored, got %v", keys)
+				}
+				return
+			}
+			if err != nil || size != int64(tt.size) || url != "http://localhost:8080/media/originals/s.png" {
+				t.Fatalf("got %d bytes at %q, %v", size, url, err)
+			}
+			got, err := Download(ctx, "originals/s.png")
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes, want %d matching bytes (%v)", len(got), len(data), err)
+			}
+			b.Delete(ctx, "originals/s.png")
+		})
+	}
+}
+
+// ---- Listing and garbage collection ------------------------------------------------------------
+
+// putAged stores an object and backdates it by age
+func putAged(t *testing.T, b *LocalBackend, key string, age time.Duration) {
+	t.Helper()
+	if err := b.Put(context.Background(), key, strings.NewReader(key), -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := b.Path(key)
+	then := time.Now().Add(-age)
+	if err := os.Chtimes(p, then, then); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listKeys(t *testing.T, b *LocalBackend, prefix string) []string {
+	t.Helper()
+	var keys []string
+	err := b.List(context.Background(), prefix, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List(%q): %v", prefix, err)
+	}
+	return keys
+}
+
+func TestLocalBackend_List(t *testing.T) {
+	b := newTestBackend(t)
+	ctx := context.Background()
+	for _, key := range []string{"originals/b.png", "originals/a.png", "originals/sub/c.png", "processed/a_1.jpg", "originalsX.png"} {
+		putAged(t, b, key, 0)
+	}
+	// Multipart parts are hidden
+	id, err := b.CreateMultipart(ctx, "originals/d.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.UploadPart(ctx, "originals/d.png", id, 1, strings.NewReader("part"), 4)
+
+	if got := strings.Join(listKeys(t, b, "originals/"), ","); got != "originals/a.png,originals/b.png,originals/sub/c.png" {
+		t.Errorf("originals/: got %s", got)
+	}
+	if got := strings.Join(listKeys(t, b, "original"), ","); got != "originals/a.png,originals/b.png,originals/sub/c.png,originalsX.png" {
+		t.Errorf("original: got %s", got)
+	}
+	if got := listKeys(t, b, "uploads/tus/"); len(got) != 0 {
+		t.Errorf("missing prefix: got %v", got)
+	}
+	if err = b.List(ctx, "../", func(ObjectInfo) error { return nil }); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("traversal: want ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	b := newTestBackend(t)
+	putAged(t, b, "originals/live.png", 48*time.Hour)
+	putAged(t, b, "originals/dead.png", 48*time.Hour)
+	putAged(t, b, "originals/new.png", time.Minute)
+	putAged(t, b, "uploads/tus/u1/tail-10", 48*time.Hour)
+	putAged(t, b, "uploads/tus/u2/tail-10", time.Minute)
+
+	var checked []string
+	rules := []GCRule{
+		{Prefix: "originals/", MinAge: 24 * time.Hour, Referenced: func(_ context.Context, keys []string) (map[string]bool, error) {
+			checked = append(checked, keys...)
+			return map[string]bool{"originals/live.png": true}, nil
+		}},
+		{Prefix: "uploads/tus/", MinAge: 24 * time.Hour},
+	}
+	deleted, err := CollectGarbage(context.Background(), b, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("want 2 deleted, got %d", deleted)
+	}
+	if got := strings.Join(checked, ","); got != "originals/dead.png,originals/live.png" {
+		t.Errorf("only old objects should be checked, got %s", got)
+	}
+	got := strings.Join(append(listKeys(t, b, "originals/"), listKeys(t, b, "uploads/")...), ",")
+	if got != "originals/live.png,originals/new.png,uploads/tus/u2/tail-10" {
+		t.Errorf("remaining objects: %s", got)
+	}
+}
+
+func TestCollectGarbage_StopsWhenReferencesUnknown(t *testing.T) {
+	b := newTestBackend(t)
+	putAged(t, b, "processed/a_1.jpg", 48*time.Hour)
+
+	rules := []GCRule{{Prefix: "processed/", MinAge: time.Hour, Referenced: func(context.Context, []string) (map[string]bool, error) {
+		return nil, errors.New("database unavailable")
+	}}}
+	if _, err := CollectGarbage(context.Background(), b, rules); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := b.Stat(context.Background(), "processed/a_1.jpg"); err != nil {
+		t.Errorf("object must be kept when references cannot be checked: %v", err)
+	}
+}
+
+func TestDeleteObjects(t *testing.T) {
+	prev := Default()
+	t.Cleanup(func() { Use(prev) })
+	b := newTestBackend(t)
+	Use(b)
+	putAged(t, b, "originals/a.png", 0)
+	putAged(t, b, "processed/a_1.jpg", 0)
+
+	if err := DeleteObjects(context.Background(), []string{"originals/a.png", "processed/a_1.jpg", "processed/missing.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := append(listKeys(t, b, "originals/"), listKeys(t, b, "processed/")...); len(got) != 0 {
+		t.Errorf("want everything deleted, got %v", got)
+	}
+}
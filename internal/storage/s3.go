@@ -1,145 +1,341 @@
 package storage
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"image-processing-service/internal/config"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
-var s3Client *s3.Client
-
-// Initialize the S3 client
-func init() {
-	// Retrieve AWS credentials from environment variables
-	awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	awsSecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	awsRegion := os.Getenv("AWS_REGION")
+// S3Backend stores objects in an S3 bucket, on AWS or any S3-compatible
+// store such as MinIO
+type S3Backend struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+	baseURL string        // Public object URLs are baseURL + "/" + key
+	private bool          // Hand out presigned URLs instead of public ones
+	expiry  time.Duration // Lifetime of presigned URLs
+}
 
-	// Set default region if not provided
-	if awsRegion == "" {
-		awsRegion = "us-west-2" // Default to us-west-2
+// Builds an S3 backend. Credentials come from the default chain, which
+// includes AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func NewS3Backend(ctx context.Context, cfg config.Storage) (*S3Backend, error) {
+	if cfg.S3Bucket == "" {
+		return nil, errors.New("storage: AWS_BUCKET_NAME is not set")
 	}
+	baseURL, err := s3BaseURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.S3Region))
+	if err != nil {
+		return nil, fmt.Errorf("storage: loading AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		o.UsePathStyle = cfg.S3PathStyle
+	})
+	return &S3Backend{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  cfg.S3Bucket,
+		baseURL: baseURL,
+		private: cfg.Private,
+		expiry:  cfg.URLExpiry,
+	}, nil
+}
 
-	var cfg aws.Config
-	var err error
+// Returns the prefix of public object URLs: STORAGE_PUBLIC_URL when set,
+// otherwise the bucket's address on the endpoint in the configured style
+func s3BaseURL(cfg config.Storage) (string, error) {
+	if cfg.PublicURL != "" {
+		return cfg.PublicURL, nil
+	}
+	if cfg.S3Endpoint == "" {
+		switch {
+		case cfg.S3PathStyle && cfg.S3Region == "us-east-1":
+			return fmt.Sprintf("https://s3.amazonaws.com/%s", cfg.S3Bucket), nil
+		case cfg.S3PathStyle:
+			return fmt.Sprintf("https://s3.%s.amazonaws.com/%s", cfg.S3Region, cfg.S3Bucket), nil
+		case cfg.S3Region == "us-east-1":
+			return fmt.Sprintf("https://%s.s3.amazonaws.com", cfg.S3Bucket), nil
+		default:
+			return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", cfg.S3Bucket, cfg.S3Region), nil
+		}
+	}
 
-	if awsAccessKey != "" && awsSecretKey != "" {
-		cfg, err = config.LoadDefaultConfig(context.Background(),
-			config.WithRegion(awsRegion),
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				awsAccessKey,
-				awsSecretKey,
-				"",
-			)),
-		)
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return "", fmt.Errorf("storage: invalid S3_ENDPOINT %q", cfg.S3Endpoint)
+	}
+	if cfg.S3PathStyle {
+		endpoint.Path = endpoint.Path + "/" + cfg.S3Bucket
 	} else {
-		// Fall back to default credential chain
-		cfg, err = config.LoadDefaultConfig(context.Background(),
-			config.WithRegion(awsRegion),
-		)
+		endpoint.Host = cfg.S3Bucket + "." + endpoint.Host
 	}
+	return endpoint.String(), nil
+}
 
-	if err != nil {
-		panic(fmt.Sprintf("Unable to load AWS config: %v", err))
+// Uploads an object to the bucket
+func (b *S3Backend) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+	if size >= 0 {
+		input.ContentLength = aws.Int64(size)
 	}
+	if _, err := b.client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("put object failed: %w", err)
+	}
+	return nil
+}
 
-	s3Client = s3.NewFromConfig(cfg)
+// Downloads an object from the bucket
+func (b *S3Backend) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error("get object", key, err)
+	}
+	info := ObjectInfo{
+		Key:         key,
+		Size:        aws.ToInt64(resp.ContentLength),
+		ContentType: aws.ToString(resp.ContentType),
+	}
+	if resp.LastModified != nil {
+		info.LastModified = *resp.LastModified
+	}
+	return resp.Body, info, nil
 }
 
-// Uploads the file to S3 and returns the public URL
-func UploadToS3(ctx context.Context, key string, file []byte) (string, error) {
-	var bucketName = os.Getenv("AWS_BUCKET_NAME")
-	if bucketName == "" {
-		return "", fmt.Errorf("AWS_BUCKET_NAME environment variable is not set")
+// Copies an object within the bucket with CopyObject, keeping its content type
+func (b *S3Backend) Copy(ctx context.Context, src, dst string) error {
+	_, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(b.bucket + "/" + (&url.URL{Path: src}).EscapedPath()),
+	})
+	if err != nil {
+		return s3Error("copy object", src, err)
 	}
+	return nil
+}
 
-	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(bucketName),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(file),
-		ContentType: aws.String(detectContentType(key)),
+// Deletes an object from the bucket
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return "", fmt.Errorf("put object failed: %w", err)
+		if err = s3Error("delete object", key, err); errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
 	}
+	return nil
+}
 
-	// Generate URL based on region
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		region = "us-west-2"
+// Reads an object's metadata with a HEAD request
+func (b *S3Backend) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error("head object", key, err)
+	}
+	info := ObjectInfo{
+		Key:         key,
+		Size:        aws.ToInt64(resp.ContentLength),
+		ContentType: aws.ToString(resp.ContentType),
+	}
+	if resp.LastModified != nil {
+		info.LastModified = *resp.LastModified
 	}
+	return info, nil
+}
 
-	var url string
-	if region == "us-east-1" {
-		url = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, key)
-	} else {
-		url = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucketName, region, key)
+// Pages through the objects under prefix with ListObjectsV2
+func (b *S3Backend) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("list objects %s failed: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			info := ObjectInfo{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size)}
+			if obj.LastModified != nil {
+				info.LastModified = *obj.LastModified
+			}
+			if err = fn(info); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	return url, nil
+// Returns the public URL of an object, or in private mode a presigned GET
+// URL that expires after STORAGE_URL_EXPIRY
+func (b *S3Backend) URL(ctx context.Context, key string) (string, error) {
+	if !b.private {
+		return joinURL(b.baseURL, key), nil
+	}
+	req, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(b.expiry))
+	if err != nil {
+		return "", fmt.Errorf("presigning %s: %w", key, err)
+	}
+	return req.URL, nil
 }
 
-// Downloads the file from S3 using the provided key and returns the file content as a byte slice
-func DownloadFromS3(ctx context.Context, key string) ([]byte, error) {
-	var bucketName = os.Getenv("AWS_BUCKET_NAME")
-	if bucketName == "" {
-		return nil, fmt.Errorf("AWS_BUCKET_NAME environment variable is not set")
+// Signs a PUT whose Content-Type and Content-Length must match, or a POST
+// policy that limits the content type and the size to at most size bytes
+func (b *S3Backend) PresignUpload(ctx context.Context, method, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error) {
+	upload := PresignedUpload{Method: method, ExpiresAt: time.Now().Add(expiry).UTC()}
+	switch method {
+	case http.MethodPut:
+		req, err := b.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(b.bucket),
+			Key:           aws.String(key),
+			ContentType:   aws.String(contentType),
+			ContentLength: aws.Int64(size),
+		}, s3.WithPresignExpires(expiry))
+		if err != nil {
+			return upload, fmt.Errorf("presigning upload of %s: %w", key, err)
+		}
+		upload.URL = req.URL
+		upload.Headers = make(map[string]string)
+		for name, values := range req.SignedHeader {
+			if !strings.EqualFold(name, "Host") && len(values) > 0 {
+				upload.Headers[name] = values[0]
+			}
+		}
+	case http.MethodPost:
+		req, err := b.presign.PresignPostObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		}, func(o *s3.PresignPostOptions) {
+			o.Expires = expiry
+			o.Conditions = []interface{}{
+				[]interface{}{"content-length-range", 1, size},
+				map[string]string{"Content-Type": contentType},
+			}
+		})
+		if err != nil {
+			return upload, fmt.Errorf("presigning upload of %s: %w", key, err)
+		}
+		upload.URL = req.URL
+		upload.Fields = req.Values
+		upload.Fields["Content-Type"] = contentType
+	default:
+		return upload, fmt.Errorf("storage: unsupported upload method %q", method)
 	}
+	return upload, nil
+}
 
-	// Get the object from S3
-	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
+// Starts an S3 multipart upload
+func (b *S3Backend) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	resp, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to download object from S3: %w", err)
+		return "", fmt.Errorf("create multipart upload %s failed: %w", key, err)
 	}
-	defer resp.Body.Close()
+	return aws.ToString(resp.UploadId), nil
+}
 
-	// Read the content from the response body into a byte slice
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(resp.Body)
+// Uploads one part of a multipart upload
+func (b *S3Backend) UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64) (Part, error) {
+	resp, err := b.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(int32(number)),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return Part{}, fmt.Errorf("upload part %d of %s failed: %w", number, key, err)
 	}
+	return Part{Number: number, ETag: aws.ToString(resp.ETag), Size: size}, nil
+}
 
-	// Return the byte slice containing the file data
-	return buf.Bytes(), nil
+// Assembles the uploaded parts into the object
+func (b *S3Backend) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = types.CompletedPart{ETag: aws.String(p.ETag), PartNumber: aws.Int32(int32(p.Number))}
+	}
+	_, err := b.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("complete multipart upload %s failed: %w", key, err)
+	}
+	return nil
 }
 
-// Attempts to determine the content type based on file extension
-func detectContentType(key string) string {
-	ext := ""
-	for i := len(key) - 1; i >= 0 && key[i] != '.'; i-- {
-		if key[i] == '.' {
-			ext = key[i:]
-			break
+// Abandons a multipart upload and frees its parts
+func (b *S3Backend) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := b.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		if err = s3Error("abort multipart upload", key, err); errors.Is(err, ErrNotFound) {
+			return nil
 		}
+		return err
 	}
+	return nil
+}
 
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".gif":
-		return "image/gif"
-	case ".pdf":
-		return "application/pdf"
-	case ".txt":
-		return "text/plain"
-	case ".html":
-		return "text/html"
-	case ".json":
-		return "application/json"
-	default:
-		// If can't determine, use binary stream as default
-		return "application/octet-stream"
+// Reports whether URL returns short-lived presigned URLs
+func (b *S3Backend) URLsExpire() bool {
+	return b.private
+}
+
+// Maps S3's missing-object errors to ErrNotFound
+func s3Error(op, key string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound", "NoSuchUpload":
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
 	}
+	return fmt.Errorf("%s %s failed: %w", op, key, err)
 }
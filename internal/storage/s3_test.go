@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"image-processing-service/internal/config"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// ---- S3Backend ------------------------------------------------------------
+
+func TestS3BaseURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Storage
+		want string
+	}{
+		{"aws virtual-hosted", config.Storage{S3Bucket: "imgs", S3Region: "us-west-2"}, "https://imgs.s3.us-west-2.amazonaws.com"},
+		{"aws us-east-1", config.Storage{S3Bucket: "imgs", S3Region: "us-east-1"}, "https://imgs.s3.amazonaws.com"},
+		{"aws path-style", config.Storage{S3Bucket: "imgs", S3Region: "eu-west-1", S3PathStyle: true}, "https://s3.eu-west-1.amazonaws.com/imgs"},
+		{"minio path-style", config.Storage{S3Bucket: "imgs", S3Endpoint: "http://minio:9000", S3PathStyle: true}, "http://minio:9000/imgs"},
+		{"endpoint virtual-hosted", config.Storage{S3Bucket: "imgs", S3Endpoint: "https://storage.example.com"}, "https://imgs.storage.example.com"},
+		{"endpoint with path", config.Storage{S3Bucket: "imgs", S3Endpoint: "http://localhost:4566/s3", S3PathStyle: true}, "http://localhost:4566/s3/imgs"},
+		{"public URL wins", config.Storage{S3Bucket: "imgs", S3Endpoint: "http://minio:9000", PublicURL: "https://cdn.example.com"}, "https://cdn.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s3BaseURL(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewS3Backend_RequiresBucket(t *testing.T) {
+	if _, err := NewS3Backend(context.Background(), config.Storage{S3Region: "us-west-2"}); err == nil {
+		t.Error("want an error without a bucket")
+	}
+}
+
+func TestS3Backend_URL(t *testing.T) {
+	b, err := NewS3Backend(context.Background(), config.Storage{
+		S3Bucket:    "imgs",
+		S3Region:    "us-east-1",
+		S3Endpoint:  "http://minio:9000",
+		S3PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := b.URL(context.Background(), "processed/a b.png")
+	if want := "http://minio:9000/imgs/processed/a%20b.png"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestS3Backend_PresignedURL(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	b, err := NewS3Backend(context.Background(), config.Storage{
+		S3Bucket:  "imgs",
+		S3Region:  "us-west-2",
+		PublicURL: "https://cdn.example.com",
+		Private:   true,
+		URLExpiry: 5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.URLsExpire() {
+		t.Error("private backend should report expiring URLs")
+	}
+
+	got, err := b.URL(context.Background(), "processed/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "imgs.s3.us-west-2.amazonaws.com" || u.Path != "/processed/a.png" {
+		t.Errorf("presigned URL should address the bucket directly, got %q", got)
+	}
+	q := u.Query()
+	if q.Get("X-Amz-Expires") != "300" || q.Get("X-Amz-Signature") == "" {
+		t.Errorf("want a signed URL valid for 300s, got %q", got)
+	}
+}
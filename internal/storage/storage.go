@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/config"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL prefix of local objects when STORAGE_PUBLIC_URL is not set
+const DefaultLocalURL = "http://localhost:8080/media"
+
+// Returned when an object does not exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// Returned for keys that are empty, absolute or escape the storage root
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// Backend stores objects under slash-separated keys such as
+// "originals/<user id>/<uuid>.png"
+type Backend interface {
+	// Stores an object, replacing any existing one with the same key.
+	// size is the length of body, or -1 if unknown.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Opens an object for reading; the caller must close it
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Describes an object without reading it
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Returns the URL clients use to fetch the object
+	URL(ctx context.Context, key string) (string, error)
+}
+
+// PresignedUpload is a request a client sends to upload an object straight
+// to storage, bypassing the API
+type PresignedUpload struct {
+	Method    string            `json:"method"`            // PUT or POST
+	URL       string            `json:"url"`               // Where to send the request
+	Headers   map[string]string `json:"headers,omitempty"` // PUT: headers that must be sent exactly as given
+	Fields    map[string]string `json:"fields,omitempty"`  // POST: form fields to send before the file field
+	ExpiresAt time.Time         `json:"expires_at"`        // When the signature stops being accepted
+}
+
+// UploadPresigner is implemented by backends that accept uploads directly
+// from clients. A PUT must carry exactly size bytes; a POST may carry up to size.
+type UploadPresigner interface {
+	PresignUpload(ctx context.Context, method, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error)
+}
+
+// Copier is implemented by backends that can copy an object without sending
+// its bytes through the caller
+type Copier interface {
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// Part is one uploaded piece of a multipart upload
+type Part struct {
+	Number int    `json:"number"` // 1-based position in the object
+	ETag   string `json:"etag"`   // Identifier returned by UploadPart
+	Size   int64  `json:"size"`
+}
+
+// MultipartUploader is implemented by backends that can assemble an object
+// from parts uploaded over time. Every part but the last must be at least
+// MinPartSize bytes.
+type MultipartUploader interface {
+	CreateMultipart(ctx context.Context, key, contentType string) (uploadID string, err error)
+	UploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64) (Part, error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+// Smallest part S3 accepts other than the last
+const MinPartSize = 5 << 20
+
+// Lister is implemented by backends that can enumerate their objects
+type Lister interface {
+	// Calls fn for every object whose key starts with prefix, stopping at
+	// the first error fn returns
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+var (
+	mu     sync.RWMutex
+	active Backend
+)
+
+// Builds the backend selected by cfg.Driver
+func New(ctx context.Context, cfg config.Storage) (Backend, error) {
+	switch cfg.Driver {
+	case config.StorageS3, "":
+		return NewS3Backend(ctx, cfg)
+	case config.StorageLocal:
+		baseURL := cfg.PublicURL
+		if baseURL == "" {
+			baseURL = DefaultLocalURL
+		}
+		return NewLocalBackend(cfg.LocalDir, baseURL)
+	default:
+		return nil, fmt.Errorf("storage: unknown driver %q", cfg.Driver)
+	}
+}
+
+// Builds the configured backend and makes it the one used by Upload and Download
+func Init(ctx context.Context, cfg config.Storage) error {
+	b, err := New(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	Use(b)
+	return nil
+}
+
+// Replaces the active backend, e.g. with a LocalBackend in tests
+func Use(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	active = b
+}
+
+// Returns the active backend, or nil before Init or Use
+func Default() Backend {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+func current() (Backend, error) {
+	b := Default()
+	if b == nil {
+		return nil, errors.New("storage: no backend configured")
+	}
+	return b, nil
+}
+
+// Reports whether the active backend's URLs expire, in which case only keys
+// may be stored and URLs must be generated for each response
+func URLsExpire() bool {
+	b, ok := Default().(interface{ URLsExpire() bool })
+	return ok && b.URLsExpire()
+}
+
+// Stores data under key in the active backend and returns the URL to record
+// for it, which is empty when URLs expire
+func Upload(ctx context.Context, key string, data []byte) (string, error) {
+	b, err := current()
+	if err != nil {
+		return "", err
+	}
+	if err = b.Put(ctx, key, bytes.NewReader(data), int64(len(data)), detectContentType(key)); err != nil {
+		return "", fmt.Errorf("storing %s: %w", key, err)
+	}
+	return StoredURL(ctx, key)
+}
+
+// Returned by UploadStream when the body is longer than allowed
+var ErrTooLarge = errors.New("storage: object too large")
+
+// Stores the body read from r under key in the active backend, holding at
+// most one MinPartSize part in memory, and returns its size and the URL to
+// record for it. A body longer than maxSize is rejected with ErrTooLarge and
+// nothing is left stored.
+func UploadStream(ctx context.Context, key string, r io.Reader, maxSize int64) (int64, string, error) {
+	b, err := current()
+	if err != nil {
+		return 0, "", err
+	}
+	contentType := detectContentType(key)
+	limited := &io.LimitedReader{R: r, N: maxSize + 1}
+	buf := make([]byte, min(MinPartSize, maxSize+1))
+
+	// A body that fits in one part is stored with a single Put
+	n, err := io.ReadFull(limited, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if int64(n) > maxSize {
+			return 0, "", ErrTooLarge
+		}
+		if err = b.Put(ctx, key, bytes.NewReader(buf[:n]), int64(n), contentType); err != nil {
+			return 0, "", fmt.Errorf("storing %s: %w", key, err)
+		}
+		url, err := StoredURL(ctx, key)
+		return int64(n), url, err
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if int64(n) > maxSize {
+		return 0, "", ErrTooLarge
+	}
+
+	uploader, ok := b.(MultipartUploader)
+	if !ok {
+		// Without multipart uploads the backend has to take a body of unknown length
+		body := io.MultiReader(bytes.NewReader(buf), limited)
+		if err = b.Put(ctx, key, body, -1, contentType); err != nil {
+			return 0, "", fmt.Errorf("storing %s: %w", key, err)
+		}
+		if limited.N == 0 {
+			b.Delete(ctx, key)
+			return 0, "", ErrTooLarge
+		}
+		url, err := StoredURL(ctx, key)
+		return maxSize + 1 - limited.N, url, err
+	}
+	size, err := uploadParts(ctx, uploader, key, contentType, buf, limited, maxSize)
+	if err != nil {
+		return 0, "", err
+	}
+	url, err := StoredURL(ctx, key)
+	return size, url, err
+}
+
+// Uploads buf, which is full, and then the rest of r as a multipart upload,
+// aborting it if anything fails or more than maxSize bytes arrive
+func uploadParts(ctx context.Context, uploader MultipartUploader, key, contentType string, buf []byte, r io.Reader, maxSize int64) (int64, error) {
+	uploadID, err := uploader.CreateMultipart(ctx, key, contentType)
+	if err != nil {
+		return 0, fmt.Errorf("starting upload of %s: %w", key, err)
+	}
+	abort := func(err error) (int64, error) {
+		if abortErr := uploader.AbortMultipart(context.WithoutCancel(ctx), key, uploadID); abortErr != nil {
+			err = errors.Join(err, abortErr)
+		}
+		return 0, err
+	}
+
+	var parts []Part
+	var size int64
+	n := len(buf)
+	for {
+		size += int64(n)
+		if size > maxSize {
+			return abort(ErrTooLarge)
+		}
+		if n > 0 {
+			part, err := uploader.UploadPart(ctx, key, uploadID, len(parts)+1, bytes.NewReader(buf[:n]), int64(n))
+			if err != nil {
+				return abort(fmt.Errorf("uploading part %d of %s: %w", len(parts)+1, key, err))
+			}
+			parts = append(parts, part)
+		}
+		if n < len(buf) {
+			break
+		}
+		if n, err = io.ReadFull(r, buf); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+	}
+	if err = uploader.CompleteMultipart(ctx, key, uploadID, parts); err != nil {
+		return abort(fmt.Errorf("completing upload of %s: %w", key, err))
+	}
+	return size, nil
+}
+
+// Returns the URL to record for an object in the database, which is empty
+// when URLs expire
+func StoredURL(ctx context.Context, key string) (string, error) {
+	b, err := current()
+	if err != nil {
+		return "", err
+	}
+	if URLsExpire() {
+		return "", nil
+	}
+	return b.URL(ctx, key)
+}
+
+// Returns the URL to hand a client for an object. A stored URL is used as is
+// unless it is missing or the backend's URLs expire; then one is generated
+// from the key.
+func ResolveURL(ctx context.Context, storedURL, key string) (string, error) {
+	if key == "" || (storedURL != "" && !URLsExpire()) {
+		return storedURL, nil
+	}
+	b, err := current()
+	if err != nil {
+		return "", err
+	}
+	return b.URL(ctx, key)
+}
+
+// Reads the whole object stored under key in the active backend
+func Download(ctx context.Context, key string) ([]byte, error) {
+	b, err := current()
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Copies the object stored under src to dst, replacing any object there.
+// Backends that are not Copiers stream it through a Get and a Put.
+func CopyObject(ctx context.Context, b Backend, src, dst string) error {
+	if copier, ok := b.(Copier); ok {
+		return copier.Copy(ctx, src, dst)
+	}
+	body, info, err := b.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return b.Put(ctx, dst, body, info.Size, info.ContentType)
+}
+
+// Deletes the objects stored under keys in the active backend; keys that
+// do not exist are skipped
+func DeleteObjects(ctx context.Context, keys []string) error {
+	b, err := current()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = b.Delete(ctx, key); err != nil {
+			return fmt.Errorf("deleting %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Appends the escaped key to a base URL that has no trailing slash
+func joinURL(base, key string) string {
+	return base + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// Rejects keys that could address anything outside the storage root, or the
+// hidden files backends keep alongside objects
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || path.Clean(key) != key {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// Attempts to determine the content type based on file extension
+func detectContentType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".pdf":
+		return "application/pdf"
+	case ".txt":
+		return "text/plain"
+	case ".html":
+		return "text/html"
+	case ".json":
+		return "application/json"
+	default:
+		// If can't determine, use binary stream as default
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,177 @@
+package uploads
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image-processing-service/internal/queue"
+	"image-processing-service/internal/storage"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys of resumable (tus) uploads
+const (
+	resumableKeyPrefix = "uploads:tus:"
+	// Outlive the uploads themselves so an expired upload's multipart upload
+	// can still be found and aborted
+	multipartsKey = "uploads:tus-multiparts" // Hash of upload ID → multipartRef
+	expiriesKey   = "uploads:tus-expiries"   // Sorted set of upload IDs, scored by when they expire (unix ms)
+)
+
+// How long a PATCH may hold an upload's lock before it is considered abandoned
+const resumableLockTTL = 5 * time.Minute
+
+// Returned when a resumable upload does not exist, has expired or was finished
+var ErrResumableNotFound = errors.New("uploads: resumable upload not found")
+
+// Returned when another request is already writing to a resumable upload
+var ErrResumableLocked = errors.New("uploads: resumable upload is locked")
+
+// Resumable tracks a tus upload as it is assembled from chunks into a
+// multipart upload. Bytes that do not yet fill a part are kept in a tail
+// object until more arrive.
+type Resumable struct {
+	ID          string            `json:"id"`
+	UserID      string            `json:"user_id"`
+	Key         string            `json:"key"`          // Storage key of the finished file
+	FileName    string            `json:"file_name"`    // Name of the file on the client
+	ContentType string            `json:"content_type"` // Declared MIME type
+	Length      int64             `json:"length"`       // Total size declared at creation
+	Offset      int64             `json:"offset"`       // Bytes received so far, including the tail
+	MultipartID string            `json:"multipart_id"` // Storage multipart upload ID
+	Parts       []storage.Part    `json:"parts"`        // Parts uploaded so far
+	TailKey     string            `json:"tail_key,omitempty"`
+	TailSize    int64             `json:"tail_size,omitempty"`
+	Assembled   bool              `json:"assembled"`           // The parts have been joined into Key
+	HeaderOK    bool              `json:"header_ok,omitempty"` // The file's header passed the upload checks
+	Metadata    map[string]string `json:"metadata"`            // Decoded Upload-Metadata, including processing options
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+func resumableKey(id string) string {
+	return resumableKeyPrefix + id
+}
+
+// The multipart upload behind a resumable upload, kept after the upload expires
+type multipartRef struct {
+	Key         string `json:"key"`
+	MultipartID string `json:"multipart_id"`
+}
+
+// Stores a resumable upload, expiring it after ttl without further saves.
+// Until its parts are assembled, its multipart upload is indexed by expiry
+// so AbortExpiredResumables can free it should the client never return.
+func SaveResumable(ctx context.Context, r Resumable, ttl time.Duration) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ref, err := json.Marshal(multipartRef{Key: r.Key, MultipartID: r.MultipartID})
+	if err != nil {
+		return err
+	}
+	_, err = queue.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, resumableKey(r.ID), data, ttl)
+		if r.Assembled {
+			pipe.HDel(ctx, multipartsKey, r.ID)
+			pipe.ZRem(ctx, expiriesKey, r.ID)
+			return nil
+		}
+		pipe.HSet(ctx, multipartsKey, r.ID, ref)
+		pipe.ZAdd(ctx, expiriesKey, redis.Z{Score: float64(time.Now().Add(ttl).UnixMilli()), Member: r.ID})
+		return nil
+	})
+	return err
+}
+
+// Retrieves a resumable upload
+func GetResumable(ctx context.Context, id string) (Resumable, error) {
+	var r Resumable
+	raw, err := queue.Rdb.Get(ctx, resumableKey(id)).Result()
+	if err == redis.Nil {
+		return r, ErrResumableNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal([]byte(raw), &r)
+	return r, err
+}
+
+// Forgets a finished or terminated resumable upload
+func DeleteResumable(ctx context.Context, id string) error {
+	_, err := queue.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, resumableKey(id))
+		pipe.HDel(ctx, multipartsKey, id)
+		pipe.ZRem(ctx, expiriesKey, id)
+		return nil
+	})
+	return err
+}
+
+// Aborts the multipart uploads of resumable uploads that expired by now
+// without being finished or terminated, freeing their parts, and returns how
+// many were aborted. Their tail objects are left to the storage collector.
+func AbortExpiredResumables(ctx context.Context, uploader storage.MultipartUploader, now time.Time) (int, error) {
+	ids, err := queue.Rdb.ZRangeByScore(ctx, expiriesKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	aborted := 0
+	for _, id := range ids {
+		// A PATCH still holding the lock may yet save the upload
+		live, err := queue.Rdb.Exists(ctx, resumableKey(id), resumableKey(id)+":lock").Result()
+		if err != nil {
+			return aborted, err
+		}
+		if live > 0 {
+			continue
+		}
+		raw, err := queue.Rdb.HGet(ctx, multipartsKey, id).Result()
+		if err != nil && err != redis.Nil {
+			return aborted, err
+		}
+		var ref multipartRef
+		if err == nil {
+			if err = json.Unmarshal([]byte(raw), &ref); err != nil {
+				return aborted, err
+			}
+			if err = uploader.AbortMultipart(ctx, ref.Key, ref.MultipartID); err != nil {
+				return aborted, fmt.Errorf("aborting upload %s: %w", id, err)
+			}
+			slog.Info("aborted expired resumable upload", "upload_id", id, "key", ref.Key)
+			aborted++
+		}
+		_, err = queue.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, multipartsKey, id)
+			pipe.ZRem(ctx, expiriesKey, id)
+			return nil
+		})
+		if err != nil {
+			return aborted, err
+		}
+	}
+	return aborted, nil
+}
+
+// Takes the lock that serializes writes to a resumable upload and returns
+// the function that releases it
+func LockResumable(ctx context.Context, id string) (func(), error) {
+	lockKey := resumableKey(id) + ":lock"
+	ok, err := queue.Rdb.SetNX(ctx, lockKey, 1, resumableLockTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrResumableLocked
+	}
+	return func() { queue.Rdb.Del(context.Background(), lockKey) }, nil
+}
@@ -0,0 +1,66 @@
+package uploads
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image-processing-service/internal/queue"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis key prefix of pending direct uploads
+const sessionKeyPrefix = "uploads:session:"
+
+// Extra time a session is kept after its upload URL expires, so a client
+// that finished sending at the last moment can still complete it
+const CompletionGrace = 15 * time.Minute
+
+// Returned when a session does not exist, has expired or was already completed
+var ErrSessionNotFound = errors.New("uploads: session not found")
+
+// Session is a direct upload that has been authorized but not yet completed
+type Session struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Key         string    `json:"key"`          // Storage key the original is kept under
+	StagingKey  string    `json:"staging_key"`  // Storage key the client uploads to; empty for sessions that upload to Key
+	FileName    string    `json:"file_name"`    // Name of the file on the client
+	ContentType string    `json:"content_type"` // Declared MIME type
+	Size        int64     `json:"size"`         // Declared size in bytes, the most accepted
+	Method      string    `json:"method"`       // PUT or POST
+	ExpiresAt   time.Time `json:"expires_at"`   // When the upload URL expires
+}
+
+func sessionKey(id string) string {
+	return sessionKeyPrefix + id
+}
+
+// Stores a session until shortly after its upload URL expires
+func Save(ctx context.Context, s Session) error {
+	ttl := time.Until(s.ExpiresAt) + CompletionGrace
+	if ttl <= 0 {
+		return ErrSessionNotFound
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return queue.Rdb.Set(ctx, sessionKey(s.ID), data, ttl).Err()
+}
+
+// Atomically removes and returns a session, so that only one request can
+// complete it. Call Save to give it back if completion fails.
+func Claim(ctx context.Context, id string) (Session, error) {
+	var s Session
+	raw, err := queue.Rdb.GetDel(ctx, sessionKey(id)).Result()
+	if err == redis.Nil {
+		return s, ErrSessionNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal([]byte(raw), &s)
+	return s, err
+}
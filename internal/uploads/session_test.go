@@ -0,0 +1,212 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"image-processing-service/internal/queue"
+	"image-processing-service/internal/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useMiniredis points queue.Rdb at an in-memory Redis for the duration of a test.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prev := queue.Rdb
+	queue.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		queue.Rdb.Close()
+		queue.Rdb = prev
+	})
+	return mr
+}
+
+// ---- Sessions ------------------------------------------------------------
+
+func TestSession_SaveAndClaimOnce(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	s := Session{ID: "u1", UserID: "user", Key: "originals/u1.png", Size: 10, ExpiresAt: time.Now().Add(time.Minute)}
+
+	if err := Save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(sessionKey("u1")); ttl <= time.Minute || ttl > time.Minute+CompletionGrace {
+		t.Errorf("unexpected TTL %v", ttl)
+	}
+
+	got, err := Claim(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != s.Key || got.UserID != s.UserID || got.Size != s.Size {
+		t.Errorf("want %+v, got %+v", s, got)
+	}
+	if _, err = Claim(ctx, "u1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("second claim: want ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestSession_ExpiresAfterGrace(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	Save(ctx, Session{ID: "u1", ExpiresAt: time.Now().Add(time.Minute)})
+
+	mr.FastForward(time.Minute + CompletionGrace + time.Second)
+	if _, err := Claim(ctx, "u1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("want ErrSessionNotFound, got %v", err)
+	}
+	if err := Save(ctx, Session{ID: "old", ExpiresAt: time.Now().Add(-time.Hour)}); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("saving a long-expired session: want ErrSessionNotFound, got %v", err)
+	}
+}
+
+// ---- Resumable uploads ------------------------------------------------------------
+
+func TestResumable_SaveGetDelete(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	r := Resumable{ID: "r1", UserID: "u1", Key: "originals/r1.jpg", Length: 100, Offset: 40, Metadata: map[string]string{"filename": "a.jpg"}}
+
+	if err := SaveResumable(ctx, r, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(resumableKey("r1")); ttl != time.Hour {
+		t.Errorf("want TTL 1h, got %v", ttl)
+	}
+	got, err := GetResumable(ctx, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Offset != 40 || got.Length != 100 || got.Metadata["filename"] != "a.jpg" {
+		t.Errorf("unexpected upload %+v", got)
+	}
+
+	DeleteResumable(ctx, "r1")
+	if _, err = GetResumable(ctx, "r1"); !errors.Is(err, ErrResumableNotFound) {
+		t.Errorf("want ErrResumableNotFound, got %v", err)
+	}
+}
+
+func TestAbortExpiredResumables(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	local, err := storage.NewLocalBackend(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Starts a resumable upload with one part stored and returns it
+	start := func(id string, ttl time.Duration) Resumable {
+		t.Helper()
+		key := "originals/" + id + ".png"
+		multipartID, err := local.CreateMultipart(ctx, key, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := local.UploadPart(ctx, key, multipartID, 1, strings.NewReader("part"), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Resumable{ID: id, Key: key, Length: 100, Offset: 4, MultipartID: multipartID, Parts: []storage.Part{part}}
+		if err = SaveResumable(ctx, r, ttl); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	// Reports whether the parts of a multipart upload are still stored
+	stored := func(r Resumable) bool {
+		err := local.CompleteMultipart(ctx, "originals/check.png", r.MultipartID, r.Parts)
+		return err == nil
+	}
+
+	abandoned := start("abandoned", time.Hour)
+	active := start("active", 3*time.Hour)
+	finished := start("finished", time.Hour)
+	if err = DeleteResumable(ctx, finished.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has expired yet
+	if n, err := AbortExpiredResumables(ctx, local, time.Now()); err != nil || n != 0 {
+		t.Fatalf("want nothing aborted, got %d (%v)", n, err)
+	}
+
+	// The session of the abandoned upload expires from Redis; its parts
+	// must not outlive it
+	mr.FastForward(2 * time.Hour)
+	if _, err = GetResumable(ctx, abandoned.ID); !errors.Is(err, ErrResumableNotFound) {
+		t.Fatalf("want the session expired, got %v", err)
+	}
+	n, err := AbortExpiredResumables(ctx, local, time.Now().Add(2*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("want 1 upload aborted, got %d (%v)", n, err)
+	}
+	if stored(abandoned) {
+		t.Error("the abandoned upload's parts should be gone")
+	}
+	if !stored(active) {
+		t.Error("the active upload's parts should be kept")
+	}
+	if mr.HGet(multipartsKey, abandoned.ID) != "" {
+		t.Error("the abandoned upload should leave the index")
+	}
+
+	// Each upload is aborted once
+	if n, err := AbortExpiredResumables(ctx, local, time.Now().Add(2*time.Hour)); err != nil || n != 0 {
+		t.Errorf("want nothing left to abort, got %d (%v)", n, err)
+	}
+}
+
+func TestAbortExpiredResumables_SkipsLockedAndAssembled(t *testing.T) {
+	mr := useMiniredis(t)
+	ctx := context.Background()
+	local, err := storage.NewLocalBackend(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SaveResumable(ctx, Resumable{ID: "locked", Key: "originals/a.png", MultipartID: "m1"}, time.Minute)
+	SaveResumable(ctx, Resumable{ID: "assembled", Key: "originals/b.png", MultipartID: "m2"}, time.Minute)
+	SaveResumable(ctx, Resumable{ID: "assembled", Key: "originals/b.png", MultipartID: "m2", Assembled: true}, time.Minute)
+	mr.FastForward(2 * time.Minute)
+	unlock, err := LockResumable(ctx, "locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if n, err := AbortExpiredResumables(ctx, local, time.Now().Add(2*time.Minute)); err != nil || n != 0 {
+		t.Errorf("want nothing aborted, got %d (%v)", n, err)
+	}
+	if mr.HGet(multipartsKey, "locked") == "" {
+		t.Error("an upload being written to should stay indexed")
+	}
+	if mr.HGet(multipartsKey, "assembled") != "" {
+		t.Error("an assembled upload has no multipart upload to abort")
+	}
+}
+
+func TestResumable_Lock(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+
+	unlock, err := LockResumable(ctx, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LockResumable(ctx, "r1"); !errors.Is(err, ErrResumableLocked) {
+		t.Errorf("second lock: want ErrResumableLocked, got %v", err)
+	}
+	unlock()
+	unlock, err = LockResumable(ctx, "r1")
+	if err != nil {
+		t.Errorf("lock after release: %v", err)
+	}
+	unlock()
+}
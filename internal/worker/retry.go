@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/db"
+	"image-processing-service/internal/queue"
+	"log/slog"
+	"time"
+)
+
+// Retry behaviour for failed tasks
+type retryPolicy struct {
+	MaxAttempts int           // Attempts before a task is dead-lettered
+	BaseDelay   time.Duration // Delay before the first retry
+	MaxDelay    time.Duration // Cap on the doubling delay
+}
+
+func retryPolicyFrom(cfg config.Worker) retryPolicy {
+	return retryPolicy{
+		MaxAttempts: cfg.MaxAttempts,
+		BaseDelay:   cfg.RetryBaseDelay,
+		MaxDelay:    cfg.RetryMaxDelay,
+	}
+}
+
+// permanentError marks a failure that no amount of retrying will fix,
+// such as an undecodable image
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Runs one attempt at a raw queue entry and records the outcome: success
+// clears the retry bookkeeping, a transient failure schedules a retry with
+// exponential backoff, and a permanent failure or the last allowed attempt
+// dead-letters it. Returns false when the entry must stay in flight (shutdown,
+// or the outcome could not be recorded).
+func (p *pool) runTask(ctx context.Context, raw string) bool {
+	// Bookkeeping uses its own context so it still happens during shutdown
+	bg := context.Background()
+
+	t, err := queue.DecodeTask(raw)
+	if err != nil {
+		return deadLetter(bg, raw, t, 1, err)
+	}
+	if t.Version == 0 {
+		slog.Warn("processing legacy task", "task_id", t.ID, "image_id", t.ImageID)
+	}
+
+	attempt, err := queue.StartAttempt(bg, t.ID)
+	if err != nil {
+		slog.Error("error recording task attempt", "task_id", t.ID, "error", err)
+	}
+
+	// Attempts are counted when they start, so a task that keeps crashing
+	// its worker ends up here once the reaper has re-queued it enough times
+	if attempt > p.policy.MaxAttempts {
+		lastErr, _ := queue.LastError(bg, t.ID)
+		if lastErr == "" {
+			lastErr = "worker stopped while processing the task"
+		}
+		return deadLetter(bg, raw, t, attempt-1, errors.New(lastErr))
+	}
+
+	slog.Info("processing task", taskAttrs(t, "attempt", attempt)...)
+	err = p.execute(ctx, t)
+	if err == nil {
+		if err := queue.ForgetTask(bg, t.ID); err != nil {
+			slog.Error("error clearing task attempts", "task_id", t.ID, "error", err)
+		}
+		return true
+	}
+	if ctx.Err() != nil {
+		slog.Warn("task interrupted by shutdown", "task_id", t.ID, "error", err)
+		return false
+	}
+
+	if isPermanent(err) || attempt >= p.policy.MaxAttempts {
+		return deadLetter(bg, raw, t, attempt, err)
+	}
+
+	delay := queue.Backoff(attempt, p.policy.BaseDelay, p.policy.MaxDelay)
+	if err := queue.RetryLater(bg, t, attempt, delay, err); err != nil {
+		slog.Error("error scheduling task retry", "task_id", t.ID, "error", err)
+		return false
+	}
+	slog.Warn("task failed, will retry", taskAttrs(t, "attempt", attempt, "retry_in", delay, "error", err)...)
+	if t.Type == queue.TaskTypeProcess {
+		db.UpdateImageStatus(bg, t.ImageID, "pending", "")
+	}
+	return true
+}
+
+// Moves a queue entry to the dead-letter queue and marks its image, if it
+// still exists, as failed
+func deadLetter(ctx context.Context, raw string, t queue.Task, attempts int, cause error) bool {
+	dl, err := queue.AddDeadLetter(ctx, raw, t, attempts, cause)
+	if err != nil {
+		slog.Error("error dead-lettering task", "task_id", t.ID, "error", err)
+		return false
+	}
+	slog.Error("task failed permanently", taskAttrs(t, "dead_letter_id", dl.ID, "attempts", attempts, "error", cause)...)
+	if t.ImageID != "" && t.Type == queue.TaskTypeProcess {
+		db.UpdateImageStatus(ctx, t.ImageID, "failed", "")
+	}
+	return true
+}
+
+// Returns the log attributes identifying a task, followed by extra key-value pairs
+func taskAttrs(t queue.Task, extra ...any) []any {
+	attrs := []any{"task_id", t.ID, "image_id", t.ImageID}
+	if tp := t.Trace["traceparent"]; tp != "" {
+		attrs = append(attrs, "traceparent", tp)
+	}
+	return append(attrs, extra...)
+}
+
+// Moves retries whose backoff has elapsed back onto the queue
+func runRetryScheduler(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			moved, err := queue.PromoteDueRetries(ctx, now)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("error promoting due retries", "error", err)
+			}
+			if moved > 0 {
+				slog.Info("re-queued tasks for retry", "count", moved)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
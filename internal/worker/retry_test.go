@@ -0,0 +1,19 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsPermanent(t *testing.T) {
+	if !isPermanent(permanent(errors.New("bad image"))) {
+		t.Error("permanent errors should be recognised")
+	}
+	if !isPermanent(fmt.Errorf("variant %q: %w", "thumb", permanent(errors.New("bad")))) {
+		t.Error("wrapped permanent errors should be recognised")
+	}
+	if isPermanent(errors.New("s3 timeout")) {
+		t.Error("plain errors should be retryable")
+	}
+}
@@ -1,186 +1,436 @@
 package worker
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image-processing-service/internal/config"
 	"image-processing-service/internal/db"
+	"image-processing-service/internal/models"
 	"image-processing-service/internal/processor"
 	"image-processing-service/internal/queue"
 	"image-processing-service/internal/storage"
 	"log/slog"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
-// Initializes the worker to process tasks from the queue
-func StartWorker(ctx context.Context) {
-	loggedEmptyQueue := false
-	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("worker stopping")
+// How often a worker refreshes its heartbeat and looks for dead workers to reap
+const (
+	heartbeatInterval = queue.HeartbeatTTL / 3
+	reapInterval      = queue.HeartbeatTTL
+)
+
+// How long a blocking dequeue waits before checking for shutdown
+const dequeueTimeout = 2 * time.Second
+
+// State shared by the goroutines of a worker pool
+type pool struct {
+	policy    retryPolicy
+	pixels    *semaphore.Weighted // Budget of decoded pixels across all in-flight tasks
+	maxPixels int64
+	limits    config.Upload // Originals outside these limits are refused
+}
+
+// Runs a pool of cfg.Concurrency workers until ctx is canceled, then drains:
+// no new tasks are taken, in-flight tasks get up to cfg.DrainTimeout to finish,
+// and whatever is still unfinished is handed back to the queue. Blocks until drained.
+//
+// Each worker holds its tasks in its own processing list until they finish,
+// and any tasks left behind by a worker that stopped heartbeating are re-queued.
+// Originals are checked against the upload limits again before decoding.
+func StartWorker(ctx context.Context, cfg config.Worker, limits config.Upload) {
+	p := &pool{
+		policy:    retryPolicyFrom(cfg),
+		pixels:    semaphore.NewWeighted(cfg.MaxDecodedPixels),
+		maxPixels: cfg.MaxDecodedPixels,
+		limits:    limits,
+	}
+
+	// In-flight tasks run on a context that outlives ctx by the drain timeout
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+
+	baseID := queue.NewWorkerID()
+	consumers := make([]*queue.Consumer, 0, cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		consumer, err := queue.NewConsumer(ctx, fmt.Sprintf("%s-%d", baseID, i))
+		if err != nil {
+			slog.Error("error registering worker", "error", err)
 			return
-		default:
-			// Dequeue task
-			task, err := queue.DequeueTask(ctx)
-			if err != nil {
-				// Handle the case where the queue is empty or other errors occur
-				if err.Error() == "redis: nil" {
-					// Only log once if queue is empty
-					if !loggedEmptyQueue {
-						slog.Info("queue is empty, waiting for tasks")
-						loggedEmptyQueue = true
-					}
-					// Sleep and check again
-					time.Sleep(2 * time.Second)
-					continue
-				}
-				// If some other error occurs, log it and continue
-				slog.Error("error dequeuing task", "error", err)
-				time.Sleep(5 * time.Second)
+		}
+		consumers = append(consumers, consumer)
+	}
+	slog.Info("worker pool started", "worker_id", baseID, "concurrency", cfg.Concurrency,
+		"max_decoded_pixels", cfg.MaxDecodedPixels, "max_attempts", p.policy.MaxAttempts)
+
+	// Heartbeats continue while draining so long tasks are not reaped mid-flight
+	go runHeartbeat(jobCtx, consumers)
+	go runReaper(ctx)
+	go runRetryScheduler(ctx)
+
+	var wg sync.WaitGroup
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.consume(ctx, jobCtx, consumer)
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+	slog.Info("worker pool draining", "timeout", cfg.DrainTimeout)
+	select {
+	case <-drained:
+		slog.Info("worker pool drained")
+	case <-time.After(cfg.DrainTimeout):
+		slog.Warn("drain timeout reached, handing back unfinished tasks")
+		cancelJobs()
+		<-drained
+	}
+}
+
+// Takes tasks off the queue one at a time until ctx is canceled.
+// Tasks run on jobCtx so that they can finish during a drain.
+func (p *pool) consume(ctx, jobCtx context.Context, consumer *queue.Consumer) {
+	defer func() {
+		// Hand back anything still in flight so another worker picks it up
+		if err := consumer.Close(context.Background()); err != nil {
+			slog.Error("error releasing in-flight tasks", "worker_id", consumer.ID, "error", err)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		// Block until a task arrives, waking periodically to check for shutdown
+		task, err := consumer.Dequeue(ctx, dequeueTimeout)
+		if err != nil {
+			if errors.Is(err, queue.ErrNoTask) || ctx.Err() != nil {
 				continue
 			}
-			// Task found, process it
-			loggedEmptyQueue = false
-			slog.Info("processing task", "task", task)
-			processImageTask(ctx, task)
+			// If some other error occurs, log it and back off
+			slog.Error("error dequeuing task", "worker_id", consumer.ID, "error", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if !p.runTask(jobCtx, task) {
+			// Interrupted: the task stays in flight and is handed back by Close
+			continue
+		}
+
+		// The task succeeded, was scheduled for retry or was dead-lettered;
+		// either way it leaves the processing list
+		if err := consumer.Ack(context.Background(), task); err != nil {
+			slog.Error("error acknowledging task", "worker_id", consumer.ID, "error", err)
 		}
 	}
 }
 
-// Processes the image task from the queue
-func processImageTask(ctx context.Context, task string) {
-	parts := strings.SplitN(task, ":", 4)
-	if len(parts) < 4 {
-		slog.Error("invalid task format", "task", task)
-		return
+// Reserves room for decoding an image of the given size, waiting while other
+// tasks hold the budget. checkInput refuses images larger than the whole
+// budget; should one get here it waits for all of it and then runs alone.
+// The returned function releases the reservation.
+func (p *pool) reservePixels(ctx context.Context, pixels int64) (func(), error) {
+	if pixels > p.maxPixels {
+		pixels = p.maxPixels
+	}
+	if pixels < 1 {
+		pixels = 1
+	}
+	if err := p.pixels.Acquire(ctx, pixels); err != nil {
+		return nil, err
 	}
+	return func() { p.pixels.Release(pixels) }, nil
+}
 
-	command := parts[0]
-	imageKey := parts[1]
-	encodedOptions := parts[2]
-	userID := parts[3]
+// Refuses an original the upload checks would have turned away, or that the
+// pixel budget cannot hold, whatever its number of frames. Uploads are
+// checked before they are recorded, but the stored object is checked again
+// here rather than trusted.
+func (p *pool) checkInput(format string, width, height, frames int) error {
+	pixels := int64(width) * int64(height)
+	switch {
+	case !slices.Contains(p.limits.AllowedFormats, format):
+		return fmt.Errorf("%s images are not accepted", format)
+	case width > p.limits.MaxDimension || height > p.limits.MaxDimension || pixels > p.limits.MaxPixels:
+		return fmt.Errorf("image is %dx%d; at most %d pixels and %d per side are accepted",
+			width, height, p.limits.MaxPixels, p.limits.MaxDimension)
+	case frames > 1 && int64(frames)*pixels > p.limits.MaxAnimationPixels:
+		return fmt.Errorf("animation has %d frames of %dx%d; at most %d pixels across all frames are accepted",
+			frames, width, height, p.limits.MaxAnimationPixels)
+	case int64(frames)*pixels > p.maxPixels:
+		return fmt.Errorf("image has %d frames of %dx%d, more than the %d pixel budget",
+			frames, width, height, p.maxPixels)
+	}
+	return nil
+}
 
-	// Only process "process" commands
-	if command != "process" {
-		slog.Error("unknown command", "command", command)
-		return
+// Keeps the workers' heartbeats alive until the context is canceled
+func runHeartbeat(ctx context.Context, consumers []*queue.Consumer) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, consumer := range consumers {
+				if err := consumer.Heartbeat(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("error sending heartbeat", "worker_id", consumer.ID, "error", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	// Decode the Base64 JSON options
-	jsonBytes, err := base64.StdEncoding.DecodeString(encodedOptions)
-	if err != nil {
-		slog.Error("error decoding task options", "error", err)
-		return
+// Periodically re-queues tasks held by workers whose heartbeat expired
+func runReaper(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			requeued, err := queue.ReapDeadWorkers(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("error reaping dead workers", "error", err)
+			}
+			if requeued > 0 {
+				slog.Warn("re-queued tasks from dead workers", "count", requeued)
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	// Parse the JSON options
-	var options map[string]interface{}
-	if err = json.Unmarshal(jsonBytes, &options); err != nil {
-		slog.Error("error parsing task options", "error", err)
-		return
+// Runs a task according to its type
+func (p *pool) execute(ctx context.Context, t queue.Task) error {
+	switch t.Type {
+	case queue.TaskTypeDelete:
+		return deleteImageObjects(ctx, t)
+	default:
+		return p.processImageTask(ctx, t)
 	}
+}
 
-	// Get the image ID from options
-	imageID, ok := options["imageID"].(string)
-	if !ok {
-		slog.Error("missing imageID in task options")
-		return
+// Removes the stored objects of a deleted image. Objects that are already
+// gone are skipped, so a retry picks up where a failed attempt stopped.
+func deleteImageObjects(ctx context.Context, t queue.Task) error {
+	if err := storage.DeleteObjects(ctx, t.Keys); err != nil {
+		if errors.Is(err, storage.ErrInvalidKey) {
+			return permanent(err)
+		}
+		return err
 	}
+	slog.Info("deleted image objects", "image_id", t.ImageID, "task_id", t.ID, "count", len(t.Keys))
+	return nil
+}
+
+// Processes an image task from the queue. The returned error is wrapped with
+// permanent when retrying cannot help; anything else is worth another attempt.
+func (p *pool) processImageTask(ctx context.Context, t queue.Task) error {
+	imageID := t.ImageID
 
 	// Update status to "processing"
-	if err = db.UpdateImageStatus(ctx, imageID, "processing", ""); err != nil {
-		slog.Error("error updating image status", "image_id", imageID, "error", err)
-		return
+	if err := db.UpdateImageStatus(ctx, imageID, "processing", ""); err != nil {
+		return fmt.Errorf("updating image status: %w", err)
 	}
 
-	// Download the original image from S3
-	imgBuf, err := storage.DownloadFromS3(ctx, imageKey)
+	// Download the original image from storage
+	imgBuf, err := storage.Download(ctx, t.ImageKey)
 	if err != nil {
-		slog.Error("error downloading image", "image_id", imageID, "key", imageKey, "error", err)
-		db.UpdateImageStatus(ctx, imageID, "failed", "")
-		return
+		return fmt.Errorf("downloading %s: %w", t.ImageKey, err)
 	}
 
-	// Decode the image
-	img, _, err := processor.DecodeImage(imgBuf)
+	// Wait for room in the decoded-pixel budget before decoding. Only tasks
+	// that use the frames of an animation decode them all, and every frame
+	// counts; an image larger than the whole budget is refused.
+	header, inputFormat, err := image.DecodeConfig(bytes.NewReader(imgBuf))
 	if err != nil {
-		slog.Error("error decoding image", "image_id", imageID, "error", err)
-		db.UpdateImageStatus(ctx, imageID, "failed", "")
-		return
+		return permanent(fmt.Errorf("reading image header: %w", err))
 	}
-
-	// Process the image according to the options
-	processedImg := img
-
-	// Apply resize if specified
-	if resizeInterface, ok := options["resize"].(map[string]interface{}); ok {
-		width := getIntFromMap(resizeInterface, "width")
-		if width <= 0 {
-			width = 600
+	frames := 1
+	if keepsFrames(t, inputFormat) {
+		if frames, err = processor.CountFrames(imgBuf); err != nil {
+			return permanent(fmt.Errorf("reading image frames: %w", err))
 		}
-		processedImg = processor.ResizeImage(processedImg, uint(width))
-		slog.Info("applied resize", "image_id", imageID, "width", width)
 	}
+	if err = p.checkInput(inputFormat, header.Width, header.Height, frames); err != nil {
+		return permanent(err)
+	}
+	pixels := int64(frames) * int64(header.Width) * int64(header.Height)
+	release, err := p.reservePixels(ctx, pixels)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	// Apply crop if specified
-	if cropInterface, ok := options["crop"].(map[string]interface{}); ok {
-		x := getIntFromMap(cropInterface, "x")
-		y := getIntFromMap(cropInterface, "y")
-		width := getIntFromMap(cropInterface, "width")
-		height := getIntFromMap(cropInterface, "height")
-
-		if width > 0 && height > 0 {
-			processedImg = processor.CropImage(processedImg, x, y, width, height)
-			slog.Info("applied crop", "image_id", imageID, "x", x, "y", y, "width", width, "height", height)
+	// Decode the image, keeping the frames of an animated GIF if they are used
+	var anim *processor.Animation
+	if frames > 1 {
+		anim, inputFormat, err = processor.DecodeAnimation(imgBuf)
+	} else {
+		var img image.Image
+		if img, inputFormat, err = processor.DecodeImage(imgBuf); err == nil {
+			anim = processor.Still(img)
 		}
 	}
+	if err != nil {
+		return permanent(fmt.Errorf("decoding image: %w", err))
+	}
 
-	// Apply tint if specified
-	if tintHex, ok := options["tint"].(string); ok {
-		tintColor, err := processor.ParseHexColor(tintHex)
-		if err == nil {
-			processedImg = processor.AddTint(processedImg, tintColor)
-			slog.Info("applied tint", "image_id", imageID, "color", tintHex)
-		} else {
-			slog.Warn("invalid tint color", "image_id", imageID, "color", tintHex)
+	// Fetch the logos of image watermarks before running any pipeline
+	load := logoLoader(ctx, t.UserID)
+	if err = t.Pipeline.LoadLogos(load); err != nil {
+		return fmt.Errorf("loading watermark: %w", err)
+	}
+	for _, variant := range t.Variants {
+		if err = variant.Pipeline.LoadLogos(load); err != nil {
+			return fmt.Errorf("variant %q: loading watermark: %w", variant.Name, err)
 		}
 	}
 
-	// Compress the processed image
-	processedImgBuf, err := processor.CompressJPEG(processedImg, 85)
+	// Run the pipeline exactly as it was specified at upload time
+	processed, err := t.Pipeline.ApplyAnimation(anim)
 	if err != nil {
-		slog.Error("error compressing image", "image_id", imageID, "error", err)
-		db.UpdateImageStatus(ctx, imageID, "failed", "")
-		return
+		return permanent(fmt.Errorf("applying pipeline: %w", err))
 	}
+	slog.Info("applied pipeline", "image_id", imageID, "steps", t.Pipeline.Names(), "frames", len(processed.Frames))
 
-	// Upload the processed image to S3
-	processedKey := fmt.Sprintf("processed/%s_%d.jpg", strings.TrimPrefix(imageKey, "originals/"), time.Now().Unix())
-	processedURL, err := storage.UploadToS3(ctx, processedKey, processedImgBuf)
+	// Encode the processed image in the requested output format
+	encoder, err := processor.NewEncoder(t.Output, inputFormat)
 	if err != nil {
-		slog.Error("error uploading processed image", "image_id", imageID, "error", err)
-		db.UpdateImageStatus(ctx, imageID, "failed", "")
-		return
+		return permanent(fmt.Errorf("invalid output options: %w", err))
+	}
+	processedImgBuf, err := processor.EncodeAnimation(processed, encoder)
+	if err != nil {
+		return permanent(fmt.Errorf("encoding image: %w", err))
 	}
 
-	// Update the image status to completed with the processed URL
-	if err = db.UpdateImageStatus(ctx, imageID, "completed", processedURL); err != nil {
-		slog.Error("error updating image status to completed", "image_id", imageID, "error", err)
-		return
+	// Upload the processed image under a key with the matching extension
+	baseName := strings.TrimSuffix(strings.TrimPrefix(t.ImageKey, "originals/"), path.Ext(t.ImageKey))
+	keyPrefix := fmt.Sprintf("processed/%s_%d", baseName, time.Now().Unix())
+	processedKey := keyPrefix + encoder.Extension()
+	processedURL, err := storage.Upload(ctx, processedKey, processedImgBuf)
+	if err != nil {
+		return fmt.Errorf("uploading processed image: %w", err)
 	}
 
-	slog.Info("image processed successfully", "image_id", imageID, "user_id", userID)
+	// Render each named variant from the processed image; any failure fails the job
+	for _, variant := range t.Variants {
+		if err = storeVariant(ctx, imageID, keyPrefix, processed, inputFormat, variant); err != nil {
+			return fmt.Errorf("variant %q: %w", variant.Name, err)
+		}
+	}
+
+	// Update the image status to completed with the processed key and URL
+	if err = db.CompleteImage(ctx, imageID, processedKey, processedURL); err != nil {
+		return fmt.Errorf("updating image status to completed: %w", err)
+	}
+
+	slog.Info("image processed successfully", "image_id", imageID, "user_id", t.UserID, "task_id", t.ID)
+	return nil
 }
 
-// Helper function to extract integers from map with different possible types
-func getIntFromMap(m map[string]interface{}, key string) int {
-	if val, ok := m[key].(float64); ok {
-		return int(val)
-	} else if val, ok := m[key].(int); ok {
-		return val
+// Reports whether any output of a task can use the frames of an animation;
+// otherwise only the first frame is decoded
+func keepsFrames(t queue.Task, inputFormat string) bool {
+	return processor.KeepsFrames(inputFormat, t.Pipeline, t.Output, t.Variants)
+}
+
+// Largest logo a watermark may use, in pixels
+const maxLogoPixels = 16 << 20
+
+// Returns the loader for the watermark logos of a task. A logo must be one of
+// the user's own images; each is downloaded and decoded once per task.
+func logoLoader(ctx context.Context, userID string) processor.LogoLoader {
+	logos := map[string]image.Image{}
+	return func(imageID string) (image.Image, error) {
+		if logo, ok := logos[imageID]; ok {
+			return logo, nil
+		}
+		meta, err := db.GetImage(ctx, imageID, userID)
+		if errors.Is(err, db.ErrImageNotFound) {
+			return nil, permanent(fmt.Errorf("logo %s: %w", imageID, err))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("looking up logo %s: %w", imageID, err)
+		}
+		buf, err := storage.Download(ctx, meta.S3Key)
+		if err != nil {
+			return nil, fmt.Errorf("downloading logo %s: %w", meta.S3Key, err)
+		}
+		header, _, err := image.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			return nil, permanent(fmt.Errorf("reading logo header: %w", err))
+		}
+		if pixels := int64(header.Width) * int64(header.Height); pixels > maxLogoPixels {
+			return nil, permanent(fmt.Errorf("logo %s has %d pixels, maximum is %d", imageID, pixels, maxLogoPixels))
+		}
+		logo, _, err := processor.DecodeImage(buf)
+		if err != nil {
+			return nil, permanent(fmt.Errorf("decoding logo: %w", err))
+		}
+		logos[imageID] = logo
+		return logo, nil
+	}
+}
+
+// Renders a variant, uploads it next to the processed image and records it
+func storeVariant(ctx context.Context, imageID, keyPrefix string, anim *processor.Animation, inputFormat string, variant processor.Variant) error {
+	out, err := variant.Pipeline.ApplyAnimation(anim)
+	if err != nil {
+		return err
+	}
+	encoder, err := processor.NewEncoder(variant.Output, inputFormat)
+	if err != nil {
+		return err
+	}
+	buf, err := processor.EncodeAnimation(out, encoder)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s_%s%s", keyPrefix, variant.Name, encoder.Extension())
+	url, err := storage.Upload(ctx, key, buf)
+	if err != nil {
+		return err
+	}
+
+	bounds := out.Frames[0].Bounds()
+	err = db.UpsertImageVariant(ctx, models.ImageVariant{
+		ImageID:     imageID,
+		Name:        variant.Name,
+		URL:         url,
+		S3Key:       key,
+		Size:        int64(len(buf)),
+		ContentType: encoder.ContentType(),
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+	})
+	if err != nil {
+		return err
 	}
-	return 0
+	slog.Info("stored variant", "image_id", imageID, "variant", variant.Name, "key", key)
+	return nil
 }
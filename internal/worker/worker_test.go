@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image-processing-service/internal/config"
+	"image-processing-service/internal/processor"
+	"image-processing-service/internal/queue"
+	"image-processing-service/internal/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/semaphore"
+)
+
+func newTestPool(maxPixels int64) *pool {
+	return &pool{
+		policy:    retryPolicyFrom(config.Default().Worker),
+		pixels:    semaphore.NewWeighted(maxPixels),
+		maxPixels: maxPixels,
+		limits:    config.Default().Upload,
+	}
+}
+
+// ---- Pixel budget ---------------------------------------------------------------
+
+func TestReservePixels_WaitsForBudget(t *testing.T) {
+	p := newTestPool(1000)
+	ctx := context.Background()
+
+	release, err := p.reservePixels(ctx, 800)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+
+	// A second reservation that does not fit must wait
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.reservePixels(waitCtx, 300); err == nil {
+		t.Fatal("reservation beyond the budget should block")
+	}
+
+	got := make(chan struct{})
+	go func() {
+		r, err := p.reservePixels(ctx, 300)
+		if err == nil {
+			r()
+		}
+		close(got)
+	}()
+	release()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("reservation should proceed once the budget is released")
+	}
+}
+
+func TestReservePixels_OversizedImageRunsAlone(t *testing.T) {
+	p := newTestPool(1000)
+	release, err := p.reservePixels(context.Background(), 1_000_000)
+	if err != nil {
+		t.Fatalf("an image larger than the budget should still be admitted: %v", err)
+	}
+	if p.pixels.TryAcquire(1) {
+		t.Error("an oversized image should hold the whole budget")
+	}
+	release()
+	if !p.pixels.TryAcquire(1000) {
+		t.Error("budget should be fully available after release")
+	}
+}
+
+func TestCheckInput(t *testing.T) {
+	p := newTestPool(1_000_000)
+	p.limits.MaxPixels = 500_000
+	p.limits.MaxDimension = 2000
+	p.limits.MaxAnimationPixels = 800_000
+	p.limits.AllowedFormats = []string{"png", "gif"}
+	tests := []struct {
+		name          string
+		format        string
+		width, height int
+		frames        int
+		ok            bool
+	}{
+		{"within the limits", "png", 500, 1000, 1, true},
+		{"format not accepted", "jpeg", 10, 10, 1, false},
+		{"too many pixels", "png", 1000, 1000, 1, false},
+		{"too wide", "png", 2001, 10, 1, false},
+		{"animation within the limits", "gif", 200, 200, 20, true},
+		{"animation over the upload limit", "gif", 200, 200, 21, false},
+	}
+	for _, tc := range tests {
+		if err := p.checkInput(tc.format, tc.width, tc.height, tc.frames); (err == nil) != tc.ok {
+			t.Errorf("%s: want ok %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+
+	// A still over the budget is refused, not decoded alone
+	p.limits.MaxPixels, p.limits.MaxDimension = 10_000_000, 10_000
+	if err := p.checkInput("png", 2000, 1000, 1); err == nil {
+		t.Error("want an image over the pixel budget refused")
+	}
+}
+
+// ---- Animations -----------------------------------------------------------------
+
+func TestKeepsFrames(t *testing.T) {
+	gif := processor.OutputOptions{Format: processor.FormatGIF}
+	frame := processor.NewPipeline(&processor.FrameOp{Index: 3})
+	tests := []struct {
+		name string
+		task queue.Task
+		want bool
+	}{
+		{"jpeg output", queue.Task{}, false},
+		{"gif output", queue.Task{Output: gif}, true},
+		{"auto output", queue.Task{Output: processor.OutputOptions{Format: processor.FormatAuto}}, true},
+		{"frame step", queue.Task{Pipeline: frame}, true},
+		{"gif variant", queue.Task{Variants: []processor.Variant{{Name: "anim", Output: gif}}}, true},
+		{"frame step in a variant", queue.Task{Variants: []processor.Variant{{Name: "poster", Pipeline: frame}}}, true},
+		{"still variant", queue.Task{Variants: []processor.Variant{{Name: "thumb"}}}, false},
+	}
+	for _, tc := range tests {
+		if got := keepsFrames(tc.task, "gif"); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+// ---- Pool lifecycle -------------------------------------------------------------
+
+func TestStartWorker_StopsAndUnregisters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	prev := queue.Rdb
+	queue.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		queue.Rdb.Close()
+		queue.Rdb = prev
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg := config.Default().Worker
+		cfg.Concurrency = 3
+		StartWorker(ctx, cfg, config.Default().Upload)
+	}()
+
+	// Wait for all three workers to register
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		members, _ := mr.Members(queue.WorkersKey)
+		if len(members) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 3 registered workers, got %v", members)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(dequeueTimeout + 2*time.Second):
+		t.Fatal("pool did not stop after cancellation")
+	}
+	if members, _ := mr.Members(queue.WorkersKey); len(members) != 0 {
+		t.Errorf("stopped workers should unregister, got %v", members)
+	}
+}
+
+// ---- Delete tasks ---------------------------------------------------------------
+
+func TestRunTask_DeletesImageObjects(t *testing.T) {
+	mr := miniredis.RunT(t)
+	prev := queue.Rdb
+	queue.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		queue.Rdb.Close()
+		queue.Rdb = prev
+	})
+	local, err := storage.NewLocalBackend(t.TempDir(), storage.DefaultLocalURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevBackend := storage.Default()
+	storage.Use(local)
+	t.Cleanup(func() { storage.Use(prevBackend) })
+
+	ctx := context.Background()
+	keys := []string{"originals/a.png", "processed/a_1.jpg", "processed/a_1_thumb.webp"}
+	for _, key := range keys[:2] { // The variant is already gone
+		local.Put(ctx, key, strings.NewReader("x"), 1, "")
+	}
+	raw, _ := json.Marshal(queue.Task{ID: "t1", Type: queue.TaskTypeDelete, Version: queue.TaskVersion, ImageID: "img-1", Keys: keys})
+
+	if !newTestPool(1).runTask(ctx, string(raw)) {
+		t.Fatal("task should finish")
+	}
+	for _, key := range keys {
+		if _, err := local.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("%s should be deleted, got %v", key, err)
+		}
+	}
+	if dls, _ := queue.ListDeadLetters(ctx); len(dls) != 0 {
+		t.Errorf("want no dead letters, got %d", len(dls))
+	}
+
+	// A key outside the storage root can never be deleted
+	raw, _ = json.Marshal(queue.Task{ID: "t2", Type: queue.TaskTypeDelete, Version: queue.TaskVersion, Keys: []string{"../etc/passwd"}})
+	if !newTestPool(1).runTask(ctx, string(raw)) {
+		t.Fatal("task should finish")
+	}
+	if dls, _ := queue.ListDeadLetters(ctx); len(dls) != 1 {
+		t.Errorf("invalid key should be dead-lettered at once, got %d dead letters", len(dls))
+	}
+}
@@ -26,5 +26,38 @@ CREATE TABLE IF NOT EXISTS images (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Key of the processed image, so URLs can be regenerated for private buckets
+ALTER TABLE images ADD COLUMN IF NOT EXISTS processed_key VARCHAR(512);
+
+-- SHA-256 of the original, so identical re-uploads by a user are deduplicated
+ALTER TABLE images ADD COLUMN IF NOT EXISTS content_hash CHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_user_content_hash ON images(user_id, content_hash) WHERE content_hash IS NOT NULL;
+
 CREATE INDEX IF NOT EXISTS idx_images_user_id ON images(user_id);
 CREATE INDEX IF NOT EXISTS idx_images_status ON images(status);
+
+-- Keyset pagination of GET /images in each sort order
+CREATE INDEX IF NOT EXISTS idx_images_user_uploaded ON images(user_id, uploaded, id);
+CREATE INDEX IF NOT EXISTS idx_images_user_size ON images(user_id, size, id);
+CREATE INDEX IF NOT EXISTS idx_images_user_file_name ON images(user_id, file_name, id);
+
+CREATE TABLE IF NOT EXISTS image_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    image_id UUID NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    name VARCHAR(32) NOT NULL,
+    s3_key VARCHAR(512) NOT NULL,
+    url VARCHAR(512) NOT NULL,
+    size BIGINT NOT NULL,
+    content_type VARCHAR(50) NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (image_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_variants_image_id ON image_variants(image_id);
+
+-- Lookups by storage key, for the garbage collector of unreferenced objects
+CREATE INDEX IF NOT EXISTS idx_images_s3_key ON images(s3_key);
+CREATE INDEX IF NOT EXISTS idx_images_processed_key ON images(processed_key);
+CREATE INDEX IF NOT EXISTS idx_image_variants_s3_key ON image_variants(s3_key);